@@ -0,0 +1,148 @@
+// Package capture describes the circumstances a SIP message was captured in,
+// so they can be passed from extraction through to publishing alongside the
+// message itself.
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Transports a SIP message may be carried over.
+const (
+	UDP  = "udp"
+	TCP  = "tcp"
+	SCTP = "sctp"
+	TLS  = "tls"
+	WS   = "ws"
+	WSS  = "wss"
+)
+
+// Meta is where and when a SIP message was captured: the addresses and ports
+// of the packets which carried it, the transport, and the capture time,
+// interface, and VLAN of the packet which completed it, and for messages
+// received over HEP, the agent which captured them and its correlation ID.
+// Its Time is published as the message's own, so isn't repeated in JSON.
+type Meta struct {
+	Time          time.Time `json:"-"`
+	SrcIP         net.IP    `json:"src_ip"`
+	DstIP         net.IP    `json:"dst_ip"`
+	SrcPort       uint16    `json:"src_port"`
+	DstPort       uint16    `json:"dst_port"`
+	Transport     string    `json:"transport"`
+	Interface     string    `json:"interface,omitempty"`
+	VLAN          uint16    `json:"vlan,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	NodeID        uint32    `json:"node_id,omitempty"`
+	NodeName      string    `json:"node_name,omitempty"`
+}
+
+// Packet is when, and on which interface and VLAN, a packet was captured.
+// Interface is empty when unknown, such as when reading a file, and VLAN is 0
+// for untagged packets.  Transport is empty unless the packet was rebuilt from
+// one carrying its message over another transport, such as from HEP, and Node
+// is the zero Node unless it was received from a HEP agent.
+type Packet struct {
+	Time      time.Time
+	Interface string
+	VLAN      uint16
+	Transport string
+	Node      Node
+}
+
+// FromFlows creates a Meta from the network and transport flows of a packet
+// or TCP stream, and the packet completing the message.  The packet's own
+// Transport, if set, replaces proto.
+func FromFlows(network, transport gopacket.Flow, proto string, pkt Packet) *Meta {
+	if pkt.Transport != "" {
+		proto = pkt.Transport
+	}
+	return &Meta{
+		Time:      pkt.Time,
+		SrcIP:     net.IP(network.Src().Raw()),
+		DstIP:     net.IP(network.Dst().Raw()),
+		SrcPort:   port(transport.Src()),
+		DstPort:   port(transport.Dst()),
+		Transport: proto,
+		Interface: pkt.Interface,
+		VLAN:      pkt.VLAN,
+
+		CorrelationID: pkt.Node.CorrelationID,
+		NodeID:        pkt.Node.ID,
+		NodeName:      pkt.Node.Name,
+	}
+}
+
+// Interface is added to the AncillaryData of a packet, naming the interface
+// it was captured on.
+type Interface string
+
+// InterfaceOf returns the interface p was captured on, or "" if it is not
+// known.
+func InterfaceOf(p gopacket.Packet) string {
+	for _, a := range p.Metadata().AncillaryData {
+		if i, ok := a.(Interface); ok {
+			return string(i)
+		}
+	}
+	return ""
+}
+
+// VLAN is added to the AncillaryData of a packet whose 802.1Q tag was
+// stripped before it was captured, such as by AF_PACKET, naming its VLAN.
+type VLAN uint16
+
+// VLANOf returns the VLAN of p's stripped tag, or 0 if it had none.
+func VLANOf(p gopacket.Packet) uint16 {
+	for _, a := range p.Metadata().AncillaryData {
+		if v, ok := a.(VLAN); ok {
+			return uint16(v)
+		}
+	}
+	return 0
+}
+
+// Transport is added to the AncillaryData of a packet rebuilt from one which
+// carried its message over another transport, naming that transport.
+type Transport string
+
+// TransportOf returns the transport p's message was originally carried over,
+// or "" if it is p's own.
+func TransportOf(p gopacket.Packet) string {
+	for _, a := range p.Metadata().AncillaryData {
+		if t, ok := a.(Transport); ok {
+			return string(t)
+		}
+	}
+	return ""
+}
+
+// Node is added to the AncillaryData of a packet rebuilt from one received
+// from a HEP agent, identifying the agent and the correlation ID it sent
+// alongside the message.
+type Node struct {
+	ID            uint32
+	Name          string
+	CorrelationID string
+}
+
+// NodeOf returns the HEP agent p was received from, or the zero Node if it
+// was captured directly.
+func NodeOf(p gopacket.Packet) Node {
+	for _, a := range p.Metadata().AncillaryData {
+		if n, ok := a.(Node); ok {
+			return n
+		}
+	}
+	return Node{}
+}
+
+func port(e gopacket.Endpoint) uint16 {
+	if raw := e.Raw(); len(raw) == 2 {
+		return binary.BigEndian.Uint16(raw)
+	}
+	return 0
+}
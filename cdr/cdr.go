@@ -0,0 +1,254 @@
+// Package cdr builds call detail records from the SIP signalling of calls:
+// who called whom, when each call was set up, answered, and ended, how it
+// ended, and how long it lasted.
+//
+// A Tracker follows each call from its initial INVITE, through provisional
+// and final responses, until a BYE, a final error response (including the
+// 487 answering a CANCEL), or a time without any of its messages, ends it.
+// A 401 or 407 asking for credentials doesn't end a call, which continues
+// with the INVITE sent again with them.
+package cdr
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/sipmsg"
+)
+
+// SchemaVersion is the version of Record's JSON.  It changes whenever fields
+// are renamed, removed, or change meaning.
+const SchemaVersion = 1
+
+// Sides of a call which may disconnect it, or why else it ended.
+const (
+	Caller  = "caller"
+	Callee  = "callee"
+	Timeout = "timeout"
+)
+
+const (
+	// DefaultTTL is how long a call is tracked after its last message,
+	// unless NewTracker is given another.
+	DefaultTTL = time.Hour
+
+	// sweepInterval is how often calls are checked for timing out.
+	sweepInterval = time.Second
+)
+
+// Record is the call detail record of a single call.  Answer is nil for calls
+// which were never answered, whose Status is the final error response to the
+// INVITE, if there was one.  Disconnect is the side which ended the call
+// (Caller or Callee), Timeout if it went quiet, or empty if it was still
+// going when tracking stopped.  Reason is the Reason header of the BYE or
+// CANCEL ending the call, or of the final error response, or else that
+// response's reason phrase.  Duration is the number of seconds between
+// Answer and End.  Capture is where the INVITE was captured.
+type Record struct {
+	Version    int           `json:"version"`
+	CallID     string        `json:"call_id"`
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Start      time.Time     `json:"start"`
+	Answer     *time.Time    `json:"answer,omitempty"`
+	End        time.Time     `json:"end"`
+	Status     int           `json:"status,omitempty"`
+	Disconnect string        `json:"disconnect,omitempty"`
+	Reason     string        `json:"reason,omitempty"`
+	Duration   float64       `json:"duration"`
+	Capture    *capture.Meta `json:"capture,omitempty"`
+}
+
+// callKey identifies a call by its Call-ID and the caller's From tag.
+// Requests from the callee have the caller's tag as their To tag.
+type callKey struct {
+	callID string
+	tag    string
+}
+
+type call struct {
+	rec       *Record
+	inviteSeq int64
+	lastSeen  time.Time
+	// cancelled is set once the caller CANCELs the INVITE, with the reason
+	// it gave, as the final response is then the callee's 487.
+	cancelled    bool
+	cancelReason string
+	// challenged is set once the INVITE is challenged for credentials, until
+	// it is sent again with them.
+	challenged bool
+}
+
+// Tracker follows calls through their signalling, producing a Record as each
+// ends.  Time is that of the messages' capture, so a capture file's calls
+// are recorded as they happened.  It is not safe for concurrent use.
+type Tracker struct {
+	ttl       time.Duration
+	calls     map[callKey]*call
+	lastSweep time.Time
+}
+
+// NewTracker returns a Tracker which times calls out ttl after their last
+// message, or after DefaultTTL if ttl is zero.
+func NewTracker(ttl time.Duration) *Tracker {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Tracker{ttl: ttl, calls: make(map[callKey]*call)}
+}
+
+// Active returns how many calls are being tracked.
+func (t *Tracker) Active() int { return len(t.calls) }
+
+// Observe follows a message captured as described by meta, returning the
+// records of the calls which have ended: the message's own, if it ended it,
+// and any which have timed out.
+func (t *Tracker) Observe(sip *layers.SIP, meta *capture.Meta) []*Record {
+	now := meta.Time
+	var ended []*Record
+	if now.Sub(t.lastSweep) >= sweepInterval {
+		ended = t.sweep(now)
+	}
+
+	callID := sip.GetCallID()
+	if callID == "" {
+		return ended
+	}
+	from, to := tag(sip.GetFrom()), tag(sip.GetTo())
+	k := callKey{callID, from}
+	c, ok := t.calls[k]
+	if !ok && to != "" {
+		k = callKey{callID, to}
+		c, ok = t.calls[k]
+	}
+	if !ok {
+		// only an initial INVITE, outside of any dialog, begins a call.
+		if !sip.IsResponse && sip.Method == layers.SIPMethodInvite && to == "" {
+			t.calls[callKey{callID, from}] = &call{
+				rec: &Record{
+					Version: SchemaVersion,
+					CallID:  callID,
+					From:    address(sip.GetFrom()),
+					To:      address(sip.GetTo()),
+					Start:   now,
+					Capture: meta,
+				},
+				inviteSeq: sip.GetCSeq(),
+				lastSeen:  now,
+			}
+		}
+		return ended
+	}
+	c.lastSeen = now
+
+	switch {
+	case !sip.IsResponse && sip.Method == layers.SIPMethodInvite && c.challenged:
+		// the INVITE sent again with credentials, whose responses are now
+		// the call's.
+		c.inviteSeq, c.challenged = sip.GetCSeq(), false
+	case !sip.IsResponse && sip.Method == layers.SIPMethodCancel:
+		if c.rec.Answer == nil {
+			c.cancelled = true
+			c.cancelReason = sip.GetFirstHeader("Reason")
+		}
+	case !sip.IsResponse && sip.Method == layers.SIPMethodBye:
+		side := Callee
+		if from == k.tag {
+			side = Caller
+		}
+		ended = append(ended, t.end(k, c, now, side, sip.GetFirstHeader("Reason")))
+	case sip.IsResponse && sip.Method == layers.SIPMethodInvite && sip.GetCSeq() == c.inviteSeq:
+		// a response's Method is that of its CSeq, so this answers the
+		// initial INVITE rather than a re-INVITE.  Provisional responses,
+		// and ACKs, change nothing recorded.
+		if c.rec.Answer != nil || sip.ResponseCode < 200 {
+			break
+		}
+		if (sip.ResponseCode == 401 || sip.ResponseCode == 407) && !c.cancelled {
+			c.challenged = true
+			break
+		}
+		c.rec.Status = sip.ResponseCode
+		if sip.ResponseCode < 300 {
+			answer := now
+			c.rec.Answer = &answer
+			break
+		}
+		side, reason := Callee, sip.GetFirstHeader("Reason")
+		if reason == "" {
+			reason = sip.ResponseStatus
+		}
+		if c.cancelled {
+			side, reason = Caller, c.cancelReason
+		}
+		ended = append(ended, t.end(k, c, now, side, reason))
+	}
+	return ended
+}
+
+// Flush ends every call still being tracked, as when capture stops, and
+// returns their records.  They end with their last message, and have no
+// Disconnect side.
+func (t *Tracker) Flush() []*Record {
+	var ended []*Record
+	for k, c := range t.calls {
+		ended = append(ended, t.end(k, c, c.lastSeen, "", ""))
+	}
+	return ended
+}
+
+// sweep ends the calls which have timed out by now.
+func (t *Tracker) sweep(now time.Time) []*Record {
+	t.lastSweep = now
+	var ended []*Record
+	for k, c := range t.calls {
+		if now.Sub(c.lastSeen) >= t.ttl {
+			ended = append(ended, t.end(k, c, c.lastSeen, Timeout, ""))
+		}
+	}
+	return ended
+}
+
+// end stops tracking a call, completing its record.
+func (t *Tracker) end(k callKey, c *call, at time.Time, side, reason string) *Record {
+	delete(t.calls, k)
+	r := c.rec
+	r.End = at
+	r.Disconnect = side
+	r.Reason = reason
+	if r.Answer != nil {
+		r.Duration = r.End.Sub(*r.Answer).Seconds()
+	}
+	return r
+}
+
+// tag returns the tag parameter of a From or To header value, or "" if it has
+// none.
+func tag(header string) string {
+	na, err := sipmsg.ParseNameAddr(header)
+	if err != nil {
+		return ""
+	}
+	return na.Tag()
+}
+
+// address returns the URI of a From or To header value, without its display
+// name, parameters, or headers, such as "sip:alice@example.com".  A value
+// which can't be parsed is returned whole.
+func address(header string) string {
+	na, err := sipmsg.ParseNameAddr(header)
+	if err != nil {
+		return header
+	}
+	u := na.URI
+	switch {
+	case u.Opaque != "":
+		return u.Scheme + ":" + u.Opaque
+	case u.Host == "":
+		return u.Scheme + ":" + u.User
+	case u.User == "":
+		return u.Scheme + ":" + u.Host
+	}
+	return u.Scheme + ":" + u.User + "@" + u.Host
+}
@@ -0,0 +1,155 @@
+package cdr
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+)
+
+// message is a SIP message of a test call, sent at seconds into it.
+type message struct {
+	at      int
+	start   string
+	from    string
+	to      string
+	cseq    string
+	headers string
+}
+
+var (
+	invite  = message{0, "INVITE sip:bob@example.com SIP/2.0", "a", "", "1 INVITE", ""}
+	trying  = message{0, "SIP/2.0 100 Trying", "a", "", "1 INVITE", ""}
+	ringing = message{1, "SIP/2.0 180 Ringing", "a", "b", "1 INVITE", ""}
+	ok      = message{5, "SIP/2.0 200 OK", "a", "b", "1 INVITE", ""}
+	ack     = message{5, "ACK sip:bob@example.com SIP/2.0", "a", "b", "1 ACK", ""}
+)
+
+func (m message) sip(is *is.I) *layers.SIP {
+	to := ""
+	if m.to != "" {
+		to = ";tag=" + m.to
+	}
+	data := fmt.Sprintf("%s\r\n"+
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK%s\r\n"+
+		"From: \"Alice\" <sip:alice@example.com;user=phone>;tag=%s\r\n"+
+		"To: <sip:bob@example.com:5060>%s\r\n"+
+		"Call-ID: call-1\r\n"+
+		"CSeq: %s\r\n"+
+		"%sContent-Length: 0\r\n\r\n", m.start, m.cseq, m.from, to, m.cseq, m.headers)
+	sip := layers.NewSIP()
+	is.NoErr(sip.DecodeFromBytes([]byte(data), gopacket.NilDecodeFeedback))
+	return sip
+}
+
+func TestTracker(t *testing.T) {
+	start := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	answer := at(5)
+
+	testCases := map[string]struct {
+		msgs   []message
+		expect *Record
+	}{
+		"caller hangs up": {
+			[]message{invite, trying, ringing, ok, ack,
+				{65, "BYE sip:bob@example.com SIP/2.0", "a", "b", "2 BYE", ""},
+				{65, "SIP/2.0 200 OK", "a", "b", "2 BYE", ""}},
+			&Record{Answer: &answer, End: at(65), Status: 200, Disconnect: Caller, Duration: 60},
+		},
+		"callee hangs up": {
+			[]message{invite, ringing, ok, ack,
+				// a failed re-INVITE doesn't end the call
+				{10, "INVITE sip:alice@example.com SIP/2.0", "b", "a", "1 INVITE", ""},
+				{10, "SIP/2.0 491 Request Pending", "b", "a", "1 INVITE", ""},
+				{20, "BYE sip:alice@example.com SIP/2.0", "b", "a", "2 BYE", "Reason: Q.850;cause=16\r\n"}},
+			&Record{Answer: &answer, End: at(20), Status: 200, Disconnect: Callee, Reason: "Q.850;cause=16", Duration: 15},
+		},
+		"challenged": {
+			[]message{invite,
+				{0, "SIP/2.0 407 Proxy Authentication Required", "a", "p", "1 INVITE", ""},
+				{0, "ACK sip:bob@example.com SIP/2.0", "a", "p", "1 ACK", ""},
+				{1, "INVITE sip:bob@example.com SIP/2.0", "a", "", "2 INVITE", ""},
+				{1, "SIP/2.0 100 Trying", "a", "", "2 INVITE", ""},
+				{5, "SIP/2.0 200 OK", "a", "b", "2 INVITE", ""},
+				{5, "ACK sip:bob@example.com SIP/2.0", "a", "b", "2 ACK", ""},
+				{65, "BYE sip:bob@example.com SIP/2.0", "a", "b", "3 BYE", ""}},
+			&Record{Answer: &answer, End: at(65), Status: 200, Disconnect: Caller, Duration: 60},
+		},
+		"busy": {
+			[]message{invite, trying,
+				{2, "SIP/2.0 486 Busy Here", "a", "b", "1 INVITE", ""},
+				{2, "ACK sip:bob@example.com SIP/2.0", "a", "b", "1 ACK", ""}},
+			&Record{End: at(2), Status: 486, Disconnect: Callee, Reason: "Busy Here"},
+		},
+		"cancelled": {
+			[]message{invite, ringing,
+				{3, "CANCEL sip:bob@example.com SIP/2.0", "a", "", "1 CANCEL", "Reason: SIP;cause=200;text=\"Call completed elsewhere\"\r\n"},
+				{3, "SIP/2.0 200 OK", "a", "", "1 CANCEL", ""},
+				{4, "SIP/2.0 487 Request Terminated", "a", "b", "1 INVITE", ""}},
+			&Record{End: at(4), Status: 487, Disconnect: Caller, Reason: `SIP;cause=200;text="Call completed elsewhere"`},
+		},
+		"timeout": {
+			[]message{invite, ringing, ok, ack,
+				// another call's message, much later
+				{5 + 3600, "OPTIONS sip:bob@example.com SIP/2.0", "z", "", "1 OPTIONS", ""}},
+			&Record{Answer: &answer, End: at(5), Status: 200, Disconnect: Timeout},
+		},
+		"not ended": {
+			[]message{invite, ringing},
+			nil,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			tr := NewTracker(0)
+			var records []*Record
+			for _, m := range tc.msgs {
+				records = append(records, tr.Observe(m.sip(is), &capture.Meta{Time: at(m.at)})...)
+			}
+			if tc.expect == nil {
+				is.Equal(len(records), 0)
+				is.Equal(tr.Active(), 1)
+				records = tr.Flush()
+				is.Equal(len(records), 1)
+				is.Equal(records[0].End, at(1))
+				is.Equal(records[0].Disconnect, "")
+				return
+			}
+			is.Equal(len(records), 1)
+			is.Equal(tr.Active(), 0)
+
+			r := records[0]
+			is.Equal(r.Version, SchemaVersion)
+			is.Equal(r.CallID, "call-1")
+			is.Equal(r.From, "sip:alice@example.com")
+			is.Equal(r.To, "sip:bob@example.com")
+			is.Equal(r.Start, start)
+			is.True(r.Capture != nil)
+			r.Version, r.CallID, r.From, r.To, r.Start, r.Capture = 0, "", "", "", time.Time{}, nil
+			is.Equal(r, tc.expect)
+		})
+	}
+}
+
+func TestAddress(t *testing.T) {
+	testCases := map[string]string{
+		`"Alice" <sip:alice@example.com:5060;transport=tcp>;tag=1`: "sip:alice@example.com",
+		`<tel:+15551234567;phone-context=example.com>`:             "tel:+15551234567",
+		`sip:example.com;tag=2`:                                    "sip:example.com",
+		`<urn:service:sos>`:                                        "urn:service:sos",
+		`broken <`:                                                 "broken <",
+	}
+	for header, expect := range testCases {
+		t.Run(header, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(address(header), expect)
+		})
+	}
+}
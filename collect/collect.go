@@ -3,9 +3,13 @@ package collect
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/cdr"
 	"github.com/nextcaller/sip-capture/filters"
+	"github.com/nextcaller/sip-capture/sipmsg"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
@@ -19,10 +23,52 @@ const (
 	// the internal structure of the Collecter can support; the message passed
 	// to Accept will not be published.
 	ErrFull = constError("publish queue is full")
+	// ErrStopped indicates that Publish has given up, its context done, so
+	// the message passed to Accept will not be published.
+	ErrStopped = constError("publishing has stopped")
 )
 
 type publisher func(context.Context, *Msg) error
 
+// captured is a SIP message waiting in the queue with where it was captured.
+type captured struct {
+	sip  *layers.SIP
+	meta *capture.Meta
+}
+
+// Options controls what is added to each message beyond its raw bytes and
+// capture metadata, which messages are published, and whether call detail
+// records are too.  The zero value adds nothing.
+type Options struct {
+	// Parse adds the message parsed by sipmsg, as Msg.Parsed.
+	Parse bool
+	// SDP adds the session description parsed from the body, as Msg.SDP.
+	SDP bool
+
+	// Dialogs makes the filter a trigger: once a message matches it, every
+	// later message of the same dialog is published too, whether or not it
+	// matches.  Dialogs are followed until a BYE or final error ends them,
+	// or for DialogTTL after their last message, and at most MaxDialogs at
+	// once.  Zero gives DefaultDialogTTL and DefaultMaxDialogs.
+	Dialogs    bool
+	DialogTTL  time.Duration
+	MaxDialogs int
+
+	// CDR, if set, publishes a call detail record of each call as it ends.
+	// Calls are tracked from every message, whether or not it matches the
+	// filter, and time out DialogTTL after their last message.
+	CDR func(context.Context, *cdr.Record) error
+
+	// Latency matches every request with its responses, whether or not they
+	// match the filter, observing the time between them in the metrics.
+	Latency bool
+
+	// Block makes Accept wait for room in the queue rather than dropping the
+	// message, for sources such as capture files which can simply be read
+	// more slowly.
+	Block bool
+}
+
 // Collecter receives incoming layers.SIP messages, discarding those that don't
 // match the configured filter, and then publishes the accepted ones.
 // It uses an internal channel to queue so that Accept won't block, making it
@@ -31,27 +77,56 @@ type Collecter struct {
 	metrics *Metrics
 	match   filters.Filter
 	publish publisher
-	msgs    chan *layers.SIP
+	msgs    chan captured
+	stopped chan struct{}
+	opts    Options
+	dialogs *dialogs
+	calls   *cdr.Tracker
+	trans   *transactions
 }
 
 // NewCollecter returns a Collecter that accepts messages that pass the match
 // filter, then uses publish to emit them.  depth controls how many messages
-// may be internally queued before discarding excess.
-func NewCollecter(match filters.Filter, publish publisher, depth int) *Collecter {
-	return &Collecter{
+// may be internally queued before discarding excess, and opts what is added
+// to them.
+func NewCollecter(match filters.Filter, publish publisher, depth int, opts Options) *Collecter {
+	c := &Collecter{
 		match:   match,
 		publish: publish,
 		metrics: NewMetrics(),
-		msgs:    make(chan *layers.SIP, depth),
+		msgs:    make(chan captured, depth),
+		stopped: make(chan struct{}),
+		opts:    opts,
+	}
+	if opts.Dialogs {
+		c.dialogs = newDialogs(c.metrics, opts.DialogTTL, opts.MaxDialogs)
+	}
+	if opts.CDR != nil {
+		c.calls = cdr.NewTracker(opts.DialogTTL)
 	}
+	if opts.Latency {
+		c.trans = newTransactions(c.metrics)
+	}
+	return c
 }
 
-// Accept receives an incoming SIP message and enqueues it for filtering and
-// publishing.  If for any reason the internal channel used for queueing is
-// full, it will discard the message and return an error.
-func (c *Collecter) Accept(sip *layers.SIP) error {
+// Accept receives an incoming SIP message and where and when it was captured,
+// and enqueues it for filtering and publishing.  If for any reason the internal
+// channel used for queueing is full, it will discard the message and return an
+// error, unless Options.Block is set, when it waits for room instead, until
+// Publish has stopped.
+func (c *Collecter) Accept(sip *layers.SIP, meta *capture.Meta) error {
+	if c.opts.Block {
+		select {
+		case c.msgs <- captured{sip: sip, meta: meta}:
+			return nil
+		case <-c.stopped:
+			c.metrics.Dropped.Inc()
+			return fmt.Errorf("dropping message %v: %w", sip, ErrStopped)
+		}
+	}
 	select {
-	case c.msgs <- sip:
+	case c.msgs <- captured{sip: sip, meta: meta}:
 		return nil
 	default:
 		c.metrics.Dropped.Inc()
@@ -61,33 +136,101 @@ func (c *Collecter) Accept(sip *layers.SIP) error {
 
 // Publish blocks, consuming the internal queue, filtering out unwanted SIP
 // messages, creating the appropriate JSON envelope and then publishes them
-// using the provided publisher.
+// using the provided publisher.  It returns once Close has been called and
+// everything queued has been published, so nothing accepted is lost as
+// sip-capture shuts down, or as soon as ctx is done, abandoning whatever is
+// still queued.
 func (c *Collecter) Publish(ctx context.Context) {
 	log := zerolog.Ctx(ctx)
+	defer close(c.stopped)
 
 	for {
+		// a queued message could be chosen over ctx being done.
+		if ctx.Err() != nil {
+			log.Info().Int("queued", len(c.msgs)).Msg("context done, accepter exiting")
+			return
+		}
 		select {
 		case <-ctx.Done():
+			log.Info().Int("queued", len(c.msgs)).Msg("context done, accepter exiting")
 			return
-		case sip, ok := <-c.msgs:
-			if sip == nil || !ok {
+		case m, ok := <-c.msgs:
+			if !ok {
+				if c.calls != nil {
+					c.publishCDRs(ctx, c.calls.Flush())
+				}
 				log.Info().Msg("channel closed, accepter exiting")
 				return
 			}
-			if !c.match(sip) {
-				c.metrics.Rejected.Inc()
-				log.Debug().Msg("discarding SIP message that does not match filter")
-				continue
-			}
-			msg := NewMsg(sip)
-			if err := c.publish(ctx, msg); err != nil {
-				log.Err(err).Interface("msg", msg).Msg("publish failed")
-			}
-			c.metrics.Published.Inc()
+			c.process(ctx, m)
 		}
 	}
 }
 
+// process filters a single queued message, publishing it if it matches.
+func (c *Collecter) process(ctx context.Context, m captured) {
+	log := zerolog.Ctx(ctx)
+
+	if c.calls != nil {
+		c.publishCDRs(ctx, c.calls.Observe(m.sip, m.meta))
+	}
+	if c.trans != nil {
+		c.trans.observe(m.sip, m.meta)
+	}
+	// the session description is parsed once, for the filter and envelope.
+	in := filters.NewInput(m.sip, m.meta)
+	match := c.match(in)
+	if c.dialogs != nil && c.dialogs.follow(m.sip, m.meta, match) && !match {
+		c.metrics.Followed.Inc()
+		match = true
+	}
+	if !match {
+		c.metrics.Rejected.Inc()
+		log.Debug().Msg("discarding SIP message that does not match filter")
+		return
+	}
+	msg := NewMsg(m.sip, m.meta)
+	if c.opts.Parse {
+		parsed, err := sipmsg.Parse(msg.SIPData)
+		if err != nil {
+			c.metrics.Unparsed.Inc()
+			log.Debug().Err(err).Str("id", msg.ID).Msg("unable to parse SIP message")
+		}
+		msg.Parsed = parsed
+	}
+	if c.opts.SDP {
+		desc, err := in.SDP.Session()
+		if err != nil {
+			c.metrics.UnparsedSDP.Inc()
+			log.Debug().Err(err).Str("id", msg.ID).Msg("unable to parse SDP body")
+		}
+		msg.SDP = desc
+	}
+	if err := c.publish(ctx, msg); err != nil {
+		log.Err(err).Interface("msg", msg).Msg("publish failed")
+	}
+	c.metrics.Published.Inc()
+}
+
+// publishCDRs publishes the records of calls which have ended.
+func (c *Collecter) publishCDRs(ctx context.Context, records []*cdr.Record) {
+	log := zerolog.Ctx(ctx)
+	for _, r := range records {
+		if err := c.opts.CDR(ctx, r); err != nil {
+			log.Err(err).Interface("cdr", r).Msg("publish cdr failed")
+			continue
+		}
+		c.metrics.CDRs.Inc()
+	}
+	c.metrics.Calls.Set(float64(c.calls.Active()))
+}
+
+// Close stops accepting messages; Publish will return once everything already
+// queued has been published, unless its context is done first.  Close must
+// only be called once nothing will call Accept again, such as once Extract has
+// returned.
+func (c *Collecter) Close() { close(c.msgs) }
+
 // Metrics returns a list of prometheus.Collecter interfaces, suitable for
 // passing to prometheus.Registry to export message collection metrics.
 func (c *Collecter) Metrics() []prometheus.Collector { return c.metrics.List() }
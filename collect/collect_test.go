@@ -9,6 +9,10 @@ import (
 
 	"github.com/google/gopacket/layers"
 	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/filters"
+	"github.com/nextcaller/sip-capture/sdp"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
@@ -17,7 +21,7 @@ type testFilter struct {
 	cnt int
 }
 
-func (f *testFilter) filterHalf(msg *layers.SIP) bool {
+func (f *testFilter) filterHalf(*filters.Input) bool {
 	f.Lock()
 	defer f.Unlock()
 	f.cnt++
@@ -47,26 +51,45 @@ func TestAcceptLimit(t *testing.T) {
 	p := &testPublisher{}
 	m := &layers.SIP{}
 
-	c := NewCollecter(f.filterHalf, p.Publish, 1)
+	c := NewCollecter(f.filterHalf, p.Publish, 1, Options{})
 
-	err := c.Accept(m)
+	err := c.Accept(m, &capture.Meta{Time: time.Now()})
 	is.NoErr(err)
 	is.Equal(testutil.ToFloat64(c.metrics.Dropped), 0.0)
 
-	err = c.Accept(m)
+	err = c.Accept(m, &capture.Meta{Time: time.Now()})
 	is.True(errors.Is(err, ErrFull))
 	is.Equal(testutil.ToFloat64(c.metrics.Dropped), 1.0)
 }
 
+func TestAcceptBlock(t *testing.T) {
+	is := is.New(t)
+
+	p := &testPublisher{}
+	c := NewCollecter(func(*filters.Input) bool { return true }, p.Publish, 1, Options{Block: true})
+
+	go func() {
+		for x := 0; x < 10; x++ {
+			if err := c.Accept(&layers.SIP{}, &capture.Meta{Time: time.Now()}); err != nil {
+				t.Error(err)
+			}
+		}
+		c.Close()
+	}()
+	c.Publish(context.Background())
+
+	is.Equal(len(p.msgs), 10)
+	is.Equal(testutil.ToFloat64(c.metrics.Dropped), 0.0)
+}
+
 func TestCollectMetrics(t *testing.T) {
 	is := is.New(t)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ctx := context.Background()
 
 	f := &testFilter{}
 	p := &testPublisher{}
 
-	c := NewCollecter(f.filterHalf, p.Publish, 10)
+	c := NewCollecter(f.filterHalf, p.Publish, 10, Options{})
 
 	done := make(chan bool, 2)
 
@@ -77,10 +100,9 @@ func TestCollectMetrics(t *testing.T) {
 
 	go func() {
 		for x := 0; x < 10; x++ {
-			c.Accept(&layers.SIP{})
+			c.Accept(&layers.SIP{}, &capture.Meta{Time: time.Now()})
 		}
-		time.Sleep(time.Millisecond * 10)
-		cancel()
+		c.Close()
 	}()
 
 	select {
@@ -95,3 +117,123 @@ func TestCollectMetrics(t *testing.T) {
 	is.Equal(testutil.ToFloat64(c.metrics.Rejected), 5.0)
 	is.Equal(testutil.ToFloat64(c.metrics.Published), 5.0)
 }
+
+func TestCollectCancel(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// a publisher which never answers, like one whose server has gone away.
+	publishing := make(chan struct{}, 10)
+	hang := func(ctx context.Context, _ *Msg) error {
+		publishing <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	c := NewCollecter(func(*filters.Input) bool { return true }, hang, 10, Options{Block: true})
+	for x := 0; x < 10; x++ {
+		is.NoErr(c.Accept(&layers.SIP{}, &capture.Meta{Time: time.Now()}))
+	}
+
+	done := make(chan struct{})
+	go func() { c.Publish(ctx); close(done) }()
+	<-publishing
+	is.NoErr(c.Accept(&layers.SIP{}, &capture.Meta{Time: time.Now()})) // full again
+	cancel()
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Publish did not return once ctx was done")
+	case <-done:
+	}
+	is.Equal(testutil.ToFloat64(c.metrics.Published), 1.0)
+
+	// with Publish stopped, a blocking Accept gives up rather than waiting.
+	err := c.Accept(&layers.SIP{}, &capture.Meta{Time: time.Now()})
+	is.True(errors.Is(err, ErrStopped))
+}
+
+func TestCollectParse(t *testing.T) {
+	is := is.New(t)
+	p := &testPublisher{}
+	c := NewCollecter(func(*filters.Input) bool { return true }, p.Publish, 10, Options{Parse: true})
+
+	c.Accept(loadSIP(is, "sip_packet_full.txt"), &capture.Meta{Time: time.Now()})
+	// gopacket decodes anything with a SIP-like first line.
+	bad := layers.NewSIP()
+	bad.BaseLayer = layers.BaseLayer{Contents: []byte("INVITE bob SIP/2.0\r\n\r\n")}
+	c.Accept(bad, &capture.Meta{Time: time.Now()})
+	c.Close()
+	c.Publish(context.Background())
+
+	is.Equal(len(p.msgs), 2)
+	parsed := p.msgs[0].Parsed
+	is.True(parsed != nil)
+	is.Equal(parsed.Method(), "INVITE")
+	is.Equal(parsed.CallID, p.msgs[0].ID)
+	is.Equal(parsed.Headers.Values("X-Foo"), []string{"first", "second"})
+	is.Equal(p.msgs[1].Parsed, nil)
+	is.Equal(testutil.ToFloat64(c.metrics.Unparsed), 1.0)
+}
+
+func TestCollectSDP(t *testing.T) {
+	is := is.New(t)
+	p := &testPublisher{}
+	// the filter is given the same session description the envelope gets.
+	var filtered []*sdp.Session
+	match := func(in *filters.Input) bool {
+		s, _ := in.SDP.Session()
+		filtered = append(filtered, s)
+		return true
+	}
+	c := NewCollecter(match, p.Publish, 10, Options{SDP: true})
+
+	c.Accept(loadSIP(is, "sip_packet_full.txt"), &capture.Meta{Time: time.Now()})
+	c.Accept(loadSIP(is, "sip_packet.txt"), &capture.Meta{Time: time.Now()})
+	bad := loadSIP(is, "sip_packet_full.txt")
+	bad.Payload()[0] = 'x'
+	c.Accept(bad, &capture.Meta{Time: time.Now()})
+	c.Close()
+	c.Publish(context.Background())
+
+	is.Equal(len(p.msgs), 3)
+	desc := p.msgs[0].SDP
+	is.True(desc != nil)
+	is.Equal(len(desc.Media), 1)
+	is.Equal(desc.Media[0].Port, 50024)
+	is.Equal(desc.Media[0].Connection.Address, "10.135.0.12")
+	is.Equal(desc.Media[0].Codecs[3].Name, "G729")
+	is.True(filtered[0] == desc)    // parsed once
+	is.Equal(p.msgs[0].Parsed, nil) // only what was asked for
+	is.Equal(p.msgs[1].SDP, nil)
+	is.Equal(p.msgs[2].SDP, nil)
+	is.Equal(testutil.ToFloat64(c.metrics.UnparsedSDP), 1.0)
+}
+
+func TestCollectCDR(t *testing.T) {
+	is := is.New(t)
+	var records []*cdr.Record
+	publishCDR := func(_ context.Context, r *cdr.Record) error {
+		records = append(records, r)
+		return nil
+	}
+	p := &testPublisher{}
+	c := NewCollecter(func(*filters.Input) bool { return false }, p.Publish, 10, Options{CDR: publishCDR})
+
+	start := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	c.Accept(sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-1", "a", "", "1 INVITE"), &capture.Meta{Time: start})
+	c.Accept(sipMsg(is, "SIP/2.0 200 OK", "call-1", "a", ";tag=b", "1 INVITE"), &capture.Meta{Time: start.Add(time.Second)})
+	c.Accept(sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-2", "c", "", "1 INVITE"), &capture.Meta{Time: start.Add(time.Second)})
+	c.Accept(sipMsg(is, "BYE sip:alice@example.com SIP/2.0", "call-1", "b", ";tag=a", "1 BYE"), &capture.Meta{Time: start.Add(11 * time.Second)})
+	c.Close()
+	c.Publish(context.Background())
+
+	is.Equal(len(p.msgs), 0) // CDRs don't depend on the filter
+	is.Equal(len(records), 2)
+	is.Equal(records[0].CallID, "call-1")
+	is.Equal(records[0].Disconnect, cdr.Callee)
+	is.Equal(records[0].Duration, 10.0)
+	is.Equal(records[1].CallID, "call-2") // flushed once capture stops
+	is.Equal(records[1].Disconnect, "")
+	is.Equal(testutil.ToFloat64(c.metrics.CDRs), 2.0)
+	is.Equal(testutil.ToFloat64(c.metrics.Calls), 0.0)
+}
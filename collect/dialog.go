@@ -0,0 +1,160 @@
+package collect
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/sipmsg"
+)
+
+const (
+	// DefaultDialogTTL is how long a dialog is followed after its last
+	// message, unless Options gives another.
+	DefaultDialogTTL = time.Hour
+	// DefaultMaxDialogs is how many dialogs may be followed at once, unless
+	// Options gives another.
+	DefaultMaxDialogs = 100000
+
+	// dialogLinger is how long a dialog is still followed after a BYE or a
+	// final error other than a challenge for credentials, so the responses
+	// and ACKs ending it are published too.
+	// It's Timer F of RFC 3261, 64*T1.
+	dialogLinger = 32 * time.Second
+	// sweepInterval is how often expired dialogs are removed.
+	sweepInterval = time.Second
+)
+
+// Reasons dialogs stop being followed, as labels of dialogs_ended_total.
+const (
+	endBye     = "bye"
+	endError   = "error"
+	endTimeout = "timeout"
+)
+
+// dialogKey identifies a dialog by its Call-ID and the From tag of the
+// message that began it.  Later messages in the dialog have that tag as
+// their From tag if sent by the same side, or To tag if sent by the other.
+type dialogKey struct {
+	callID string
+	tag    string
+}
+
+type dialog struct {
+	expires  time.Time
+	answered bool
+	// ending is why the dialog will stop being followed once it expires, if
+	// it's been ended rather than timing out.
+	ending string
+}
+
+// dialogs is the table of dialogs being followed.  Time is that of the
+// messages' capture, so a capture file is followed as it was captured.
+type dialogs struct {
+	metrics   *Metrics
+	ttl       time.Duration
+	max       int
+	table     map[dialogKey]*dialog
+	lastSweep time.Time
+}
+
+func newDialogs(metrics *Metrics, ttl time.Duration, max int) *dialogs {
+	if ttl <= 0 {
+		ttl = DefaultDialogTTL
+	}
+	if max <= 0 {
+		max = DefaultMaxDialogs
+	}
+	return &dialogs{
+		metrics: metrics,
+		ttl:     ttl,
+		max:     max,
+		table:   make(map[dialogKey]*dialog),
+	}
+}
+
+// follow reports whether sip is in a dialog being followed, first beginning
+// one if it triggers it, and updates the dialog with what sip says about it.
+func (t *dialogs) follow(sip *layers.SIP, meta *capture.Meta, trigger bool) bool {
+	now := meta.Time
+	if now.Sub(t.lastSweep) >= sweepInterval {
+		t.sweep(now)
+	}
+
+	callID := sip.GetCallID()
+	from, to := tag(sip.GetFrom()), tag(sip.GetTo())
+	d, ok := t.table[dialogKey{callID, from}]
+	if !ok && to != "" {
+		d, ok = t.table[dialogKey{callID, to}]
+	}
+	if !ok {
+		if !trigger || callID == "" {
+			return false
+		}
+		if len(t.table) >= t.max {
+			t.metrics.DialogsFull.Inc()
+			return false
+		}
+		d = &dialog{}
+		t.table[dialogKey{callID, from}] = d
+		t.metrics.DialogsStarted.Inc()
+		t.metrics.DialogsActive.Set(float64(len(t.table)))
+	}
+
+	switch {
+	case d.ending != "" && trigger && !sip.IsResponse && sip.Method == layers.SIPMethodInvite:
+		// an INVITE sent again, such as with credentials, begins it anew.
+		d.ending = ""
+	case d.ending != "":
+		// already ending; let it linger no longer.
+		return true
+	case !sip.IsResponse && sip.Method == layers.SIPMethodBye:
+		d.ending = endBye
+	case sip.IsResponse && sip.Method == layers.SIPMethodInvite && !d.answered:
+		// a response's Method is that of its CSeq.
+		if sip.ResponseCode >= 200 && sip.ResponseCode < 300 {
+			d.answered = true
+		} else if sip.ResponseCode >= 300 && !challenge(sip.ResponseCode) {
+			d.ending = endError
+		}
+	}
+	if d.ending != "" {
+		d.expires = now.Add(dialogLinger)
+	} else {
+		d.expires = now.Add(t.ttl)
+	}
+	return true
+}
+
+// challenge reports whether a response code asks for credentials, which the
+// INVITE is usually sent again with, continuing the dialog.
+func challenge(code int) bool {
+	return code == 401 || code == 407
+}
+
+// sweep removes the dialogs which have expired by now.
+func (t *dialogs) sweep(now time.Time) {
+	t.lastSweep = now
+	for k, d := range t.table {
+		if now.Before(d.expires) {
+			continue
+		}
+		delete(t.table, k)
+		reason := d.ending
+		if reason == "" {
+			reason = endTimeout
+		}
+		t.metrics.DialogsEnded.WithLabelValues(reason).Inc()
+	}
+	t.metrics.DialogsActive.Set(float64(len(t.table)))
+}
+
+// tag returns the tag parameter of a From or To header value, or "" if it has
+// none.
+func tag(header string) string {
+	na, err := sipmsg.ParseNameAddr(header)
+	if err != nil {
+		return ""
+	}
+	return na.Tag()
+}
@@ -0,0 +1,141 @@
+package collect
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/filters"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sipMsg builds a message from its start line, Call-ID, From and To tags,
+// and CSeq.
+func sipMsg(is *is.I, start, callID, from, to, cseq string) *layers.SIP {
+	data := fmt.Sprintf("%s\r\n"+
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK%s\r\n"+
+		"From: <sip:alice@example.com>;tag=%s\r\n"+
+		"To: <sip:bob@example.com>%s\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %s\r\n"+
+		"Content-Length: 0\r\n\r\n", start, cseq[:1], from, to, callID, cseq)
+	sip := layers.NewSIP()
+	is.NoErr(sip.DecodeFromBytes([]byte(data), gopacket.NilDecodeFeedback))
+	return sip
+}
+
+func TestCollectDialogs(t *testing.T) {
+	is := is.New(t)
+	p := &testPublisher{}
+	invites := func(in *filters.Input) bool {
+		return !in.SIP.IsResponse && in.SIP.Method == layers.SIPMethodInvite
+	}
+	c := NewCollecter(invites, p.Publish, 100, Options{Dialogs: true, DialogTTL: time.Minute, MaxDialogs: 3})
+
+	start := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	msgs := []struct {
+		at      time.Duration
+		sip     *layers.SIP
+		publish bool
+	}{
+		// an answered call, ended by BYE
+		{0, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-1", "a", "", "1 INVITE"), true},
+		{0, sipMsg(is, "SIP/2.0 100 Trying", "call-1", "a", "", "1 INVITE"), true},
+		{1, sipMsg(is, "SIP/2.0 180 Ringing", "call-1", "a", ";tag=b", "1 INVITE"), true},
+		{2, sipMsg(is, "SIP/2.0 200 OK", "call-1", "a", ";tag=b", "1 INVITE"), true},
+		{2, sipMsg(is, "ACK sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=b", "1 ACK"), true},
+		{3, sipMsg(is, "OPTIONS sip:bob@example.com SIP/2.0", "other", "c", "", "1 OPTIONS"), false},
+		// the callee sends the re-INVITE, so the tags are reversed
+		{4, sipMsg(is, "INVITE sip:alice@example.com SIP/2.0", "call-1", "b", ";tag=a", "1 INVITE"), true},
+		{4, sipMsg(is, "SIP/2.0 491 Request Pending", "call-1", "b", ";tag=a", "1 INVITE"), true},
+		{5, sipMsg(is, "BYE sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=b", "2 BYE"), true},
+		{6, sipMsg(is, "SIP/2.0 200 OK", "call-1", "a", ";tag=b", "2 BYE"), true},
+
+		// a rejected call
+		{10, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-2", "d", "", "1 INVITE"), true},
+		{11, sipMsg(is, "SIP/2.0 486 Busy Here", "call-2", "d", ";tag=e", "1 INVITE"), true},
+		{11, sipMsg(is, "ACK sip:bob@example.com SIP/2.0", "call-2", "d", ";tag=e", "1 ACK"), true},
+
+		// once calls 1 and 2 have ended, a call which goes quiet, and more
+		// than can be followed
+		{50, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-3", "f", "", "1 INVITE"), true},
+		{51, sipMsg(is, "SIP/2.0 200 OK", "call-3", "f", ";tag=g", "1 INVITE"), true},
+		{52, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-4", "h", "", "1 INVITE"), true},
+		{53, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-5", "i", "", "1 INVITE"), true},
+		{54, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-6", "j", "", "1 INVITE"), true},
+		{55, sipMsg(is, "SIP/2.0 180 Ringing", "call-6", "j", ";tag=k", "1 INVITE"), false},
+
+		// calls 1 and 2 are over, but 3 is still followed
+		{60, sipMsg(is, "BYE sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=b", "3 BYE"), false},
+		{61, sipMsg(is, "SIP/2.0 200 OK", "call-2", "d", ";tag=e", "1 INVITE"), false},
+		{70, sipMsg(is, "INFO sip:bob@example.com SIP/2.0", "call-3", "f", ";tag=g", "2 INFO"), true},
+		// and then long enough for them to time out
+		{140, sipMsg(is, "BYE sip:bob@example.com SIP/2.0", "call-3", "f", ";tag=g", "3 BYE"), false},
+	}
+	for _, m := range msgs {
+		is.NoErr(c.Accept(m.sip, &capture.Meta{Time: start.Add(m.at * time.Second)}))
+	}
+	c.Close()
+	c.Publish(context.Background())
+
+	var expect []*layers.SIP
+	for _, m := range msgs {
+		if m.publish {
+			expect = append(expect, m.sip)
+		}
+	}
+	is.Equal(len(p.msgs), len(expect))
+	for i, m := range p.msgs {
+		is.Equal(m.SIPData, append(expect[i].LayerContents(), expect[i].Payload()...))
+	}
+
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsStarted), 5.0)
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsFull), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.Followed), 11.0)
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsEnded.WithLabelValues("bye")), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsEnded.WithLabelValues("error")), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsEnded.WithLabelValues("timeout")), 3.0)
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsActive), 0.0)
+}
+
+// A challenge for credentials doesn't end the dialog, which continues with
+// the INVITE sent again with them.
+func TestCollectDialogsAuth(t *testing.T) {
+	is := is.New(t)
+	p := &testPublisher{}
+	invites := func(in *filters.Input) bool {
+		return !in.SIP.IsResponse && in.SIP.Method == layers.SIPMethodInvite
+	}
+	c := NewCollecter(invites, p.Publish, 100, Options{Dialogs: true})
+
+	start := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	msgs := []struct {
+		at  time.Duration
+		sip *layers.SIP
+	}{
+		{0, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-1", "a", "", "1 INVITE")},
+		{0, sipMsg(is, "SIP/2.0 407 Proxy Authentication Required", "call-1", "a", ";tag=p", "1 INVITE")},
+		{0, sipMsg(is, "ACK sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=p", "1 ACK")},
+		{1, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-1", "a", "", "2 INVITE")},
+		{1, sipMsg(is, "SIP/2.0 100 Trying", "call-1", "a", "", "2 INVITE")},
+		{5, sipMsg(is, "SIP/2.0 200 OK", "call-1", "a", ";tag=b", "2 INVITE")},
+		{5, sipMsg(is, "ACK sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=b", "2 ACK")},
+		// long after the challenge would have stopped the dialog being followed
+		{120, sipMsg(is, "BYE sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=b", "3 BYE")},
+		{120, sipMsg(is, "SIP/2.0 200 OK", "call-1", "a", ";tag=b", "3 BYE")},
+	}
+	for _, m := range msgs {
+		is.NoErr(c.Accept(m.sip, &capture.Meta{Time: start.Add(m.at * time.Second)}))
+	}
+	c.Close()
+	c.Publish(context.Background())
+
+	is.Equal(len(p.msgs), len(msgs)) // every message of the call is published
+	is.Equal(testutil.ToFloat64(c.metrics.DialogsStarted), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.Followed), 7.0)
+}
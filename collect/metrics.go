@@ -5,14 +5,37 @@ import (
 )
 
 // Metrics contains Prometheus metrics about SIP filtering, including the
-// current filter and how many messages have been rejected and published.
+// current filter and how many messages have been rejected and published, and
+// about the dialogs followed, calls recorded, and transactions timed.
 type Metrics struct {
-	Filter    *prometheus.GaugeVec
-	Rejected  prometheus.Counter
-	Published prometheus.Counter
-	Dropped   prometheus.Counter
+	Filter      *prometheus.GaugeVec
+	Rejected    prometheus.Counter
+	Published   prometheus.Counter
+	Dropped     prometheus.Counter
+	Unparsed    prometheus.Counter
+	UnparsedSDP prometheus.Counter
+
+	Followed       prometheus.Counter
+	DialogsActive  prometheus.Gauge
+	DialogsStarted prometheus.Counter
+	DialogsEnded   *prometheus.CounterVec
+	DialogsFull    prometheus.Counter
+
+	Calls prometheus.Gauge
+	CDRs  prometheus.Counter
+
+	Transactions  prometheus.Gauge
+	Provisional   *prometheus.HistogramVec
+	Final         *prometheus.HistogramVec
+	PostDialDelay prometheus.Histogram
+	AnswerDelay   prometheus.Histogram
+	Unanswered    *prometheus.CounterVec
 }
 
+// latencyBuckets are the buckets of signalling latency histograms, from 10ms
+// to almost three minutes, long enough for a call to ring and be answered.
+var latencyBuckets = prometheus.ExponentialBuckets(0.01, 2, 15)
+
 // NewMetrics creates a newly initialied Metrics.
 func NewMetrics() *Metrics {
 	m := &Metrics{
@@ -32,8 +55,75 @@ func NewMetrics() *Metrics {
 			Name: "msgs_dropped_total",
 			Help: "Number of messages dropped due to full publishing queue",
 		}),
+		Unparsed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "msgs_unparsed_total",
+			Help: "Number of messages published without parsed headers, as they could not be parsed",
+		}),
+		UnparsedSDP: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "msgs_sdp_unparsed_total",
+			Help: "Number of messages published without their SDP body, as it could not be parsed",
+		}),
+		Followed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "msgs_followed_total",
+			Help: "Number of messages published for being in a followed dialog, though not matching SIP filter",
+		}),
+		DialogsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dialogs_active",
+			Help: "Number of dialogs currently followed",
+		}),
+		DialogsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dialogs_started_total",
+			Help: "Number of dialogs followed after a message matched SIP filter",
+		}),
+		DialogsEnded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dialogs_ended_total",
+			Help: "Number of dialogs no longer followed, by reason (bye, error, timeout)",
+		}, []string{"reason"}),
+		DialogsFull: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dialogs_full_total",
+			Help: "Number of dialogs not followed as too many already were",
+		}),
+		Calls: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "calls_active",
+			Help: "Number of calls currently tracked for call detail records",
+		}),
+		CDRs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cdrs_published_total",
+			Help: "Number of call detail records published",
+		}),
+		Transactions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "transactions_active",
+			Help: "Number of requests awaiting a final response",
+		}),
+		Provisional: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "transactions_provisional_seconds",
+			Help:    "Time from a request to its first provisional response, by method",
+			Buckets: latencyBuckets,
+		}, []string{"method"}),
+		Final: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "transactions_final_seconds",
+			Help:    "Time from a request to its final response, by method and response class",
+			Buckets: latencyBuckets,
+		}, []string{"method", "class"}),
+		PostDialDelay: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "calls_post_dial_delay_seconds",
+			Help:    "Time from an initial INVITE to its first 180 or 183 response",
+			Buckets: latencyBuckets,
+		}),
+		AnswerDelay: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "calls_answer_delay_seconds",
+			Help:    "Time from an initial INVITE to its 2xx response",
+			Buckets: latencyBuckets,
+		}),
+		Unanswered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "transactions_unanswered_total",
+			Help: "Number of requests without a final response before timing out, by method",
+		}, []string{"method"}),
 	}
 
+	for _, reason := range []string{endBye, endError, endTimeout} {
+		m.DialogsEnded.WithLabelValues(reason)
+	}
 	return m
 }
 
@@ -45,5 +135,20 @@ func (m Metrics) List() []prometheus.Collector {
 		m.Rejected,
 		m.Published,
 		m.Dropped,
+		m.Unparsed,
+		m.UnparsedSDP,
+		m.Followed,
+		m.DialogsActive,
+		m.DialogsStarted,
+		m.DialogsEnded,
+		m.DialogsFull,
+		m.Calls,
+		m.CDRs,
+		m.Transactions,
+		m.Provisional,
+		m.Final,
+		m.PostDialDelay,
+		m.AnswerDelay,
+		m.Unanswered,
 	}
 }
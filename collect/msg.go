@@ -6,20 +6,36 @@ import (
 	"time"
 
 	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/sdp"
+	"github.com/nextcaller/sip-capture/sipmsg"
 )
 
+// SchemaVersion is the version of Msg's JSON envelope.  It changes whenever
+// fields are renamed, removed, or change meaning; envelopes without a version
+// predate it, and have no capture metadata.
+const SchemaVersion = 1
+
 // Msg represents a captured SIP message and metadata.  It exists to create a
-// JSON envelop for MQTT publishing.  SIPData will be base64 encoded.
+// JSON envelop for MQTT publishing.  SIPData will be base64 encoded.  Capture
+// keeps where the message was captured: its addresses, ports, transport,
+// interface and VLAN, with Time being the capture time.  Parsed is the
+// message parsed by sipmsg, and SDP the session description in its body, if
+// enabled and they could be.
 type Msg struct {
-	SIPData []byte    `json:"sip"`
-	Time    time.Time `json:"time"`
-	ID      string    `json:"id"`
+	Version int             `json:"version"`
+	SIPData []byte          `json:"sip"`
+	Time    time.Time       `json:"time"`
+	ID      string          `json:"id"`
+	Capture *capture.Meta   `json:"capture,omitempty"`
+	Parsed  *sipmsg.Message `json:"parsed,omitempty"`
+	SDP     *sdp.Session    `json:"sdp,omitempty"`
 }
 
-// NewMsg creates a Msg structure from raw SIP Message data.  Its ID will be
-// the SIP Call-ID (or i:) header if available, or a hash as of the entire SIP
-// message if not available.
-func NewMsg(sip *layers.SIP) *Msg {
+// NewMsg creates a Msg structure from raw SIP Message data captured as
+// described by meta.  Its ID will be the SIP Call-ID (or i:) header if
+// available, or a hash as of the entire SIP message if not available.
+func NewMsg(sip *layers.SIP, meta *capture.Meta) *Msg {
 	cid := sip.GetCallID()
 	msg := append(sip.LayerContents(), sip.Payload()...)
 	if cid == "" {
@@ -28,8 +44,10 @@ func NewMsg(sip *layers.SIP) *Msg {
 		cid = fmt.Sprintf("%x", h.Sum64())
 	}
 	return &Msg{
+		Version: SchemaVersion,
 		SIPData: msg,
-		Time:    time.Now().UTC(),
+		Time:    meta.Time.UTC(),
 		ID:      cid,
+		Capture: meta,
 	}
 }
@@ -2,13 +2,17 @@ package collect
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"net"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
 )
 
 func loadSIP(is *is.I, file string) *layers.SIP {
@@ -44,21 +48,69 @@ func TestFunction(t *testing.T) {
 			is := is.New(t)
 			sip := loadSIP(is, tc.sourceFile)
 
-			msg := NewMsg(sip)
+			ts := time.Date(2020, 7, 20, 12, 0, 0, 0, time.FixedZone("EST", -5*3600))
+			msg := NewMsg(sip, &capture.Meta{Time: ts})
 
 			t.Logf("[test:%s] [id:%v] %+v", name, sip.GetFirstHeader("Call-ID"), msg)
 			is.Equal(msg.ID, tc.expectedID)                                        // MsgID should match
 			is.True(bytes.Contains(msg.SIPData, []byte("INVITE foo@bar SIP/2.0"))) // SIPData contains expected invite.
+			is.True(msg.Time.Equal(ts))                                            // Time is the capture time
+			is.Equal(msg.Time.Location(), time.UTC)                                // Time is in UTC
 
 		})
 	}
 }
 
+func TestMsgJSON(t *testing.T) {
+	is := is.New(t)
+	sip := loadSIP(is, "sip_packet.txt")
+	ts := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	msg := NewMsg(sip, &capture.Meta{
+		Time:      ts,
+		SrcIP:     net.IPv4(10, 0, 0, 1),
+		DstIP:     net.ParseIP("2001:db8::2"),
+		SrcPort:   5060,
+		DstPort:   5061,
+		Transport: capture.TLS,
+		Interface: "eth1",
+		VLAN:      100,
+	})
+
+	data, err := json.Marshal(msg)
+	is.NoErr(err)
+	var got map[string]interface{}
+	is.NoErr(json.Unmarshal(data, &got))
+	is.Equal(got["version"], float64(SchemaVersion))
+	is.Equal(got["time"], "2020-07-20T12:00:00Z")
+	is.Equal(got["id"], "12345678@foo.com")
+	is.Equal(got["capture"], map[string]interface{}{
+		"src_ip":    "10.0.0.1",
+		"dst_ip":    "2001:db8::2",
+		"src_port":  float64(5060),
+		"dst_port":  float64(5061),
+		"transport": "tls",
+		"interface": "eth1",
+		"vlan":      float64(100),
+	})
+
+	// an unknown interface, and untagged packets, are left out.
+	msg = NewMsg(sip, &capture.Meta{Time: ts, Transport: capture.UDP})
+	data, err = json.Marshal(msg)
+	is.NoErr(err)
+	got = nil
+	is.NoErr(json.Unmarshal(data, &got))
+	capt := got["capture"].(map[string]interface{})
+	_, ok := capt["interface"]
+	is.True(!ok)
+	_, ok = capt["vlan"]
+	is.True(!ok)
+}
+
 func BenchmarkNewMsg(b *testing.B) {
 	is := is.New(b)
 	sip := loadSIP(is, "sip_packet.txt")
 	for i := 0; i < b.N; i++ {
-		NewMsg(sip)
+		NewMsg(sip, &capture.Meta{Time: time.Now()})
 	}
 }
 
@@ -66,6 +118,6 @@ func BenchmarkNewMsgHashed(b *testing.B) {
 	is := is.New(b)
 	sip := loadSIP(is, "sip_packet_no_call_id.txt")
 	for i := 0; i < b.N; i++ {
-		NewMsg(sip)
+		NewMsg(sip, &capture.Meta{Time: time.Now()})
 	}
 }
@@ -0,0 +1,144 @@
+package collect
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/sipmsg"
+)
+
+const (
+	// transactionTimeout is how long a transaction waits for a final
+	// response before it's counted unanswered.  It's Timers B and F of RFC
+	// 3261, 64*T1.
+	transactionTimeout = 32 * time.Second
+	// proceedingTimeout is how long an INVITE transaction which has had a
+	// provisional response waits for a final one.  It's Timer C of RFC 3261.
+	proceedingTimeout = 3 * time.Minute
+	// maxTransactions is how many transactions may be matched at once; more
+	// requests than this are not timed.
+	maxTransactions = 100000
+)
+
+// transactionKey identifies a transaction by the branch of its top Via, and
+// its Call-ID and CSeq, which its responses all share.
+type transactionKey struct {
+	branch string
+	callID string
+	cseq   string
+}
+
+type transaction struct {
+	method      string
+	sent        time.Time
+	expires     time.Time
+	provisional bool
+	// initial is set for an INVITE outside of any dialog, whose responses
+	// time how long the call took to ring and be answered.
+	initial bool
+	ringing bool
+}
+
+// transactions matches requests with their responses, observing the time
+// between them.  Time is that of the messages' capture.
+type transactions struct {
+	metrics   *Metrics
+	table     map[transactionKey]*transaction
+	lastSweep time.Time
+}
+
+func newTransactions(metrics *Metrics) *transactions {
+	return &transactions{metrics: metrics, table: make(map[transactionKey]*transaction)}
+}
+
+// observe matches sip to its transaction, beginning one for a request, and
+// observing the time a response took.
+func (t *transactions) observe(sip *layers.SIP, meta *capture.Meta) {
+	now := meta.Time
+	if now.Sub(t.lastSweep) >= sweepInterval {
+		t.sweep(now)
+	}
+
+	k, ok := keyOf(sip)
+	if !ok {
+		return
+	}
+	tr, found := t.table[k]
+
+	if !sip.IsResponse {
+		// ACKs have no response, and retransmissions keep the first's time.
+		if found || sip.Method == layers.SIPMethodAck || len(t.table) >= maxTransactions {
+			return
+		}
+		t.table[k] = &transaction{
+			method:  sip.Method.String(),
+			sent:    now,
+			expires: now.Add(transactionTimeout),
+			initial: sip.Method == layers.SIPMethodInvite && tag(sip.GetTo()) == "",
+		}
+		t.metrics.Transactions.Set(float64(len(t.table)))
+		return
+	}
+	if !found {
+		return
+	}
+
+	elapsed := now.Sub(tr.sent).Seconds()
+	code := sip.ResponseCode
+	if code < 200 {
+		if !tr.provisional {
+			tr.provisional = true
+			t.metrics.Provisional.WithLabelValues(tr.method).Observe(elapsed)
+		}
+		if tr.initial && !tr.ringing && (code == 180 || code == 183) {
+			tr.ringing = true
+			t.metrics.PostDialDelay.Observe(elapsed)
+		}
+		if tr.method == layers.SIPMethodInvite.String() {
+			tr.expires = now.Add(proceedingTimeout)
+		}
+		return
+	}
+	t.metrics.Final.WithLabelValues(tr.method, fmt.Sprintf("%dxx", code/100)).Observe(elapsed)
+	if tr.initial && code < 300 {
+		t.metrics.AnswerDelay.Observe(elapsed)
+	}
+	delete(t.table, k)
+	t.metrics.Transactions.Set(float64(len(t.table)))
+}
+
+// sweep counts and removes the transactions which went unanswered by now.
+func (t *transactions) sweep(now time.Time) {
+	t.lastSweep = now
+	for k, tr := range t.table {
+		if now.Before(tr.expires) {
+			continue
+		}
+		delete(t.table, k)
+		t.metrics.Unanswered.WithLabelValues(tr.method).Inc()
+	}
+	t.metrics.Transactions.Set(float64(len(t.table)))
+}
+
+// keyOf returns the key of the transaction sip is part of, and whether it
+// has the headers to have one.
+func keyOf(sip *layers.SIP) (transactionKey, bool) {
+	via := sip.GetFirstHeader("Via")
+	// several Vias may share a header line; the first is the top one.
+	if i := strings.IndexByte(via, ','); i >= 0 {
+		via = via[:i]
+	}
+	v, err := sipmsg.ParseVia(via)
+	if err != nil {
+		return transactionKey{}, false
+	}
+	k := transactionKey{
+		branch: v.Branch,
+		callID: sip.GetCallID(),
+		cseq:   strings.Join(strings.Fields(sip.GetFirstHeader("CSeq")), " "),
+	}
+	return k, k.callID != "" && k.cseq != ""
+}
@@ -0,0 +1,79 @@
+package collect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/filters"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogram returns the count and sum of a histogram's observations.
+func histogram(is *is.I, o prometheus.Observer) (uint64, float64) {
+	m := &dto.Metric{}
+	is.NoErr(o.(prometheus.Metric).Write(m))
+	return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+}
+
+func TestCollectLatency(t *testing.T) {
+	is := is.New(t)
+	p := &testPublisher{}
+	c := NewCollecter(func(*filters.Input) bool { return true }, p.Publish, 100, Options{Latency: true})
+
+	start := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	msgs := []struct {
+		at  time.Duration
+		sip *layers.SIP
+	}{
+		{0, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-1", "a", "", "1 INVITE")},
+		{0, sipMsg(is, "OPTIONS sip:bob@example.com SIP/2.0", "call-2", "c", "", "1 OPTIONS")},
+		{50 * time.Millisecond, sipMsg(is, "SIP/2.0 200 OK", "call-2", "c", ";tag=d", "1 OPTIONS")},
+		{100 * time.Millisecond, sipMsg(is, "SIP/2.0 100 Trying", "call-1", "a", "", "1 INVITE")},
+		// a retransmission doesn't restart the clock
+		{time.Second, sipMsg(is, "INVITE sip:bob@example.com SIP/2.0", "call-1", "a", "", "1 INVITE")},
+		{2 * time.Second, sipMsg(is, "SIP/2.0 180 Ringing", "call-1", "a", ";tag=b", "1 INVITE")},
+		{3 * time.Second, sipMsg(is, "SIP/2.0 183 Session Progress", "call-1", "a", ";tag=b", "1 INVITE")},
+		{5 * time.Second, sipMsg(is, "SIP/2.0 200 OK", "call-1", "a", ";tag=b", "1 INVITE")},
+		{5 * time.Second, sipMsg(is, "ACK sip:bob@example.com SIP/2.0", "call-1", "a", ";tag=b", "1 ACK")},
+		// a re-INVITE is timed, but doesn't answer a call
+		{10 * time.Second, sipMsg(is, "INVITE sip:alice@example.com SIP/2.0", "call-1", "b", ";tag=a", "2 INVITE")},
+		{11 * time.Second, sipMsg(is, "SIP/2.0 200 OK", "call-1", "b", ";tag=a", "2 INVITE")},
+		{20 * time.Second, sipMsg(is, "BYE sip:alice@example.com SIP/2.0", "call-1", "b", ";tag=a", "3 BYE")},
+		{20*time.Second + 200*time.Millisecond, sipMsg(is, "SIP/2.0 404 Not Found", "call-1", "b", ";tag=a", "3 BYE")},
+		{30 * time.Second, sipMsg(is, "REGISTER sip:example.com SIP/2.0", "call-3", "e", "", "4 REGISTER")},
+		{70 * time.Second, sipMsg(is, "SIP/2.0 200 OK", "call-3", "e", "", "4 REGISTER")},
+	}
+	for _, m := range msgs {
+		is.NoErr(c.Accept(m.sip, &capture.Meta{Time: start.Add(m.at)}))
+	}
+	c.Close()
+	c.Publish(context.Background())
+
+	n, sum := histogram(is, c.metrics.Provisional.WithLabelValues("INVITE"))
+	is.Equal(n, uint64(1))
+	is.Equal(sum, 0.1)
+	n, sum = histogram(is, c.metrics.PostDialDelay)
+	is.Equal(n, uint64(1))
+	is.Equal(sum, 2.0)
+	n, sum = histogram(is, c.metrics.AnswerDelay)
+	is.Equal(n, uint64(1))
+	is.Equal(sum, 5.0)
+	n, sum = histogram(is, c.metrics.Final.WithLabelValues("INVITE", "2xx"))
+	is.Equal(n, uint64(2))
+	is.Equal(sum, 6.0)
+	n, _ = histogram(is, c.metrics.Final.WithLabelValues("OPTIONS", "2xx"))
+	is.Equal(n, uint64(1))
+	n, _ = histogram(is, c.metrics.Final.WithLabelValues("BYE", "4xx"))
+	is.Equal(n, uint64(1))
+	n, _ = histogram(is, c.metrics.Final.WithLabelValues("REGISTER", "2xx"))
+	is.Equal(n, uint64(0)) // it came too late
+
+	is.Equal(testutil.ToFloat64(c.metrics.Unanswered.WithLabelValues("REGISTER")), 1.0)
+	is.Equal(testutil.ToFloat64(c.metrics.Transactions), 0.0)
+}
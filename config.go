@@ -2,18 +2,48 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/nextcaller/sip-capture/extract"
 	"github.com/nextcaller/sip-capture/publisher"
+	"github.com/nextcaller/sip-capture/source"
+	"github.com/nextcaller/sip-capture/tlsdecrypt"
 )
 
 type config struct {
 	LogLevel    string
 	Interface   string
+	Interfaces  []captureInterface
+	DedupWindow time.Duration
+	Capture     string
+	ReadFile    string
+	HEPListen   []string
 	BPFFilter   string
 	SIPFilter   string
 	MetricsAddr string
+	AFPacket    source.AFPacketOptions
+	Extract     extract.Options
+	Collect     collect.Options
+	CDR         bool
+	Publisher   string
 	MQTT        publisher.MQTTOptions
+	HEP         publisher.HEPOptions
+	Kafka       publisher.KafkaOptions
+	NATS        publisher.NATSOptions
+	HTTP        publisher.HTTPOptions
+}
+
+// captureInterface is one entry of the interface list, with the BPF filter
+// to capture from it with.
+type captureInterface struct {
+	Name   string
+	Filter string
 }
 
 func defEnvStr(k, dval string) string {
@@ -23,20 +53,243 @@ func defEnvStr(k, dval string) string {
 	return dval
 }
 
+func defEnvInt(k string, dval int) int {
+	if v, ok := os.LookupEnv(k); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return dval
+}
+
+func defEnvBool(k string, dval bool) bool {
+	if v, ok := os.LookupEnv(k); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return dval
+}
+
+func defEnvDuration(k string, dval time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(k); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return dval
+}
+
+// parseInterfaces splits a comma separated list of interfaces, each
+// optionally followed by =filter, using filter for those without one.
+func parseInterfaces(list, filter string) ([]captureInterface, error) {
+	var ifaces []captureInterface
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		ci := captureInterface{Filter: filter}
+		if i := strings.Index(entry, "="); i >= 0 {
+			ci.Filter = strings.TrimSpace(entry[i+1:])
+			entry = entry[:i]
+		}
+		ci.Name = strings.TrimSpace(entry)
+		if ci.Name == "" {
+			return nil, fmt.Errorf("empty interface name in %q", list)
+		}
+		if seen[ci.Name] {
+			return nil, fmt.Errorf("interface %q listed more than once", ci.Name)
+		}
+		seen[ci.Name] = true
+		ifaces = append(ifaces, ci)
+	}
+	return ifaces, nil
+}
+
+// parseDecap enables each tunnel in a comma separated list for extraction.
+func parseDecap(list string, o *extract.Options) error {
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "gre":
+			o.GRE = true
+		case "erspan":
+			o.ERSPAN = true
+		case "vxlan":
+			o.VXLAN = true
+		default:
+			return fmt.Errorf("unknown tunnel %q to decapsulate", name)
+		}
+	}
+	return nil
+}
+
+// loadTLSKeys opens the key log, and reads each of a comma separated list of
+// RSA private key files, that TLS sessions are to be decrypted with.  TLS is
+// left encrypted if neither is given.
+func loadTLSKeys(keylog, keyFiles string, o *extract.Options) error {
+	keys := &tlsdecrypt.Keys{}
+	if keylog != "" {
+		kl, err := tlsdecrypt.OpenKeyLog(keylog)
+		if err != nil {
+			return err
+		}
+		keys.KeyLog = kl
+	}
+	for _, path := range strings.Split(keyFiles, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		key, err := tlsdecrypt.LoadRSAKey(path)
+		if err != nil {
+			return err
+		}
+		keys.RSA = append(keys.RSA, key)
+	}
+	if keys.KeyLog != nil || len(keys.RSA) > 0 {
+		o.TLS = keys
+	}
+	return nil
+}
+
 func (c *config) Load(args []string) error {
 	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
 	fs.StringVar(&c.LogLevel, "log-level", defEnvStr("LOG_LEVEL", "info"), "logging level (debug, info, error)")
-	fs.StringVar(&c.Interface, "interface", defEnvStr("INTERFACE", "lo"), "Interface for pcap to capture from")
+	fs.StringVar(&c.Interface, "interface", defEnvStr("INTERFACE", "lo"), "comma separated interfaces to capture from, each optionally name=bpf-filter")
+	fs.DurationVar(&c.DedupWindow, "dedup-window", defEnvDuration("DEDUP_WINDOW", 100*time.Millisecond), "drop packets seen on another interface within this long (0 disables)")
+	fs.StringVar(&c.Capture, "capture", defEnvStr("CAPTURE", "pcap"), "live capture method (pcap, afpacket, hep)")
+	hepListen := fs.String("hep-listen", defEnvStr("HEP_LISTEN", source.DefaultHEPListen), "comma separated udp:// and tcp:// addresses to receive HEP on, with the hep capture")
+	fs.StringVar(&c.ReadFile, "read-file", defEnvStr("READ_FILE", ""), "pcap or pcapng file to read instead of capturing live (- for stdin)")
 	fs.StringVar(&c.BPFFilter, "bpf-filter", defEnvStr("BPF_FILTER", "udp and port 5060"), "pcap BPF packet selection filter")
 	fs.StringVar(&c.SIPFilter, "sip-filter", defEnvStr("SIP_FILTER", ""), "SIP selection filter")
+	fs.BoolVar(&c.Collect.Parse, "parse", defEnvBool("PARSE", false), "add the parsed start line, headers, and multipart body to published JSON")
+	fs.BoolVar(&c.Collect.SDP, "sdp", defEnvBool("SDP", false), "add the parsed SDP body's media, addresses, and codecs to published JSON")
+	fs.BoolVar(&c.Collect.Dialogs, "dialogs", defEnvBool("DIALOGS", false), "publish every message of a dialog once one matches the SIP filter")
+	fs.DurationVar(&c.Collect.DialogTTL, "dialog-ttl", defEnvDuration("DIALOG_TTL", collect.DefaultDialogTTL), "stop following a dialog this long after its last message")
+	fs.IntVar(&c.Collect.MaxDialogs, "max-dialogs", defEnvInt("MAX_DIALOGS", collect.DefaultMaxDialogs), "most dialogs to follow at once")
+	fs.BoolVar(&c.CDR, "cdr", defEnvBool("CDR", false), "publish a call detail record of each call as it ends")
+	fs.BoolVar(&c.Collect.Latency, "latency", defEnvBool("LATENCY", false), "match requests with their responses for signalling latency metrics")
 	fs.StringVar(&c.MetricsAddr, "metric-filter", defEnvStr("METRICS_ADDR", ""), "IP:Port to bind for /metrics endpoint")
 
+	fs.IntVar(&c.AFPacket.BlockSize, "afpacket-block-size", defEnvInt("AFPACKET_BLOCK_SIZE", source.DefaultBlockSize), "AF_PACKET ring block size in bytes")
+	fs.IntVar(&c.AFPacket.NumBlocks, "afpacket-blocks", defEnvInt("AFPACKET_BLOCKS", source.DefaultNumBlocks), "number of blocks in the AF_PACKET ring")
+	fanout := fs.Uint("afpacket-fanout-group", uint(defEnvInt("AFPACKET_FANOUT_GROUP", 0)), "AF_PACKET fanout group id to join, each further interface taking the next id (0 disables fanout)")
+	fs.StringVar(&c.AFPacket.FanoutType, "afpacket-fanout-type", defEnvStr("AFPACKET_FANOUT_TYPE", source.DefaultFanoutType), "AF_PACKET fanout mode (hash, lb, cpu, rollover, random, qm)")
+
+	decap := fs.String("decap", defEnvStr("DECAP", "gre,erspan,vxlan"), "comma separated tunnels to decapsulate (gre, erspan, vxlan)")
+	vxlanPort := fs.Uint("vxlan-port", uint(defEnvInt("VXLAN_PORT", extract.DefaultVXLANPort)), "UDP port of VXLAN tunnels")
+	tlsKeyLog := fs.String("tls-keylog", defEnvStr("TLS_KEYLOG", ""), "NSS key log file (SSLKEYLOGFILE) to decrypt SIP over TLS with")
+	tlsKeys := fs.String("tls-key", defEnvStr("TLS_KEY", ""), "comma separated RSA server private key files (pem) to decrypt SIP over TLS with")
+
+	fs.StringVar(&c.Publisher, "publisher", defEnvStr("PUBLISHER", "mqtt"), "comma separated publishers to send SIP messages to ("+strings.Join(publisher.Names(), ", ")+")")
+
 	fs.StringVar(&c.MQTT.Broker, "broker", defEnvStr("BROKER", "tcp://localhost:1883"), "MQTT broker")
 	fs.StringVar(&c.MQTT.ClientID, "client-id", defEnvStr("CLIENT_ID", ""), "MQTT Client ID")
 	fs.StringVar(&c.MQTT.Topic, "topic", defEnvStr("TOPIC", ""), "MQTT publishing topic for SIP data")
+	fs.StringVar(&c.MQTT.CDRTopic, "cdr-topic", defEnvStr("CDR_TOPIC", ""), "MQTT publishing topic for call detail records (default the SIP topic with /cdr appended)")
 	fs.StringVar(&c.MQTT.Telemetry, "telemetry-topic", defEnvStr("TELEMETRY_TOPIC", ""), "MQTT publishing topic for telemetry")
 	fs.StringVar(&c.MQTT.TLSKeyFile, "key-file", defEnvStr("KEY_FILE", ""), "MQTT TLS key file (pem)")
 	fs.StringVar(&c.MQTT.TLSCertFile, "cert-file", defEnvStr("CERT_FILE", ""), "MQTT TLS cert file (pem)")
+	fs.StringVar(&c.MQTT.Spool.Dir, "spool-dir", defEnvStr("SPOOL_DIR", ""), "directory to spool MQTT messages in while the broker can't be reached (empty disables)")
+	spoolMax := fs.Int("spool-max-mb", defEnvInt("SPOOL_MAX_MB", 1024), "most megabytes to spool (0 for no limit)")
+	fs.DurationVar(&c.MQTT.Spool.MaxAge, "spool-max-age", defEnvDuration("SPOOL_MAX_AGE", 24*time.Hour), "drop spooled messages older than this (0 for no limit)")
+	spoolMinFree := fs.Int("spool-min-free-mb", defEnvInt("SPOOL_MIN_FREE_MB", 512), "megabytes to leave free on the spool's disk")
+
+	fs.StringVar(&c.HEP.Server, "hep-server", defEnvStr("HEP_SERVER", "udp://localhost:9060"), "HOMER server URL to publish HEP to (udp:// or tcp://)")
+	fs.StringVar(&c.HEP.AuthKey, "hep-auth-key", defEnvStr("HEP_AUTH_KEY", ""), "HEP authentication key")
+	nodeID := fs.Uint("hep-node-id", uint(defEnvInt("HEP_NODE_ID", 0)), "HEP capture node ID")
+	fs.StringVar(&c.HEP.NodeName, "hep-node-name", defEnvStr("HEP_NODE_NAME", ""), "HEP capture node name")
+
+	kafkaBrokers := fs.String("kafka-brokers", defEnvStr("KAFKA_BROKERS", "localhost:9092"), "comma separated Kafka bootstrap brokers (host:port)")
+	fs.StringVar(&c.Kafka.Topic, "kafka-topic", defEnvStr("KAFKA_TOPIC", "sip"), "Kafka topic for SIP data")
+	fs.StringVar(&c.Kafka.CDRTopic, "kafka-cdr-topic", defEnvStr("KAFKA_CDR_TOPIC", ""), "Kafka topic for call detail records (default the SIP topic with .cdr appended)")
+	fs.StringVar(&c.Kafka.ClientID, "kafka-client-id", defEnvStr("KAFKA_CLIENT_ID", "sip-capture"), "Kafka client ID")
+	fs.StringVar(&c.Kafka.Version, "kafka-version", defEnvStr("KAFKA_VERSION", "1.0.0"), "oldest Kafka version of the brokers")
+	fs.StringVar(&c.Kafka.Key, "kafka-key", defEnvStr("KAFKA_KEY", publisher.KafkaKeyCallID), "Kafka partition key (call-id, none)")
+	fs.StringVar(&c.Kafka.Acks, "kafka-acks", defEnvStr("KAFKA_ACKS", "all"), "Kafka acknowledgements to wait for (all, leader, none)")
+	fs.StringVar(&c.Kafka.Compression, "kafka-compression", defEnvStr("KAFKA_COMPRESSION", "none"), "Kafka compression (none, gzip, snappy, lz4, zstd)")
+	fs.IntVar(&c.Kafka.BatchSize, "kafka-batch-size", defEnvInt("KAFKA_BATCH_SIZE", 1000), "most messages to send to Kafka at once")
+	fs.DurationVar(&c.Kafka.Linger, "kafka-linger", defEnvDuration("KAFKA_LINGER", 100*time.Millisecond), "longest to wait for a batch of Kafka messages to fill")
+	fs.BoolVar(&c.Kafka.Idempotent, "kafka-idempotent", defEnvBool("KAFKA_IDEMPOTENT", false), "idempotent Kafka delivery, without duplicates on retries (needs acks all)")
+	fs.StringVar(&c.Kafka.SASL, "kafka-sasl", defEnvStr("KAFKA_SASL", ""), "Kafka SASL mechanism (plain, scram-sha-256, scram-sha-512)")
+	fs.StringVar(&c.Kafka.SASLUser, "kafka-user", defEnvStr("KAFKA_USER", ""), "Kafka SASL user")
+	fs.StringVar(&c.Kafka.SASLPassword, "kafka-password", defEnvStr("KAFKA_PASSWORD", ""), "Kafka SASL password")
+	fs.BoolVar(&c.Kafka.TLS, "kafka-tls", defEnvBool("KAFKA_TLS", false), "connect to Kafka with TLS")
+	fs.StringVar(&c.Kafka.TLSCAFile, "kafka-ca-file", defEnvStr("KAFKA_CA_FILE", ""), "Kafka TLS CA file (pem) to verify brokers with")
+	fs.StringVar(&c.Kafka.TLSKeyFile, "kafka-key-file", defEnvStr("KAFKA_KEY_FILE", ""), "Kafka TLS client key file (pem)")
+	fs.StringVar(&c.Kafka.TLSCertFile, "kafka-cert-file", defEnvStr("KAFKA_CERT_FILE", ""), "Kafka TLS client cert file (pem)")
 
-	return fs.Parse(args[1:])
+	fs.StringVar(&c.NATS.URL, "nats-url", defEnvStr("NATS_URL", "nats://localhost:4222"), "comma separated NATS server URLs")
+	fs.StringVar(&c.NATS.Subject, "nats-subject", defEnvStr("NATS_SUBJECT", "sip"), "NATS subject template for SIP data")
+	fs.StringVar(&c.NATS.CDRSubject, "nats-cdr-subject", defEnvStr("NATS_CDR_SUBJECT", ""), "NATS subject template for call detail records (default the SIP subject with .cdr appended)")
+	fs.StringVar(&c.NATS.Name, "nats-name", defEnvStr("NATS_NAME", "sip-capture"), "NATS connection name")
+	fs.BoolVar(&c.NATS.JetStream, "nats-jetstream", defEnvBool("NATS_JETSTREAM", false), "wait for a NATS JetStream stream to acknowledge each message")
+	fs.StringVar(&c.NATS.Token, "nats-token", defEnvStr("NATS_TOKEN", ""), "NATS authentication token")
+	fs.StringVar(&c.NATS.NKeyFile, "nats-nkey-file", defEnvStr("NATS_NKEY_FILE", ""), "NATS nkey seed file")
+	fs.StringVar(&c.NATS.CredsFile, "nats-creds-file", defEnvStr("NATS_CREDS_FILE", ""), "NATS user credentials file")
+	fs.BoolVar(&c.NATS.TLS, "nats-tls", defEnvBool("NATS_TLS", false), "require TLS connecting to NATS")
+	fs.StringVar(&c.NATS.TLSCAFile, "nats-ca-file", defEnvStr("NATS_CA_FILE", ""), "NATS TLS CA file (pem) to verify servers with")
+	fs.StringVar(&c.NATS.TLSKeyFile, "nats-key-file", defEnvStr("NATS_KEY_FILE", ""), "NATS TLS client key file (pem)")
+	fs.StringVar(&c.NATS.TLSCertFile, "nats-cert-file", defEnvStr("NATS_CERT_FILE", ""), "NATS TLS client cert file (pem)")
+
+	fs.StringVar(&c.HTTP.URL, "http-url", defEnvStr("HTTP_URL", "http://localhost:8080/sip"), "HTTP collector URL SIP data is posted to")
+	fs.StringVar(&c.HTTP.CDRURL, "http-cdr-url", defEnvStr("HTTP_CDR_URL", ""), "HTTP collector URL call detail records are posted to (default the SIP URL with /cdr appended)")
+	fs.StringVar(&c.HTTP.Format, "http-format", defEnvStr("HTTP_FORMAT", publisher.HTTPFormatJSON), "HTTP batch format (json, ndjson)")
+	fs.BoolVar(&c.HTTP.Gzip, "http-gzip", defEnvBool("HTTP_GZIP", false), "gzip HTTP batches")
+	fs.IntVar(&c.HTTP.BatchSize, "http-batch-size", defEnvInt("HTTP_BATCH_SIZE", 100), "most messages posted in one HTTP batch")
+	fs.DurationVar(&c.HTTP.BatchAge, "http-batch-age", defEnvDuration("HTTP_BATCH_AGE", time.Second), "longest a message waits for its HTTP batch to fill")
+	fs.DurationVar(&c.HTTP.Timeout, "http-timeout", defEnvDuration("HTTP_TIMEOUT", 10*time.Second), "HTTP request timeout")
+	fs.IntVar(&c.HTTP.MaxRetries, "http-max-retries", defEnvInt("HTTP_MAX_RETRIES", 5), "times a failed HTTP batch is retried")
+	fs.DurationVar(&c.HTTP.Backoff, "http-backoff", defEnvDuration("HTTP_BACKOFF", 500*time.Millisecond), "wait before the first HTTP retry, doubled for each after")
+	fs.StringVar(&c.HTTP.BearerToken, "http-token", defEnvStr("HTTP_TOKEN", ""), "HTTP bearer token")
+	fs.StringVar(&c.HTTP.TLSCAFile, "http-ca-file", defEnvStr("HTTP_CA_FILE", ""), "HTTP TLS CA file (pem) to verify the collector with")
+	fs.StringVar(&c.HTTP.TLSKeyFile, "http-key-file", defEnvStr("HTTP_KEY_FILE", ""), "HTTP TLS client key file (pem)")
+	fs.StringVar(&c.HTTP.TLSCertFile, "http-cert-file", defEnvStr("HTTP_CERT_FILE", ""), "HTTP TLS client cert file (pem)")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch c.Capture {
+	case "pcap", "afpacket", "hep":
+	default:
+		return fmt.Errorf("unknown capture method %v, must be pcap, afpacket, or hep", c.Capture)
+	}
+	if *fanout > math.MaxUint16 {
+		return fmt.Errorf("afpacket fanout group %d must be less than %d", *fanout, math.MaxUint16+1)
+	}
+	c.AFPacket.FanoutGroup = uint16(*fanout)
+	if err := parseDecap(*decap, &c.Extract); err != nil {
+		return err
+	}
+	if *vxlanPort == 0 || *vxlanPort > math.MaxUint16 {
+		return fmt.Errorf("vxlan port %d must be between 1 and %d", *vxlanPort, math.MaxUint16)
+	}
+	c.Extract.VXLANPort = uint16(*vxlanPort)
+	if err := loadTLSKeys(*tlsKeyLog, *tlsKeys, &c.Extract); err != nil {
+		return err
+	}
+	if *nodeID > math.MaxUint32 {
+		return fmt.Errorf("hep node id %d must be less than %d", *nodeID, math.MaxUint32+1)
+	}
+	c.HEP.NodeID = uint32(*nodeID)
+	if *spoolMax < 0 || *spoolMinFree < 0 {
+		return fmt.Errorf("spool sizes %d and %d must not be negative", *spoolMax, *spoolMinFree)
+	}
+	c.MQTT.Spool.MaxSize = int64(*spoolMax) << 20
+	c.MQTT.Spool.MinFree = int64(*spoolMinFree) << 20
+
+	ifaces, err := parseInterfaces(c.Interface, c.BPFFilter)
+	if err != nil {
+		return err
+	}
+	c.Interfaces = ifaces
+	// each interface joins its own fanout group, numbered on from the first.
+	if last := uint(*fanout) + uint(len(ifaces)) - 1; *fanout != 0 && last > math.MaxUint16 {
+		return fmt.Errorf("afpacket fanout groups %d to %d for %d interfaces must be less than %d", *fanout, last, len(ifaces), math.MaxUint16+1)
+	}
+	for _, b := range strings.Split(*kafkaBrokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			c.Kafka.Brokers = append(c.Kafka.Brokers, b)
+		}
+	}
+	c.HEPListen = strings.Split(*hepListen, ",")
+	return nil
 }
@@ -10,7 +10,7 @@
 // that can be found in the LICENSE file in the root of the source
 // tree.
 
-// Package defrag implements a IPv4 defragmenter
+// Package defrag implements IPv4 and IPv6 defragmenters
 package defrag
 
 import (
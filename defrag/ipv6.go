@@ -0,0 +1,306 @@
+package defrag
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Constants determining how to handle IPv6 fragments.
+// Reference RFC 8200, section 4.5.  As with IPv4, the minimum fragment size
+// is overridden to 1 so that short fragments from misbehaving hardware are
+// still reassembled.
+const (
+	IPv6MinimumFragmentSize    = 1     // Minimum size of a single fragment
+	IPv6MaximumSize            = 65535 // Maximum size of a reassembled payload (2^16)
+	IPv6MaximumFragmentOffset  = 8191  // Maximum offset of a fragment (13 bits)
+	IPv6MaximumFragmentListLen = 8192  // Back out if we get more than this many fragments
+)
+
+// DefragIPv6 takes in an IPv6 packet and its Fragment extension header.
+//
+// It behaves the same as DefragIPv4: 'in' remains untouched, a nil frag
+// means the packet is not fragmented and is returned as is, a nil return
+// means more fragments are needed, and the final fragment returns a new IPv6
+// layer holding the whole reassembled payload.  The returned layer has the
+// Fragment extension header removed, so its NextHeader is the protocol of the
+// reassembled payload.
+func (d *IPv6Defragmenter) DefragIPv6(in *layers.IPv6, frag *layers.IPv6Fragment) (*layers.IPv6, error) {
+	return d.DefragIPv6WithTimestamp(in, frag, time.Now())
+}
+
+// DefragIPv6WithTimestamp provides functionality of DefragIPv6 with
+// an additional timestamp parameter which is used for discarding
+// old fragments instead of time.Now()
+func (d *IPv6Defragmenter) DefragIPv6WithTimestamp(in *layers.IPv6, frag *layers.IPv6Fragment, t time.Time) (*layers.IPv6, error) {
+	if frag == nil {
+		debug.Printf("defrag6: do nothing, do not need anything")
+		return in, nil
+	}
+	if err := d.securityChecks(frag); err != nil {
+		debug.Printf("defrag6: alert security check")
+		return nil, err
+	}
+
+	// An atomic fragment (RFC 6946) is a whole packet by itself, and must
+	// not be mixed up with any other fragments using the same Identification.
+	if frag.FragmentOffset == 0 && !frag.MoreFragments {
+		debug.Printf("defrag6: atomic fragment in.Id=%d\n", frag.Identification)
+		return buildIPv6(in, frag.NextHeader, frag.Payload), nil
+	}
+
+	debug.Printf("defrag6: got a new fragment in.Id=%d in.FragOffset=%d in.More=%v\n",
+		frag.Identification, frag.FragmentOffset*8, frag.MoreFragments)
+
+	ipf := newIPv6(in, frag)
+	d.Lock()
+	fl, exist := d.ipFlows[ipf]
+	if !exist {
+		debug.Printf("defrag6: unknown flow, creating a new one\n")
+		fl = new(fragmentList6)
+		d.ipFlows[ipf] = fl
+	}
+	d.Unlock()
+
+	out, err := fl.insert(in, frag, t)
+	if err != nil {
+		// Overlaps mean the whole datagram must be silently dropped, per
+		// RFC 5722; report it so it can be counted.
+		d.flush(ipf)
+		return nil, err
+	}
+
+	if out == nil && fl.List.Len()+1 > IPv6MaximumFragmentListLen {
+		d.flush(ipf)
+		return nil, fmt.Errorf("defrag6: Fragment List hits its maximum"+
+			"size(%d), without success. Flushing the list",
+			IPv6MaximumFragmentListLen)
+	}
+
+	if out != nil {
+		d.flush(ipf)
+		return out, nil
+	}
+	return nil, nil
+}
+
+// DiscardOlderThan forgets all packets without any activity since
+// time t. It returns the number of FragmentList aka number of
+// fragment packets it has discarded.
+func (d *IPv6Defragmenter) DiscardOlderThan(t time.Time) int {
+	var nb int
+	d.Lock()
+	for k, v := range d.ipFlows {
+		if v.LastSeen.Before(t) {
+			nb = nb + 1
+			delete(d.ipFlows, k)
+		}
+	}
+	d.Unlock()
+	return nb
+}
+
+// flush the fragment list for a particular flow
+func (d *IPv6Defragmenter) flush(ipf ipv6) {
+	d.Lock()
+	delete(d.ipFlows, ipf)
+	d.Unlock()
+}
+
+// securityChecks performs the needed security checks
+func (d *IPv6Defragmenter) securityChecks(frag *layers.IPv6Fragment) error {
+	fragSize := len(frag.Payload)
+
+	// don't allow small fragments outside of specification
+	if fragSize < IPv6MinimumFragmentSize {
+		return fmt.Errorf("defrag6: fragment too small "+
+			"(handcrafted? %d < %d)", fragSize, IPv6MinimumFragmentSize)
+	}
+
+	// every fragment but the last must be a multiple of 8 bytes, or RFC 8200
+	// requires it be discarded
+	if frag.MoreFragments && fragSize%8 != 0 {
+		return fmt.Errorf("defrag6: non-final fragment not a multiple of 8 bytes "+
+			"(handcrafted? %d)", fragSize)
+	}
+
+	// don't allow too big fragment offset
+	if frag.FragmentOffset > IPv6MaximumFragmentOffset {
+		return fmt.Errorf("defrag6: fragment offset too big "+
+			"(handcrafted? %d > %d)", frag.FragmentOffset, IPv6MaximumFragmentOffset)
+	}
+
+	// don't allow fragment that would oversize an IPv6 payload
+	if end := int(frag.FragmentOffset)*8 + fragSize; end > IPv6MaximumSize {
+		return fmt.Errorf("defrag6: fragment will overrun "+
+			"(handcrafted? %d > %d)", end, IPv6MaximumSize)
+	}
+
+	return nil
+}
+
+// fragment6 is a single IPv6 fragment's data and position.
+type fragment6 struct {
+	offset int
+	data   []byte
+}
+
+// fragmentList6 holds a container/list of fragment6 ordered by offset, and
+// the same counters as fragmentList.  The first fragment's next header is
+// kept, since only the first fragment is required to carry it correctly.
+type fragmentList6 struct {
+	List          list.List
+	Highest       int
+	Current       int
+	FinalReceived bool
+	NextHeader    layers.IPProtocol
+	LastSeen      time.Time
+}
+
+// insert inserts an IPv6 fragment into the Fragment List, ordered by offset.
+// Unlike IPv4, overlapping fragments are an error (RFC 5722), while exact
+// duplicates are ignored.  So is a final fragment which ends before data
+// already received, or any fragment past the end of the final one, as the
+// datagram could never be completed (RFC 8200 section 4.5).
+func (f *fragmentList6) insert(in *layers.IPv6, frag *layers.IPv6Fragment, t time.Time) (*layers.IPv6, error) {
+	nf := &fragment6{offset: int(frag.FragmentOffset) * 8, data: frag.Payload}
+	end := nf.offset + len(nf.data)
+	if !frag.MoreFragments && end < f.Highest {
+		return nil, fmt.Errorf("defrag6: final fragment ends at %d, before data up to %d",
+			end, f.Highest)
+	}
+	if f.FinalReceived && end > f.Highest {
+		return nil, fmt.Errorf("defrag6: fragment ending at %d is past the final fragment's end at %d",
+			end, f.Highest)
+	}
+
+	var before *list.Element
+	for e := f.List.Front(); e != nil; e = e.Next() {
+		cur := e.Value.(*fragment6)
+		curEnd := cur.offset + len(cur.data)
+		if cur.offset == nf.offset && curEnd == end {
+			debug.Printf("defrag6: ignoring frag %d as we already have it (duplicate?)\n",
+				nf.offset)
+			f.LastSeen = t
+			return nil, nil
+		}
+		if nf.offset < curEnd && cur.offset < end {
+			return nil, fmt.Errorf("defrag6: overlapping fragment at %d with %d-%d",
+				nf.offset, cur.offset, curEnd)
+		}
+		if nf.offset < cur.offset {
+			before = e
+			break
+		}
+	}
+	if before != nil {
+		f.List.InsertBefore(nf, before)
+	} else {
+		f.List.PushBack(nf)
+	}
+
+	f.LastSeen = t
+	if nf.offset == 0 {
+		f.NextHeader = frag.NextHeader
+	}
+	if end > f.Highest {
+		f.Highest = end
+	}
+	f.Current += len(nf.data)
+
+	debug.Printf("defrag6: insert ListLen: %d Highest:%d Current:%d\n",
+		f.List.Len(), f.Highest, f.Current)
+
+	if !frag.MoreFragments {
+		f.FinalReceived = true
+	}
+	if f.FinalReceived && f.Highest == f.Current {
+		return f.build(in)
+	}
+	return nil, nil
+}
+
+// build assembles the final datagram's payload from the ordered fragments.
+func (f *fragmentList6) build(in *layers.IPv6) (*layers.IPv6, error) {
+	final := make([]byte, 0, f.Highest)
+	for e := f.List.Front(); e != nil; e = e.Next() {
+		frag := e.Value.(*fragment6)
+		if frag.offset != len(final) {
+			debug.Printf("defrag6: hole found while building, " +
+				"stopping the defrag process\n")
+			return nil, errors.New("defrag6: building - hole found")
+		}
+		final = append(final, frag.data...)
+	}
+	return buildIPv6(in, f.NextHeader, final), nil
+}
+
+// buildIPv6 creates a new unfragmented IPv6 layer from the header of in.
+func buildIPv6(in *layers.IPv6, next layers.IPProtocol, payload []byte) *layers.IPv6 {
+	out := &layers.IPv6{
+		Version:      in.Version,
+		TrafficClass: in.TrafficClass,
+		FlowLabel:    in.FlowLabel,
+		Length:       uint16(len(payload)),
+		NextHeader:   next,
+		HopLimit:     in.HopLimit,
+		SrcIP:        in.SrcIP,
+		DstIP:        in.DstIP,
+	}
+	out.Payload = payload
+	return out
+}
+
+// ipv6 is a struct to be used as a key.
+type ipv6 struct {
+	ip6 gopacket.Flow
+	id  uint32
+}
+
+// newIPv6 returns a new initialized IPv6 Flow
+func newIPv6(ip *layers.IPv6, frag *layers.IPv6Fragment) ipv6 {
+	return ipv6{
+		ip6: ip.NetworkFlow(),
+		id:  frag.Identification,
+	}
+}
+
+// IPv6Defragmenter is a struct which embedded a map of
+// all fragment/packet.
+type IPv6Defragmenter struct {
+	sync.RWMutex
+	ipFlows map[ipv6]*fragmentList6
+}
+
+// NewIPv6Defragmenter returns a new IPv6Defragmenter
+// with an initialized map.
+func NewIPv6Defragmenter() *IPv6Defragmenter {
+	return &IPv6Defragmenter{
+		ipFlows: make(map[ipv6]*fragmentList6),
+	}
+}
+
+// Defragmenter reassembles both IPv4 and IPv6 fragments.
+type Defragmenter struct {
+	*IPv4Defragmenter
+	*IPv6Defragmenter
+}
+
+// NewDefragmenter returns a Defragmenter able to handle both IPv4 and IPv6.
+func NewDefragmenter() *Defragmenter {
+	return &Defragmenter{
+		IPv4Defragmenter: NewIPv4Defragmenter(),
+		IPv6Defragmenter: NewIPv6Defragmenter(),
+	}
+}
+
+// DiscardOlderThan forgets all IPv4 and IPv6 fragments without any activity
+// since time t, returning how many fragmented packets were discarded.
+func (d *Defragmenter) DiscardOlderThan(t time.Time) int {
+	return d.IPv4Defragmenter.DiscardOlderThan(t) + d.IPv6Defragmenter.DiscardOlderThan(t)
+}
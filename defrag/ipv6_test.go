@@ -0,0 +1,216 @@
+package defrag
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// udp6Payload is a UDP datagram (header and data) that will be split up into
+// IPv6 fragments.
+var udp6Payload = func() []byte {
+	b := make([]byte, 8+1400)
+	b[0], b[1] = 0x13, 0xc4 // 5060
+	b[2], b[3] = 0x13, 0xc4
+	b[4], b[5] = byte(len(b)>>8), byte(len(b))
+	for i := 8; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	return b
+}()
+
+// frag6 builds a decoded IPv6 fragment of udp6Payload from offset to end.
+func frag6(t *testing.T, id uint32, offset, end int, more bool) (*layers.IPv6, *layers.IPv6Fragment) {
+	t.Helper()
+	fh := make([]byte, 8)
+	fh[0] = byte(layers.IPProtocolUDP)
+	off := uint16(offset/8) << 3
+	if more {
+		off |= 1
+	}
+	fh[2], fh[3] = byte(off>>8), byte(off)
+	fh[4], fh[5], fh[6], fh[7] = byte(id>>24), byte(id>>16), byte(id>>8), byte(id)
+
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolIPv6Fragment,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		ip, gopacket.Payload(append(fh, udp6Payload[offset:end]...)))
+	if err != nil {
+		t.Fatalf("defrag6: unable to serialize fragment: %v", err)
+	}
+
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
+	in, _ := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	frag, _ := p.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+	if in == nil || frag == nil {
+		t.Fatalf("defrag6: unable to decode fragment: %v", p)
+	}
+	return in, frag
+}
+
+func TestDefrag6NotFrag(t *testing.T) {
+	ip := &layers.IPv6{Version: 6, SrcIP: net.ParseIP("::1"), DstIP: net.ParseIP("::1")}
+	out, err := NewIPv6Defragmenter().DefragIPv6(ip, nil)
+	if out != ip || err != nil {
+		t.Errorf("defrag6: this packet do not need to be defrag ['%v']", err)
+	}
+}
+
+func TestDefrag6Atomic(t *testing.T) {
+	in, frag := frag6(t, 1, 0, len(udp6Payload), false)
+	out, err := NewIPv6Defragmenter().DefragIPv6(in, frag)
+	if err != nil || out == nil {
+		t.Fatalf("defrag6: atomic fragment not returned: %v", err)
+	}
+	if out.NextHeader != layers.IPProtocolUDP || !bytes.Equal(out.Payload, udp6Payload) {
+		t.Errorf("defrag6: atomic fragment payload is incorrect")
+	}
+}
+
+func TestDefrag6Order(t *testing.T) {
+	type piece struct {
+		offset, end int
+		more        bool
+	}
+	testCases := map[string][]piece{
+		"in order":        {{0, 512, true}, {512, 1024, true}, {1024, 1408, false}},
+		"reversed":        {{1024, 1408, false}, {512, 1024, true}, {0, 512, true}},
+		"middle last":     {{0, 512, true}, {1024, 1408, false}, {512, 1024, true}},
+		"duplicate":       {{0, 512, true}, {0, 512, true}, {512, 1024, true}, {1024, 1408, false}},
+		"short fragments": {{0, 8, true}, {16, 1408, false}, {8, 16, true}},
+		"short final":     {{1400, 1408, false}, {0, 1400, true}},
+	}
+	for name, pieces := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewIPv6Defragmenter()
+			var out *layers.IPv6
+			for i, p := range pieces {
+				in, frag := frag6(t, 42, p.offset, p.end, p.more)
+				o, err := d.DefragIPv6(in, frag)
+				if err != nil {
+					t.Fatalf("defrag6: fragment %d: %v", i, err)
+				}
+				if o != nil && i != len(pieces)-1 {
+					t.Fatalf("defrag6: packet completed early at fragment %d", i)
+				}
+				out = o
+			}
+			if out == nil {
+				t.Fatal("defrag6: packet not reassembled")
+			}
+			if out.NextHeader != layers.IPProtocolUDP {
+				t.Errorf("defrag6: next header %v, expected UDP", out.NextHeader)
+			}
+			if !bytes.Equal(out.Payload, udp6Payload) {
+				t.Errorf("defrag6: payload is not correctly defragmented")
+			}
+			if n := d.DiscardOlderThan(time.Now()); n != 0 {
+				t.Errorf("defrag6: flow not flushed after reassembly, discarded %d", n)
+			}
+		})
+	}
+}
+
+func TestDefrag6Overlap(t *testing.T) {
+	d := NewIPv6Defragmenter()
+	in, frag := frag6(t, 7, 0, 512, true)
+	if _, err := d.DefragIPv6(in, frag); err != nil {
+		t.Fatalf("defrag6: first fragment: %v", err)
+	}
+	in, frag = frag6(t, 7, 256, 768, true)
+	if _, err := d.DefragIPv6(in, frag); err == nil {
+		t.Fatal("defrag6: overlapping fragment accepted")
+	}
+	// The whole datagram is dropped, so later fragments never complete it.
+	in, frag = frag6(t, 7, 512, 1408, false)
+	out, err := d.DefragIPv6(in, frag)
+	if out != nil || err != nil {
+		t.Errorf("defrag6: datagram reassembled after overlap: %v", err)
+	}
+}
+
+func TestDefrag6FinalEnd(t *testing.T) {
+	type piece struct {
+		offset, end int
+		more        bool
+	}
+	testCases := map[string][]piece{
+		"final before data":   {{0, 1024, true}, {512, 768, false}},
+		"final before final":  {{1024, 1408, false}, {512, 768, false}},
+		"fragment past final": {{512, 1024, false}, {1024, 1408, true}},
+	}
+	for name, pieces := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewIPv6Defragmenter()
+			in, frag := frag6(t, 13, pieces[0].offset, pieces[0].end, pieces[0].more)
+			if _, err := d.DefragIPv6(in, frag); err != nil {
+				t.Fatalf("defrag6: first fragment: %v", err)
+			}
+			in, frag = frag6(t, 13, pieces[1].offset, pieces[1].end, pieces[1].more)
+			if _, err := d.DefragIPv6(in, frag); err == nil {
+				t.Fatal("defrag6: fragment inconsistent with the final one accepted")
+			}
+			// The whole datagram is dropped, rather than left to time out.
+			if n := d.DiscardOlderThan(time.Now()); n != 0 {
+				t.Errorf("defrag6: malformed datagram kept, discarded %d", n)
+			}
+		})
+	}
+}
+
+func TestDefrag6SecurityChecks(t *testing.T) {
+	d := NewIPv6Defragmenter()
+	in, frag := frag6(t, 9, 0, 512, true)
+	frag.FragmentOffset = IPv6MaximumFragmentOffset
+	if _, err := d.DefragIPv6(in, frag); err == nil {
+		t.Error("defrag6: overrunning fragment accepted")
+	}
+	frag.Payload = nil
+	frag.FragmentOffset = 1
+	if _, err := d.DefragIPv6(in, frag); err == nil {
+		t.Error("defrag6: empty fragment accepted")
+	}
+	in, frag = frag6(t, 10, 0, 511, true)
+	if _, err := d.DefragIPv6(in, frag); err == nil {
+		t.Error("defrag6: unaligned non-final fragment accepted")
+	}
+	in, frag = frag6(t, 11, 1400, 1408, false)
+	frag.Payload = frag.Payload[:7]
+	if _, err := d.DefragIPv6(in, frag); err != nil {
+		t.Errorf("defrag6: unaligned final fragment rejected: %v", err)
+	}
+}
+
+func TestDefrag6Discard(t *testing.T) {
+	d := NewIPv6Defragmenter()
+	start := time.Now()
+	in, frag := frag6(t, 11, 0, 512, true)
+	if _, err := d.DefragIPv6WithTimestamp(in, frag, start); err != nil {
+		t.Fatalf("defrag6: %v", err)
+	}
+	in, frag = frag6(t, 12, 0, 512, true)
+	if _, err := d.DefragIPv6WithTimestamp(in, frag, start.Add(time.Minute)); err != nil {
+		t.Fatalf("defrag6: %v", err)
+	}
+	if n := d.DiscardOlderThan(start.Add(time.Second)); n != 1 {
+		t.Errorf("defrag6: discarded %d fragment lists, expected 1", n)
+	}
+
+	both := NewDefragmenter()
+	if _, err := both.DefragIPv6WithTimestamp(in, frag, start); err != nil {
+		t.Fatalf("defrag6: %v", err)
+	}
+	if n := both.DiscardOlderThan(start.Add(time.Second)); n != 1 {
+		t.Errorf("defrag: combined defragmenter discarded %d, expected 1", n)
+	}
+}
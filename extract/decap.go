@@ -0,0 +1,200 @@
+package extract
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+)
+
+// DefaultVXLANPort is the IANA assigned VXLAN UDP port.
+const DefaultVXLANPort = 4789
+
+// maxDecap limits how deeply tunnels may be nested within each other.
+const maxDecap = 4
+
+// encapsulation label values for metrics.
+const (
+	encapVLAN   = "vlan"
+	encapSLL    = "sll"
+	encapGRE    = "gre"
+	encapERSPAN = "erspan"
+	encapVXLAN  = "vxlan"
+)
+
+// GRE protocol types of ERSPAN which gopacket doesn't know.
+const (
+	greERSPAN   layers.EthernetType = 0x88be // type I, or type II with a sequence number
+	greERSPAN3  layers.EthernetType = 0x22eb
+	erspan2Size                     = 8
+	erspan3Size                     = 12
+	// erspan3Platform is the size of the optional ERSPAN type III platform
+	// specific subheader, present if the O flag is set.
+	erspan3Platform = 8
+	vxlanSize       = 8
+)
+
+var (
+	errTunnel    = errors.New("truncated tunnel header")
+	errTooNested = errors.New("tunnels nested too deeply")
+)
+
+// tunnelPayload finds the outermost enabled tunnel in p, returning the packet
+// it carries, how to decode it, and the encapsulation label.  It returns a
+// nil decoder if p isn't tunnelled, or is a fragment yet to be reassembled,
+// since its payload is incomplete; once reassembled, the payload decoded after
+// the fragment is searched instead.  The VLAN tags and cooked capture headers
+// outside of the tunnel are counted on the way, once p is whole.
+func (e *Extracter) tunnelPayload(p gopacket.Packet) ([]byte, gopacket.Decoder, string, error) {
+	var outer []string
+	defer func() {
+		for _, encap := range outer {
+			e.metrics.Decap.WithLabelValues(encap).Inc()
+		}
+	}()
+
+	ls := p.Layers()
+	for i, l := range ls {
+		switch l := l.(type) {
+		case *layers.Dot1Q:
+			outer = append(outer, encapVLAN)
+		case *layers.LinuxSLL:
+			outer = append(outer, encapSLL)
+
+		case *gopacket.Fragment:
+			// reassembly decodes the whole payload after the fragment.
+			if i == len(ls)-1 {
+				outer = nil
+				return nil, nil, "", nil
+			}
+
+		case *layers.GRE:
+			switch l.Protocol {
+			case greERSPAN, greERSPAN3:
+				if !e.opts.ERSPAN {
+					return nil, nil, "", nil
+				}
+				// type I has no header of its own, and no sequence number.
+				size := 0
+				if l.Protocol == greERSPAN3 {
+					size = erspan3Size
+					if len(l.Payload) >= size && l.Payload[size-1]&1 != 0 {
+						size += erspan3Platform
+					}
+				} else if l.SeqPresent {
+					size = erspan2Size
+				}
+				if len(l.Payload) < size {
+					return nil, nil, "", errTunnel
+				}
+				return l.Payload[size:], layers.LayerTypeEthernet, encapERSPAN, nil
+			case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6, layers.EthernetTypeTransparentEthernetBridging:
+				if !e.opts.GRE {
+					return nil, nil, "", nil
+				}
+				return l.Payload, l.Protocol, encapGRE, nil
+			}
+			return nil, nil, "", nil
+
+		case *layers.UDP:
+			if !e.opts.VXLAN || uint16(l.DstPort) != e.opts.VXLANPort {
+				return nil, nil, "", nil
+			}
+			// the I flag must be set for the VNI to be valid.
+			if len(l.Payload) < vxlanSize || l.Payload[0]&0x08 == 0 {
+				return nil, nil, "", errTunnel
+			}
+			return l.Payload[vxlanSize:], layers.LayerTypeEthernet, encapVXLAN, nil
+
+		case *layers.TCP:
+			return nil, nil, "", nil
+		}
+	}
+	return nil, nil, "", nil
+}
+
+// decapsulate returns the packet carried inside any enabled tunnels of p,
+// decoded afresh so that its network and transport layers are those of the
+// tunnelled traffic rather than of the tunnel.  The inner packet keeps the
+// capture metadata of p.  Packets which aren't tunnelled are returned as is.
+func (e *Extracter) decapsulate(p gopacket.Packet) (gopacket.Packet, error) {
+	for depth := 0; ; depth++ {
+		data, decoder, encap, err := e.tunnelPayload(p)
+		if err != nil || decoder == nil {
+			return p, err
+		}
+		if depth == maxDecap {
+			return p, errTooNested
+		}
+		e.metrics.Decap.WithLabelValues(encap).Inc()
+
+		inner := gopacket.NewPacket(data, decoder, gopacket.Default)
+		md := inner.Metadata()
+		md.CaptureInfo = p.Metadata().CaptureInfo
+		md.Length -= md.CaptureLength - len(data)
+		md.CaptureLength = len(data)
+		p = inner
+	}
+}
+
+// vlanOf returns the innermost VLAN tag in front of the network layer of p,
+// falling back to the tag stripped before capture, or 0 if it isn't tagged.
+func vlanOf(p gopacket.Packet) uint16 {
+	var vlan uint16
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.Dot1Q:
+			vlan = l.VLANIdentifier
+		case *layers.IPv4, *layers.IPv6:
+			return orStripped(vlan, p)
+		}
+	}
+	return orStripped(vlan, p)
+}
+
+// orStripped returns vlan, or if it's 0, the VLAN of the tag stripped from p
+// before capture.  A stripped tag is the outermost, so any left in the
+// packet are closer to its message.
+func orStripped(vlan uint16, p gopacket.Packet) uint16 {
+	if vlan != 0 {
+		return vlan
+	}
+	return capture.VLANOf(p)
+}
+
+// transportOf returns the transport layer carried directly by the network
+// layer of p, and the SIP message directly within that, if any.  gopacket
+// decodes the contents of many tunnels on its own, but any layers found past
+// a tunnel which wasn't decapsulated belong to other flows than the outer
+// network layer's, so they aren't returned.
+func transportOf(p gopacket.Packet) (gopacket.TransportLayer, *layers.SIP) {
+	ls := p.Layers()
+	i := 0
+	for ; i < len(ls); i++ {
+		if t := ls[i].LayerType(); t == layers.LayerTypeIPv4 || t == layers.LayerTypeIPv6 {
+			break
+		}
+	}
+	for i++; i < len(ls); i++ {
+		switch ls[i].LayerType() {
+		case gopacket.LayerTypeFragment, layers.LayerTypeIPv6Fragment,
+			layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Routing, layers.LayerTypeIPv6Destination:
+			continue
+		}
+		break
+	}
+	if i >= len(ls) {
+		return nil, nil
+	}
+	t, ok := ls[i].(gopacket.TransportLayer)
+	if !ok {
+		return nil, nil
+	}
+	if i+1 < len(ls) {
+		if sip, ok := ls[i+1].(*layers.SIP); ok {
+			return t, sip
+		}
+	}
+	return t, nil
+}
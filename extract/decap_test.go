@@ -0,0 +1,145 @@
+package extract
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+)
+
+// extractFile returns the capture metadata of every message extracted from a
+// test capture file.
+func extractFile(is *is.I, ext *Extracter, file string) []*capture.Meta {
+	f, err := os.Open(filepath.Join("testdata", file))
+	is.NoErr(err)
+	defer f.Close()
+	handle, err := pcapgo.NewReader(f)
+	is.NoErr(err)
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	// TCP streams accept their messages concurrently.
+	var mu sync.Mutex
+	var metas []*capture.Meta
+	ext.Extract(context.Background(), source.Packets(), func(_ *layers.SIP, meta *capture.Meta) error {
+		mu.Lock()
+		defer mu.Unlock()
+		metas = append(metas, meta)
+		return nil
+	})
+	return metas
+}
+
+func TestDecapInnerFlows(t *testing.T) {
+	for _, file := range []string{"decap-vxlan.pcap", "decap-erspan.pcap", "decap-gre.pcap"} {
+		t.Run(file, func(t *testing.T) {
+			is := is.New(t)
+			ext := NewExtracter(nil, Options{GRE: true, ERSPAN: true, VXLAN: true})
+			metas := extractFile(is, ext, file)
+			is.True(len(metas) > 0)
+			for _, m := range metas {
+				// the inner addresses, not the tunnel's 10.0.0.x
+				is.True(m.SrcIP.Equal(net.IPv4(192, 168, 1, 1)))
+				is.True(m.DstIP.Equal(net.IPv4(192, 168, 1, 2)))
+				is.Equal(m.SrcPort, uint16(5060))
+			}
+		})
+	}
+}
+
+func TestDecapDisabled(t *testing.T) {
+	is := is.New(t)
+
+	ext := NewExtracter(nil, Options{GRE: true})
+	is.Equal(len(extractFile(is, ext, "decap-vxlan.pcap")), 0)
+	is.Equal(len(extractFile(is, ext, "decap-erspan.pcap")), 0)
+
+	// VXLAN on another port is left alone
+	ext = NewExtracter(nil, Options{VXLAN: true, VXLANPort: 8472})
+	is.Equal(len(extractFile(is, ext, "decap-vxlan.pcap")), 0)
+}
+
+func TestDecapVLAN(t *testing.T) {
+	is := is.New(t)
+	ext := NewExtracter(nil, Options{VXLAN: true})
+	metas := extractFile(is, ext, "decap-vxlan.pcap")
+	is.Equal(len(metas), 1)
+	// the inner of the QinQ tags inside the tunnel
+	is.Equal(metas[0].VLAN, uint16(200))
+}
+
+// fragment splits the outer IPv4 packet of p into fragments carrying size
+// bytes of its payload each, last first.
+func fragment(is *is.I, p gopacket.Packet, size int) []gopacket.Packet {
+	eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	var frags []gopacket.Packet
+	for off := 0; off < len(ip.Payload); off += size {
+		end, flags := off+size, layers.IPv4MoreFragments
+		if end >= len(ip.Payload) {
+			end, flags = len(ip.Payload), 0
+		}
+		frag := *ip
+		frag.Flags, frag.FragOffset = flags, uint16(off/8)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		is.NoErr(gopacket.SerializeLayers(buf, opts, eth, &frag, gopacket.Payload(ip.Payload[off:end])))
+
+		fp := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+		md := fp.Metadata()
+		md.Timestamp = p.Metadata().Timestamp
+		md.CaptureLength, md.Length = len(buf.Bytes()), len(buf.Bytes())
+		frags = append([]gopacket.Packet{fp}, frags...)
+	}
+	return frags
+}
+
+// Fragmented tunnel packets are reassembled, then decapsulated.
+func TestDecapFragmented(t *testing.T) {
+	is := is.New(t)
+	f, err := os.Open(filepath.Join("testdata", "decap-erspan.pcap"))
+	is.NoErr(err)
+	defer f.Close()
+	handle, err := pcapgo.NewReader(f)
+	is.NoErr(err)
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	var whole int
+	var frags []gopacket.Packet
+	for p := range source.Packets() {
+		whole++
+		frags = append(frags, fragment(is, p, 64)...)
+	}
+	packets := make(chan gopacket.Packet)
+	go func() {
+		for _, p := range frags {
+			packets <- p
+		}
+		close(packets)
+	}()
+
+	ext := NewExtracter(nil, Options{ERSPAN: true})
+	var metas []*capture.Meta
+	ext.Extract(context.Background(), packets, func(_ *layers.SIP, meta *capture.Meta) error {
+		metas = append(metas, meta)
+		return nil
+	})
+	is.Equal(len(metas), whole)
+	for _, m := range metas {
+		is.True(m.SrcIP.Equal(net.IPv4(192, 168, 1, 1)))
+		is.True(m.DstIP.Equal(net.IPv4(192, 168, 1, 2)))
+	}
+	is.NoErr(testMetrics(map[string]int{
+		"defrag":            whole,
+		"invalid":           0,
+		"decap:erspan":      whole,
+		"captured:udp:ipv4": whole,
+	}, ext.metrics))
+}
@@ -9,27 +9,68 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/tcpassembly"
+	"github.com/nextcaller/sip-capture/capture"
 	"github.com/nextcaller/sip-capture/defrag"
+	"github.com/nextcaller/sip-capture/tlsdecrypt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
 const (
 	flushInterval = time.Second * 60
+
+	// network label values for metrics.
+	ipv4 = "ipv4"
+	ipv6 = "ipv6"
 )
 
 var (
-	errIncomplete      = errors.New("incomplete ipv4 packet")
+	errIncomplete      = errors.New("incomplete ip packet")
 	errNoPacketBuilder = errors.New("unable to create packerbuilder interface")
 )
 
 // Defragmenter is the minimum parts of a gopacket/ip4defrag that we care
-// about for packet handling.   Use this so we can accept either a default
-// defragmenter or our custom degfragger which handles IP packets with shorter
-// fragments than required by gopacket.
+// about for packet handling, extended to IPv6 fragments.  Use this so we can
+// accept our custom degfragger which handles IP packets with shorter
+// fragments than required by gopacket, or any other implementation.
+// Fragments are aged by their packet capture time, not the wall clock, so
+// that capture files are handled the same as live captures.
 type Defragmenter interface {
 	DiscardOlderThan(time.Time) int
-	DefragIPv4(*layers.IPv4) (*layers.IPv4, error)
+	DefragIPv4WithTimestamp(*layers.IPv4, time.Time) (*layers.IPv4, error)
+	DefragIPv6WithTimestamp(*layers.IPv6, *layers.IPv6Fragment, time.Time) (*layers.IPv6, error)
+}
+
+// Accepter receives each extracted SIP message, along with where it was
+// captured and the capture time of the packet that completed it.
+type Accepter func(*layers.SIP, *capture.Meta) error
+
+// Options controls which tunnels Extract removes to find the packets they
+// carry, whether it decrypts SIP over TLS, and which clock ages incomplete
+// packets.  The zero value removes no tunnels, decrypts nothing, and uses the
+// wall clock; VLAN tags and Linux cooked capture headers are always
+// understood.
+type Options struct {
+	// GRE decapsulates IPv4, IPv6, and Ethernet carried in GRE.
+	GRE bool
+	// ERSPAN decapsulates ERSPAN type I, II, and III mirrors (over GRE).
+	ERSPAN bool
+	// VXLAN decapsulates VXLAN on VXLANPort.
+	VXLAN     bool
+	VXLANPort uint16
+	// TLS decrypts TCP streams carrying TLS with these keys, if set.
+	TLS *tlsdecrypt.Keys
+	// PacketClock ages fragments and TCP segments by packet capture time
+	// alone, rather than every flush interval of the wall clock, for capture
+	// files, which may be read much faster or slower than they were recorded.
+	PacketClock bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.VXLANPort == 0 {
+		o.VXLANPort = DefaultVXLANPort
+	}
+	return o
 }
 
 // Extracter converts incoming packets into gopacket *layers.SIP structs.
@@ -40,19 +81,22 @@ type Extracter struct {
 	metrics   *Metrics
 	defragger Defragmenter
 	flush     time.Duration
+	opts      Options
 }
 
-// NewExtracter creates a Extracter, using the given defragmenter.  If the
-// defragmenter is nil, it instantiates a sip-capture/defrag, which handles
-// short packet fragments, unlike the normal gopacket/ip4defrag.
-func NewExtracter(defragger Defragmenter) *Extracter {
+// NewExtracter creates a Extracter, using the given defragmenter, which
+// decapsulates the tunnels enabled in opts.  If the defragmenter is nil, it
+// instantiates a sip-capture/defrag, which handles short packet fragments,
+// unlike the normal gopacket/ip4defrag.
+func NewExtracter(defragger Defragmenter, opts Options) *Extracter {
 	if defragger == nil {
-		defragger = defrag.NewIPv4Defragmenter()
+		defragger = defrag.NewDefragmenter()
 	}
 	p := &Extracter{
 		defragger: defragger,
 		flush:     flushInterval,
 		metrics:   NewMetrics(),
+		opts:      opts.withDefaults(),
 	}
 	return p
 }
@@ -68,7 +112,7 @@ func someAssemblyRequired(ip4 *layers.IPv4) bool {
 }
 
 // attempt to reassemble an ipv4 packet if it's been fragmented.
-func (e *Extracter) reassembleIPv4(ip4 *layers.IPv4) (*layers.IPv4, error) {
+func (e *Extracter) reassembleIPv4(ip4 *layers.IPv4, ts time.Time) (*layers.IPv4, error) {
 	l := ip4.Length
 	if l < 28 && ip4.FragOffset > 0 {
 		// gopacket believes this is an error; we have a custom defragmenter
@@ -76,7 +120,7 @@ func (e *Extracter) reassembleIPv4(ip4 *layers.IPv4) (*layers.IPv4, error) {
 		e.metrics.ShortFrags.Inc()
 	}
 
-	nip4, err := e.defragger.DefragIPv4(ip4)
+	nip4, err := e.defragger.DefragIPv4WithTimestamp(ip4, ts)
 	if err != nil {
 		return nil, fmt.Errorf("defragmenter failed: %w", err)
 	} else if nip4 == nil {
@@ -103,7 +147,7 @@ func reinsertIPv4(packet gopacket.Packet, ip4 *layers.IPv4) error {
 func (e *Extracter) rebuildPacket(packet gopacket.Packet, ip4 *layers.IPv4) error {
 	// if we got called, we know we're part of a fragmented packet
 	l := ip4.Length
-	ip4, err := e.reassembleIPv4(ip4)
+	ip4, err := e.reassembleIPv4(ip4, packet.Metadata().Timestamp)
 	if err != nil {
 		// This may include errIncomplete, so let reassembleIPv4 handle metrics.
 		return err
@@ -117,113 +161,252 @@ func (e *Extracter) rebuildPacket(packet gopacket.Packet, ip4 *layers.IPv4) erro
 	return nil
 }
 
+// attempt to reassemble an ipv6 packet from its fragment extension header.
+func (e *Extracter) reassembleIPv6(ip6 *layers.IPv6, frag *layers.IPv6Fragment, ts time.Time) (*layers.IPv6, error) {
+	if len(frag.Payload) < 8 && frag.FragmentOffset > 0 {
+		e.metrics.ShortFrags.Inc()
+	}
+
+	nip6, err := e.defragger.DefragIPv6WithTimestamp(ip6, frag, ts)
+	if err != nil {
+		return nil, fmt.Errorf("defragmenter failed: %w", err)
+	} else if nip6 == nil {
+		// not complete, but saved for future reassembly.
+		return nil, errIncomplete
+	}
+
+	return nip6, nil
+}
+
+// rebuildPacket6 reassembles a fragmented ipv6 packet, and decodes the whole
+// payload back into the packet in place of the fragment.  Since the fragment
+// header is gone, the payload is always reinserted.
+func (e *Extracter) rebuildPacket6(packet gopacket.Packet, ip6 *layers.IPv6, frag *layers.IPv6Fragment) error {
+	ip6, err := e.reassembleIPv6(ip6, frag, packet.Metadata().Timestamp)
+	if err != nil {
+		return err
+	}
+
+	pb, ok := packet.(gopacket.PacketBuilder)
+	if !ok {
+		return errNoPacketBuilder
+	}
+	if err := ip6.NextLayerType().Decode(ip6.Payload, pb); err != nil {
+		return fmt.Errorf("reinserting ip6 back into packet: packet encoder failed: %w", err)
+	}
+	return nil
+}
+
+// unwrap takes a packet out of any enabled tunnels and reassembles its IP
+// fragments, returning the whole packet inside, its IP version, and the
+// protocol following its IP layer.  A fragmented tunnel packet is reassembled
+// before it is decapsulated, then the packet it carries is reassembled in
+// turn.  The VLAN of pkt becomes the innermost tag found.  A nil packet is
+// returned when there is nothing to extract yet, such as from an incomplete
+// fragment, or at all, which is recorded in metrics.
+func (e *Extracter) unwrap(log zerolog.Logger, packet gopacket.Packet, pkt *capture.Packet) (gopacket.Packet, string, gopacket.LayerType) {
+	var network string
+	var next gopacket.LayerType
+	for reassembled := false; ; reassembled = true {
+		inner, err := e.decapsulate(packet)
+		if err != nil {
+			e.metrics.Invalid.Inc()
+			log.Err(err).Str("packet", packet.String()).Msg("undecapsulatable packet")
+			return nil, "", next
+		}
+		if reassembled && inner == packet {
+			// whole, and not a tunnel after all.
+			return packet, network, next
+		}
+		packet = inner
+
+		// a tunnel's own VLAN tag is closer to the message than the tunnel's.
+		if vlan := vlanOf(packet); vlan != 0 {
+			pkt.VLAN = vlan
+		}
+
+		if errlayer := packet.ErrorLayer(); errlayer != nil {
+			e.metrics.Invalid.Inc()
+			log.Err(errlayer.Error()).Str("packet", packet.String()).Msg("undecodable packet")
+			return nil, "", next
+		}
+
+		var fragmented bool
+		switch ip := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			network, next = ipv4, ip.NextLayerType()
+			if someAssemblyRequired(ip) {
+				fragmented = true
+				err = e.rebuildPacket(packet, ip)
+			}
+		case *layers.IPv6:
+			network, next = ipv6, ip.NextLayerType()
+			if frag, ok := packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment); ok {
+				fragmented, next = true, frag.NextHeader.LayerType()
+				err = e.rebuildPacket6(packet, ip, frag)
+			}
+		default:
+			e.metrics.Invalid.Inc()
+			log.Error().Str("packet", packet.String()).Msg("packet missing ipv4 or ipv6 layer")
+			return nil, "", next
+		}
+
+		if !fragmented {
+			return packet, network, next
+		}
+		switch err {
+		case nil:
+			// No err, packet is now updated with new assembled ip layer, which
+			// may be a tunnel.
+			e.metrics.Defrag.Inc()
+		case errIncomplete:
+			e.metrics.Fragments.Inc()
+			log.Debug().Str("network", network).Msg("incomplete ip fragment, continuing")
+			return nil, "", next
+		default:
+			e.metrics.BadDefrag.Inc()
+			// Any error that isn't an incomplete packet gets reported
+			log.Err(err).Str("packet", packet.String()).Msgf("reassembling %s packet", network)
+			return nil, "", next
+		}
+	}
+}
+
 // Extract consumes gopackets.Packets from the packet channel, and produces all
 // the capturable SIP messages as *layers.SIP objects into the msgs channel.
-// It handles IPv4 packet defragmentation and TCP stream reassembly.
+// It accepts both IPv4 and IPv6 packets, and handles IP packet
+// defragmentation, TCP stream reassembly, and SCTP user message reassembly.
+// Packets are taken out of any tunnels enabled by the Extracter's Options,
+// reassembling fragmented tunnel packets first, so that the inner packets are
+// defragmented and reassembled as if they had been captured directly.
+//
+// Messages are stamped with the capture time of their packets.  Old
+// fragments and TCP segments are given up on every flush interval of the wall
+// clock, so a quiet live capture still sheds them, unless Options.PacketClock
+// is set, when that too follows the capture timestamps of the packets, so a
+// capture file is processed the same way no matter how long ago it was
+// recorded or how fast it is read.
 //
 // Extract blocks and will not return until the context is canceled or the
-// packets channel is closed.  Incomplete or otherwise defective packets are
-// discarded without any sort of error, though they are recorded in metrics.
-func (e *Extracter) Extract(ctx context.Context, packets <-chan gopacket.Packet, accept func(*layers.SIP) error) {
+// packets channel is closed.  Either way, any TCP streams are flushed and
+// Extract waits for their final messages to be accepted before returning, so
+// nothing calls accept once it has returned.  Incomplete or otherwise
+// defective packets are discarded without any sort of error, though they are
+// recorded in metrics.
+func (e *Extracter) Extract(ctx context.Context, packets <-chan gopacket.Packet, accept Accepter) {
 	log := zerolog.Ctx(ctx).With().Logger()
-	ticker := time.NewTicker(e.flush)
+	var lastFlush time.Time
+	var tick <-chan time.Time
+	if !e.opts.PacketClock {
+		ticker := time.NewTicker(e.flush)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-	streamFactory := newStreamFactory(log, e.metrics, accept)
+	streamFactory := newStreamFactory(log, e.metrics, accept, e.opts.TLS)
 	streamPool := tcpassembly.NewStreamPool(streamFactory)
 	assembler := tcpassembly.NewAssembler(streamPool)
+	sctpAssembler := newSCTPAssembler(log, e.metrics, accept)
 
 	log = log.With().Str("component", "packet-source").Logger()
 
+	finish := func() {
+		flushed := assembler.FlushAll()
+		log.Debug().Int("flushed", flushed).Msg("flushing tcp assembly")
+		dropped := sctpAssembler.FlushAll()
+		log.Debug().Int("dropped", dropped).Msg("flushing sctp assembly")
+		streamFactory.Wait()
+	}
+
+	// clean out IP fragments and TCP reassembly segments that are too old to
+	// matter.  Even if we finally get matches, we're well past caring about
+	// capturing them after 2 minutes.
+	flushOlderThan := func(now time.Time) {
+		when := now.Add(time.Minute * -2)
+		assembler.FlushOlderThan(when)
+		e.defragger.DiscardOlderThan(when)
+		sctpAssembler.FlushOlderThan(when)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			finish()
 			return
+		case now := <-tick:
+			flushOlderThan(now)
 		case packet, ok := <-packets:
 			if packet == nil || !ok {
-				flushed := assembler.FlushAll()
-				log.Debug().Int("flushed", flushed).Msg("flushing tcp assembly")
+				finish()
 				return
 			}
 
 			e.metrics.Incoming.Inc()
 
-			if errlayer := packet.ErrorLayer(); errlayer != nil {
-				e.metrics.Invalid.Inc()
-				log.Err(errlayer.Error()).Str("packet", packet.String()).Msg("undecodable packet")
-				continue
+			ts := packet.Metadata().Timestamp
+			if e.opts.PacketClock && lastFlush.IsZero() {
+				lastFlush = ts
+			} else if e.opts.PacketClock && ts.Sub(lastFlush) >= e.flush {
+				flushOlderThan(ts)
+				lastFlush = ts
 			}
 
-			ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-			if !ok {
-				e.metrics.Invalid.Inc()
-				log.Error().Str("packet", packet.String()).Msg("packet missing ipv4 layer")
-				continue
+			pkt := capture.Packet{
+				Time:      ts,
+				Interface: capture.InterfaceOf(packet),
+				VLAN:      vlanOf(packet),
+				Transport: capture.TransportOf(packet),
+				Node:      capture.NodeOf(packet),
 			}
-
-			if someAssemblyRequired(ip4) {
-				err := e.rebuildPacket(packet, ip4)
-				switch err {
-				case nil:
-					// No err, packet is now updated with new assembled ipv4 layer.
-					e.metrics.Defrag.Inc()
-				case errIncomplete:
-					e.metrics.Fragments.Inc()
-					log.Debug().Msg("incomplete ipv4 fragment, continuing")
-					continue
-				default:
-					e.metrics.BadDefrag.Inc()
-					// Any error that isn't an incomplete packet gets reported
-					log.Err(err).Str("packet", packet.String()).Msg("reassembling ipv4 packet")
-					continue
-				}
+			packet, network, next := e.unwrap(log, packet, &pkt)
+			if packet == nil {
+				continue
 			}
+			e.metrics.Network.WithLabelValues(network).Inc()
 
-			if packet.TransportLayer() == nil {
+			transport, sip := transportOf(packet)
+			if transport == nil {
 				// this is not TCP or UDP; probably ICMP.
 				e.metrics.Invalid.Inc()
-				log.Warn().Interface("next-layer", ip4.NextLayerType().String()).Msg("no transport layer after reassembly, adjust the BPF filter")
+				log.Warn().Interface("next-layer", next.String()).Msg("no transport layer after reassembly, adjust the BPF filter")
 				continue
 			}
 
-			switch packet.TransportLayer().LayerType() {
+			switch transport.LayerType() {
 			case layers.LayerTypeTCP:
-				e.metrics.Seen.WithLabelValues("tcp").Inc()
+				e.metrics.Seen.WithLabelValues("tcp", network).Inc()
 				// send to reassembler, which will send to msgs channel on its own.
 				log.Debug().Msg("sending tcp packet to assembler")
-				tcplayer := packet.TransportLayer().(*layers.TCP)
-				ip4 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
-				assembler.AssembleWithTimestamp(ip4.NetworkFlow(), tcplayer, packet.Metadata().Timestamp)
+				tcplayer := transport.(*layers.TCP)
+				streamFactory.packet = pkt
+				assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcplayer, packet.Metadata().Timestamp)
 
 			case layers.LayerTypeUDP:
-				e.metrics.Seen.WithLabelValues("udp").Inc()
-				sip, ok := packet.Layer(layers.LayerTypeSIP).(*layers.SIP)
-				if !ok {
+				e.metrics.Seen.WithLabelValues("udp", network).Inc()
+				if sip == nil {
 					// This UDP packet did not have identifiable SIP data in it.
-					e.metrics.Discarded.WithLabelValues("udp").Inc()
+					e.metrics.Discarded.WithLabelValues("udp", network).Inc()
 					continue
 				}
 				// UDP SIP packets are complete.  Just do the thing now.
-				e.metrics.Captured.WithLabelValues("udp").Inc()
-				err := accept(sip)
+				e.metrics.Captured.WithLabelValues("udp", network).Inc()
+				meta := capture.FromFlows(packet.NetworkLayer().NetworkFlow(), transport.TransportFlow(), capture.UDP, pkt)
+				err := accept(sip, meta)
 				if err != nil {
 					log.Err(err).Msg("unable to accept UDP sip packet")
 				}
 
+			case layers.LayerTypeSCTP:
+				e.metrics.Seen.WithLabelValues("sctp", network).Inc()
+				sctpAssembler.Assemble(packet.NetworkLayer().NetworkFlow(), transport.(*layers.SCTP), pkt)
+
 			default:
 				// Since the TransportLayer check above will filter out stuff like ICMP,
-				// this can only be sctp or rudp, according to gopacket.
-				e.metrics.Seen.WithLabelValues("unknown").Inc()
-				e.metrics.Discarded.WithLabelValues("unknown").Inc()
-				log.Debug().Interface("layer-type", ip4.LayerType()).Msg("what type am I even getting?")
+				// this can only be rudp, according to gopacket.
+				e.metrics.Seen.WithLabelValues("unknown", network).Inc()
+				e.metrics.Discarded.WithLabelValues("unknown", network).Inc()
+				log.Debug().Interface("layer-type", transport.LayerType()).Msg("what type am I even getting?")
 			}
-
-		case <-ticker.C:
-			// clean out IP fragments and TCP reassembly segments that are too
-			// old to matter.  Even if we finally get matches, we're well past
-			// caring about capturing them after 2 minutes.
-			when := time.Now().Add(time.Minute * -2)
-			assembler.FlushOlderThan(when)
-			e.defragger.DiscardOlderThan(when)
 		}
 	}
 }
@@ -3,15 +3,19 @@ package extract
 import (
 	"context"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/defrag"
 	"github.com/nextcaller/sip-capture/testhelpers"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
@@ -32,10 +36,13 @@ func (e *firstErr) testCounter(c prometheus.Counter, name string, expected int)
 }
 
 // helper to deal with prometheus metrics not being serializable for easy testing.
+// Labeled metrics are named as metric:label[:label...], eg "seen:udp:ipv4".
 func testMetrics(expected map[string]int, m *Metrics) error {
 	e := &firstErr{}
 	for name, cnt := range expected {
-		switch name {
+		parts := strings.Split(name, ":")
+		labels := parts[1:]
+		switch parts[0] {
 		case "incoming":
 			e.testCounter(m.Incoming, name, cnt)
 		case "fragments":
@@ -44,14 +51,24 @@ func testMetrics(expected map[string]int, m *Metrics) error {
 			e.testCounter(m.Defrag, name, cnt)
 		case "invalid":
 			e.testCounter(m.Invalid, name, cnt)
-		case "seen:udp":
-			e.testCounter(m.Seen.WithLabelValues("udp"), name, cnt)
-		case "seen:tcp":
-			e.testCounter(m.Seen.WithLabelValues("tcp"), name, cnt)
-		case "captured:udp":
-			e.testCounter(m.Captured.WithLabelValues("udp"), name, cnt)
-		case "captured:tcp":
-			e.testCounter(m.Captured.WithLabelValues("tcp"), name, cnt)
+		case "network":
+			e.testCounter(m.Network.WithLabelValues(labels...), name, cnt)
+		case "decap":
+			e.testCounter(m.Decap.WithLabelValues(labels...), name, cnt)
+		case "seen":
+			e.testCounter(m.Seen.WithLabelValues(labels...), name, cnt)
+		case "captured":
+			e.testCounter(m.Captured.WithLabelValues(labels...), name, cnt)
+		case "discarded":
+			e.testCounter(m.Discarded.WithLabelValues(labels...), name, cnt)
+		case "websocket":
+			e.testCounter(m.WebSocket.WithLabelValues(labels...), name, cnt)
+		case "tls":
+			e.testCounter(m.TLS.WithLabelValues(labels...), name, cnt)
+		case "undecryptable":
+			e.testCounter(m.TLSFailed.WithLabelValues(labels...), name, cnt)
+		case "incomplete":
+			e.testCounter(m.Incomplete.WithLabelValues(labels...), name, cnt)
 		default:
 			e.err = fmt.Errorf("don't know field %v", name)
 		}
@@ -69,70 +86,179 @@ func TestIPPacketAssembler(t *testing.T) {
 			"no-to-tag.pcap",
 			1,
 			map[string]int{
-				"incoming":     1,
-				"invalid":      0,
-				"fragments":    0,
-				"defrag":       0,
-				"seen:udp":     1,
-				"seen:tcp":     0,
-				"captured:udp": 1,
-				"captured:tcp": 0,
+				"incoming":          1,
+				"invalid":           0,
+				"fragments":         0,
+				"defrag":            0,
+				"seen:udp:ipv4":     1,
+				"seen:tcp:ipv4":     0,
+				"captured:udp:ipv4": 1,
+				"captured:tcp:ipv4": 0,
 			},
 		},
 		"fragmented complete": {
 			"sip-i.pcap",
 			2,
 			map[string]int{
-				"incoming":     3,
-				"invalid":      0,
-				"fragments":    1, // request is fragmented
-				"defrag":       1,
-				"seen:udp":     2,
-				"seen:tcp":     0,
-				"captured:udp": 2, // request and response
-				"captured:tcp": 0,
+				"incoming":          3,
+				"invalid":           0,
+				"fragments":         1, // request is fragmented
+				"defrag":            1,
+				"seen:udp:ipv4":     2,
+				"seen:tcp:ipv4":     0,
+				"captured:udp:ipv4": 2, // request and response
+				"captured:tcp:ipv4": 0,
 			},
 		},
 		"fragmented incomplete": {
 			"sip-frag.pcap",
 			0,
 			map[string]int{
-				"incoming":     1,
-				"invalid":      0,
-				"fragments":    1,
-				"defrag":       0,
-				"seen:udp":     0,
-				"seen:tcp":     0,
-				"captured:udp": 0,
-				"captured:tcp": 0,
+				"incoming":          1,
+				"invalid":           0,
+				"fragments":         1,
+				"defrag":            0,
+				"seen:udp:ipv4":     0,
+				"seen:tcp:ipv4":     0,
+				"captured:udp:ipv4": 0,
+				"captured:tcp:ipv4": 0,
 			},
 		},
 		"tcp stream": {
 			"sip-tcp.pcap",
 			30, // 5 complete TCP calls with INVTE/ACK/BYE req and Ringing/OK/OK resp
 			map[string]int{
-				"incoming":     30,
-				"invalid":      0,
-				"fragments":    0,
-				"defrag":       0,
-				"seen:udp":     0,
-				"seen:tcp":     30,
-				"captured:udp": 0,
-				"captured:tcp": 30,
+				"incoming":          30,
+				"invalid":           0,
+				"fragments":         0,
+				"defrag":            0,
+				"seen:udp:ipv4":     0,
+				"seen:tcp:ipv4":     30,
+				"captured:udp:ipv4": 0,
+				"captured:tcp:ipv4": 30,
+			},
+		},
+		"ipv6 udp": {
+			"sip-ipv6.pcap",
+			2,
+			map[string]int{
+				"incoming":          2,
+				"invalid":           0,
+				"network:ipv4":      0,
+				"network:ipv6":      2,
+				"seen:udp:ipv4":     0,
+				"seen:udp:ipv6":     2,
+				"captured:udp:ipv4": 0,
+				"captured:udp:ipv6": 2,
+			},
+		},
+		"ipv6 tcp stream": {
+			"sip-tcp-ipv6.pcap",
+			2, // INVITE split across two segments, and its response
+			map[string]int{
+				"incoming":          9,
+				"invalid":           0,
+				"network:ipv6":      9,
+				"seen:tcp:ipv4":     0,
+				"seen:tcp:ipv6":     9,
+				"captured:tcp:ipv4": 0,
+				"captured:tcp:ipv6": 2,
+			},
+		},
+		"ipv6 fragmented": {
+			"sip-frag-ipv6.pcap",
+			1, // one complete INVITE, plus an unfinished fragment
+			map[string]int{
+				"incoming":          4,
+				"invalid":           0,
+				"fragments":         3,
+				"defrag":            1,
+				"network:ipv6":      1,
+				"seen:udp:ipv6":     1,
+				"captured:udp:ipv6": 1,
+			},
+		},
+		"sctp": {
+			"sip-sctp.pcap",
+			4, // one single, two bundled, and one fragmented
+			map[string]int{
+				"incoming":             8,
+				"invalid":              0,
+				"seen:sctp:ipv4":       8,
+				"captured:sctp:ipv4":   4,
+				"discarded:sctp:ipv4":  1, // not SIP
+				"incomplete:sctp:ipv4": 1, // never finished
+			},
+		},
+		"websocket": {
+			"sip-ws.pcap",
+			3, // an INVITE, a fragmented MESSAGE, and its 200 OK
+			map[string]int{
+				"incoming":           14,
+				"seen:tcp:ipv4":      14,
+				"websocket:ipv4":     2, // one for each direction
+				"captured:tcp:ipv4":  0,
+				"captured:ws:ipv4":   3,
+				"discarded:ws:ipv4":  1, // not SIP
+				"incomplete:ws:ipv4": 0,
+			},
+		},
+		"vxlan with qinq": {
+			"decap-vxlan.pcap",
+			1,
+			map[string]int{
+				"incoming":          1,
+				"invalid":           0,
+				"decap:vxlan":       1,
+				"decap:vlan":        2,
+				"network:ipv4":      1,
+				"captured:udp:ipv4": 1,
+			},
+		},
+		"erspan": {
+			"decap-erspan.pcap",
+			3, // types I, II, and III
+			map[string]int{
+				"incoming":          3,
+				"invalid":           0,
+				"decap:erspan":      3,
+				"decap:gre":         0,
+				"decap:vlan":        2,
+				"captured:udp:ipv4": 3,
+			},
+		},
+		"gre": {
+			"decap-gre.pcap",
+			2, // IPv4 and Ethernet in GRE
+			map[string]int{
+				"incoming":          2,
+				"invalid":           0,
+				"decap:gre":         2,
+				"captured:udp:ipv4": 2,
+			},
+		},
+		"linux cooked": {
+			"decap-sll.pcap",
+			1,
+			map[string]int{
+				"incoming":          1,
+				"invalid":           0,
+				"decap:sll":         1,
+				"captured:udp:ipv4": 1,
 			},
 		},
 		"not sip": {
 			"smtp.pcap",
 			0,
 			map[string]int{
-				"incoming":     60,
-				"invalid":      4, // has ICMP packets
-				"fragments":    0,
-				"defrag":       0,
-				"seen:udp":     3,
-				"seen:tcp":     53,
-				"captured:udp": 0,
-				"captured:tcp": 0,
+				"incoming":          60,
+				"invalid":           4, // has ICMP packets
+				"fragments":         0,
+				"defrag":            0,
+				"seen:udp:ipv4":     3,
+				"seen:tcp:ipv4":     53,
+				"captured:udp:ipv4": 0,
+				"captured:tcp:ipv4": 0,
 			},
 		},
 	}
@@ -143,18 +269,40 @@ func TestIPPacketAssembler(t *testing.T) {
 			log := zerolog.New(buf)
 			zerolog.SetGlobalLevel(zerolog.DebugLevel)
 			ctx := log.WithContext(context.Background())
-			ext := NewExtracter(ip4defrag.NewIPv4Defragmenter())
-			handle, err := pcap.OpenOffline(filepath.Join("testdata", tc.input))
+			ext := NewExtracter(defrag.NewDefragmenter(), Options{GRE: true, ERSPAN: true, VXLAN: true, PacketClock: true})
+			f, err := os.Open(filepath.Join("testdata", tc.input))
+			is.NoErr(err)
+			defer f.Close()
+			handle, err := pcapgo.NewReader(f)
 			is.NoErr(err)
-			defer handle.Close()
 			source := gopacket.NewPacketSource(handle, handle.LinkType())
 
+			// Record every packet's capture time on the way through, so we
+			// can check messages are stamped with packet time, not wall time.
+			packets := make(chan gopacket.Packet)
+			stamps := map[time.Time]bool{}
+			go func() {
+				for p := range source.Packets() {
+					stamps[p.Metadata().Timestamp] = true
+					packets <- p
+				}
+				close(packets)
+			}()
+
+			var lock sync.Mutex
 			msgs := make([]*layers.SIP, 0, 1000)
-			accept := func(s *layers.SIP) error { msgs = append(msgs, s); return nil }
+			metas := make([]*capture.Meta, 0, 1000)
+			accept := func(s *layers.SIP, meta *capture.Meta) error {
+				lock.Lock()
+				defer lock.Unlock()
+				msgs = append(msgs, s)
+				metas = append(metas, meta)
+				return nil
+			}
 
 			done := make(chan bool)
 			go func() {
-				ext.Extract(ctx, source.Packets(), accept)
+				ext.Extract(ctx, packets, accept)
 				done <- true
 			}()
 
@@ -171,6 +319,117 @@ func TestIPPacketAssembler(t *testing.T) {
 			}
 			is.Equal(captured, tc.msgs)                    // count of captured vs expected
 			is.NoErr(testMetrics(tc.metrics, ext.metrics)) // fields as expected
+			for _, meta := range metas {
+				is.True(stamps[meta.Time]) // message time is a packet capture time
+				is.True(meta.SrcIP != nil && meta.DstIP != nil)
+				is.True(meta.SrcPort != 0 && meta.DstPort != 0)
+				is.True(meta.Transport == capture.UDP || meta.Transport == capture.TCP || meta.Transport == capture.SCTP || meta.Transport == capture.WS ||
+					meta.Transport == capture.TLS || meta.Transport == capture.WSS)
+			}
+		})
+	}
+}
+
+// Packets from a live capture are tagged with their interface, which every
+// message they carry keeps, whether it was reassembled or not.
+func TestExtractInterface(t *testing.T) {
+	for _, file := range []string{"sip-i.pcap", "sip-tcp.pcap", "sip-sctp.pcap"} {
+		t.Run(file, func(t *testing.T) {
+			is := is.New(t)
+			f, err := os.Open(filepath.Join("testdata", file))
+			is.NoErr(err)
+			defer f.Close()
+			handle, err := pcapgo.NewReader(f)
+			is.NoErr(err)
+			source := gopacket.NewPacketSource(handle, handle.LinkType())
+
+			packets := make(chan gopacket.Packet)
+			go func() {
+				for p := range source.Packets() {
+					md := p.Metadata()
+					md.AncillaryData = append(md.AncillaryData, capture.Interface("eth1"))
+					packets <- p
+				}
+				close(packets)
+			}()
+
+			var mu sync.Mutex
+			var metas []*capture.Meta
+			NewExtracter(nil, Options{}).Extract(context.Background(), packets, func(_ *layers.SIP, meta *capture.Meta) error {
+				mu.Lock()
+				defer mu.Unlock()
+				metas = append(metas, meta)
+				return nil
+			})
+			is.True(len(metas) > 0)
+			for _, m := range metas {
+				is.Equal(m.Interface, "eth1")
+				is.Equal(m.VLAN, uint16(0))
+			}
 		})
 	}
 }
+
+// Packets whose VLAN tag was stripped before capture, as AF_PACKET does, keep
+// their VLAN from the ancillary data, unless the packet itself is tagged.
+func TestExtractStrippedVLAN(t *testing.T) {
+	is := is.New(t)
+	f, err := os.Open(filepath.Join("testdata", "sip-i.pcap"))
+	is.NoErr(err)
+	defer f.Close()
+	handle, err := pcapgo.NewReader(f)
+	is.NoErr(err)
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	packets := make(chan gopacket.Packet)
+	go func() {
+		for p := range source.Packets() {
+			md := p.Metadata()
+			md.AncillaryData = append(md.AncillaryData, capture.VLAN(100))
+			packets <- p
+		}
+		close(packets)
+	}()
+
+	var metas []*capture.Meta
+	NewExtracter(nil, Options{}).Extract(context.Background(), packets, func(_ *layers.SIP, meta *capture.Meta) error {
+		metas = append(metas, meta)
+		return nil
+	})
+	is.True(len(metas) > 0)
+	for _, m := range metas {
+		is.Equal(m.VLAN, uint16(100))
+	}
+}
+
+// Packets rebuilt from another transport, such as from HEP, keep the
+// transport their message was originally carried over.
+func TestExtractTransport(t *testing.T) {
+	is := is.New(t)
+	f, err := os.Open(filepath.Join("testdata", "sip-i.pcap"))
+	is.NoErr(err)
+	defer f.Close()
+	handle, err := pcapgo.NewReader(f)
+	is.NoErr(err)
+	source := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	packets := make(chan gopacket.Packet)
+	go func() {
+		for p := range source.Packets() {
+			md := p.Metadata()
+			md.AncillaryData = append(md.AncillaryData, capture.Transport(capture.TCP))
+			packets <- p
+		}
+		close(packets)
+	}()
+
+	var metas []*capture.Meta
+	NewExtracter(nil, Options{}).Extract(context.Background(), packets, func(_ *layers.SIP, meta *capture.Meta) error {
+		metas = append(metas, meta)
+		return nil
+	})
+	is.True(len(metas) > 0)
+	for _, m := range metas {
+		is.Equal(m.Transport, capture.TCP)
+	}
+}
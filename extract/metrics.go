@@ -14,6 +14,11 @@ type Metrics struct {
 	BadDefrag  prometheus.Counter
 	Defrag     prometheus.Counter
 
+	Network    *prometheus.CounterVec
+	Decap      *prometheus.CounterVec
+	WebSocket  *prometheus.CounterVec
+	TLS        *prometheus.CounterVec
+	TLSFailed  *prometheus.CounterVec
 	Seen       *prometheus.CounterVec
 	Incomplete *prometheus.CounterVec
 	Discarded  *prometheus.CounterVec
@@ -48,31 +53,71 @@ func NewMetrics() *Metrics {
 			Name: "packets_defragmented_total",
 			Help: "packet fragments successfully reassembled into whole packets",
 		}),
+		Network: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "packets_network_total",
+			Help: "packets with a usable IP layer, by IP version",
+		}, []string{"network"}),
+		Decap: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "packets_decapsulated_total",
+			Help: "encapsulation headers removed from packets, by type",
+		}, []string{"encapsulation"}),
+		WebSocket: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flows_websocket_total",
+			Help: "tcp streams upgraded to websocket, counting each direction",
+		}, []string{"network"}),
+		TLS: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flows_tls_total",
+			Help: "tcp connections carrying tls, when decryption is enabled",
+		}, []string{"network"}),
+		TLSFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "flows_tls_undecryptable_total",
+			Help: "tls connections which could not be decrypted",
+		}, []string{"network"}),
 		Seen: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "msgs_seen_total",
 			Help: "SIP messages encountered",
-		}, []string{"transport"}),
+		}, []string{"transport", "network"}),
 		Incomplete: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "msgs_incomplete_total",
 			Help: "SIP messages ignored as incomplete",
-		}, []string{"transport"}),
+		}, []string{"transport", "network"}),
 		Discarded: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "msgs_discarded_total",
 			Help: "SIP messages discarded as unparseable",
-		}, []string{"transport"}),
+		}, []string{"transport", "network"}),
 		Captured: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "msgs_captured_total",
 			Help: "SIP messages successfully prepared for capture",
-		}, []string{"transport"}),
+		}, []string{"transport", "network"}),
 	}
 
-	// Ensure our important transport labels are 0 filled so they always show
-	// up, even if they haven't yet received data.
-	for _, s := range []string{"udp", "tcp"} {
-		m.Seen.WithLabelValues(s)
-		m.Incomplete.WithLabelValues(s)
-		m.Discarded.WithLabelValues(s)
-		m.Captured.WithLabelValues(s)
+	// Ensure our important transport and network labels are 0 filled so they
+	// always show up, even if they haven't yet received data.
+	for _, n := range []string{ipv4, ipv6} {
+		m.Network.WithLabelValues(n)
+		for _, s := range []string{"udp", "tcp", "sctp"} {
+			m.Seen.WithLabelValues(s, n)
+			m.Incomplete.WithLabelValues(s, n)
+			m.Discarded.WithLabelValues(s, n)
+			m.Captured.WithLabelValues(s, n)
+		}
+		// websocket messages are seen as tcp packets.
+		m.WebSocket.WithLabelValues(n)
+		m.Incomplete.WithLabelValues("ws", n)
+		m.Discarded.WithLabelValues("ws", n)
+		m.Captured.WithLabelValues("ws", n)
+		// as are decrypted tls connections, and secure websockets.
+		m.TLS.WithLabelValues(n)
+		m.TLSFailed.WithLabelValues(n)
+		for _, s := range []string{"tls", "wss"} {
+			m.Incomplete.WithLabelValues(s, n)
+			m.Discarded.WithLabelValues(s, n)
+			m.Captured.WithLabelValues(s, n)
+		}
+	}
+
+	for _, d := range []string{encapVLAN, encapSLL, encapGRE, encapERSPAN, encapVXLAN} {
+		m.Decap.WithLabelValues(d)
 	}
 
 	return m
@@ -86,6 +131,11 @@ func (m Metrics) List() []prometheus.Collector {
 		m.Fragments,
 		m.ShortFrags,
 		m.BadDefrag,
+		m.Network,
+		m.Decap,
+		m.WebSocket,
+		m.TLS,
+		m.TLSFailed,
 		m.Seen,
 		m.Incomplete,
 		m.Discarded,
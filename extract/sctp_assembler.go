@@ -0,0 +1,221 @@
+package extract
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/sipsplitter"
+	"github.com/rs/zerolog"
+)
+
+/*
+  SCTP is much kinder than TCP:
+  - SIP messages are each sent as exactly one SCTP user message (RFC 4168),
+    so there's no need to split a byte stream.
+  - A user message too large for a packet is split into DATA chunk
+    fragments, marked beginning and end, with consecutive TSNs.
+  - Several DATA chunks, for any streams, may be bundled into one packet.
+  - Chunks may be retransmitted, so TSNs already seen are ignored.
+*/
+
+const (
+	sctpChunkData      = 0
+	sctpChunkHeader    = 4
+	sctpDataHeader     = 16
+	sctpFlagEnd        = 0x01
+	sctpFlagBegin      = 0x02
+	sctpMaxFragmentRun = 1 << 16
+)
+
+// sctpKey identifies one direction of an SCTP association.
+type sctpKey struct {
+	net, transport gopacket.Flow
+}
+
+// sctpFragment is a DATA chunk awaiting the rest of its user message.
+type sctpFragment struct {
+	begin, end bool
+	data       []byte
+	seen       time.Time
+}
+
+// sctpAssociation tracks the DATA chunks of one direction of an association.
+type sctpAssociation struct {
+	frags map[uint32]*sctpFragment
+	// tsns records when each TSN already used was seen, so that
+	// retransmissions are ignored.
+	tsns map[uint32]time.Time
+	seen time.Time
+}
+
+// sctpAssembler reassembles the user messages of SCTP associations and
+// extracts the SIP message in each.
+type sctpAssembler struct {
+	accept  Accepter
+	metrics *Metrics
+	log     zerolog.Logger
+	assocs  map[sctpKey]*sctpAssociation
+}
+
+func newSCTPAssembler(log zerolog.Logger, metrics *Metrics, accept Accepter) *sctpAssembler {
+	return &sctpAssembler{
+		accept:  accept,
+		metrics: metrics,
+		log:     log.With().Str("component", "sctp-assembler").Logger(),
+		assocs:  make(map[sctpKey]*sctpAssociation),
+	}
+}
+
+// Assemble handles every DATA chunk in an SCTP packet, accepting the SIP
+// messages of any user messages it completes.
+func (s *sctpAssembler) Assemble(netFlow gopacket.Flow, sctp *layers.SCTP, pkt capture.Packet) {
+	key := sctpKey{netFlow, sctp.TransportFlow()}
+	network := networkLabel(netFlow)
+
+	for data := sctp.LayerPayload(); len(data) >= sctpChunkHeader; {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < sctpChunkHeader || length > len(data) {
+			s.metrics.Discarded.WithLabelValues("sctp", network).Inc()
+			s.log.Debug().Int("length", length).Msg("malformed sctp chunk")
+			return
+		}
+		chunk := data[:length]
+		// chunks are padded to 4 bytes, except perhaps the last
+		if padded := (length + 3) &^ 3; padded < len(data) {
+			data = data[padded:]
+		} else {
+			data = nil
+		}
+
+		if chunk[0] != sctpChunkData {
+			continue
+		}
+		if length < sctpDataHeader {
+			s.metrics.Discarded.WithLabelValues("sctp", network).Inc()
+			continue
+		}
+		s.addData(key, network, chunk, pkt)
+	}
+}
+
+// addData records a DATA chunk, and accepts the user message it completes,
+// if any.
+func (s *sctpAssembler) addData(key sctpKey, network string, chunk []byte, pkt capture.Packet) {
+	a, ok := s.assocs[key]
+	if !ok {
+		a = &sctpAssociation{
+			frags: make(map[uint32]*sctpFragment),
+			tsns:  make(map[uint32]time.Time),
+		}
+		s.assocs[key] = a
+	}
+	a.seen = pkt.Time
+
+	tsn := binary.BigEndian.Uint32(chunk[4:])
+	if _, dup := a.tsns[tsn]; dup {
+		s.log.Debug().Uint32("tsn", tsn).Msg("ignoring retransmitted sctp chunk")
+		return
+	}
+	a.tsns[tsn] = pkt.Time
+	a.frags[tsn] = &sctpFragment{
+		begin: chunk[1]&sctpFlagBegin != 0,
+		end:   chunk[1]&sctpFlagEnd != 0,
+		data:  append([]byte(nil), chunk[sctpDataHeader:]...),
+		seen:  pkt.Time,
+	}
+
+	msg, ok := a.complete(tsn)
+	if !ok {
+		s.log.Debug().Uint32("tsn", tsn).Msg("sctp fragment awaiting the rest of its message")
+		return
+	}
+
+	if !sipsplitter.IsMessage(msg) {
+		s.metrics.Discarded.WithLabelValues("sctp", network).Inc()
+		s.log.Debug().Msg("sctp user message is not SIP")
+		return
+	}
+	sip := layers.NewSIP()
+	if err := sip.DecodeFromBytes(msg, gopacket.NilDecodeFeedback); err != nil {
+		s.metrics.Discarded.WithLabelValues("sctp", network).Inc()
+		s.log.Debug().Err(err).Msg("unable to decode sctp sip message")
+		return
+	}
+	s.metrics.Captured.WithLabelValues("sctp", network).Inc()
+	if err := s.accept(sip, capture.FromFlows(key.net, key.transport, capture.SCTP, pkt)); err != nil {
+		s.log.Err(err).Msg("unable to accept SCTP sip message")
+	}
+}
+
+// complete returns the whole user message containing the fragment with the
+// given TSN, and forgets its fragments, if every fragment has been seen.
+func (a *sctpAssociation) complete(tsn uint32) ([]byte, bool) {
+	first := tsn
+	for n := 0; !a.frags[first].begin; n++ {
+		if _, ok := a.frags[first-1]; !ok || n == sctpMaxFragmentRun {
+			return nil, false
+		}
+		first--
+	}
+	last := tsn
+	for n := 0; !a.frags[last].end; n++ {
+		if _, ok := a.frags[last+1]; !ok || n == sctpMaxFragmentRun {
+			return nil, false
+		}
+		last++
+	}
+
+	var msg []byte
+	for t := first; ; t++ {
+		msg = append(msg, a.frags[t].data...)
+		delete(a.frags, t)
+		if t == last {
+			return msg, true
+		}
+	}
+}
+
+// FlushOlderThan forgets fragments, retransmission history, and associations
+// last seen before t, returning how many incomplete messages were discarded.
+func (s *sctpAssembler) FlushOlderThan(t time.Time) int {
+	var dropped int
+	for key, a := range s.assocs {
+		for tsn, f := range a.frags {
+			if f.seen.Before(t) {
+				if f.begin {
+					dropped++
+					s.metrics.Incomplete.WithLabelValues("sctp", networkLabel(key.net)).Inc()
+				}
+				delete(a.frags, tsn)
+			}
+		}
+		for tsn, seen := range a.tsns {
+			if seen.Before(t) {
+				delete(a.tsns, tsn)
+			}
+		}
+		if a.seen.Before(t) && len(a.frags) == 0 {
+			delete(s.assocs, key)
+		}
+	}
+	return dropped
+}
+
+// FlushAll forgets everything, returning how many incomplete messages were
+// discarded.
+func (s *sctpAssembler) FlushAll() int {
+	var dropped int
+	for key, a := range s.assocs {
+		for _, f := range a.frags {
+			if f.begin {
+				dropped++
+				s.metrics.Incomplete.WithLabelValues("sctp", networkLabel(key.net)).Inc()
+			}
+		}
+		delete(s.assocs, key)
+	}
+	return dropped
+}
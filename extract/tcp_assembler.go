@@ -2,13 +2,18 @@ package extract
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
+	"sync"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/nextcaller/sip-capture/capture"
 	"github.com/nextcaller/sip-capture/sipsplitter"
+	"github.com/nextcaller/sip-capture/tlsdecrypt"
 
 	"github.com/rs/zerolog"
 )
@@ -30,40 +35,100 @@ import (
 // SIPStreamFactory is used by a tcpassembly.StreamPool to create a new SIP
 // extraction stream when a tcp flow begins.
 type sipStreamFactory struct {
-	accept  func(*layers.SIP) error
+	accept  Accepter
 	metrics *Metrics
 	log     zerolog.Logger
-	trace   *sipsplitter.Trace
+	streams sync.WaitGroup
+
+	// keys decrypt TLS streams, if set, and conns pairs up the two
+	// directions of each TCP connection so that they can be.
+	keys  *tlsdecrypt.Keys
+	mu    sync.Mutex
+	conns map[connKey]*tlsConn
+
+	// packet is the one Extract is currently assembling, which streams
+	// record as their data is reassembled.
+	packet capture.Packet
 }
 
-// newStreamFactory creates a SIPStreamFactory that's initialized with tracing functions.
-func newStreamFactory(log zerolog.Logger, metrics *Metrics, accepter func(*layers.SIP) error) *sipStreamFactory {
+// newStreamFactory creates a SIPStreamFactory that will record metrics and
+// logs for each stream it creates, and decrypt TLS streams with keys, if they
+// aren't nil.
+func newStreamFactory(log zerolog.Logger, metrics *Metrics, accepter Accepter, keys *tlsdecrypt.Keys) *sipStreamFactory {
 	return &sipStreamFactory{
 		metrics: metrics,
 		log:     log,
 		accept:  accepter,
-		trace: &sipsplitter.Trace{
-			Discard: func(d []byte) {
-				log.Warn().Str("contents", string(d)).Msg("invalid SIP message discarded")
-				metrics.Discarded.WithLabelValues("tcp").Inc()
-			},
-			NoStartLine: func() {
-				log.Debug().Msg("no SIP request or status line found.")
-				metrics.Incomplete.WithLabelValues("tcp").Inc()
-			},
-			NoHeaders: func() {
-				log.Debug().Msg("incomplete SIP headers")
-				metrics.Incomplete.WithLabelValues("tcp").Inc()
-			},
-			NoBody: func() {
-				log.Debug().Msg("incomplete SIP body")
-				metrics.Incomplete.WithLabelValues("tcp").Inc()
-			},
-			Complete: func(b []byte) {
-				log.Debug().Str("SIP", string(b)).Msg("complete message found")
-			},
+		keys:    keys,
+		conns:   make(map[connKey]*tlsConn),
+	}
+}
+
+// newTrace creates the sipsplitter tracing functions for a single stream,
+// recording metrics under the stream's transport and network labels.
+func (s *sipStreamFactory) newTrace(log zerolog.Logger, proto, network string) *sipsplitter.Trace {
+	metrics := s.metrics
+	return &sipsplitter.Trace{
+		Discard: func(d []byte) {
+			log.Warn().Str("contents", string(d)).Msg("invalid SIP message discarded")
+			metrics.Discarded.WithLabelValues(proto, network).Inc()
+		},
+		NoStartLine: func() {
+			log.Debug().Msg("no SIP request or status line found.")
+			metrics.Incomplete.WithLabelValues(proto, network).Inc()
 		},
+		NoHeaders: func() {
+			log.Debug().Msg("incomplete SIP headers")
+			metrics.Incomplete.WithLabelValues(proto, network).Inc()
+		},
+		NoBody: func() {
+			log.Debug().Msg("incomplete SIP body")
+			metrics.Incomplete.WithLabelValues(proto, network).Inc()
+		},
+		Complete: func(b []byte) {
+			log.Debug().Str("SIP", string(b)).Msg("complete message found")
+		},
+	}
+}
+
+// networkLabel gives the metrics label for the IP version of a network flow.
+func networkLabel(net gopacket.Flow) string {
+	if net.EndpointType() == layers.EndpointIPv6 {
+		return ipv6
 	}
+	return ipv4
+}
+
+// timedStream is a tcpreader.ReaderStream which remembers the capture time,
+// interface, and VLAN of the most recent data handed to its reader.  Since
+// ReaderStream.Reassembled blocks until the reader has consumed everything,
+// that is the packet which completed whatever message the reader is currently
+// scanning.
+type timedStream struct {
+	tcpreader.ReaderStream
+	sync.Mutex
+	seen capture.Packet
+	// packet is the factory's, describing the packet being assembled.
+	packet *capture.Packet
+}
+
+// Reassembled records the latest packet and passes the data on to the reader.
+// Data flushed from the assembler is stamped with its own capture time.
+func (t *timedStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	if n := len(reassembly); n > 0 {
+		t.Lock()
+		t.seen = *t.packet
+		t.seen.Time = reassembly[n-1].Seen
+		t.Unlock()
+	}
+	t.ReaderStream.Reassembled(reassembly)
+}
+
+// Seen returns the packet of the latest data given to the reader.
+func (t *timedStream) Seen() capture.Packet {
+	t.Lock()
+	defer t.Unlock()
+	return t.seen
 }
 
 // New creates a SIPStreamFactory that generates tcpassembly.Streams.  It uses
@@ -72,37 +137,139 @@ func newStreamFactory(log zerolog.Logger, metrics *Metrics, accepter func(*layer
 // individual SIP messages out of the TCP byte stream.
 func (s *sipStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
 	log := s.log.With().Str("component", "sip-stream").Str("flow", transport.String()).Logger()
-	r := tcpreader.NewReaderStream()
-	go s.scanStream(&r, log)
+	r := &timedStream{ReaderStream: tcpreader.NewReaderStream(), packet: &s.packet}
+	var conn *tlsConn
+	var side int
+	if s.keys != nil {
+		conn, side = s.pair(net, transport, log)
+	}
+	s.streams.Add(1)
+	go func() {
+		defer s.streams.Done()
+		s.scanStream(r, log, net, transport, conn, side)
+	}()
 
-	return &r
+	return r
 }
 
-func (s *sipStreamFactory) scanStream(r io.Reader, log zerolog.Logger) {
+// Wait blocks until every stream's scanner has finished, which will happen
+// once the assembler has flushed them all.
+func (s *sipStreamFactory) Wait() { s.streams.Wait() }
+
+// scanStream extracts the SIP messages from one direction of a TCP stream,
+// decrypting it first if it's TLS and can be.  Anything left unread once it's
+// finished is discarded, so the assembler is never left waiting on the
+// stream.
+func (s *sipStreamFactory) scanStream(r *timedStream, log zerolog.Logger, netFlow, transport gopacket.Flow, conn *tlsConn, side int) {
+	defer func() { _, _ = io.Copy(ioutil.Discard, r) }()
+
+	br := bufio.NewReader(r)
+	if conn != nil {
+		defer s.release(conn, side)
+		if start, _ := br.Peek(3); tlsdecrypt.IsRecord(start) {
+			s.scanTLS(br, r, log, netFlow, transport, conn, side)
+			return
+		}
+	}
+	s.scanPlain(br, r.Seen, capture.TCP, log, netFlow, transport)
+}
+
+// scanPlain extracts the SIP messages from an unencrypted stream, either
+// directly or from within WebSocket messages if the stream begins with a
+// WebSocket handshake for the sip subprotocol.  WebSockets for any other
+// subprotocol are ignored.  The stream is TCP, or TLS which has been
+// decrypted.
+func (s *sipStreamFactory) scanPlain(br *bufio.Reader, seen func() capture.Packet, proto string, log zerolog.Logger, netFlow, transport gopacket.Flow) {
+	if ws, protocol := wsUpgrade(br); ws {
+		if !wsSIP(protocol) {
+			log.Debug().Str("protocol", protocol).Msg("websocket upgrade to another subprotocol, ignored")
+			return
+		}
+		s.metrics.WebSocket.WithLabelValues(networkLabel(netFlow)).Inc()
+		log.Debug().Str("protocol", protocol).Msg("websocket upgrade")
+		wsProto := capture.WS
+		if proto == capture.TLS {
+			wsProto = capture.WSS
+		}
+		s.scanWebSocket(br, seen, wsProto, log, netFlow, transport)
+		return
+	}
+	s.scanSIP(br, seen, proto, log, netFlow, transport)
+}
+
+// scanSIP splits a stream of bytes into SIP messages.
+func (s *sipStreamFactory) scanSIP(br *bufio.Reader, seen func() capture.Packet, proto string, log zerolog.Logger, netFlow, transport gopacket.Flow) {
+	network := networkLabel(netFlow)
 	splitter := &sipsplitter.Splitter{
 		ExitOnError: false,
-		Trace:       s.trace,
+		Trace:       s.newTrace(log, proto, network),
 	}
 
-	sc := bufio.NewScanner(r)
+	sc := bufio.NewScanner(br)
 	sc.Split(splitter.SplitSIP)
 
 	for sc.Scan() {
 		msg := layers.NewSIP()
 		if err := msg.DecodeFromBytes(sc.Bytes(), gopacket.NilDecodeFeedback); err != nil {
-			s.metrics.Discarded.WithLabelValues("tcp").Inc()
+			s.metrics.Discarded.WithLabelValues(proto, network).Inc()
 			log.Err(err).
 				Bytes("sip", sc.Bytes()).
 				Msg("error decoding tcp SIP layer bytes, skipping.")
 			continue
 		}
-		if err := s.accept(msg); err != nil {
+		if err := s.accept(msg, capture.FromFlows(netFlow, transport, proto, seen())); err != nil {
 			log.Err(err).Msg("unable to accept TCP SIP message")
 		}
-		s.metrics.Captured.WithLabelValues("tcp").Inc()
+		s.metrics.Captured.WithLabelValues(proto, network).Inc()
 	}
 	if err := sc.Err(); err != nil {
 		// This can only happen if the tcpreader stream is broken.
 		log.Err(err).Msg("failed to fully scan tcp strem")
 	}
 }
+
+// scanWebSocket reads a SIP message from each WebSocket message in a stream,
+// until the stream ends or its framing is broken.
+func (s *sipStreamFactory) scanWebSocket(br *bufio.Reader, seen func() capture.Packet, proto string, log zerolog.Logger, netFlow, transport gopacket.Flow) {
+	network := networkLabel(netFlow)
+	for {
+		data, err := readWSMessage(br)
+		switch err {
+		case nil:
+		case io.EOF:
+			return
+		case errWSTooLarge:
+			s.metrics.Discarded.WithLabelValues(proto, network).Inc()
+			log.Warn().Msg("websocket message too large, discarded")
+			continue
+		case io.ErrUnexpectedEOF:
+			s.metrics.Incomplete.WithLabelValues(proto, network).Inc()
+			log.Debug().Msg("incomplete websocket message")
+			return
+		default:
+			s.metrics.Discarded.WithLabelValues(proto, network).Inc()
+			log.Warn().Err(err).Msg("unable to read websocket stream, skipping the rest")
+			return
+		}
+
+		// some clients send blank lines as keep-alives.
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		if !sipsplitter.IsMessage(data) {
+			s.metrics.Discarded.WithLabelValues(proto, network).Inc()
+			log.Warn().Str("contents", string(data)).Msg("invalid SIP message discarded")
+			continue
+		}
+		msg := layers.NewSIP()
+		if err := msg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			s.metrics.Discarded.WithLabelValues(proto, network).Inc()
+			log.Err(err).Bytes("sip", data).Msg("error decoding websocket SIP layer bytes, skipping.")
+			continue
+		}
+		if err := s.accept(msg, capture.FromFlows(netFlow, transport, proto, seen())); err != nil {
+			log.Err(err).Msg("unable to accept websocket SIP message")
+		}
+		s.metrics.Captured.WithLabelValues(proto, network).Inc()
+	}
+}
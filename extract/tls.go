@@ -0,0 +1,184 @@
+package extract
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/tlsdecrypt"
+
+	"github.com/rs/zerolog"
+)
+
+// connKey identifies one direction of a TCP connection.
+type connKey struct {
+	net, transport gopacket.Flow
+}
+
+// tlsConn joins the two directions of a TCP connection, which tcpassembly
+// delivers as independent streams, so that a TLS session can be decrypted
+// using the handshake messages from both.  Side 0 is whichever direction was
+// seen first.
+type tlsConn struct {
+	key     connKey
+	network string
+	log     zerolog.Logger
+
+	// started and ended are guarded by the factory's mutex.
+	started [2]bool
+	ended   [2]bool
+
+	mu      sync.Mutex
+	session *tlsdecrypt.Session
+	plain   [2]*plainStream
+	seen    [2]capture.Packet
+	failed  bool
+}
+
+// plainStream carries the decrypted data from one direction of a TLS session
+// to the scanner extracting SIP from it.
+type plainStream struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	mu   sync.Mutex
+	seen capture.Packet
+}
+
+func newPlainStream() *plainStream {
+	r, w := io.Pipe()
+	return &plainStream{r: r, w: w}
+}
+
+// write hands data, decrypted from the records completed by pkt, to the
+// scanner, blocking until it has all been read.
+func (p *plainStream) write(data []byte, pkt capture.Packet) {
+	p.mu.Lock()
+	p.seen = pkt
+	p.mu.Unlock()
+	// the reader drains the pipe until it's closed, so never fails.
+	_, _ = p.w.Write(data)
+}
+
+// Seen returns the packet of the latest data written.
+func (p *plainStream) Seen() capture.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seen
+}
+
+// pair finds the connection the new stream belongs to, returning it and the
+// stream's side of it.  The first direction of a connection creates it, and
+// the opposite direction joins it.
+func (s *sipStreamFactory) pair(net, transport gopacket.Flow, log zerolog.Logger) (*tlsConn, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conns[connKey{net.Reverse(), transport.Reverse()}]; ok && !c.started[1] {
+		c.started[1] = true
+		return c, 1
+	}
+	c := &tlsConn{
+		key:     connKey{net, transport},
+		network: networkLabel(net),
+		log:     log,
+	}
+	c.started[0] = true
+	s.conns[c.key] = c
+	return c, 0
+}
+
+// scanTLS decrypts one direction of a TLS connection, extracting SIP from the
+// plaintext in another goroutine as it becomes available.
+func (s *sipStreamFactory) scanTLS(br *bufio.Reader, r *timedStream, log zerolog.Logger, netFlow, transport gopacket.Flow, c *tlsConn, side int) {
+	p := s.startTLS(c, side)
+	s.streams.Add(1)
+	go func() {
+		defer s.streams.Done()
+		defer func() { _, _ = io.Copy(ioutil.Discard, p.r) }()
+		s.scanPlain(bufio.NewReader(p.r), p.Seen, capture.TLS, log, netFlow, transport)
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := br.Read(buf)
+		if n > 0 {
+			s.feedTLS(c, side, buf[:n], r.Seen())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// startTLS creates the connection's session, if the other side hasn't
+// already, and the plaintext stream for this side.
+func (s *sipStreamFactory) startTLS(c *tlsConn, side int) *plainStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		s.metrics.TLS.WithLabelValues(c.network).Inc()
+		c.session = tlsdecrypt.NewSession(s.keys, func(side int, plain []byte) {
+			if p := c.plain[side]; p != nil {
+				p.write(plain, c.seen[side])
+			}
+		})
+	}
+	c.plain[side] = newPlainStream()
+	return c.plain[side]
+}
+
+// feedTLS passes data from one side to the session, counting it as
+// undecryptable the first time it fails.
+func (s *sipStreamFactory) feedTLS(c *tlsConn, side int, data []byte, pkt capture.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[side] = pkt
+	c.session.Feed(side, data)
+	if err := c.session.Err(); err != nil && !c.failed {
+		s.tlsFailed(c, err)
+	}
+}
+
+func (s *sipStreamFactory) tlsFailed(c *tlsConn, err error) {
+	c.failed = true
+	s.metrics.TLSFailed.WithLabelValues(c.network).Inc()
+	c.log.Warn().Err(err).Msg("unable to decrypt tls connection")
+}
+
+// release is called as each side of a connection ends.  A side's plaintext
+// ends with it, unless some of its records are still waiting on the other
+// side's handshake.  Once both sides have ended the session is finished, and
+// forgotten.
+func (s *sipStreamFactory) release(c *tlsConn, side int) {
+	s.mu.Lock()
+	c.ended[side] = true
+	last := !c.started[1-side] || c.ended[1-side]
+	if last && s.conns[c.key] == c {
+		delete(s.conns, c.key)
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !last {
+		if p := c.plain[side]; p != nil && !c.session.Pending(side) {
+			p.w.Close()
+			c.plain[side] = nil
+		}
+		return
+	}
+	if c.session != nil {
+		if err := c.session.Close(); err != nil && !c.failed {
+			s.tlsFailed(c, err)
+		}
+	}
+	for i, p := range c.plain {
+		if p != nil {
+			p.w.Close()
+			c.plain[i] = nil
+		}
+	}
+}
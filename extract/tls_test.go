@@ -0,0 +1,47 @@
+package extract
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/tlsdecrypt"
+)
+
+// sip-tls.pcap holds four connections to port 5061: TLS 1.3 and TLS 1.2
+// sessions carrying SIP, a TLS 1.3 session missing from the key log, and
+// SIP over a TLS 1.3 websocket.
+func TestExtractTLS(t *testing.T) {
+	is := is.New(t)
+	keylog, err := tlsdecrypt.OpenKeyLog(filepath.Join("testdata", "sip-tls.keylog"))
+	is.NoErr(err)
+	ext := NewExtracter(nil, Options{TLS: &tlsdecrypt.Keys{KeyLog: keylog}})
+
+	metas := extractFile(is, ext, "sip-tls.pcap")
+	is.Equal(len(metas), 7)
+	transports := map[string]int{}
+	for _, m := range metas {
+		transports[m.Transport]++
+		is.True(m.SrcPort == 5061 || m.DstPort == 5061)
+		is.True(!m.Time.IsZero())
+	}
+	is.Equal(transports, map[string]int{capture.TLS: 5, capture.WSS: 2})
+
+	is.NoErr(testMetrics(map[string]int{
+		"tls:ipv4":           4,
+		"undecryptable:ipv4": 1,
+		"websocket:ipv4":     2,
+		"captured:tls:ipv4":  5,
+		"captured:wss:ipv4":  2,
+		"captured:tcp:ipv4":  0,
+		"discarded:tls:ipv4": 0,
+	}, ext.metrics))
+}
+
+func TestExtractTLSDisabled(t *testing.T) {
+	is := is.New(t)
+	ext := NewExtracter(nil, Options{})
+	is.Equal(len(extractFile(is, ext, "sip-tls.pcap")), 0)
+	is.NoErr(testMetrics(map[string]int{"tls:ipv4": 0}, ext.metrics))
+}
@@ -0,0 +1,217 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+)
+
+/*
+  SIP over WebSocket (RFC 7118) is nearly as kind as SCTP:
+  - A connection begins as HTTP, with the client asking to Upgrade to
+    websocket with the "sip" subprotocol, and the server answering 101
+    Switching Protocols.  Each direction of a TCP stream is assembled on its
+    own, but each begins with its own half of the handshake, so they can
+    each be recognised without the other.
+  - After that, each WebSocket message carries exactly one SIP message, so
+    there are no start lines or Content-Lengths to hunt for.
+  - A message may be fragmented over several frames, with control frames
+    (ping, pong, close) between them.
+  - Frames sent by the client are masked.
+*/
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpControl      = 0x8 // every opcode with this bit set is a control frame
+	wsMaxControl     = 125
+	// wsMaxMessage limits the size of WebSocket messages which will be
+	// reassembled, much like bufio.Scanner limits TCP SIP messages.
+	wsMaxMessage = bufio.MaxScanTokenSize
+)
+
+var (
+	errWSFrame    = errors.New("invalid websocket frame")
+	errWSTooLarge = errors.New("websocket message too large")
+)
+
+// wsUpgrade reads the HTTP request or response at the start of a stream, if
+// it starts with one, and reports whether it upgrades the stream to
+// WebSocket, along with the subprotocol asked for or agreed.  Streams which
+// don't start with HTTP are left unread.
+func wsUpgrade(r *bufio.Reader) (bool, string) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return false, ""
+	}
+	request := bytes.HasPrefix(start, []byte("GET "))
+	if !request && !bytes.Equal(start, []byte("HTTP/")) {
+		return false, ""
+	}
+
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return false, ""
+	}
+	// a response must be 101 Switching Protocols.
+	if fields := strings.Fields(line); !request && (len(fields) < 2 || fields[1] != "101") {
+		return false, ""
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return false, ""
+	}
+	for _, v := range strings.Split(header.Get("Upgrade"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "websocket") {
+			return true, header.Get("Sec-WebSocket-Protocol")
+		}
+	}
+	return false, ""
+}
+
+// wsSIP reports whether a Sec-WebSocket-Protocol header, as offered by a
+// client or agreed by a server, includes the sip subprotocol of RFC 7118.
+func wsSIP(protocol string) bool {
+	for _, p := range strings.Split(protocol, ",") {
+		if strings.EqualFold(strings.TrimSpace(p), "sip") {
+			return true
+		}
+	}
+	return false
+}
+
+// wsFrame is the header of a WebSocket frame.
+type wsFrame struct {
+	fin    bool
+	op     byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+// readWSFrame reads the header of the next WebSocket frame, leaving its
+// payload to be read.
+func readWSFrame(r io.Reader) (wsFrame, error) {
+	var f wsFrame
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return f, err
+	}
+	f.fin = b[0]&0x80 != 0
+	f.op = b[0] & 0x0f
+	f.masked = b[1]&0x80 != 0
+	f.length = uint64(b[1] & 0x7f)
+	switch f.length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return f, unexpected(err)
+		}
+		f.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return f, unexpected(err)
+		}
+		f.length = binary.BigEndian.Uint64(b[:8])
+		if f.length>>63 != 0 {
+			return f, errWSFrame
+		}
+	}
+	if f.masked {
+		if _, err := io.ReadFull(r, f.mask[:]); err != nil {
+			return f, unexpected(err)
+		}
+	}
+	return f, nil
+}
+
+// unexpected turns an io.EOF part way through something into
+// io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readWSMessage returns the payload of the next text or binary message in a
+// WebSocket stream, unmasked and with its fragments joined, skipping any
+// control frames.  It returns io.EOF at the end of the stream or once a close
+// frame is read.  Messages larger than wsMaxMessage are skipped, returning
+// errWSTooLarge; the stream can be read on from there.  Any other error means
+// the stream can't be trusted to be framed correctly any more.
+func readWSMessage(r io.Reader) ([]byte, error) {
+	var msg []byte
+	started, tooLarge := false, false
+	for {
+		f, err := readWSFrame(r)
+		if err != nil {
+			if started {
+				return nil, unexpected(err)
+			}
+			return nil, err
+		}
+
+		if f.op&wsOpControl != 0 {
+			// control frames are short, never fragmented, and may come
+			// between the fragments of a message.
+			if !f.fin || f.length > wsMaxControl {
+				return nil, errWSFrame
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(f.length)); err != nil {
+				return nil, unexpected(err)
+			}
+			if f.op == wsOpClose {
+				return nil, io.EOF
+			}
+			continue
+		}
+
+		// a message begins with a text or binary frame, and goes on with
+		// continuation frames.
+		switch f.op {
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, errWSFrame
+			}
+		case wsOpContinuation:
+			if !started {
+				return nil, errWSFrame
+			}
+		default:
+			return nil, errWSFrame
+		}
+
+		started = !f.fin
+		if tooLarge || uint64(len(msg))+f.length > wsMaxMessage {
+			tooLarge = true
+			if _, err := io.CopyN(ioutil.Discard, r, int64(f.length)); err != nil {
+				return nil, unexpected(err)
+			}
+		} else {
+			start := len(msg)
+			msg = append(msg, make([]byte, f.length)...)
+			if _, err := io.ReadFull(r, msg[start:]); err != nil {
+				return nil, unexpected(err)
+			}
+			if f.masked {
+				for i := range msg[start:] {
+					msg[start+i] ^= f.mask[i%4]
+				}
+			}
+		}
+		if f.fin {
+			if tooLarge {
+				return nil, errWSTooLarge
+			}
+			return msg, nil
+		}
+	}
+}
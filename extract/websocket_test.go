@@ -0,0 +1,210 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// wsFrameBytes builds a WebSocket frame, masked if a key is given.
+func wsFrameBytes(fin bool, op byte, key []byte, payload []byte) []byte {
+	b := []byte{op, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] = byte(len(payload))
+	case len(payload) < 1<<16:
+		b[1] = 126
+		b = append(b, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(payload)))
+	default:
+		b[1] = 127
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[2:], uint64(len(payload)))
+	}
+	if key == nil {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	b = append(b, key...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+	return b
+}
+
+func TestReadWSMessage(t *testing.T) {
+	key := []byte{1, 2, 3, 4}
+	large := bytes.Repeat([]byte("x"), wsMaxMessage+1)
+	cat := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+
+	testCases := map[string]struct {
+		stream []byte
+		msgs   []string
+		err    error
+	}{
+		"unmasked": {
+			stream: wsFrameBytes(true, wsOpText, nil, []byte("one")),
+			msgs:   []string{"one"},
+			err:    io.EOF,
+		},
+		"masked": {
+			stream: wsFrameBytes(true, wsOpBinary, key, []byte("masked message")),
+			msgs:   []string{"masked message"},
+			err:    io.EOF,
+		},
+		"fragmented with control frames between": {
+			stream: cat(
+				wsFrameBytes(false, wsOpText, key, []byte("frag")),
+				wsFrameBytes(true, 0x9, key, []byte("ping")),
+				wsFrameBytes(false, wsOpContinuation, nil, []byte("men")),
+				wsFrameBytes(true, 0xa, nil, nil),
+				wsFrameBytes(true, wsOpContinuation, key, []byte("ted")),
+				wsFrameBytes(true, wsOpText, nil, []byte("next")),
+			),
+			msgs: []string{"fragmented", "next"},
+			err:  io.EOF,
+		},
+		"close ends the stream": {
+			stream: cat(
+				wsFrameBytes(true, wsOpText, nil, []byte("one")),
+				wsFrameBytes(true, wsOpClose, nil, []byte{0x03, 0xe8}),
+				wsFrameBytes(true, wsOpText, nil, []byte("two")),
+			),
+			msgs: []string{"one"},
+			err:  io.EOF,
+		},
+		"too large is skipped": {
+			stream: cat(
+				wsFrameBytes(false, wsOpBinary, nil, large[:100]),
+				wsFrameBytes(true, wsOpContinuation, key, large[100:]),
+				wsFrameBytes(true, wsOpText, nil, []byte("after")),
+			),
+			msgs: []string{"after"},
+			err:  io.EOF,
+		},
+		"continuation without a start": {
+			stream: wsFrameBytes(true, wsOpContinuation, nil, []byte("lost")),
+			err:    errWSFrame,
+		},
+		"new message before the last finished": {
+			stream: cat(
+				wsFrameBytes(false, wsOpText, nil, []byte("one")),
+				wsFrameBytes(true, wsOpText, nil, []byte("two")),
+			),
+			err: errWSFrame,
+		},
+		"fragmented control frame": {
+			stream: wsFrameBytes(false, 0x9, nil, []byte("ping")),
+			err:    errWSFrame,
+		},
+		"reserved opcode": {
+			stream: wsFrameBytes(true, 0x3, nil, []byte("what")),
+			err:    errWSFrame,
+		},
+		"truncated payload": {
+			stream: wsFrameBytes(true, wsOpText, key, []byte("truncated"))[:10],
+			err:    io.ErrUnexpectedEOF,
+		},
+		"truncated between fragments": {
+			stream: wsFrameBytes(false, wsOpText, nil, []byte("one")),
+			err:    io.ErrUnexpectedEOF,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			r := bytes.NewReader(tc.stream)
+			var msgs []string
+			var err error
+			for {
+				var msg []byte
+				msg, err = readWSMessage(r)
+				if err == errWSTooLarge {
+					continue
+				}
+				if err != nil {
+					break
+				}
+				msgs = append(msgs, string(msg))
+			}
+			is.Equal(msgs, tc.msgs)
+			is.Equal(err, tc.err)
+		})
+	}
+}
+
+func TestWSUpgrade(t *testing.T) {
+	testCases := map[string]struct {
+		stream   string
+		ws       bool
+		protocol string
+		sip      bool
+		rest     string
+	}{
+		"request": {
+			stream:   "GET /sip HTTP/1.1\r\nHost: gw\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: sip\r\n\r\nframes",
+			ws:       true,
+			protocol: "sip",
+			sip:      true,
+			rest:     "frames",
+		},
+		"response": {
+			stream:   "HTTP/1.1 101 Switching Protocols\r\nupgrade: WebSocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: sip\r\n\r\nframes",
+			ws:       true,
+			protocol: "sip",
+			sip:      true,
+			rest:     "frames",
+		},
+		"another subprotocol": {
+			stream:   "GET /chat HTTP/1.1\r\nHost: gw\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: chat, superchat\r\n\r\nframes",
+			ws:       true,
+			protocol: "chat, superchat",
+			rest:     "frames",
+		},
+		"offering sip among others": {
+			stream:   "GET /sip HTTP/1.1\r\nHost: gw\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: chat, SIP\r\n\r\nframes",
+			ws:       true,
+			protocol: "chat, SIP",
+			sip:      true,
+			rest:     "frames",
+		},
+		"refused": {
+			stream: "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n",
+		},
+		"plain http": {
+			stream: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		"sip is left unread": {
+			stream: "INVITE sip:bob@example.com SIP/2.0\r\n\r\n",
+			rest:   "INVITE sip:bob@example.com SIP/2.0\r\n\r\n",
+		},
+		"short is left unread": {
+			stream: "GET",
+			rest:   "GET",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			r := bufio.NewReader(strings.NewReader(tc.stream))
+			ws, protocol := wsUpgrade(r)
+			is.Equal(ws, tc.ws)
+			is.Equal(protocol, tc.protocol)
+			is.Equal(wsSIP(protocol), tc.sip)
+			if tc.rest != "" {
+				rest, err := ioutil.ReadAll(r)
+				is.NoErr(err)
+				is.Equal(string(rest), tc.rest)
+			}
+		})
+	}
+}
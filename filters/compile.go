@@ -2,14 +2,36 @@ package filters
 
 import (
 	"fmt"
+	"net"
 	"regexp"
 	"strings"
 
 	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/sdp"
 )
 
-// Filter is a function which decides if a SIP message should pass or fail.
-type Filter func(msg *layers.SIP) bool
+// Input is what a Filter decides on: a SIP message, how it was captured, and
+// the session description in its body, found and parsed at most once however
+// many filters look at it.  Meta may be nil if how isn't known.
+type Input struct {
+	SIP  *layers.SIP
+	Meta *capture.Meta
+	SDP  *sdp.Body
+}
+
+// NewInput returns the Input of a SIP message captured as described by meta.
+func NewInput(msg *layers.SIP, meta *capture.Meta) *Input {
+	return &Input{
+		SIP:  msg,
+		Meta: meta,
+		SDP:  sdp.NewBody(msg.GetFirstHeader("Content-Type"), msg.Payload()),
+	}
+}
+
+// Filter is a function which decides if a SIP message, given with how it was
+// captured, should pass or fail.
+type Filter func(in *Input) bool
 
 type filterBuilders map[string]func([]sexp) (Filter, error)
 
@@ -49,6 +71,18 @@ func (fb *filterBuilders) init() {
 		"from":      filterFrom,
 		"header":    filterHeader,
 		"body":      filterBody,
+		"sdp":       filterSDP,
+		"has-sdp":   filterHasSDP,
+		"codec":     filterCodec,
+		"media":     filterMedia,
+		"media-ip":  filterMediaIP,
+		"direction": filterDirection,
+		"src-ip":    filterSrcIP,
+		"dst-ip":    filterDstIP,
+		"src-port":  filterSrcPort,
+		"dst-port":  filterDstPort,
+		"transport": filterTransport,
+		"interface": filterInterface,
 		"message":   filterMessage,
 		"not":       filterNot,
 		"any":       filterAny,
@@ -102,3 +136,58 @@ func regexpString(a sexp) (*regexp.Regexp, error) {
 	}
 	return re, nil
 }
+
+// words returns the arguments of a function taking a list of names, which
+// may be strings or bare words.
+func words(name string, args []sexp) ([]string, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("%v needs 1 or more args: %w", name, ErrWrongArgCount)
+	}
+	list := make([]string, len(args))
+	for i, a := range args {
+		switch v := a.i.(type) {
+		case qString:
+			list[i] = string(v)
+		case string:
+			list[i] = v
+		default:
+			return nil, fmt.Errorf("%v arg %v: %w", name, a, ErrNeedString)
+		}
+	}
+	return list, nil
+}
+
+// networks parses arguments which are each an IP address or CIDR network.
+func networks(name string, args []sexp) ([]*net.IPNet, error) {
+	list, err := words(name, args)
+	if err != nil {
+		return nil, err
+	}
+	nets := make([]*net.IPNet, len(list))
+	for i, s := range list {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets[i] = n
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%v arg %q: %w", name, s, ErrNeedNetwork)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return nets, nil
+}
+
+// contains reports whether ip is within any of nets.
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
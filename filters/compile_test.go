@@ -3,11 +3,13 @@ package filters
 import (
 	"errors"
 	"io/ioutil"
+	"net"
 	"path/filepath"
 	"testing"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
 
 	"github.com/matryer/is"
 )
@@ -70,6 +72,21 @@ func TestSexpParseFailures(t *testing.T) {
 		"header - arg2 type":   {`(header "via" 100)`, ErrNeedString},
 		"message - wrong args": {`(message "[" "that")`, ErrWrongArgCount},
 		"message - bad regexp": {`(message "[")`, ErrBadRegexp},
+		"sdp - many args":      {`(sdp "a" "b")`, ErrWrongArgCount},
+		"sdp - wrong args":     {`(sdp 100)`, ErrNeedString},
+		"has-sdp - args":       {`(has-sdp "a")`, ErrWrongArgCount},
+		"codec - no args":      {`(codec)`, ErrWrongArgCount},
+		"codec - wrong args":   {`(codec 8)`, ErrNeedString},
+		"media - no args":      {`(media)`, ErrWrongArgCount},
+		"media-ip - bad net":   {`(media-ip "10.0.0.0/33")`, ErrNeedNetwork},
+		"media-ip - bad ip":    {`(media-ip gateway)`, ErrNeedNetwork},
+		"direction - bad":      {`(direction up)`, ErrDirectionType},
+		"src-ip - no args":     {`(src-ip)`, ErrWrongArgCount},
+		"dst-ip - bad net":     {`(dst-ip "10.0.0.0/")`, ErrNeedNetwork},
+		"src-port - string":    {`(src-port "5060")`, ErrNeedPort},
+		"dst-port - range":     {`(dst-port 65536)`, ErrNeedPort},
+		"transport - bad":      {`(transport udp quic)`, ErrTransportType},
+		"interface - int":      {`(interface 0)`, ErrNeedString},
 	}
 
 	for name, tc := range testCases {
@@ -88,44 +105,62 @@ func TestCompiler(t *testing.T) {
 
 	request := loadSIP(is, "invite-request.sip")
 	response := loadSIP(is, "invite-response.sip")
+	sipi := loadSIP(is, "invite-sip-i.sip")
 
 	testCases := map[string]struct {
 		src    string
 		msg    *layers.SIP
 		expect bool
 	}{
-		"empty":          {``, request, true},
-		"response pass":  {`response`, response, true},
-		"response fail":  {`response`, request, false},
-		"request pass":   {`request`, response, false},
-		"request fail":   {`request`, request, true},
-		"status pass":    {`(status 200)`, response, true},
-		"status fail":    {`(status 403)`, response, false},
-		"status many":    {`(status 100 180 200)`, response, true},
-		"status request": {`(status 200)`, request, false},
-		"body pass":      {`(body "(?i:world)")`, request, true},
-		"methods pass":   {`(methods invite)`, request, true},
-		"methods fail":   {`(methods options)`, request, false},
-		"methods many":   {`(methods options invite)`, request, true},
-		"methods quoted": {`(methods options "invite")`, request, true},
-		"hasheader pass": {`(hasheader "Via")`, request, true},
-		"hasheader fail": {`(hasheader "Not-There")`, request, false},
-		"to pass":        {`(to "alice")`, request, true},
-		"to fail":        {`(to "luigi")`, request, false},
-		"from pass":      {`(from "bob")`, request, true},
-		"from fail":      {`(from "luigi")`, request, false},
-		"header pass":    {`(header "Contact" "bob")`, request, true},
-		"header fail":    {`(header "Contact" "alice")`, request, false},
-		"message pass":   {`(message "@172.*6{2,3}")`, request, true},
-		"message fail":   {`(message "shazam")`, request, false},
-		"not pass":       {`(not request)`, response, true},
-		"not fail":       {`(not response)`, response, false},
-		"any left pass":  {`(any request (hasheader "magic"))`, request, true},
-		"any right pass": {`(any request (status 200))`, response, true},
-		"any both fail":  {`(any request (hasheader "magic"))`, response, false},
-		"all left fail":  {`(all response (status 200))`, request, false},
-		"all right fail": {`(all request (hasheader "magic"))`, request, false},
-		"all both pass":  {`(all response (status 200))`, response, true},
+		"empty":           {``, request, true},
+		"response pass":   {`response`, response, true},
+		"response fail":   {`response`, request, false},
+		"request pass":    {`request`, response, false},
+		"request fail":    {`request`, request, true},
+		"status pass":     {`(status 200)`, response, true},
+		"status fail":     {`(status 403)`, response, false},
+		"status many":     {`(status 100 180 200)`, response, true},
+		"status request":  {`(status 200)`, request, false},
+		"body pass":       {`(body "(?i:world)")`, request, true},
+		"methods pass":    {`(methods invite)`, request, true},
+		"methods fail":    {`(methods options)`, request, false},
+		"methods many":    {`(methods options invite)`, request, true},
+		"methods quoted":  {`(methods options "invite")`, request, true},
+		"hasheader pass":  {`(hasheader "Via")`, request, true},
+		"hasheader fail":  {`(hasheader "Not-There")`, request, false},
+		"to pass":         {`(to "alice")`, request, true},
+		"to fail":         {`(to "luigi")`, request, false},
+		"from pass":       {`(from "bob")`, request, true},
+		"from fail":       {`(from "luigi")`, request, false},
+		"header pass":     {`(header "Contact" "bob")`, request, true},
+		"header fail":     {`(header "Contact" "alice")`, request, false},
+		"sdp pass":        {`(sdp "m=audio 16384 ")`, sipi, true},
+		"sdp not isup":    {`(sdp "ISUP")`, sipi, false},
+		"sdp none":        {`(sdp "")`, request, false},
+		"has-sdp pass":    {`has-sdp`, sipi, true},
+		"has-sdp fail":    {`(has-sdp)`, request, false},
+		"codec pass":      {`(codec "PCMU" "G729")`, sipi, true},
+		"codec rtpmap":    {`(codec telephone-event)`, sipi, true},
+		"codec fail":      {`(codec "PCMA")`, sipi, false},
+		"codec none":      {`(codec "PCMU")`, request, false},
+		"media pass":      {`(media audio video)`, sipi, true},
+		"media fail":      {`(media image)`, sipi, false},
+		"media-ip pass":   {`(media-ip "10.0.0.0/8")`, sipi, true},
+		"media-ip media":  {`(media-ip "192.0.2.44")`, sipi, true},
+		"media-ip fail":   {`(media-ip "172.16.0.0/12" "2001:db8::/32")`, sipi, false},
+		"direction pass":  {`(direction sendonly)`, sipi, true},
+		"direction media": {`(direction "INACTIVE")`, sipi, true},
+		"direction fail":  {`(direction sendrecv recvonly)`, sipi, false},
+		"message pass":    {`(message "@172.*6{2,3}")`, request, true},
+		"message fail":    {`(message "shazam")`, request, false},
+		"not pass":        {`(not request)`, response, true},
+		"not fail":        {`(not response)`, response, false},
+		"any left pass":   {`(any request (hasheader "magic"))`, request, true},
+		"any right pass":  {`(any request (status 200))`, response, true},
+		"any both fail":   {`(any request (hasheader "magic"))`, response, false},
+		"all left fail":   {`(all response (status 200))`, request, false},
+		"all right fail":  {`(all request (hasheader "magic"))`, request, false},
+		"all both pass":   {`(all response (status 200))`, response, true},
 		"complex": {
 			`(all request
 				  (methods invite publish)
@@ -144,12 +179,61 @@ func TestCompiler(t *testing.T) {
 			filter, err := Compile(tc.src)
 			is.NoErr(err) // filter compiles
 			is.True(filter != nil)
-			allow := filter(tc.msg)
+			allow := filter(NewInput(tc.msg, nil))
 			is.Equal(allow, tc.expect) // filter did what it should
 		})
 	}
 }
 
+func TestNetworkFilters(t *testing.T) {
+	is := is.New(t)
+
+	request := loadSIP(is, "invite-request.sip")
+	meta := &capture.Meta{
+		SrcIP:     net.ParseIP("172.16.254.66"),
+		DstIP:     net.ParseIP("2001:db8::5"),
+		SrcPort:   5060,
+		DstPort:   5080,
+		Transport: capture.TLS,
+		Interface: "eth1",
+	}
+
+	testCases := map[string]struct {
+		src    string
+		meta   *capture.Meta
+		expect bool
+	}{
+		"src-ip pass":    {`(src-ip "172.16.0.0/12")`, meta, true},
+		"src-ip address": {`(src-ip "10.0.0.1" "172.16.254.66")`, meta, true},
+		"src-ip fail":    {`(src-ip "10.0.0.0/8")`, meta, false},
+		"dst-ip pass":    {`(dst-ip "2001:db8::/32")`, meta, true},
+		"dst-ip fail":    {`(dst-ip "172.16.0.0/12")`, meta, false},
+		"src-port pass":  {`(src-port 5060 5061)`, meta, true},
+		"src-port fail":  {`(src-port 5080)`, meta, false},
+		"dst-port pass":  {`(dst-port 5080)`, meta, true},
+		"dst-port fail":  {`(dst-port 5060)`, meta, false},
+		"transport pass": {`(transport udp "TLS")`, meta, true},
+		"transport fail": {`(transport udp tcp)`, meta, false},
+		"interface pass": {`(interface "eth0" eth1)`, meta, true},
+		"interface fail": {`(interface "eth0")`, meta, false},
+		"no meta":        {`(src-port 5060)`, nil, false},
+		"combined": {
+			`(all (methods invite) request (src-ip "172.16.0.0/12") (not (transport udp)))`,
+			meta,
+			true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			filter, err := Compile(tc.src)
+			is.NoErr(err) // filter compiles
+			is.Equal(filter(NewInput(request, tc.meta)), tc.expect)
+		})
+	}
+}
+
 func BenchmarkCompiler(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, err := Compile(`(all request
@@ -179,7 +263,7 @@ func BenchmarkComplexFilter(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		filter(msg)
+		filter(NewInput(msg, nil))
 	}
 }
 
@@ -192,6 +276,6 @@ func BenchmarkSimpleFilter(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		filter(msg)
+		filter(NewInput(msg, nil))
 	}
 }
@@ -2,8 +2,10 @@
 Package filters implements a SIP message matching filter s-expression DSL.
 
 The syntax of the DSL is an s-expressions, selecting which aspects of the SIP
-message to match against.   The input to the resulting Filter is in the form of
-github.com/google/gopacket *layers.SIP structs.
+message to match against.  The input to the resulting Filter is an Input
+holding a github.com/google/gopacket *layers.SIP struct, with the capture.Meta
+describing the addresses, ports, transport, and interface the message was
+captured with, and the session description in its body.
 
 The simplest filter is the empty string, which returns a Filter function that
 will match any possible *layers.SIP message.
@@ -16,6 +18,20 @@ The following SIP selection functions are available:
 	(hasheader s)	has any header with the given name
 	(header s re)	has the given header with a value that matches a regexp
 	(body re)		the body matches a regexp
+	(sdp re)		the body's session description matches a regexp
+	has-sdp		carries a session description
+	(codec s ...)	offers media with any of the codecs
+	(media s ...)	offers media of any of the types
+	(media-ip n ...)	offers media at an address in any of the networks
+	(direction s ...)	offers media with any of the directions
+
+The following network selection functions are available:
+	(src-ip n ...)	sent from an address in any of the networks
+	(dst-ip n ...)	sent to an address in any of the networks
+	(src-port n ...)	sent from any of the ports
+	(dst-port n ...)	sent to any of the ports
+	(transport s ...)	carried over any of the transports
+	(interface s ...)	captured on any of the interfaces
 	(message re)	anywhere in the whole message matches a regexp
 
 Additionally, the following three logic functions can be used to build
@@ -67,9 +83,62 @@ Function descriptions:
 	(body re) - Returns a match if the SIP message's body contains text matching the
 	regular expression argument.
 
+	(sdp re) - Returns a match if the SIP message carries an SDP session
+	description containing text matching the regular expression argument.  The
+	description may be the whole body, or one part of a multipart body, such
+	as the SDP alongside ISUP in SIP-I; other parts are not searched.
+
+	has-sdp - Returns a match if the SIP message carries an SDP session
+	description, found as with sdp, which can be parsed.
+
+The functions below look at the media of a parsed SDP session description,
+found as with sdp.  Media lines rejected with a zero port are ignored, and
+messages without a session description never match.
+
+	(codec s ...) - Returns a match if any media offers a codec with one of the
+	names given, such as "PCMU" or "G729".  Names are those of rtpmap
+	attributes, or of the static RTP payload types, and are case-insensitive.
+
+	(media s ...) - Returns a match if there is media of any of the types given,
+	such as audio, video, or image.
+
+	(media-ip n ...) - Returns a match if any media is to be sent to an address
+	within one of the given networks.  Each is a CIDR network, such as
+	"10.0.0.0/8", or a single IP address.  Media without its own connection
+	address uses the session's.
+
+	(direction s ...) - Returns a match if any media has one of the directions
+	given: sendrecv, sendonly, recvonly, or inactive.  Media without its own
+	direction attribute takes the session's, or else sendrecv.
+
 	(message re) - Returns a match if the SIP message's contains text matching the
 	regular expression argument anywhere in any header or the entire body.
 
+The functions below look at where the message was captured, rather than
+the message itself.
+
+	(src-ip n ...) - Returns a match if the message was sent from an address
+	within one of the given networks.  Each is a CIDR network, such as
+	"10.0.0.0/8", or a single IP address.  For messages carried over TCP,
+	TLS, SCTP, or WebSocket, the address is that of the packets carrying them.
+
+	(dst-ip n ...) - Returns a match if the message was sent to an address
+	within one of the given networks, as with src-ip.
+
+	(src-port n ...) - Returns a match if the message was sent from one of the
+	given ports, which must be integer numbers.
+
+	(dst-port n ...) - Returns a match if the message was sent to one of the
+	given ports, which must be integer numbers.
+
+	(transport s ...) - Returns a match if the message was carried over one of
+	the given transports: udp, tcp, sctp, tls, ws, or wss.  Names are
+	case-insensitive.
+
+	(interface s ...) - Returns a match if the message was captured on one of
+	the named interfaces.  Messages read from a capture file have no
+	interface.
+
 	(all f ...) - Returns a match if each and every one of the given functions
 	evaluate to a match.  The arguments must be a list of 1 or more other
 	functions.
@@ -117,6 +186,17 @@ Match any requests or accepted responses to Invites or terminations for calls
 destined to alice@provider.com.  This is the sort of rule that could be used to
 log VoIP usage for Alice for billing or support purposes.
 
+	(all (method invite)
+	     (codec "G729")
+	     (not (media-ip "10.0.0.0/8" "192.168.0.0/16")))
+
+Matches any Invite, or response to one, offering G.729 with media to be sent
+outside of the private networks.
+
+	(all (method invite) request (src-ip "198.51.100.0/24"))
+
+Matches any Invite request sent from a carrier's subnet.
+
 	(all request
 	     (method invite publish)
 		 (not (body "don't capture"))
@@ -19,6 +19,18 @@ const (
 	// ErrMethodsType indicates the methods function received a non-sip method
 	// name
 	ErrMethodsType = constErr("methods takes a list of sip method names")
+	// ErrDirectionType indicates the direction function received something
+	// other than an SDP media direction.
+	ErrDirectionType = constErr("direction takes sendrecv, sendonly, recvonly, or inactive")
+	// ErrNeedNetwork indicates a function got an argument which is neither
+	// an IP address nor a CIDR network.
+	ErrNeedNetwork = constErr("not an IP address or CIDR network")
+	// ErrNeedPort indicates a function got an argument which isn't a port
+	// number.
+	ErrNeedPort = constErr("not a port number")
+	// ErrTransportType indicates the transport function received something
+	// other than the name of a transport SIP is captured over.
+	ErrTransportType = constErr("transport takes udp, tcp, sctp, tls, ws, or wss")
 	// ErrWrongArgCount indicates the function received too few or too many
 	// args.
 	ErrWrongArgCount = constErr("wrong number of args")
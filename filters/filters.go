@@ -11,8 +11,8 @@ func filterRequest(args []sexp) (Filter, error) {
 	if len(args) != 0 {
 		return nil, fmt.Errorf("request takes no args, got %v: %w", args, ErrWrongArgCount)
 	}
-	return func(msg *layers.SIP) bool {
-		return !msg.IsResponse
+	return func(in *Input) bool {
+		return !in.SIP.IsResponse
 	}, nil
 }
 
@@ -21,8 +21,8 @@ func filterResponse(args []sexp) (Filter, error) {
 	if len(args) != 0 {
 		return nil, fmt.Errorf("response takes no args, got %v: %w", args, ErrWrongArgCount)
 	}
-	return func(msg *layers.SIP) bool {
-		return msg.IsResponse
+	return func(in *Input) bool {
+		return in.SIP.IsResponse
 	}, nil
 }
 
@@ -50,9 +50,9 @@ func filterMethods(args []sexp) (Filter, error) {
 		methods[i] = method
 	}
 
-	return func(msg *layers.SIP) bool {
+	return func(in *Input) bool {
 		for _, m := range methods {
-			if msg.Method == m {
+			if in.SIP.Method == m {
 				return true
 			}
 		}
@@ -77,12 +77,12 @@ func filterStatus(args []sexp) (Filter, error) {
 		}
 	}
 
-	return func(msg *layers.SIP) bool {
-		if !msg.IsResponse {
+	return func(in *Input) bool {
+		if !in.SIP.IsResponse {
 			return false
 		}
 		for _, c := range codes {
-			if msg.ResponseCode == c {
+			if in.SIP.ResponseCode == c {
 				return true
 			}
 		}
@@ -100,9 +100,9 @@ func filterHasHeader(args []sexp) (Filter, error) {
 		return nil, fmt.Errorf("hasheaders: %w", ErrNeedString)
 	}
 	field := string(h)
-	return func(msg *layers.SIP) bool {
+	return func(in *Input) bool {
 		// Don't care what the value is, just that it's not empty.
-		return msg.GetFirstHeader(field) != ""
+		return in.SIP.GetFirstHeader(field) != ""
 	}, nil
 }
 
@@ -121,8 +121,8 @@ func filterHeader(args []sexp) (Filter, error) {
 		return nil, fmt.Errorf("compiling header regexp: %w", err)
 	}
 	field := string(h)
-	return func(msg *layers.SIP) bool {
-		for _, h := range msg.GetHeader(field) {
+	return func(in *Input) bool {
+		for _, h := range in.SIP.GetHeader(field) {
 			if re.MatchString(h) {
 				return true
 			}
@@ -141,8 +141,8 @@ func filterTo(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("compiling to regexp: %w", err)
 	}
-	return func(msg *layers.SIP) bool {
-		return re.MatchString(msg.GetTo())
+	return func(in *Input) bool {
+		return re.MatchString(in.SIP.GetTo())
 	}, nil
 }
 
@@ -156,8 +156,8 @@ func filterFrom(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("compiling from regexp: %w", err)
 	}
-	return func(msg *layers.SIP) bool {
-		return re.MatchString(msg.GetFrom())
+	return func(in *Input) bool {
+		return re.MatchString(in.SIP.GetFrom())
 	}, nil
 }
 
@@ -170,8 +170,8 @@ func filterMessage(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("compiling regexp %v in message: %w", args[0].i, err)
 	}
-	return func(msg *layers.SIP) bool {
-		return re.Match(msg.LayerContents()) || re.Match(msg.Payload())
+	return func(in *Input) bool {
+		return re.Match(in.SIP.LayerContents()) || re.Match(in.SIP.Payload())
 	}, nil
 }
 
@@ -185,8 +185,8 @@ func filterBody(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("compiling regexp %v in body: %w", args[0].i, err)
 	}
-	return func(msg *layers.SIP) bool {
-		return re.Match(msg.Payload())
+	return func(in *Input) bool {
+		return re.Match(in.SIP.Payload())
 	}, nil
 }
 
@@ -199,8 +199,8 @@ func filterNot(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("compiling not filter: %w", err)
 	}
-	return func(msg *layers.SIP) bool {
-		return !f(msg)
+	return func(in *Input) bool {
+		return !f(in)
 	}, nil
 }
 
@@ -226,9 +226,9 @@ func filterAny(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, err
 	}
-	return func(msg *layers.SIP) bool {
+	return func(in *Input) bool {
 		for _, f := range filters {
-			if f(msg) {
+			if f(in) {
 				return true
 			}
 		}
@@ -242,9 +242,9 @@ func filterAll(args []sexp) (Filter, error) {
 	if err != nil {
 		return nil, err
 	}
-	return func(msg *layers.SIP) bool {
+	return func(in *Input) bool {
 		for _, f := range filters {
-			if !f(msg) {
+			if !f(in) {
 				return false
 			}
 		}
@@ -253,6 +253,6 @@ func filterAll(args []sexp) (Filter, error) {
 }
 
 // a filter function which always passes (used if filter source is empty).
-func passFunc(*layers.SIP) bool {
+func passFunc(*Input) bool {
 	return true
 }
@@ -0,0 +1,127 @@
+package filters
+
+import (
+	"fmt"
+
+	"github.com/nextcaller/sip-capture/capture"
+)
+
+// transports are the names the transport function accepts.
+var transports = []string{capture.UDP, capture.TCP, capture.SCTP, capture.TLS, capture.WS, capture.WSS}
+
+// ports parses arguments which are each a port number.
+func ports(name string, args []sexp) ([]uint16, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("%v needs 1 or more args: %w", name, ErrWrongArgCount)
+	}
+	list := make([]uint16, len(args))
+	for i, a := range args {
+		n, ok := a.i.(int)
+		if !ok || n < 0 || n > 65535 {
+			return nil, fmt.Errorf("%v arg %v: %w", name, a, ErrNeedPort)
+		}
+		list[i] = uint16(n)
+	}
+	return list, nil
+}
+
+// create a filter that's true if the message was sent from an address within
+// one of the networks in the arguments.
+func filterSrcIP(args []sexp) (Filter, error) {
+	nets, err := networks("src-ip", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		return in.Meta != nil && contains(nets, in.Meta.SrcIP)
+	}, nil
+}
+
+// create a filter that's true if the message was sent to an address within
+// one of the networks in the arguments.
+func filterDstIP(args []sexp) (Filter, error) {
+	nets, err := networks("dst-ip", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		return in.Meta != nil && contains(nets, in.Meta.DstIP)
+	}, nil
+}
+
+// create a filter that's true if the message was sent from one of the ports
+// in the arguments.
+func filterSrcPort(args []sexp) (Filter, error) {
+	list, err := ports("src-port", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		if in.Meta == nil {
+			return false
+		}
+		for _, p := range list {
+			if in.Meta.SrcPort == p {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// create a filter that's true if the message was sent to one of the ports in
+// the arguments.
+func filterDstPort(args []sexp) (Filter, error) {
+	list, err := ports("dst-port", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		if in.Meta == nil {
+			return false
+		}
+		for _, p := range list {
+			if in.Meta.DstPort == p {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// create a filter that's true if the message was carried over one of the
+// transports in the arguments.
+func filterTransport(args []sexp) (Filter, error) {
+	list, err := words("transport", args)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		if !containsFold(transports, t) {
+			return nil, fmt.Errorf("bad argument %v: %w", t, ErrTransportType)
+		}
+	}
+	return func(in *Input) bool {
+		return in.Meta != nil && containsFold(list, in.Meta.Transport)
+	}, nil
+}
+
+// create a filter that's true if the message was captured on one of the
+// interfaces named in the arguments.
+func filterInterface(args []sexp) (Filter, error) {
+	list, err := words("interface", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		if in.Meta == nil {
+			return false
+		}
+		for _, name := range list {
+			if in.Meta.Interface == name {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,141 @@
+package filters
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nextcaller/sip-capture/sdp"
+)
+
+// sdpMedia returns the media of the message's session description which
+// weren't rejected with a zero port.  It returns nil if there's no session
+// description, or it can't be parsed.
+func sdpMedia(in *Input) []sdp.Media {
+	s, err := in.SDP.Session()
+	if s == nil || err != nil {
+		return nil
+	}
+	media := make([]sdp.Media, 0, len(s.Media))
+	for _, m := range s.Media {
+		if m.Port != 0 {
+			media = append(media, m)
+		}
+	}
+	return media
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// create a filter that's true if the message carries a session description
+// that matches the regexp.
+func filterSDP(args []sexp) (Filter, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("sdp [%v]: %w", args, ErrWrongArgCount)
+	}
+	re, err := regexpString(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("compiling regexp %v in sdp: %w", args[0].i, err)
+	}
+	return func(in *Input) bool {
+		b := in.SDP.Raw()
+		return b != nil && re.Match(b)
+	}, nil
+}
+
+// create a filter that's true if the message carries a session description
+// which can be parsed.
+func filterHasSDP(args []sexp) (Filter, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("has-sdp takes no args, got %v: %w", args, ErrWrongArgCount)
+	}
+	return func(in *Input) bool {
+		s, err := in.SDP.Session()
+		return s != nil && err == nil
+	}, nil
+}
+
+// create a filter that's true if any media in the session description offers
+// one of the codecs named in the arguments.
+func filterCodec(args []sexp) (Filter, error) {
+	names, err := words("codec", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		for _, m := range sdpMedia(in) {
+			for _, c := range m.Codecs {
+				if containsFold(names, c.Name) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// create a filter that's true if the session description has media of one of
+// the types in the arguments.
+func filterMedia(args []sexp) (Filter, error) {
+	types, err := words("media", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		for _, m := range sdpMedia(in) {
+			if containsFold(types, m.Type) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// create a filter that's true if any media in the session description is to
+// be sent to an address within one of the networks in the arguments.
+func filterMediaIP(args []sexp) (Filter, error) {
+	nets, err := networks("media-ip", args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in *Input) bool {
+		for _, m := range sdpMedia(in) {
+			if m.Connection == nil {
+				continue
+			}
+			if ip := net.ParseIP(m.Connection.Address); ip != nil && contains(nets, ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// create a filter that's true if any media in the session description has
+// one of the directions in the arguments.
+func filterDirection(args []sexp) (Filter, error) {
+	dirs, err := words("direction", args)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !containsFold([]string{"sendrecv", "sendonly", "recvonly", "inactive"}, d) {
+			return nil, fmt.Errorf("bad argument %v: %w", d, ErrDirectionType)
+		}
+	}
+	return func(in *Input) bool {
+		for _, m := range sdpMedia(in) {
+			if containsFold(dirs, m.Direction) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
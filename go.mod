@@ -3,14 +3,18 @@ module github.com/nextcaller/sip-capture
 go 1.13
 
 require (
+	github.com/Shopify/sarama v1.27.2
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/google/gopacket v1.1.18-0.20200612154125-403ca653c45d
 	github.com/matryer/is v1.3.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/povilasv/prommod v0.0.12
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.10.0
 	github.com/rs/zerolog v1.19.0
-	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae // indirect
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	google.golang.org/protobuf v1.25.0 // indirect
 )
 
@@ -0,0 +1,357 @@
+// Package hep decodes and encodes the Homer Encapsulation Protocol (HEP, also
+// called EEP), which HOMER and many SIP servers such as Kamailio and OpenSIPS
+// use to mirror the signalling they handle to a capture server.
+//
+// Versions 1 and 2 are fixed headers followed by the payload, and are only
+// sent as UDP datagrams.  Version 3 is a series of typed chunks, preceded by a
+// total length so that it can also be streamed over TCP.
+package hep
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// HEP protocol types of payloads.
+const (
+	// ProtoSIP is the HEP protocol type of SIP payloads.
+	ProtoSIP = 1
+	// ProtoLog is the HEP protocol type of JSON logs, which HOMER shows
+	// alongside the SIP messages with the same correlation ID.
+	ProtoLog = 100
+)
+
+// address families used in HEP headers, as numbered by Linux.
+const (
+	familyIPv4 = 2
+	familyIPv6 = 10
+)
+
+// HEPv3 generic chunk types.
+const (
+	chunkFamily        = 1
+	chunkProtocol      = 2
+	chunkIPv4Src       = 3
+	chunkIPv4Dst       = 4
+	chunkIPv6Src       = 5
+	chunkIPv6Dst       = 6
+	chunkSrcPort       = 7
+	chunkDstPort       = 8
+	chunkTimeSec       = 9
+	chunkTimeUsec      = 10
+	chunkProtoType     = 11
+	chunkNodeID        = 12
+	chunkAuthKey       = 14
+	chunkPayload       = 15
+	chunkCorrelationID = 17
+	chunkNodeName      = 19
+)
+
+var (
+	// ErrVersion is returned for data which is not a HEP packet.
+	ErrVersion = errors.New("hep: unknown version")
+	// ErrTruncated is returned if a packet or chunk is shorter than its
+	// headers say.
+	ErrTruncated = errors.New("hep: truncated packet")
+	// ErrFamily is returned for addresses which are neither IPv4 nor IPv6.
+	ErrFamily = errors.New("hep: unknown address family")
+	// ErrNoPayload is returned for a packet without a captured payload.
+	ErrNoPayload = errors.New("hep: no payload")
+	// ErrTooLarge is returned by Encode for packets which don't fit in the
+	// 16 bit HEPv3 length.
+	ErrTooLarge = errors.New("hep: packet too large")
+)
+
+// hep3Magic begins every HEPv3 packet.
+var hep3Magic = []byte("HEP3")
+
+// Packet is a decoded HEP packet: a captured payload along with the
+// addressing and time it was captured with.
+type Packet struct {
+	Version int
+	// Protocol is the transport the payload was carried over, usually UDP
+	// or TCP.
+	Protocol layers.IPProtocol
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	// Timestamp is the capture time, or the zero time if the sender didn't
+	// include one (as in HEPv1).
+	Timestamp time.Time
+	// ProtoType is the type of the payload, such as ProtoSIP.
+	ProtoType     uint8
+	NodeID        uint32
+	NodeName      string
+	AuthKey       string
+	CorrelationID string
+	Payload       []byte
+}
+
+// Decode decodes a HEP packet of any version.  The packet doesn't refer to
+// data once it is returned.
+func Decode(data []byte) (*Packet, error) {
+	if len(data) >= len(hep3Magic) && string(data[:len(hep3Magic)]) == string(hep3Magic) {
+		return decode3(data)
+	}
+	if len(data) > 0 && (data[0] == 1 || data[0] == 2) {
+		return decode12(data)
+	}
+	return nil, ErrVersion
+}
+
+// decode12 decodes the fixed headers of HEPv1 and HEPv2.  Ports are in
+// network byte order, but the HEPv2 time header is little endian.
+func decode12(data []byte) (*Packet, error) {
+	if len(data) < 8 {
+		return nil, ErrTruncated
+	}
+	p := &Packet{
+		Version:   int(data[0]),
+		Protocol:  layers.IPProtocol(data[3]),
+		SrcPort:   binary.BigEndian.Uint16(data[4:]),
+		DstPort:   binary.BigEndian.Uint16(data[6:]),
+		ProtoType: ProtoSIP,
+	}
+
+	var size int
+	switch data[2] {
+	case familyIPv4:
+		size = net.IPv4len
+	case familyIPv6:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("%w %d", ErrFamily, data[2])
+	}
+	off := 8 + 2*size
+	if len(data) < off {
+		return nil, ErrTruncated
+	}
+	p.SrcIP = copyIP(data[8 : 8+size])
+	p.DstIP = copyIP(data[8+size : off])
+
+	if p.Version == 2 {
+		if len(data) < off+10 {
+			return nil, ErrTruncated
+		}
+		sec := binary.LittleEndian.Uint32(data[off:])
+		usec := binary.LittleEndian.Uint32(data[off+4:])
+		p.Timestamp = time.Unix(int64(sec), int64(usec)*1000)
+		p.NodeID = uint32(binary.LittleEndian.Uint16(data[off+8:]))
+		off += 10
+	}
+
+	if len(data) == off {
+		return nil, ErrNoPayload
+	}
+	p.Payload = append([]byte(nil), data[off:]...)
+	return p, nil
+}
+
+// decode3 decodes the chunks of a HEPv3 packet.  Chunks of other vendors,
+// and generic chunks it doesn't know, are skipped.
+func decode3(data []byte) (*Packet, error) {
+	if len(data) < 6 {
+		return nil, ErrTruncated
+	}
+	total := int(binary.BigEndian.Uint16(data[4:]))
+	if total < 6 || len(data) < total {
+		return nil, ErrTruncated
+	}
+	data = data[:total]
+
+	p := &Packet{Version: 3}
+	var sec, usec uint32
+	var haveTime bool
+	for off := 6; off < len(data); {
+		if len(data)-off < 6 {
+			return nil, ErrTruncated
+		}
+		vendor := binary.BigEndian.Uint16(data[off:])
+		typ := binary.BigEndian.Uint16(data[off+2:])
+		size := int(binary.BigEndian.Uint16(data[off+4:]))
+		if size < 6 || off+size > len(data) {
+			return nil, ErrTruncated
+		}
+		body := data[off+6 : off+size]
+		off += size
+		if vendor != 0 {
+			continue
+		}
+
+		var err error
+		switch typ {
+		case chunkFamily:
+			// implied by the address chunks present
+			err = wantLen(body, 1)
+		case chunkProtocol:
+			if err = wantLen(body, 1); err == nil {
+				p.Protocol = layers.IPProtocol(body[0])
+			}
+		case chunkIPv4Src:
+			if err = wantLen(body, net.IPv4len); err == nil {
+				p.SrcIP = copyIP(body)
+			}
+		case chunkIPv4Dst:
+			if err = wantLen(body, net.IPv4len); err == nil {
+				p.DstIP = copyIP(body)
+			}
+		case chunkIPv6Src:
+			if err = wantLen(body, net.IPv6len); err == nil {
+				p.SrcIP = copyIP(body)
+			}
+		case chunkIPv6Dst:
+			if err = wantLen(body, net.IPv6len); err == nil {
+				p.DstIP = copyIP(body)
+			}
+		case chunkSrcPort:
+			if err = wantLen(body, 2); err == nil {
+				p.SrcPort = binary.BigEndian.Uint16(body)
+			}
+		case chunkDstPort:
+			if err = wantLen(body, 2); err == nil {
+				p.DstPort = binary.BigEndian.Uint16(body)
+			}
+		case chunkTimeSec:
+			if err = wantLen(body, 4); err == nil {
+				sec, haveTime = binary.BigEndian.Uint32(body), true
+			}
+		case chunkTimeUsec:
+			if err = wantLen(body, 4); err == nil {
+				usec = binary.BigEndian.Uint32(body)
+			}
+		case chunkProtoType:
+			if err = wantLen(body, 1); err == nil {
+				p.ProtoType = body[0]
+			}
+		case chunkNodeID:
+			if err = wantLen(body, 4); err == nil {
+				p.NodeID = binary.BigEndian.Uint32(body)
+			}
+		case chunkAuthKey:
+			p.AuthKey = string(body)
+		case chunkPayload:
+			p.Payload = append([]byte(nil), body...)
+		case chunkCorrelationID:
+			p.CorrelationID = string(body)
+		case chunkNodeName:
+			p.NodeName = string(body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", typ, err)
+		}
+	}
+
+	if haveTime {
+		p.Timestamp = time.Unix(int64(sec), int64(usec)*1000)
+	}
+	if len(p.Payload) == 0 {
+		return nil, ErrNoPayload
+	}
+	return p, nil
+}
+
+// Read reads and decodes the next HEPv3 packet from a stream, such as a TCP
+// connection.  Earlier versions have no length, so can't be read from a
+// stream.  If the stream doesn't hold a HEPv3 packet, it can't be
+// resynchronized, so the error should end it.
+func Read(r *bufio.Reader) (*Packet, error) {
+	hdr, err := r.Peek(6)
+	if err != nil {
+		if err == io.EOF && r.Buffered() > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if string(hdr[:len(hep3Magic)]) != string(hep3Magic) {
+		return nil, ErrVersion
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[4:]))
+	if len(data) < 6 {
+		return nil, ErrTruncated
+	}
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return decode3(data)
+}
+
+// Encode encodes p as HEPv3, whatever its Version.  Addresses are encoded as
+// IPv4 if both are IPv4, or else as IPv6; a missing address is unspecified.
+// Empty strings and a zero NodeID are left out.
+func Encode(p *Packet) ([]byte, error) {
+	b := append(make([]byte, 0, 128+len(p.Payload)), hep3Magic...)
+	b = append(b, 0, 0)
+	chunk := func(typ uint16, body ...byte) {
+		var hdr [6]byte
+		binary.BigEndian.PutUint16(hdr[2:], typ)
+		binary.BigEndian.PutUint16(hdr[4:], uint16(len(hdr)+len(body)))
+		b = append(append(b, hdr[:]...), body...)
+	}
+	u16 := func(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	u32 := func(v uint32) []byte { return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+
+	src, dst := p.SrcIP, p.DstIP
+	if src == nil {
+		src = net.IPv4zero
+	}
+	if dst == nil {
+		dst = net.IPv4zero
+	}
+	if src.To4() != nil && dst.To4() != nil {
+		chunk(chunkFamily, familyIPv4)
+		chunk(chunkProtocol, byte(p.Protocol))
+		chunk(chunkIPv4Src, src.To4()...)
+		chunk(chunkIPv4Dst, dst.To4()...)
+	} else {
+		chunk(chunkFamily, familyIPv6)
+		chunk(chunkProtocol, byte(p.Protocol))
+		chunk(chunkIPv6Src, src.To16()...)
+		chunk(chunkIPv6Dst, dst.To16()...)
+	}
+	chunk(chunkSrcPort, u16(p.SrcPort)...)
+	chunk(chunkDstPort, u16(p.DstPort)...)
+	chunk(chunkTimeSec, u32(uint32(p.Timestamp.Unix()))...)
+	chunk(chunkTimeUsec, u32(uint32(p.Timestamp.Nanosecond()/1000))...)
+	chunk(chunkProtoType, p.ProtoType)
+	if p.NodeID != 0 {
+		chunk(chunkNodeID, u32(p.NodeID)...)
+	}
+	if p.AuthKey != "" {
+		chunk(chunkAuthKey, []byte(p.AuthKey)...)
+	}
+	if p.CorrelationID != "" {
+		chunk(chunkCorrelationID, []byte(p.CorrelationID)...)
+	}
+	if p.NodeName != "" {
+		chunk(chunkNodeName, []byte(p.NodeName)...)
+	}
+	chunk(chunkPayload, p.Payload...)
+
+	if len(b) > 0xffff {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, len(b))
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	return b, nil
+}
+
+func wantLen(body []byte, n int) error {
+	if len(body) != n {
+		return fmt.Errorf("%w: %d bytes, not %d", ErrTruncated, len(body), n)
+	}
+	return nil
+}
+
+func copyIP(b []byte) net.IP {
+	return append(net.IP(nil), b...)
+}
@@ -0,0 +1,201 @@
+package hep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+)
+
+const invite = "INVITE sip:bob@example.com SIP/2.0\r\nContent-Length: 0\r\n\r\n"
+
+func chunk(typ uint16, body []byte) []byte {
+	b := make([]byte, 6, 6+len(body))
+	binary.BigEndian.PutUint16(b[2:], typ)
+	binary.BigEndian.PutUint16(b[4:], uint16(6+len(body)))
+	return append(b, body...)
+}
+
+func u16(v uint16) []byte { b := make([]byte, 2); binary.BigEndian.PutUint16(b, v); return b }
+func u32(v uint32) []byte { b := make([]byte, 4); binary.BigEndian.PutUint32(b, v); return b }
+
+func hep3(chunks ...[]byte) []byte {
+	b := append([]byte("HEP3"), 0, 0)
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	return b
+}
+
+func sipHEP3() []byte {
+	return hep3(
+		chunk(chunkFamily, []byte{familyIPv6}),
+		chunk(chunkProtocol, []byte{byte(layers.IPProtocolTCP)}),
+		chunk(chunkIPv6Src, net.ParseIP("2001:db8::1")),
+		chunk(chunkIPv6Dst, net.ParseIP("2001:db8::2")),
+		chunk(chunkSrcPort, u16(5061)),
+		chunk(chunkDstPort, u16(5060)),
+		chunk(chunkTimeSec, u32(1591000000)),
+		chunk(chunkTimeUsec, u32(250000)),
+		chunk(chunkProtoType, []byte{ProtoSIP}),
+		chunk(chunkNodeID, u32(2001)),
+		chunk(chunkAuthKey, []byte("secret")),
+		chunk(chunkCorrelationID, []byte("abc@host")),
+		chunk(chunkNodeName, []byte("sbc-1")),
+		// vendor specific chunks are skipped
+		append([]byte{0, 9}, chunk(chunkPayload, []byte("ignored"))[2:]...),
+		chunk(chunkPayload, []byte(invite)),
+	)
+}
+
+func TestDecode3(t *testing.T) {
+	is := is.New(t)
+
+	p, err := Decode(sipHEP3())
+	is.NoErr(err)
+	is.Equal(p.Version, 3)
+	is.Equal(p.Protocol, layers.IPProtocolTCP)
+	is.True(p.SrcIP.Equal(net.ParseIP("2001:db8::1")))
+	is.True(p.DstIP.Equal(net.ParseIP("2001:db8::2")))
+	is.Equal(p.SrcPort, uint16(5061))
+	is.Equal(p.DstPort, uint16(5060))
+	is.True(p.Timestamp.Equal(time.Unix(1591000000, 250000000)))
+	is.Equal(p.ProtoType, uint8(ProtoSIP))
+	is.Equal(p.NodeID, uint32(2001))
+	is.Equal(p.AuthKey, "secret")
+	is.Equal(p.CorrelationID, "abc@host")
+	is.Equal(p.NodeName, "sbc-1")
+	is.Equal(string(p.Payload), invite)
+}
+
+func TestDecode2(t *testing.T) {
+	is := is.New(t)
+
+	b := []byte{2, 16, familyIPv4, byte(layers.IPProtocolUDP), 0x13, 0xc4, 0x13, 0xc5}
+	b = append(b, net.IPv4(10, 0, 0, 1).To4()...)
+	b = append(b, net.IPv4(10, 0, 0, 2).To4()...)
+	tm := make([]byte, 10)
+	binary.LittleEndian.PutUint32(tm, 1591000000)
+	binary.LittleEndian.PutUint32(tm[4:], 1000)
+	binary.LittleEndian.PutUint16(tm[8:], 7)
+	b = append(b, tm...)
+	b = append(b, invite...)
+
+	p, err := Decode(b)
+	is.NoErr(err)
+	is.Equal(p.Version, 2)
+	is.Equal(p.Protocol, layers.IPProtocolUDP)
+	is.True(p.SrcIP.Equal(net.IPv4(10, 0, 0, 1)))
+	is.True(p.DstIP.Equal(net.IPv4(10, 0, 0, 2)))
+	is.Equal(p.SrcPort, uint16(5060))
+	is.Equal(p.DstPort, uint16(5061))
+	is.True(p.Timestamp.Equal(time.Unix(1591000000, 1000000)))
+	is.Equal(p.NodeID, uint32(7))
+	is.Equal(p.ProtoType, uint8(ProtoSIP))
+	is.Equal(string(p.Payload), invite)
+
+	// version 1 has no time header
+	b = append([]byte{1}, b[1:16]...)
+	b = append(b, invite...)
+	p, err = Decode(b)
+	is.NoErr(err)
+	is.Equal(p.Version, 1)
+	is.True(p.Timestamp.IsZero())
+	is.Equal(string(p.Payload), invite)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	good := sipHEP3()
+	long := hep3(chunk(chunkPayload, []byte(invite)))
+	long = long[:len(long)-1]
+	binary.BigEndian.PutUint16(long[4:], uint16(len(long)+1))
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrVersion},
+		{"not hep", []byte(invite), ErrVersion},
+		{"short v3", good[:5], ErrTruncated},
+		{"v3 shorter than length", good[:len(good)-1], ErrTruncated},
+		{"chunk past end", long, ErrTruncated},
+		{"bad port chunk", hep3(chunk(chunkSrcPort, []byte{1}), chunk(chunkPayload, []byte(invite))), ErrTruncated},
+		{"no payload", hep3(chunk(chunkSrcPort, u16(5060))), ErrNoPayload},
+		{"short v2", []byte{2, 16, familyIPv4, 17}, ErrTruncated},
+		{"bad family", []byte{2, 16, 99, 17, 0, 0, 0, 0}, ErrFamily},
+		{"v2 without time", []byte{2, 16, familyIPv4, 17, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}, ErrTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Decode() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	is := is.New(t)
+
+	one := sipHEP3()
+	r := bufio.NewReader(bytes.NewReader(append(append([]byte{}, one...), one...)))
+	for i := 0; i < 2; i++ {
+		p, err := Read(r)
+		is.NoErr(err)
+		is.Equal(string(p.Payload), invite)
+	}
+	_, err := Read(r)
+	is.Equal(err, io.EOF)
+
+	r = bufio.NewReader(bytes.NewReader(one[:len(one)-3]))
+	_, err = Read(r)
+	is.Equal(err, io.ErrUnexpectedEOF)
+
+	r = bufio.NewReader(bytes.NewReader([]byte(invite)))
+	_, err = Read(r)
+	is.Equal(err, ErrVersion)
+}
+
+func TestEncode(t *testing.T) {
+	is := is.New(t)
+
+	for _, ips := range [][2]string{{"10.0.0.1", "10.0.0.2"}, {"2001:db8::1", "2001:db8::2"}} {
+		want := &Packet{
+			Version:       3,
+			Protocol:      layers.IPProtocolUDP,
+			SrcIP:         net.ParseIP(ips[0]),
+			DstIP:         net.ParseIP(ips[1]),
+			SrcPort:       5060,
+			DstPort:       5062,
+			Timestamp:     time.Unix(1591000000, 123456000),
+			ProtoType:     ProtoSIP,
+			NodeID:        2001,
+			NodeName:      "sbc-1",
+			AuthKey:       "secret",
+			CorrelationID: "abc@host",
+			Payload:       []byte(invite),
+		}
+		b, err := Encode(want)
+		is.NoErr(err)
+		got, err := Decode(b)
+		is.NoErr(err)
+		is.True(got.SrcIP.Equal(want.SrcIP))
+		is.True(got.DstIP.Equal(want.DstIP))
+		is.True(got.Timestamp.Equal(want.Timestamp))
+		got.SrcIP, got.DstIP, got.Timestamp = want.SrcIP, want.DstIP, want.Timestamp
+		is.Equal(got, want) // round trips through Decode
+	}
+
+	_, err := Encode(&Packet{Payload: make([]byte, 0x10000)})
+	is.True(errors.Is(err, ErrTooLarge))
+}
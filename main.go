@@ -59,10 +59,21 @@ func run(args []string, stdout io.Writer) error {
 	zerolog.SetGlobalLevel(level)
 	log.Debug().Msg("debug logging active")
 
+	// a quit signal stops capturing, while publishing goes on until what was
+	// captured has been published; a second gives up on publishing too.
 	log.Debug().Msg("setting up signal handling")
-	signals := make(chan os.Signal, 1)
+	captureCtx, stopCapture := context.WithCancel(ctx)
+	defer stopCapture()
+	signals := make(chan os.Signal, 2)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
-	go func() { <-signals; log.Debug().Msg("received quit signal"); cancel() }()
+	go func() {
+		<-signals
+		log.Debug().Msg("received quit signal")
+		stopCapture()
+		<-signals
+		log.Debug().Msg("received second quit signal")
+		cancel()
+	}()
 
 	log.Debug().Msg("compiling SIP selection filter")
 	filter, err := filters.Compile(cfg.SIPFilter)
@@ -70,30 +81,49 @@ func run(args []string, stdout io.Writer) error {
 		return fmt.Errorf("unable to compile SIP filter: %w", err)
 	}
 
-	log.Debug().Msg("creating MQTT publisher")
-	publ := publisher.NewMQTT(cfg.MQTT)
+	log.Debug().Str("publisher", cfg.Publisher).Msg("creating publisher")
+	publ, err := publisher.New(cfg.Publisher, publisher.Options{MQTT: cfg.MQTT, HEP: cfg.HEP, Kafka: cfg.Kafka, NATS: cfg.NATS, HTTP: cfg.HTTP})
+	if err != nil {
+		return err
+	}
 	if err := publ.Connect(ctx); err != nil {
-		return fmt.Errorf("unable to connect to MQTT broker: %w", err)
+		return fmt.Errorf("unable to connect %s publisher: %w", cfg.Publisher, err)
 	}
 
 	log.Debug().Msg("building message collecter")
-	collecter := collect.NewCollecter(filter, publ.Publish, 10000)
-	go collecter.Publish(ctx)
-
-	log.Debug().Msg("initializing pcap source")
-	capture, err := source.NewPCAP(cfg.Interface, cfg.BPFFilter)
+	if cfg.CDR {
+		cfg.Collect.CDR = publ.PublishCDR
+	}
+	// a capture file can wait for messages to be published, rather than
+	// dropping them.
+	cfg.Collect.Block = cfg.ReadFile != ""
+	collecter := collect.NewCollecter(filter, publ.Publish, 10000, cfg.Collect)
+	published := make(chan struct{})
+	go func() { collecter.Publish(ctx); close(published) }()
+
+	var capture *source.ClosableSource
+	if cfg.ReadFile != "" {
+		log.Debug().Str("file", cfg.ReadFile).Msg("initializing capture file source")
+		capture, err = source.NewFile(cfg.ReadFile, cfg.BPFFilter)
+	} else if cfg.Capture == "hep" {
+		log.Debug().Strs("listen", cfg.HEPListen).Msg("initializing HEP source")
+		capture, err = source.NewHEP(cfg.HEPListen...)
+	} else {
+		capture, err = openInterfaces(ctx, cfg)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to initialize pcap source: %w", err)
+		return fmt.Errorf("unable to initialize capture source: %w", err)
 	}
 
 	log.Debug().Msg("launching source shutdown closer")
-	go func() { <-ctx.Done(); capture.Close() }()
+	go func() { <-captureCtx.Done(); capture.Close() }()
 
 	log.Debug().Msg("building packet defragmentation assembler")
-	defragger := defrag.NewIPv4Defragmenter()
+	defragger := defrag.NewDefragmenter()
 
 	log.Debug().Msg("building SIP packet message extracter")
-	extracter := extract.NewExtracter(defragger)
+	cfg.Extract.PacketClock = cfg.ReadFile != ""
+	extracter := extract.NewExtracter(defragger, cfg.Extract)
 
 	if cfg.MetricsAddr != "" {
 		log.Debug().Msg("creating Prometheus registry")
@@ -111,6 +141,7 @@ func run(args []string, stdout io.Writer) error {
 		reg.MustRegister(capture.Metrics()...)
 		reg.MustRegister(extracter.Metrics()...)
 		reg.MustRegister(collecter.Metrics()...)
+		reg.MustRegister(publ.Metrics()...)
 
 		log.Debug().
 			Str("address", cfg.MetricsAddr).
@@ -125,14 +156,55 @@ func run(args []string, stdout io.Writer) error {
 	}
 
 	log.Debug().Msg("beginning signaling capture")
-	extracter.Extract(ctx, capture.Packets(), collecter.Accept)
+	extracter.Extract(captureCtx, capture.Packets(), collecter.Accept)
+	if err := capture.Err(); err != nil {
+		log.Err(err).Msg("capture ended early")
+	}
 
+	// Extract only returns early for a live capture when shutting down, but a
+	// capture file ends on its own; either way let everything already queued
+	// be published before disconnecting.
+	collecter.Close()
+	<-published
 	publ.Close()
 	log.Info().Msg("shutdown complete.")
 
 	return nil
 }
 
+// openInterfaces starts a live capture on each configured interface, merged
+// into a single source.
+func openInterfaces(ctx context.Context, cfg *config) (*source.ClosableSource, error) {
+	log := zerolog.Ctx(ctx)
+	var srcs []*source.ClosableSource
+	for i, iface := range cfg.Interfaces {
+		var src *source.ClosableSource
+		var err error
+		if cfg.Capture == "afpacket" {
+			log.Debug().Str("interface", iface.Name).Msg("initializing AF_PACKET source")
+			opts := cfg.AFPacket
+			if opts.FanoutGroup != 0 {
+				// fanout groups are per socket family, not interface, so
+				// each interface needs a group of its own, taking
+				// consecutive ids, which config.Load checks fit.
+				opts.FanoutGroup += uint16(i)
+			}
+			src, err = source.NewAFPacket(iface.Name, iface.Filter, opts)
+		} else {
+			log.Debug().Str("interface", iface.Name).Msg("initializing pcap source")
+			src, err = source.NewPCAP(iface.Name, iface.Filter)
+		}
+		if err != nil {
+			for _, s := range srcs {
+				s.Close()
+			}
+			return nil, fmt.Errorf("interface %s: %w", iface.Name, err)
+		}
+		srcs = append(srcs, src)
+	}
+	return source.NewMerged(cfg.DedupWindow, srcs...), nil
+}
+
 func main() {
 	// these are stateful global module level changes; only do them in main
 	time.Local = time.UTC
@@ -0,0 +1,294 @@
+package pcapfilter
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/net/bpf"
+)
+
+// expr is an arithmetic expression: one of exprConst, exprLen, exprLoad,
+// exprBinary, or exprNeg.
+type expr interface{}
+
+type exprConst uint32
+type exprLen struct{}
+type exprLoad struct {
+	proto string
+	off   uint32
+	size  int
+}
+type exprBinary struct {
+	op   bpf.ALUOp
+	l, r expr
+}
+type exprNeg struct{ x expr }
+
+// scratchSlots is the number of memory words available to a BPF program.
+const scratchSlots = 16
+
+func (p *parser) parseArith() (expr, error) { return p.parseBinary(0) }
+
+func (p *parser) parseBinary(level int) (expr, error) {
+	if level == len(arithLevels) {
+		return p.parseUnary()
+	}
+	l, err := p.parseBinary(level + 1)
+	for err == nil {
+		op, ok := arithLevels[level][p.peek().text]
+		if !ok || p.peek().kind != tokOp {
+			break
+		}
+		p.next()
+		var r expr
+		if r, err = p.parseBinary(level + 1); err == errNotArith {
+			err = fmt.Errorf("expected arithmetic expression, found %v: %w", p.peek(), ErrSyntax)
+		}
+		l = exprBinary{op, l, r}
+	}
+	return l, err
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.peek().kind == tokOp && p.accept("-") {
+		x, err := p.parseUnary()
+		return exprNeg{x}, err
+	}
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (expr, error) {
+	t := p.peek()
+	if t.kind == tokOp && t.text == "(" {
+		p.next()
+		x, err := p.parseArith()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	if t.kind != tokWord {
+		return nil, errNotArith
+	}
+	if n, err := strconv.ParseUint(t.text, 0, 32); err == nil {
+		p.next()
+		return exprConst(n), nil
+	}
+	if n, ok := namedConsts[t.text]; ok {
+		p.next()
+		return exprConst(n), nil
+	}
+	if t.text == "len" {
+		p.next()
+		return exprLen{}, nil
+	}
+	if !loadProtos[t.text] || p.peekAt(1).text != "[" {
+		return nil, errNotArith
+	}
+
+	p.pos += 2
+	index, err := p.parseArith()
+	if err == errNotArith {
+		return nil, fmt.Errorf("%v[] needs an offset: %w", t.text, ErrSyntax)
+	}
+	if err != nil {
+		return nil, err
+	}
+	off, ok := constFold(index)
+	if !ok {
+		return nil, fmt.Errorf("%v[] with a variable offset: %w", t.text, ErrUnsupported)
+	}
+	size := uint32(1)
+	if p.accept(":") {
+		if size, err = p.number("size", 4); err != nil {
+			return nil, err
+		}
+		if size != 1 && size != 2 && size != 4 {
+			return nil, fmt.Errorf("size %d must be 1, 2, or 4: %w", size, ErrSyntax)
+		}
+	}
+	return exprLoad{proto: t.text, off: off, size: int(size)}, p.expect("]")
+}
+
+// constFold evaluates e if it does not depend on the packet.
+func constFold(e expr) (uint32, bool) {
+	switch v := e.(type) {
+	case exprConst:
+		return uint32(v), true
+	case exprNeg:
+		x, ok := constFold(v.x)
+		return -x, ok
+	case exprBinary:
+		l, lok := constFold(v.l)
+		r, rok := constFold(v.r)
+		if !lok || !rok {
+			return 0, false
+		}
+		switch v.op {
+		case bpf.ALUOpAdd:
+			return l + r, true
+		case bpf.ALUOpSub:
+			return l - r, true
+		case bpf.ALUOpMul:
+			return l * r, true
+		case bpf.ALUOpDiv:
+			return l / r, r != 0
+		case bpf.ALUOpMod:
+			return l % r, r != 0
+		case bpf.ALUOpAnd:
+			return l & r, true
+		case bpf.ALUOpOr:
+			return l | r, true
+		case bpf.ALUOpXor:
+			return l ^ r, true
+		case bpf.ALUOpShiftLeft:
+			return l << r, true
+		case bpf.ALUOpShiftRight:
+			return l >> r, true
+		}
+	}
+	return 0, false
+}
+
+// loads lists the protocols of the packet data e accesses.
+func loads(e expr, found map[string]bool) {
+	switch v := e.(type) {
+	case exprLoad:
+		found[v.proto] = true
+	case exprNeg:
+		loads(v.x, found)
+	case exprBinary:
+		loads(v.l, found)
+		loads(v.r, found)
+	}
+}
+
+// relation compares two expressions.  Transport layer data is found
+// differently in IPv4 and IPv6 packets, so the comparison is generated for
+// each family that could contain every protocol it accesses, guarded by
+// checks that the packet does contain them.
+func (p *parser) relation(l expr, test bpf.JumpTest, r expr) (pred, error) {
+	protos := map[string]bool{}
+	loads(l, protos)
+	loads(r, protos)
+
+	transport := false
+	for proto := range protos {
+		_, isIP := ipProtos[proto]
+		transport = transport || isIP
+	}
+
+	var variants []pred
+	for _, v6 := range []bool{false, true} {
+		if !transport && v6 ||
+			v6 && (protos["ip"] || protos["icmp"]) ||
+			!v6 && (protos["ip6"] || protos["icmp6"]) && transport {
+			continue
+		}
+
+		var guards []pred
+		for _, proto := range []string{"ip", "ip6", "icmp", "icmp6", "tcp", "udp", "sctp"} {
+			if !protos[proto] {
+				continue
+			}
+			switch {
+			case proto == "ip":
+				guards = append(guards, p.link.ipv4())
+			case proto == "ip6":
+				guards = append(guards, p.link.ipv6())
+			case v6:
+				guards = append(guards, p.link.v6next(ipProtos[proto]))
+			default:
+				guards = append(guards, p.link.v4proto(ipProtos[proto]), p.link.v4unfragmented())
+			}
+		}
+
+		cmp, err := p.compare(l, test, r, v6)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, allOf(append(guards, cmp)...))
+	}
+	if len(variants) == 0 {
+		return never, nil
+	}
+	return anyOf(variants...), nil
+}
+
+// compare generates the comparison of l and r for one address family.
+func (p *parser) compare(l expr, test bpf.JumpTest, r expr, v6 bool) (pred, error) {
+	if rc, ok := constFold(r); ok {
+		code, err := p.genArith(l, v6, 0)
+		return atom{code: code, test: test, val: rc}, err
+	}
+	code, err := p.genArith(r, v6, 0)
+	if err != nil {
+		return nil, err
+	}
+	code = append(code, bpf.StoreScratch{Src: bpf.RegA, N: 0})
+	lcode, err := p.genArith(l, v6, 1)
+	if err != nil {
+		return nil, err
+	}
+	code = append(append(code, lcode...), bpf.LoadScratch{Dst: bpf.RegX, N: 0})
+	return atom{code: code, test: test, x: true}, nil
+}
+
+// genArith generates code leaving the value of e in A, using scratch memory
+// from slot s upwards for intermediate values.
+func (p *parser) genArith(e expr, v6 bool, s int) ([]bpf.Instruction, error) {
+	if c, ok := constFold(e); ok {
+		return []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: c}}, nil
+	}
+	if s >= scratchSlots {
+		return nil, fmt.Errorf("expression nested too deeply: %w", ErrTooComplex)
+	}
+
+	switch v := e.(type) {
+	case exprLen:
+		return []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, nil
+
+	case exprLoad:
+		switch {
+		case v.proto == "ether":
+			return loadAbs(v.off, v.size), nil
+		case v.proto == "ip" || v.proto == "ip6":
+			return loadAbs(p.link.hdr+v.off, v.size), nil
+		case v6:
+			return p.link.transport6(v.off, v.size), nil
+		}
+		return p.link.transport4(v.off, v.size), nil
+
+	case exprNeg:
+		code, err := p.genArith(v.x, v6, s)
+		return append(code,
+			bpf.StoreScratch{Src: bpf.RegA, N: s},
+			bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
+			bpf.LoadScratch{Dst: bpf.RegX, N: s},
+			bpf.ALUOpX{Op: bpf.ALUOpSub},
+		), err
+
+	case exprBinary:
+		if rc, ok := constFold(v.r); ok {
+			if rc == 0 && (v.op == bpf.ALUOpDiv || v.op == bpf.ALUOpMod) {
+				return nil, fmt.Errorf("division by zero: %w", ErrSyntax)
+			}
+			code, err := p.genArith(v.l, v6, s)
+			return append(code, bpf.ALUOpConstant{Op: v.op, Val: rc}), err
+		}
+		code, err := p.genArith(v.r, v6, s)
+		if err != nil {
+			return nil, err
+		}
+		code = append(code, bpf.StoreScratch{Src: bpf.RegA, N: s})
+		lcode, err := p.genArith(v.l, v6, s+1)
+		if err != nil {
+			return nil, err
+		}
+		return append(append(code, lcode...),
+			bpf.LoadScratch{Dst: bpf.RegX, N: s},
+			bpf.ALUOpX{Op: v.op},
+		), nil
+	}
+	return nil, fmt.Errorf("arithmetic expression %v: %w", e, ErrSyntax)
+}
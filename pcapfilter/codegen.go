@@ -0,0 +1,193 @@
+package pcapfilter
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// pred is a boolean expression which can generate code jumping to t if it is
+// true, or f if it is false.
+type pred interface {
+	gen(a *assembler, t, f label)
+}
+
+type andPred struct{ l, r pred }
+type orPred struct{ l, r pred }
+type notPred struct{ x pred }
+
+// atom loads a value into A with code, then tests it against val, or against
+// X when x is set.
+type atom struct {
+	code []bpf.Instruction
+	test bpf.JumpTest
+	val  uint32
+	x    bool
+}
+
+func (p andPred) gen(a *assembler, t, f label) {
+	m := a.newLabel()
+	p.l.gen(a, m, f)
+	a.mark(m)
+	p.r.gen(a, t, f)
+}
+
+func (p orPred) gen(a *assembler, t, f label) {
+	m := a.newLabel()
+	p.l.gen(a, t, m)
+	a.mark(m)
+	p.r.gen(a, t, f)
+}
+
+func (p notPred) gen(a *assembler, t, f label) { p.x.gen(a, f, t) }
+
+func (p atom) gen(a *assembler, t, f label) {
+	for _, ins := range p.code {
+		a.prog = append(a.prog, ins)
+	}
+	a.prog = append(a.prog, jump{test: p.test, val: p.val, x: p.x, t: t, f: f})
+}
+
+// allOf and anyOf join predicates with and/or, skipping nils.
+func allOf(ps ...pred) pred {
+	var out pred
+	for _, p := range ps {
+		switch {
+		case p == nil:
+		case out == nil:
+			out = p
+		default:
+			out = andPred{out, p}
+		}
+	}
+	return out
+}
+
+func anyOf(ps ...pred) pred {
+	var out pred
+	for _, p := range ps {
+		switch {
+		case p == nil:
+		case out == nil:
+			out = p
+		default:
+			out = orPred{out, p}
+		}
+	}
+	return out
+}
+
+// never is a predicate which is always false.
+var never = atom{code: []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: 0}}, test: bpf.JumpEqual, val: 1}
+
+func loadAbs(off uint32, size int) []bpf.Instruction {
+	return []bpf.Instruction{bpf.LoadAbsolute{Off: off, Size: size}}
+}
+
+type label int
+
+// maxInstructions is the longest program the kernel accepts.
+const maxInstructions = 4096
+
+// jump is a conditional jump to labels, resolved once the program is
+// complete.
+type jump struct {
+	test bpf.JumpTest
+	val  uint32
+	x    bool
+	t, f label
+}
+
+// assembler collects instructions, jumps, and labels.  Every jump is forward,
+// since labels are only ever marked after the code jumping to them.
+type assembler struct {
+	prog   []interface{}
+	labels int
+}
+
+func (a *assembler) newLabel() label {
+	a.labels++
+	return label(a.labels)
+}
+
+func (a *assembler) mark(l label) { a.prog = append(a.prog, l) }
+
+// program generates the whole filter, returning snaplen for matches.
+func program(p pred, snaplen uint32) ([]bpf.Instruction, error) {
+	if p == nil {
+		return []bpf.Instruction{bpf.RetConstant{Val: snaplen}}, nil
+	}
+	a := &assembler{}
+	accept, reject := a.newLabel(), a.newLabel()
+	p.gen(a, accept, reject)
+	a.mark(accept)
+	a.prog = append(a.prog, bpf.RetConstant{Val: snaplen})
+	a.mark(reject)
+	a.prog = append(a.prog, bpf.RetConstant{Val: 0})
+	return a.resolve()
+}
+
+// resolve replaces labels with jump offsets.  Conditional jumps can only skip
+// 255 instructions, so one whose target is further jumps to a pair of
+// unconditional jumps after it, which can skip any number.  Since that moves
+// later targets further away, jumps are lengthened until none are too far.
+func (a *assembler) resolve() ([]bpf.Instruction, error) {
+	long := map[int]bool{}
+	width := func(i int, x interface{}) int {
+		switch x.(type) {
+		case label:
+			return 0
+		case jump:
+			if long[i] {
+				return 3
+			}
+		}
+		return 1
+	}
+	var pos map[label]int
+	for grown := true; grown; {
+		pos = map[label]int{}
+		n := 0
+		for i, x := range a.prog {
+			if l, ok := x.(label); ok {
+				pos[l] = n
+			}
+			n += width(i, x)
+		}
+		grown = false
+		n = 0
+		for i, x := range a.prog {
+			if v, ok := x.(jump); ok && !long[i] && (pos[v.t]-n-1 > 255 || pos[v.f]-n-1 > 255) {
+				long[i], grown = true, true
+			}
+			n += width(i, x)
+		}
+	}
+
+	out := make([]bpf.Instruction, 0, len(a.prog))
+	for i, x := range a.prog {
+		switch v := x.(type) {
+		case label:
+		case jump:
+			st, sf := 0, 1
+			if !long[i] {
+				st, sf = pos[v.t]-len(out)-1, pos[v.f]-len(out)-1
+			}
+			if v.x {
+				out = append(out, bpf.JumpIfX{Cond: v.test, SkipTrue: uint8(st), SkipFalse: uint8(sf)})
+			} else {
+				out = append(out, bpf.JumpIf{Cond: v.test, Val: v.val, SkipTrue: uint8(st), SkipFalse: uint8(sf)})
+			}
+			if long[i] {
+				out = append(out, bpf.Jump{Skip: uint32(pos[v.t] - len(out) - 1)})
+				out = append(out, bpf.Jump{Skip: uint32(pos[v.f] - len(out) - 1)})
+			}
+		case bpf.Instruction:
+			out = append(out, v)
+		}
+	}
+	if len(out) > maxInstructions {
+		return nil, fmt.Errorf("%d instructions, more than %d: %w", len(out), maxInstructions, ErrTooComplex)
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package pcapfilter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// compile parses a filter and generates its program.
+func compile(filter string, lt layers.LinkType, snaplen int) ([]bpf.Instruction, error) {
+	link, err := newLinkLayer(lt)
+	if err != nil {
+		return nil, err
+	}
+	toks, err := lex(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var root pred
+	p := &parser{toks: toks, link: link}
+	if strings.TrimSpace(filter) != "" {
+		if root, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.kind != tokEOF {
+			return nil, fmt.Errorf("unexpected %v: %w", t, ErrSyntax)
+		}
+	}
+	return program(root, uint32(snaplen))
+}
+
+// Compile compiles a pcap-filter expression for packets of link type lt into
+// a classic BPF program which accepts up to snaplen bytes of matching
+// packets.  An empty filter accepts every packet.
+func Compile(filter string, lt layers.LinkType, snaplen int) ([]bpf.RawInstruction, error) {
+	insns, err := compile(filter, lt, snaplen)
+	if err != nil {
+		return nil, fmt.Errorf("compiling filter %q: %w", filter, err)
+	}
+	return bpf.Assemble(insns)
+}
+
+// Matcher runs a compiled filter against packets in Go, for packets that
+// don't come from a socket the filter could be attached to.
+type Matcher struct {
+	vm *bpf.VM
+}
+
+// NewMatcher compiles filter for packets of link type lt.
+func NewMatcher(filter string, lt layers.LinkType) (*Matcher, error) {
+	insns, err := compile(filter, lt, 65535)
+	if err != nil {
+		return nil, fmt.Errorf("compiling filter %q: %w", filter, err)
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		return nil, fmt.Errorf("loading filter %q: %w", filter, err)
+	}
+	return &Matcher{vm: vm}, nil
+}
+
+// Matches returns true if the packet data is selected by the filter.
+func (m *Matcher) Matches(data []byte) bool {
+	n, err := m.vm.Run(data)
+	return err == nil && n > 0
+}
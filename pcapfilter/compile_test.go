@@ -0,0 +1,256 @@
+package pcapfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+)
+
+// packet serializes the layers of a test packet, with correct lengths and
+// checksums.
+func packet(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	for _, l := range ls {
+		if n, ok := l.(gopacket.NetworkLayer); ok {
+			for _, o := range ls {
+				if tl, ok := o.(interface {
+					SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+				}); ok {
+					_ = tl.SetNetworkLayerForChecksum(n)
+				}
+			}
+		}
+	}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatalf("serializing test packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func ether(t layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: t,
+	}
+}
+
+func ip4(proto layers.IPProtocol, src, dst string) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+func ip6(next layers.IPProtocol, src, dst string) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: next, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+var payload = gopacket.Payload("INVITE sip:bob@example.com SIP/2.0\r\n\r\n")
+
+func testPackets(t *testing.T) map[string][]byte {
+	withOptions := ip4(layers.IPProtocolTCP, "10.0.0.1", "10.0.0.2")
+	withOptions.Options = []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 0}}
+	fragment := ip4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2")
+	fragment.FragOffset = 185
+
+	return map[string][]byte{
+		"udp4": packet(t, ether(layers.EthernetTypeIPv4), ip4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2"),
+			&layers.UDP{SrcPort: 5060, DstPort: 5080}, payload),
+		"tcp4 options": packet(t, ether(layers.EthernetTypeIPv4), withOptions,
+			&layers.TCP{SrcPort: 40000, DstPort: 5060, SYN: true, Window: 100}, payload),
+		"sctp4": packet(t, ether(layers.EthernetTypeIPv4), ip4(layers.IPProtocolSCTP, "192.168.1.1", "10.0.0.2"),
+			&layers.SCTP{SrcPort: 5060, DstPort: 5060}),
+		"fragment4": packet(t, ether(layers.EthernetTypeIPv4), fragment, gopacket.Payload{0x13, 0xc4, 0x13, 0xc4, 1, 2, 3, 4}),
+		"udp6": packet(t, ether(layers.EthernetTypeIPv6), ip6(layers.IPProtocolUDP, "2001:db8::1", "2001:db8::2"),
+			&layers.UDP{SrcPort: 5070, DstPort: 5060}, payload),
+		"tcp6": packet(t, ether(layers.EthernetTypeIPv6), ip6(layers.IPProtocolTCP, "2001:db8:1::1", "2001:db8::2"),
+			&layers.TCP{SrcPort: 5061, DstPort: 40000, ACK: true, Window: 100}, payload),
+		"frag6": packet(t, ether(layers.EthernetTypeIPv6), ip6(layers.IPProtocolIPv6Fragment, "2001:db8::1", "2001:db8::2"),
+			gopacket.Payload{byte(layers.IPProtocolUDP), 0, 0, 1, 0, 0, 0, 42, 0x13, 0xc4, 0x13, 0xc4}),
+		"arp": packet(t, ether(layers.EthernetTypeARP), &layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			SourceHwAddress: []byte{0, 1, 2, 3, 4, 5}, SourceProtAddress: []byte{10, 0, 0, 1},
+			DstHwAddress: []byte{0, 0, 0, 0, 0, 0}, DstProtAddress: []byte{10, 0, 0, 2},
+		}),
+	}
+}
+
+func TestMatches(t *testing.T) {
+	pkts := testPackets(t)
+	testCases := map[string][]string{
+		``:                                       {"udp4", "tcp4 options", "sctp4", "fragment4", "udp6", "tcp6", "frag6", "arp"},
+		`ip`:                                     {"udp4", "tcp4 options", "sctp4", "fragment4"},
+		`ip6`:                                    {"udp6", "tcp6", "frag6"},
+		`arp`:                                    {"arp"},
+		`udp`:                                    {"udp4", "fragment4", "udp6", "frag6"},
+		`tcp or sctp`:                            {"tcp4 options", "sctp4", "tcp6"},
+		`not ip and not ip6`:                     {"arp"},
+		`!(udp || tcp) && ip`:                    {"sctp4"},
+		`port 5060`:                              {"udp4", "tcp4 options", "sctp4", "udp6"},
+		`udp port 5060`:                          {"udp4", "udp6"},
+		`ip6 and port 5060`:                      {"udp6"},
+		`ip6 port 5060 or 5061`:                  {"udp6", "tcp6"},
+		`src port 5060`:                          {"udp4", "sctp4"},
+		`dst port 5060`:                          {"tcp4 options", "sctp4", "udp6"},
+		`src and dst port 5060`:                  {"sctp4"},
+		`tcp dst port 5060`:                      {"tcp4 options"},
+		`portrange 5061-5080`:                    {"udp4", "udp6", "tcp6"},
+		`udp and (port 5080 or port 5070)`:       {"udp4", "udp6"},
+		`host 10.0.0.1`:                          {"udp4", "tcp4 options", "fragment4"},
+		`dst host 10.0.0.2 and not src 10.0.0.1`: {"sctp4"},
+		`host 2001:db8::2`:                       {"udp6", "tcp6", "frag6"},
+		`src net 2001:db8::/48`:                  {"udp6", "frag6"},
+		`net 192.168.0.0/16`:                     {"sctp4"},
+		`net 0.0.0.0/0`:                          {"udp4", "tcp4 options", "sctp4", "fragment4"},
+		`proto 17`:                               {"udp4", "fragment4", "udp6", "frag6"},
+		`ip proto sctp`:                          {"sctp4"},
+		`ip6 proto udp`:                          {"udp6", "frag6"},
+		`icmp`:                                   {},
+		`(ip[6:2] & 0x1fff) != 0`:                {"fragment4"},
+		`ip[6:2] & 0x1fff != 0 or ip6[6] == 44`:  {"fragment4", "frag6"},
+		`udp and port 5060 or (ip[6:2] & 0x1fff) != 0 or (ip6 and ip6[6] == 44)`: {"udp4", "fragment4", "udp6", "frag6"},
+		`tcp[tcpflags] & tcp-syn != 0`:                                           {"tcp4 options"},
+		`tcp[13] & (tcp-syn|tcp-ack) = tcp-ack`:                                  {"tcp6"},
+		`udp[2:2] = 5080`:                                                        {"udp4"},
+		`udp[0:2] + 20 == udp[2:2]`:                                              {"udp4"},
+		`udp[0:2] - 10 == udp[2:2]`:                                              {"udp6"},
+		`udp[2:2] - udp[0:2] > 0x7fffffff`:                                       {"udp6"},
+		`-udp[0:2] + 5060 = 0`:                                                   {"udp4"},
+		`ip[0] & 0xf > 5`:                                                        {"tcp4 options"},
+		`ether[12:2] = 0x806`:                                                    {"arp"},
+		`greater 80 and ip`:                                                      {"udp4", "tcp4 options"},
+		`less 60`:                                                                {"sctp4", "fragment4", "arp"},
+		`len - 100 > 0x80000000`:                                                 {"udp4", "tcp4 options", "sctp4", "fragment4", "arp", "frag6"},
+		`len-100 > 0x80000000`:                                                   {"udp4", "tcp4 options", "sctp4", "fragment4", "arp", "frag6"},
+		`udp[2:2] = 5090-10`:                                                     {"udp4"},
+		`udp portrange 5061-5080 or 5060-5060`:                                   {"udp4", "udp6"},
+	}
+	for filter, want := range testCases {
+		filter, want := filter, want
+		t.Run(filter, func(t *testing.T) {
+			is := is.New(t)
+			m, err := NewMatcher(filter, layers.LinkTypeEthernet)
+			is.NoErr(err) // filter compiles
+			expected := map[string]bool{}
+			for _, name := range want {
+				expected[name] = true
+			}
+			for name, data := range pkts {
+				if m.Matches(data) != expected[name] {
+					t.Errorf("%v: match = %v, expected %v", name, m.Matches(data), expected[name])
+				}
+			}
+		})
+	}
+}
+
+// Enough terms need conditional jumps further than 255 instructions, which
+// jump through unconditional ones instead.
+func TestLongJumps(t *testing.T) {
+	is := is.New(t)
+	var terms []string
+	for port := 6000; port < 6012; port++ {
+		terms = append(terms, fmt.Sprintf("port %d", port))
+	}
+	filter := strings.Join(append(terms, "port 5060"), " or ")
+	prog, err := Compile(filter, layers.LinkTypeEthernet, 65535)
+	is.NoErr(err)
+	is.True(len(prog) > 256) // long enough to need long jumps
+
+	m, err := NewMatcher(filter, layers.LinkTypeEthernet)
+	is.NoErr(err)
+	short, err := NewMatcher("port 5060", layers.LinkTypeEthernet)
+	is.NoErr(err)
+	for _, data := range testPackets(t) {
+		is.Equal(m.Matches(data), short.Matches(data)) // same as the last term alone
+	}
+}
+
+func TestLinkTypes(t *testing.T) {
+	udp := &layers.UDP{SrcPort: 5060, DstPort: 5060}
+	testCases := map[string]struct {
+		lt   layers.LinkType
+		data []byte
+	}{
+		"raw ipv4": {layers.LinkTypeRaw, packet(t, ip4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2"), udp, payload)},
+		"raw ipv6": {layers.LinkTypeRaw, packet(t, ip6(layers.IPProtocolUDP, "::1", "::2"), udp, payload)},
+		"linux sll": {layers.LinkTypeLinuxSLL, append(
+			[]byte{0, 0, 0, 1, 0, 6, 0, 1, 2, 3, 4, 5, 0, 0, 0x08, 0x00},
+			packet(t, ip4(layers.IPProtocolUDP, "10.0.0.1", "10.0.0.2"), udp, payload)...)},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			m, err := NewMatcher("udp port 5060", tc.lt)
+			is.NoErr(err)
+			is.True(m.Matches(tc.data)) // SIP packet matches
+			m, err = NewMatcher("tcp or arp", tc.lt)
+			is.NoErr(err)
+			is.True(!m.Matches(tc.data)) // SIP packet does not match
+		})
+	}
+	_, err := Compile("udp", layers.LinkTypeFDDI, 65535)
+	is.New(t).True(errors.Is(err, ErrLinkType)) // unknown link types fail
+}
+
+func TestCompile(t *testing.T) {
+	is := is.New(t)
+	prog, err := Compile("", layers.LinkTypeEthernet, 1500)
+	is.NoErr(err)
+	is.Equal(len(prog), 1) // empty filter is a single return
+	is.Equal(prog[0].K, uint32(1500))
+
+	// The same program tcpdump -d produces for "ip".
+	prog, err = Compile("ip", layers.LinkTypeEthernet, 65535)
+	is.NoErr(err)
+	is.Equal(len(prog), 4)
+	is.Equal([]uint32{prog[0].K, prog[1].K, prog[2].K, prog[3].K}, []uint32{12, 0x800, 65535, 0})
+	is.Equal([]uint8{prog[1].Jt, prog[1].Jf}, []uint8{0, 1})
+}
+
+func TestCompileFailures(t *testing.T) {
+	testCases := map[string]error{
+		`foo`:                          ErrSyntax,
+		`udp and`:                      ErrSyntax,
+		`(udp`:                         ErrSyntax,
+		`udp)`:                         ErrSyntax,
+		`port`:                         ErrSyntax,
+		`ip[0`:                         ErrSyntax,
+		`ip[0:3] = 1`:                  ErrSyntax,
+		`ip[0] +`:                      ErrSyntax,
+		`ip[0] / 0 = 1`:                ErrSyntax,
+		`ip[0]`:                        ErrSyntax,
+		`len >`:                        ErrSyntax,
+		`udp port 5060 $`:              ErrSyntax,
+		`host example.com`:             ErrNeedAddress,
+		`net 10.0.0.1/8`:               ErrNeedAddress,
+		`port sip`:                     ErrNeedNumber,
+		`port 70000`:                   ErrNeedNumber,
+		`portrange 5060`:               ErrNeedNumber,
+		`ip proto 300`:                 ErrNeedNumber,
+		`ip6 host 10.0.0.1`:            ErrQualifier,
+		`tcp host 10.0.0.1`:            ErrQualifier,
+		`arp port 53`:                  ErrQualifier,
+		`vlan 100`:                     ErrUnsupported,
+		`ether host 00:01:02:03:04:05`: ErrUnsupported,
+		`gateway 10.0.0.1`:             ErrUnsupported,
+		`net 10.0.0.0 mask 255.0.0.0`:  ErrUnsupported,
+		`tcp[ip[0]] = 1`:               ErrUnsupported,
+		`udp or broadcast`:             ErrUnsupported,
+	}
+	for filter, expected := range testCases {
+		filter, expected := filter, expected
+		t.Run(filter, func(t *testing.T) {
+			_, err := Compile(filter, layers.LinkTypeEthernet, 65535)
+			if !errors.Is(err, expected) {
+				t.Errorf("error = %v, expected %v", err, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+/*
+Package pcapfilter compiles the common subset of libpcap's filter syntax
+(pcap-filter(7)) into classic BPF, without needing libpcap.
+
+The output of Compile is a []bpf.RawInstruction program which can be attached
+to a raw or AF_PACKET socket, and NewMatcher runs the same program in Go to
+filter packets read from capture files.  Programs return the snap length for
+accepted packets and 0 for rejected ones, as libpcap's do.
+
+The following primitives are supported, combined with and/&&, or/||, not/!,
+and parentheses:
+
+	[ip|ip6] [dir] host addr	IPv4 or IPv6 address, source and/or destination
+	[ip|ip6] [dir] net cidr	address in the network, e.g. 10.0.0.0/8
+	[proto] [dir] port n		TCP, UDP, or SCTP port
+	[proto] [dir] portrange n-m	port in the inclusive range
+	ip, ip6, arp, tcp, udp, sctp, icmp, icmp6	packet protocol
+	[ip|ip6] proto n		IP protocol (or IPv6 next header) number
+	less n, greater n		packet length
+	expr relop expr		comparison of arithmetic expressions
+
+dir is one of src, dst, "src or dst" (the default) or "src and dst", and proto
+is one of ip, ip6, tcp, udp, or sctp.  As in libpcap, a bare host, network,
+or port after and/or reuses the previous qualifiers, so "port 5060 or 5061"
+is the same as "port 5060 or port 5061".
+
+Arithmetic expressions are built from numbers (decimal, 0x hex, or 0 octal),
+len, the named constants tcpflags, tcp-fin, tcp-syn, tcp-rst, tcp-push,
+tcp-ack, tcp-urg, icmptype, and icmpcode, and packet data accessed as
+proto[offset] or proto[offset:size], with a size of 1, 2, or 4 bytes.  proto
+is one of ether, ip, ip6, tcp, udp, sctp, icmp, or icmp6, and offsets must be
+constant.  The operators are + - * / % & | ^ << >> and unary -, and the
+comparisons > < >= <= = == !=.  For example, to select IPv4 fragments:
+
+	(ip[6:2] & 0x1fff) != 0
+
+Transport layer data (tcp[], udp[], port, ...) is found after the IPv4 header
+options of unfragmented packets, and after a fixed IPv6 header, the same as
+libpcap.  The protocol checks of tcp, udp, and sctp also match IPv6 packets
+whose fragment header carries that protocol.
+
+Anything else, such as hostnames, service names, ether, vlan, or gateway
+primitives, fails with an error wrapping ErrUnsupported, rather than being
+compiled into a program that silently selects the wrong traffic.
+*/
+package pcapfilter
@@ -0,0 +1,27 @@
+package pcapfilter
+
+type constErr string
+
+func (e constErr) Error() string { return string(e) }
+
+const (
+	// ErrSyntax indicates the filter could not be parsed.
+	ErrSyntax = constErr("syntax error")
+	// ErrUnsupported indicates valid pcap-filter syntax that this package
+	// does not implement.
+	ErrUnsupported = constErr("unsupported filter syntax")
+	// ErrNeedAddress indicates a host or net primitive without a valid IP
+	// address or network; hostnames are not resolved.
+	ErrNeedAddress = constErr("not an IP address")
+	// ErrNeedNumber indicates a port, protocol, size, or length was not a
+	// valid number.
+	ErrNeedNumber = constErr("not a valid number")
+	// ErrQualifier indicates qualifiers that can't be used together, such as
+	// "ip6 host 10.0.0.1" or "tcp host ...".
+	ErrQualifier = constErr("invalid qualifier combination")
+	// ErrLinkType indicates the capture's link type is not supported.
+	ErrLinkType = constErr("unsupported link type")
+	// ErrTooComplex indicates the program needs more scratch memory or
+	// instructions than classic BPF allows.
+	ErrTooComplex = constErr("filter too complex")
+)
@@ -0,0 +1,105 @@
+package pcapfilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators, longest first so that "<=" isn't lexed as "<" "=".
+var operators = []string{
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"(", ")", "[", "]", ":", "&", "|", "^", "+", "-", "*", "/", "%", "=", "<", ">", "!",
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// arithOps are the operators after which a number is an arithmetic operand,
+// rather than the start of a port range.
+var arithOps = map[string]bool{
+	"<<": true, ">>": true, "<=": true, ">=": true, "==": true, "!=": true, "&": true, "|": true,
+	"^": true, "+": true, "-": true, "*": true, "/": true, "%": true, "=": true, "<": true, ">": true,
+}
+
+// lex splits a filter into words and operators.  Outside of brackets, words
+// may contain '.', ':', '/', and '-' so that addresses, networks, port ranges,
+// and names like tcp-syn are single words; inside brackets ':' separates the
+// offset from the size.  In arithmetic, '-' ends "len", and a number following
+// an arithmetic operator, so that "len-14" and "100-14" are subtractions.
+func lex(src string) ([]token, error) {
+	var toks []token
+	depth := 0
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isAlnum(c) || depth == 0 && c == ':':
+			start := i
+			for i < len(src) && (isAlnum(src[i]) || depth == 0 && strings.IndexByte(".:/-", src[i]) >= 0) {
+				if src[i] == '-' && subtracts(src[start:i], toks) {
+					break
+				}
+				i++
+			}
+			toks = append(toks, token{tokWord, src[start:i], start})
+			continue
+		}
+
+		op := ""
+		for _, o := range operators {
+			if strings.HasPrefix(src[i:], o) {
+				op = o
+				break
+			}
+		}
+		switch op {
+		case "":
+			return nil, fmt.Errorf("unexpected character %q at offset %d: %w", c, i, ErrSyntax)
+		case "[":
+			depth++
+		case "]":
+			depth--
+		}
+		toks = append(toks, token{tokOp, op, i})
+		i += len(op)
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+// subtracts reports whether a '-' after word is subtraction, rather than part
+// of the word, given the tokens before it.
+func subtracts(word string, toks []token) bool {
+	if word == "len" {
+		return true
+	}
+	if _, err := strconv.ParseUint(word, 0, 32); err != nil || len(toks) == 0 {
+		return false
+	}
+	prev := toks[len(toks)-1]
+	return prev.kind == tokOp && arithOps[prev.text]
+}
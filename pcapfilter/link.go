@@ -0,0 +1,103 @@
+package pcapfilter
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// EtherTypes and IP protocol numbers used by the generated code.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeARP  = 0x0806
+
+	ipv6HeaderLen  = 40
+	ipv6FragHeader = 44
+)
+
+// linkLayer describes where the network header and its type are found.
+type linkLayer struct {
+	hdr     uint32 // length of the link layer header
+	typeOff uint32 // offset of the EtherType
+	raw     bool   // no link layer; the IP version tells IPv4 from IPv6
+}
+
+func newLinkLayer(lt layers.LinkType) (linkLayer, error) {
+	switch lt {
+	case layers.LinkTypeEthernet:
+		return linkLayer{hdr: 14, typeOff: 12}, nil
+	case layers.LinkTypeLinuxSLL:
+		return linkLayer{hdr: 16, typeOff: 14}, nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return linkLayer{raw: true}, nil
+	}
+	return linkLayer{}, fmt.Errorf("%v: %w", lt, ErrLinkType)
+}
+
+// etherType matches packets whose network layer is of type t.
+func (l linkLayer) etherType(t uint16) pred {
+	if !l.raw {
+		return atom{code: loadAbs(l.typeOff, 2), test: bpf.JumpEqual, val: uint32(t)}
+	}
+	version := func(v uint32) pred {
+		return atom{code: []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0},
+		}, test: bpf.JumpEqual, val: v << 4}
+	}
+	switch t {
+	case etherTypeIPv4:
+		return version(4)
+	case etherTypeIPv6:
+		return version(6)
+	}
+	return never
+}
+
+func (l linkLayer) ipv4() pred { return l.etherType(etherTypeIPv4) }
+func (l linkLayer) ipv6() pred { return l.etherType(etherTypeIPv6) }
+
+// v4proto matches IPv4 packets carrying protocol p.
+func (l linkLayer) v4proto(p uint32) pred {
+	return allOf(l.ipv4(), atom{code: loadAbs(l.hdr+9, 1), test: bpf.JumpEqual, val: p})
+}
+
+// v4unfragmented matches IPv4 packets that are not a later fragment, and so
+// start with their transport header.
+func (l linkLayer) v4unfragmented() pred {
+	return atom{code: loadAbs(l.hdr+6, 2), test: bpf.JumpBitsNotSet, val: 0x1fff}
+}
+
+// v6next matches IPv6 packets whose fixed header is directly followed by a
+// header of protocol p.
+func (l linkLayer) v6next(p uint32) pred {
+	return allOf(l.ipv6(), atom{code: loadAbs(l.hdr+6, 1), test: bpf.JumpEqual, val: p})
+}
+
+// v6proto matches IPv6 packets carrying protocol p, including fragments.
+func (l linkLayer) v6proto(p uint32) pred {
+	return allOf(l.ipv6(), anyOf(
+		atom{code: loadAbs(l.hdr+6, 1), test: bpf.JumpEqual, val: p},
+		allOf(
+			atom{code: loadAbs(l.hdr+6, 1), test: bpf.JumpEqual, val: ipv6FragHeader},
+			atom{code: loadAbs(l.hdr+ipv6HeaderLen, 1), test: bpf.JumpEqual, val: p},
+		),
+	))
+}
+
+// transport4 loads size bytes at off into the transport header of an IPv4
+// packet, after any IP options.
+func (l linkLayer) transport4(off uint32, size int) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadMemShift{Off: l.hdr},
+		bpf.LoadIndirect{Off: l.hdr + off, Size: size},
+	}
+}
+
+// transport6 loads size bytes at off into the transport header of an IPv6
+// packet without extension headers.
+func (l linkLayer) transport6(off uint32, size int) []bpf.Instruction {
+	return loadAbs(l.hdr+ipv6HeaderLen+off, size)
+}
@@ -0,0 +1,465 @@
+package pcapfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// IP protocol numbers which can be named in filters.
+var ipProtos = map[string]uint32{
+	"icmp":  1,
+	"tcp":   6,
+	"udp":   17,
+	"sctp":  132,
+	"icmp6": 58,
+}
+
+// protocols which may qualify a primitive or stand alone.
+var protoQualifiers = map[string]bool{
+	"ip": true, "ip6": true, "arp": true, "tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true,
+}
+
+// kinds of id a primitive can match.
+var kinds = map[string]bool{"host": true, "net": true, "port": true, "portrange": true, "proto": true}
+
+// pcap-filter keywords which are deliberately not implemented.
+var unsupported = map[string]bool{
+	"ether": true, "fddi": true, "tr": true, "wlan": true, "link": true, "ppp": true, "slip": true,
+	"rarp": true, "decnet": true, "atalk": true, "aarp": true, "ipx": true, "iso": true,
+	"stp": true, "netbeui": true, "lat": true, "mopdl": true, "moprc": true, "igmp": true,
+	"igrp": true, "pim": true, "ah": true, "esp": true, "vrrp": true, "carp": true, "radio": true,
+	"gateway": true, "broadcast": true, "multicast": true, "vlan": true, "mpls": true, "pppoed": true,
+	"pppoes": true, "geneve": true, "inbound": true, "outbound": true, "ifname": true, "on": true,
+	"rnr": true, "rulenum": true, "reason": true, "rset": true, "ruleset": true, "srnr": true,
+	"subrulenum": true, "action": true, "type": true, "subtype": true, "dir": true, "ra": true,
+	"ta": true, "addr1": true, "addr2": true, "addr3": true, "addr4": true, "llc": true,
+	"protochain": true, "mask": true,
+}
+
+// named constants usable in arithmetic expressions.
+var namedConsts = map[string]uint32{
+	"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+	"tcp-ack": 0x10, "tcp-urg": 0x20, "icmptype": 0, "icmpcode": 1,
+}
+
+// protocols whose data can be accessed with proto[offset:size].
+var loadProtos = map[string]bool{
+	"ether": true, "ip": true, "ip6": true, "tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true,
+}
+
+var relops = map[string]bpf.JumpTest{
+	">": bpf.JumpGreaterThan, "<": bpf.JumpLessThan, ">=": bpf.JumpGreaterOrEqual,
+	"<=": bpf.JumpLessOrEqual, "=": bpf.JumpEqual, "==": bpf.JumpEqual, "!=": bpf.JumpNotEqual,
+}
+
+// binary arithmetic operators, lowest precedence first.
+var arithLevels = []map[string]bpf.ALUOp{
+	{"|": bpf.ALUOpOr},
+	{"^": bpf.ALUOpXor},
+	{"&": bpf.ALUOpAnd},
+	{"<<": bpf.ALUOpShiftLeft, ">>": bpf.ALUOpShiftRight},
+	{"+": bpf.ALUOpAdd, "-": bpf.ALUOpSub},
+	{"*": bpf.ALUOpMul, "/": bpf.ALUOpDiv, "%": bpf.ALUOpMod},
+}
+
+// errNotArith means the tokens don't start an arithmetic expression, so they
+// should be parsed as a primitive instead.
+var errNotArith = errors.New("not an arithmetic expression")
+
+// qualifiers of a primitive, such as "tcp src port".
+type qualifiers struct {
+	proto, dir, kind string
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	link linkLayer
+	last *qualifiers
+}
+
+func (p *parser) peek() token { return p.peekAt(0) }
+
+func (p *parser) peekAt(n int) token {
+	if p.pos+n < len(p.toks) {
+		return p.toks[p.pos+n]
+	}
+	return p.toks[len(p.toks)-1]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of texts.
+func (p *parser) accept(texts ...string) bool {
+	t := p.peek()
+	for _, s := range texts {
+		if t.kind != tokEOF && t.text == s {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return fmt.Errorf("expected %q, found %v: %w", text, p.peek(), ErrSyntax)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (pred, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.accept("or", "||") {
+		var r pred
+		if r, err = p.parseAnd(); err == nil {
+			l = orPred{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseAnd() (pred, error) {
+	l, err := p.parseNot()
+	for err == nil && p.accept("and", "&&") {
+		var r pred
+		if r, err = p.parseNot(); err == nil {
+			l = andPred{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseNot() (pred, error) {
+	if p.accept("not", "!") {
+		x, err := p.parseNot()
+		return notPred{x}, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (pred, error) {
+	start := p.pos
+	if rel, ok, err := p.tryRelation(); ok {
+		return rel, err
+	}
+	p.pos = start
+
+	if p.accept("(") {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	return p.parsePrimitive()
+}
+
+// tryRelation parses a comparison of arithmetic expressions.  ok is false if
+// the tokens are not a comparison, and should be parsed as something else:
+// a parenthesized boolean expression, or a bare number inheriting the last
+// primitive's qualifiers.
+func (p *parser) tryRelation() (rel pred, ok bool, err error) {
+	first := p.peek()
+	l, err := p.parseArith()
+	if err == errNotArith || err != nil && first.text == "(" {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	test, isRel := relops[p.peek().text]
+	if !isRel || p.peek().kind != tokOp {
+		if _, isConst := l.(exprConst); isConst || first.text == "(" {
+			return nil, false, nil
+		}
+		return nil, true, fmt.Errorf("expected comparison, found %v: %w", p.peek(), ErrSyntax)
+	}
+	p.next()
+
+	r, err := p.parseArith()
+	if err == errNotArith {
+		return nil, true, fmt.Errorf("expected arithmetic expression, found %v: %w", p.peek(), ErrSyntax)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	rel, err = p.relation(l, test, r)
+	return rel, true, err
+}
+
+func (p *parser) parsePrimitive() (pred, error) {
+	t := p.peek()
+	if t.kind != tokWord {
+		return nil, fmt.Errorf("unexpected %v: %w", t, ErrSyntax)
+	}
+	if unsupported[t.text] {
+		return nil, fmt.Errorf("%q: %w", t.text, ErrUnsupported)
+	}
+	if t.text == "less" || t.text == "greater" {
+		p.next()
+		n, err := p.number("length", 0xffffffff)
+		if err != nil {
+			return nil, err
+		}
+		test := bpf.JumpLessOrEqual
+		if t.text == "greater" {
+			test = bpf.JumpGreaterOrEqual
+		}
+		return atom{code: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, test: test, val: n}, nil
+	}
+
+	var q qualifiers
+	if protoQualifiers[t.text] {
+		q.proto = p.next().text
+	}
+	if w := p.peek().text; w == "src" || w == "dst" {
+		p.next()
+		q.dir = w
+		if c, o := p.peek().text, p.peekAt(1).text; (c == "or" || c == "and") && (o == "src" || o == "dst") && o != w {
+			p.pos += 2
+			q.dir = "src " + c + " dst"
+		}
+	}
+	if kinds[p.peek().text] {
+		q.kind = p.next().text
+	}
+
+	if q.dir == "" && q.kind == "" {
+		if q.proto != "" {
+			return p.protocol(q.proto), nil
+		}
+		if p.last == nil {
+			return nil, fmt.Errorf("unexpected %v: %w", t, ErrSyntax)
+		}
+		q = *p.last
+	}
+	if q.kind == "" {
+		q.kind = "host"
+	}
+
+	id := p.next()
+	if id.kind != tokWord {
+		return nil, fmt.Errorf("%v needs an argument, found %v: %w", q.kind, id, ErrSyntax)
+	}
+	last := q
+	p.last = &last
+	return p.primitive(q, id.text)
+}
+
+// primitive builds the predicate matching id according to its qualifiers.
+func (p *parser) primitive(q qualifiers, id string) (pred, error) {
+	switch q.kind {
+	case "host":
+		ip := net.ParseIP(id)
+		if ip == nil {
+			return nil, fmt.Errorf("host %q: %w", id, ErrNeedAddress)
+		}
+		return p.address(q, ip, nil)
+
+	case "net":
+		if p.peek().text == "mask" {
+			return nil, fmt.Errorf("net mask: %w; use CIDR notation", ErrUnsupported)
+		}
+		if ip := net.ParseIP(id); ip != nil {
+			return p.address(q, ip, nil)
+		}
+		ip, n, err := net.ParseCIDR(id)
+		if err != nil {
+			return nil, fmt.Errorf("net %q: %w", id, ErrNeedAddress)
+		}
+		if !ip.Equal(n.IP) {
+			return nil, fmt.Errorf("net %q has host bits set: %w", id, ErrNeedAddress)
+		}
+		return p.address(q, n.IP, n.Mask)
+
+	case "port":
+		n, err := parsePort(id)
+		if err != nil {
+			return nil, err
+		}
+		return p.ports(q, n, n)
+
+	case "portrange":
+		parts := strings.SplitN(id, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("portrange %q: %w", id, ErrNeedNumber)
+		}
+		lo, err := parsePort(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		hi, err := parsePort(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		return p.ports(q, lo, hi)
+
+	case "proto":
+		n, ok := ipProtos[id]
+		if !ok {
+			v, err := strconv.ParseUint(id, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("proto %q: %w", id, ErrNeedNumber)
+			}
+			n = uint32(v)
+		}
+		switch q.proto {
+		case "":
+			return anyOf(p.link.v4proto(n), p.link.v6proto(n)), nil
+		case "ip":
+			return p.link.v4proto(n), nil
+		case "ip6":
+			return p.link.v6proto(n), nil
+		}
+	}
+	return nil, fmt.Errorf("%v %v: %w", q.proto, q.kind, ErrQualifier)
+}
+
+// protocol matches all packets of a protocol.
+func (p *parser) protocol(name string) pred {
+	switch name {
+	case "ip":
+		return p.link.ipv4()
+	case "ip6":
+		return p.link.ipv6()
+	case "arp":
+		return p.link.etherType(etherTypeARP)
+	case "icmp":
+		return p.link.v4proto(ipProtos[name])
+	case "icmp6":
+		return p.link.v6proto(ipProtos[name])
+	}
+	return anyOf(p.link.v4proto(ipProtos[name]), p.link.v6proto(ipProtos[name]))
+}
+
+// direction combines source and destination matches per the dir qualifier.
+func direction(dir string, src, dst pred) pred {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	case "src and dst":
+		return allOf(src, dst)
+	}
+	return anyOf(src, dst)
+}
+
+// address matches IPv4 or IPv6 addresses in the network ip/mask; a nil mask
+// matches the single address.
+func (p *parser) address(q qualifiers, ip net.IP, mask net.IPMask) (pred, error) {
+	family, src, dst := p.link.ipv4(), p.link.hdr+12, p.link.hdr+16
+	want := "ip"
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+	} else {
+		family, src, dst = p.link.ipv6(), p.link.hdr+8, p.link.hdr+24
+		want = "ip6"
+	}
+	if q.proto != "" && q.proto != want {
+		return nil, fmt.Errorf("%v %v with %v address: %w", q.proto, q.kind, want, ErrQualifier)
+	}
+
+	match := func(off uint32) pred {
+		var words []pred
+		for i := 0; i < len(ip); i += 4 {
+			m := uint32(0xffffffff)
+			if mask != nil {
+				m = word(mask[i:])
+			}
+			if m == 0 {
+				continue
+			}
+			code := loadAbs(off+uint32(i), 4)
+			if m != 0xffffffff {
+				code = append(code, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: m})
+			}
+			words = append(words, atom{code: code, test: bpf.JumpEqual, val: word(ip[i:]) & m})
+		}
+		return allOf(words...)
+	}
+	return allOf(family, direction(q.dir, match(src), match(dst))), nil
+}
+
+func word(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// ports matches TCP, UDP, or SCTP ports from lo to hi inclusive.
+func (p *parser) ports(q qualifiers, lo, hi uint32) (pred, error) {
+	protos := []uint32{ipProtos["tcp"], ipProtos["udp"], ipProtos["sctp"]}
+	switch q.proto {
+	case "", "ip", "ip6":
+	case "tcp", "udp", "sctp":
+		protos = []uint32{ipProtos[q.proto]}
+	default:
+		return nil, fmt.Errorf("%v %v: %w", q.proto, q.kind, ErrQualifier)
+	}
+
+	check := func(load func(uint32, int) []bpf.Instruction) pred {
+		at := func(off uint32) pred {
+			if lo == hi {
+				return atom{code: load(off, 2), test: bpf.JumpEqual, val: lo}
+			}
+			return allOf(
+				atom{code: load(off, 2), test: bpf.JumpGreaterOrEqual, val: lo},
+				atom{code: load(off, 2), test: bpf.JumpLessOrEqual, val: hi},
+			)
+		}
+		return direction(q.dir, at(0), at(2))
+	}
+
+	var v4, v6 pred
+	if q.proto != "ip6" {
+		var match []pred
+		for _, n := range protos {
+			match = append(match, atom{code: loadAbs(p.link.hdr+9, 1), test: bpf.JumpEqual, val: n})
+		}
+		v4 = allOf(p.link.ipv4(), anyOf(match...), p.link.v4unfragmented(), check(p.link.transport4))
+	}
+	if q.proto != "ip" {
+		var match []pred
+		for _, n := range protos {
+			match = append(match, atom{code: loadAbs(p.link.hdr+6, 1), test: bpf.JumpEqual, val: n})
+		}
+		v6 = allOf(p.link.ipv6(), anyOf(match...), check(p.link.transport6))
+	}
+	return anyOf(v4, v6), nil
+}
+
+func parsePort(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("port %q: %w; service names are not supported", s, ErrNeedNumber)
+	}
+	return uint32(n), nil
+}
+
+// number parses the next token as a number no larger than limit.
+func (p *parser) number(what string, limit uint64) (uint32, error) {
+	t := p.next()
+	n, err := strconv.ParseUint(t.text, 0, 32)
+	if t.kind != tokWord || err != nil || n > limit {
+		return 0, fmt.Errorf("%v %v: %w", what, t, ErrNeedNumber)
+	}
+	return uint32(n), nil
+}
@@ -0,0 +1,240 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultFanoutDepth is how many messages may be queued for each sink of a
+// Fanout before more are dropped.
+const DefaultFanoutDepth = 10000
+
+// fanoutDrainTimeout is how long Close waits for the sinks to publish what's
+// already queued before dropping the rest.
+const fanoutDrainTimeout = 10 * time.Second
+
+// fanoutRetry is how long a sink which failed to connect waits before trying
+// again.
+const fanoutRetry = 10 * time.Second
+
+var (
+	// ErrSinkFull indicates that a message couldn't be queued for one or more
+	// sinks of a Fanout, as they had too many waiting to be published.
+	ErrSinkFull = errors.New("publisher queue is full")
+)
+
+// item is a message or call detail record queued for a sink.
+type item struct {
+	msg *collect.Msg
+	cdr *cdr.Record
+}
+
+// sink is one Publisher of a Fanout, with its own queue, so a sink which is
+// slow or failing doesn't hold up the others.
+type sink struct {
+	Publisher
+	name      string
+	queue     chan item
+	dropped   prometheus.Counter
+	failures  prometheus.Counter
+	connected bool
+}
+
+// Fanout is a Publisher sending every message and record to each of several
+// sinks at once.  Each sink publishes from its own queue, in order, so one
+// which is slow, failing, or not yet connected doesn't hold up the others; if
+// its queue fills, what doesn't fit is dropped for that sink alone.
+type Fanout struct {
+	sinks   []*sink
+	wg      sync.WaitGroup
+	timeout time.Duration
+	retry   time.Duration
+	cancel  context.CancelFunc
+	closing chan struct{}
+}
+
+// NewFanout creates a Fanout to the given sinks, by name, with a queue of
+// DefaultFanoutDepth for each.
+func NewFanout(sinks map[string]Publisher) *Fanout {
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f := &Fanout{timeout: fanoutDrainTimeout, retry: fanoutRetry, closing: make(chan struct{})}
+	for _, name := range names {
+		f.sinks = append(f.sinks, &sink{
+			Publisher: sinks[name],
+			name:      name,
+			queue:     make(chan item, DefaultFanoutDepth),
+			dropped: prometheus.NewCounter(prometheus.CounterOpts{
+				Name:        "publisher_dropped_total",
+				Help:        "Number of messages and call detail records dropped due to a full publisher queue, by publisher",
+				ConstLabels: prometheus.Labels{"publisher": name},
+			}),
+			failures: prometheus.NewCounter(prometheus.CounterOpts{
+				Name:        "publisher_connect_failures_total",
+				Help:        "Number of failed attempts to connect a publisher, by publisher",
+				ConstLabels: prometheus.Labels{"publisher": name},
+			}),
+		})
+	}
+	return f
+}
+
+// Connect connects every sink, then starts each publishing from its queue.
+// A sink which fails to connect keeps queueing, trying to connect again every
+// fanoutRetry, so it doesn't stop the others publishing; only if every sink
+// fails is an error returned.
+func (f *Fanout) Connect(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	var errs []string
+	for _, s := range f.sinks {
+		if err := s.Connect(ctx); err != nil {
+			s.failures.Inc()
+			log.Warn().Err(err).Str("publisher", s.name).Msg("publisher failed to connect, retrying")
+			errs = append(errs, fmt.Sprintf("%s publisher: %v", s.name, err))
+			continue
+		}
+		s.connected = true
+	}
+	if len(errs) == len(f.sinks) {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	ctx, f.cancel = context.WithCancel(ctx)
+	for _, s := range f.sinks {
+		f.wg.Add(1)
+		go f.drain(ctx, s)
+	}
+	return nil
+}
+
+// reconnect tries to connect a sink every retry, until it succeeds, ctx is
+// done, or the Fanout is closing.
+func (f *Fanout) reconnect(ctx context.Context, s *sink) bool {
+	log := zerolog.Ctx(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-f.closing:
+			return false
+		case <-time.After(f.retry):
+		}
+		if err := s.Connect(ctx); err != nil {
+			s.failures.Inc()
+			log.Warn().Err(err).Str("publisher", s.name).Msg("publisher failed to connect, retrying")
+			continue
+		}
+		log.Info().Str("publisher", s.name).Msg("publisher connected")
+		s.connected = true
+		return true
+	}
+}
+
+// drain publishes everything queued for a sink until its queue is closed,
+// connecting it first if it isn't already.  Failures are counted and logged
+// by each sink.  Once ctx is done, or if the sink never connects, what's left
+// is dropped.
+func (f *Fanout) drain(ctx context.Context, s *sink) {
+	defer f.wg.Done()
+	log := zerolog.Ctx(ctx)
+	if !s.connected && !f.reconnect(ctx, s) {
+		for range s.queue {
+			s.dropped.Inc()
+		}
+		return
+	}
+	for it := range s.queue {
+		if ctx.Err() != nil {
+			s.dropped.Inc()
+			continue
+		}
+		if it.msg != nil {
+			if err := s.Publish(ctx, it.msg); err != nil {
+				log.Err(err).Str("publisher", s.name).Str("id", it.msg.ID).Msg("publish failed")
+			}
+		} else if err := s.PublishCDR(ctx, it.cdr); err != nil {
+			log.Err(err).Str("publisher", s.name).Str("call_id", it.cdr.CallID).Msg("publish cdr failed")
+		}
+	}
+}
+
+// enqueue queues an item for every sink, returning ErrSinkFull naming each
+// whose queue was full.
+func (f *Fanout) enqueue(it item) error {
+	var full []string
+	for _, s := range f.sinks {
+		select {
+		case s.queue <- it:
+		default:
+			s.dropped.Inc()
+			full = append(full, s.name)
+		}
+	}
+	if full != nil {
+		return fmt.Errorf("%s: %w", strings.Join(full, ", "), ErrSinkFull)
+	}
+	return nil
+}
+
+// Publish queues a collect.Msg for every sink.  It doesn't wait for them to
+// publish it.
+func (f *Fanout) Publish(_ context.Context, msg *collect.Msg) error {
+	return f.enqueue(item{msg: msg})
+}
+
+// PublishCDR queues a cdr.Record for every sink.  It doesn't wait for them
+// to publish it.
+func (f *Fanout) PublishCDR(_ context.Context, r *cdr.Record) error {
+	return f.enqueue(item{cdr: r})
+}
+
+// Close publishes everything already queued, dropping what the sinks haven't
+// published within fanoutDrainTimeout, or can't as they never connected, then
+// closes every connected sink.
+func (f *Fanout) Close() {
+	close(f.closing)
+	for _, s := range f.sinks {
+		close(s.queue)
+	}
+	drained := make(chan struct{})
+	go func() { f.wg.Wait(); close(drained) }()
+	timer := time.NewTimer(f.timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+	}
+	if f.cancel != nil {
+		f.cancel()
+	}
+	<-drained
+	for _, s := range f.sinks {
+		if s.connected {
+			s.Close()
+		}
+	}
+}
+
+// Metrics returns the metrics of every sink, and of how many items each
+// dropped and how often it failed to connect.
+func (f *Fanout) Metrics() []prometheus.Collector {
+	var list []prometheus.Collector
+	for _, s := range f.sinks {
+		list = append(list, s.Metrics()...)
+		list = append(list, s.dropped, s.failures)
+	}
+	return list
+}
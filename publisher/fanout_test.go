@@ -0,0 +1,201 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var errTest = errors.New("test failure")
+
+// testSink records what it publishes, failing every message while fail is
+// set.
+type testSink struct {
+	sync.Mutex
+	metrics   *Metrics
+	fail      bool
+	msgs      []*collect.Msg
+	records   []*cdr.Record
+	connected bool
+	closed    bool
+}
+
+func newTestSink(name string) *testSink { return &testSink{metrics: NewMetrics(name)} }
+
+func (s *testSink) Connect(context.Context) error { s.connected = true; return nil }
+
+func (s *testSink) Publish(_ context.Context, m *collect.Msg) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.fail {
+		return s.metrics.Count(errTest)
+	}
+	s.msgs = append(s.msgs, m)
+	return s.metrics.Count(nil)
+}
+
+func (s *testSink) PublishCDR(_ context.Context, r *cdr.Record) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records = append(s.records, r)
+	return s.metrics.Count(nil)
+}
+
+func (s *testSink) Close() { s.closed = true }
+
+func (s *testSink) Metrics() []prometheus.Collector { return s.metrics.List() }
+
+func TestFanout(t *testing.T) {
+	is := is.New(t)
+	good, failing, slow := newTestSink("good"), newTestSink("failing"), newTestSink("slow")
+	failing.fail = true
+	f := NewFanout(map[string]Publisher{"good": good, "failing": failing, "slow": slow})
+	is.Equal(f.sinks[2].name, "slow")
+	// nothing is published until Connect, so the slow sink's short queue
+	// fills while the others still take everything.
+	f.sinks[2].queue = make(chan item, 2)
+
+	for i := 0; i < 4; i++ {
+		err := f.Publish(context.Background(), &collect.Msg{})
+		if i < 2 {
+			is.NoErr(err)
+			continue
+		}
+		is.True(errors.Is(err, ErrSinkFull))
+		is.Equal(err.Error(), "slow: "+ErrSinkFull.Error())
+	}
+	err := f.PublishCDR(context.Background(), &cdr.Record{CallID: "call-1"})
+	is.True(errors.Is(err, ErrSinkFull))
+
+	is.NoErr(f.Connect(context.Background()))
+	is.True(good.connected && failing.connected && slow.connected)
+	f.Close()
+
+	is.True(good.closed && failing.closed && slow.closed)
+	is.Equal(len(good.msgs), 4)
+	is.Equal(len(good.records), 1)
+	is.Equal(len(failing.msgs), 0)
+	is.Equal(len(failing.records), 1)
+	is.Equal(len(slow.msgs), 2)
+	is.Equal(len(slow.records), 0)
+	is.Equal(testutil.ToFloat64(good.metrics.Published), 5.0)
+	is.Equal(testutil.ToFloat64(failing.metrics.Failed), 4.0)
+	is.Equal(testutil.ToFloat64(f.sinks[2].dropped), 3.0)
+	is.Equal(len(f.Metrics()), 12)
+}
+
+// downSink fails to connect until up is set.
+type downSink struct {
+	*testSink
+	up chan struct{}
+}
+
+func (s downSink) Connect(ctx context.Context) error {
+	select {
+	case <-s.up:
+		return s.testSink.Connect(ctx)
+	default:
+		return errTest
+	}
+}
+
+func TestFanoutConnectFailure(t *testing.T) {
+	is := is.New(t)
+	good, down := newTestSink("good"), downSink{newTestSink("down"), make(chan struct{})}
+	f := NewFanout(map[string]Publisher{"good": good, "down": down})
+	f.retry = time.Millisecond
+
+	// one sink failing to connect doesn't stop the other publishing.
+	is.NoErr(f.Connect(context.Background()))
+	is.NoErr(f.Publish(context.Background(), &collect.Msg{}))
+	for i := 0; i < 100 && testutil.ToFloat64(good.metrics.Published) < 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(testutil.ToFloat64(good.metrics.Published), 1.0)
+	is.True(testutil.ToFloat64(f.sinks[0].failures) >= 1) // down sorts first
+
+	// once it connects, it publishes what was queued meanwhile.
+	close(down.up)
+	for i := 0; i < 100 && testutil.ToFloat64(down.metrics.Published) < 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	f.Close()
+	is.True(down.connected && down.closed)
+	is.Equal(testutil.ToFloat64(down.metrics.Published), 1.0)
+	is.Equal(testutil.ToFloat64(f.sinks[0].dropped), 0.0)
+
+	// a sink which never connects drops what was queued, and isn't closed.
+	never := downSink{newTestSink("never"), make(chan struct{})}
+	f = NewFanout(map[string]Publisher{"good": newTestSink("good"), "never": never})
+	is.NoErr(f.Connect(context.Background()))
+	is.NoErr(f.Publish(context.Background(), &collect.Msg{}))
+	f.Close()
+	is.True(!never.closed)
+	is.Equal(testutil.ToFloat64(f.sinks[1].dropped), 1.0)
+
+	// only if every sink fails does Connect fail.
+	f = NewFanout(map[string]Publisher{"never": never})
+	is.True(f.Connect(context.Background()) != nil)
+}
+
+// blockingSink publishes nothing until ctx is done.
+type blockingSink struct{ *testSink }
+
+func (s blockingSink) Publish(ctx context.Context, _ *collect.Msg) error {
+	<-ctx.Done()
+	return s.metrics.Count(ctx.Err())
+}
+
+func TestFanoutCloseTimeout(t *testing.T) {
+	is := is.New(t)
+	stuck := blockingSink{newTestSink("stuck")}
+	f := NewFanout(map[string]Publisher{"stuck": stuck})
+	f.timeout = 10 * time.Millisecond
+	is.NoErr(f.Connect(context.Background()))
+	for i := 0; i < 3; i++ {
+		is.NoErr(f.Publish(context.Background(), &collect.Msg{}))
+	}
+	f.Close()
+
+	is.True(stuck.closed)
+	is.Equal(testutil.ToFloat64(stuck.metrics.Failed), 1.0) // the one being published
+	is.Equal(testutil.ToFloat64(f.sinks[0].dropped), 2.0)   // the rest
+}
+
+func TestNew(t *testing.T) {
+	testCases := map[string]struct {
+		list  string
+		sinks int
+		err   bool
+	}{
+		"one":      {"mqtt", 1, false},
+		"several":  {" MQTT, hep ", 2, false},
+		"repeated": {"hep,hep", 1, false},
+		"unknown":  {"mqtt,carrier-pigeon", 0, true},
+		"none":     {",", 0, true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			p, err := New(tc.list, Options{})
+			if tc.err {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			f, ok := p.(*Fanout)
+			is.Equal(ok, tc.sinks > 1)
+			if ok {
+				is.Equal(len(f.sinks), tc.sinks)
+			}
+		})
+	}
+}
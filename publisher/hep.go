@@ -0,0 +1,185 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/nextcaller/sip-capture/hep"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// HEPPublisher sends each collect.Msg as HEPv3 to a HOMER capture server,
+// such as heplify-server, over UDP or TCP.  Call detail records are sent as
+// JSON logs, correlated with their calls' messages by Call-ID.
+type HEPPublisher struct {
+	opts    HEPOptions
+	metrics *Metrics
+
+	mu      sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+// HEPOptions controls where HEPPublisher sends messages, and how it
+// identifies itself.
+type HEPOptions struct {
+	// Server is a URL such as udp://homer:9060 or tcp://homer:9061.
+	Server   string
+	AuthKey  string
+	NodeID   uint32
+	NodeName string
+}
+
+// NewHEP creates a HEPPublisher from the given options.
+func NewHEP(o HEPOptions) *HEPPublisher {
+	return &HEPPublisher{opts: o, metrics: NewMetrics("hep")}
+}
+
+// dial connects to the server; the lock must be held.
+func (h *HEPPublisher) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: defaultResponseTimeout}
+	conn, err := d.DialContext(ctx, h.network, h.addr)
+	if err != nil {
+		return fmt.Errorf("hep connect failed: %w", err)
+	}
+	h.conn = conn
+	return nil
+}
+
+// Connect checks the server address and connects to it.
+func (h *HEPPublisher) Connect(ctx context.Context) error {
+	u, err := url.Parse(h.opts.Server)
+	if err != nil {
+		return fmt.Errorf("parsing hep server: %w", err)
+	}
+	switch u.Scheme {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("hep server %v must be a udp:// or tcp:// URL", h.opts.Server)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.network, h.addr = u.Scheme, u.Host
+	return h.dial(ctx)
+}
+
+// packet converts a collect.Msg into a HEP packet.
+func (h *HEPPublisher) packet(msg *collect.Msg) *hep.Packet {
+	p := &hep.Packet{
+		Version:       3,
+		Protocol:      layers.IPProtocolUDP,
+		Timestamp:     msg.Time,
+		ProtoType:     hep.ProtoSIP,
+		NodeID:        h.opts.NodeID,
+		NodeName:      h.opts.NodeName,
+		AuthKey:       h.opts.AuthKey,
+		CorrelationID: msg.ID,
+		Payload:       msg.SIPData,
+	}
+	setCapture(p, msg.Capture)
+	return p
+}
+
+// setCapture sets the addresses, ports, and transport of a HEP packet from
+// where its payload was captured.
+func setCapture(p *hep.Packet, m *capture.Meta) {
+	if m == nil {
+		return
+	}
+	p.SrcIP, p.DstIP = m.SrcIP, m.DstIP
+	p.SrcPort, p.DstPort = m.SrcPort, m.DstPort
+	switch m.Transport {
+	case capture.TCP, capture.TLS, capture.WS, capture.WSS:
+		p.Protocol = layers.IPProtocolTCP
+	case capture.SCTP:
+		p.Protocol = layers.IPProtocolSCTP
+	}
+}
+
+// Publish encodes a collect.Msg as HEPv3 and sends it to the server.
+func (h *HEPPublisher) Publish(ctx context.Context, msg *collect.Msg) error {
+	data, err := hep.Encode(h.packet(msg))
+	if err != nil {
+		return h.metrics.Count(fmt.Errorf("encoding Msg as hep: %w", err))
+	}
+	return h.metrics.Count(h.send(ctx, data))
+}
+
+// PublishCDR encodes a cdr.Record as a HEPv3 JSON log, with the addresses of
+// its call's INVITE, and sends it to the server.
+func (h *HEPPublisher) PublishCDR(ctx context.Context, r *cdr.Record) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return h.metrics.Count(fmt.Errorf("marshaling Record to json: %w", err))
+	}
+	p := &hep.Packet{
+		Version:       3,
+		Protocol:      layers.IPProtocolUDP,
+		Timestamp:     r.End,
+		ProtoType:     hep.ProtoLog,
+		NodeID:        h.opts.NodeID,
+		NodeName:      h.opts.NodeName,
+		AuthKey:       h.opts.AuthKey,
+		CorrelationID: r.CallID,
+		Payload:       payload,
+	}
+	setCapture(p, r.Capture)
+	data, err := hep.Encode(p)
+	if err != nil {
+		return h.metrics.Count(fmt.Errorf("encoding Record as hep: %w", err))
+	}
+	return h.metrics.Count(h.send(ctx, data))
+}
+
+// send writes an encoded packet to the server.  If the connection has
+// failed, it reconnects and tries once more.
+func (h *HEPPublisher) send(ctx context.Context, data []byte) error {
+	log := zerolog.Ctx(ctx)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if h.conn == nil {
+			if err := h.dial(ctx); err != nil {
+				return err
+			}
+			log.Info().Str("server", h.opts.Server).Msg("hep reconnected")
+		}
+		_ = h.conn.SetWriteDeadline(time.Now().Add(timeoutFromCtx(ctx, defaultResponseTimeout)))
+		_, err := h.conn.Write(data)
+		if err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+		if attempt > 0 {
+			return fmt.Errorf("hep publish failed: %w", err)
+		}
+		log.Err(err).Msg("hep send failed, reconnecting")
+	}
+}
+
+// Close disconnects from the server.
+func (h *HEPPublisher) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// Metrics returns a list of prometheus.Collector interfaces, suitable for
+// passing to prometheus.Registry to export publishing metrics.
+func (h *HEPPublisher) Metrics() []prometheus.Collector { return h.metrics.List() }
@@ -0,0 +1,132 @@
+package publisher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/nextcaller/sip-capture/hep"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var hepTestMsg = &collect.Msg{
+	ID:      "call-1",
+	Time:    time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC),
+	SIPData: []byte("BYE sip:bob@example.com SIP/2.0\r\nCall-ID: call-1\r\n\r\n"),
+	Capture: &capture.Meta{
+		SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2"),
+		SrcPort: 5060, DstPort: 5061, Transport: capture.TLS,
+	},
+}
+
+// checkHEPMsg checks a HEP packet is hepTestMsg, as sent by a publisher with
+// the options of TestHEP.
+func checkHEPMsg(is *is.I, p *hep.Packet) {
+	is.Equal(p.ProtoType, uint8(hep.ProtoSIP))
+	is.Equal(p.Protocol, layers.IPProtocolTCP) // TLS is carried over TCP
+	is.True(p.SrcIP.Equal(hepTestMsg.Capture.SrcIP))
+	is.True(p.DstIP.Equal(hepTestMsg.Capture.DstIP))
+	is.Equal(p.SrcPort, uint16(5060))
+	is.Equal(p.DstPort, uint16(5061))
+	is.True(p.Timestamp.Equal(hepTestMsg.Time))
+	is.Equal(p.CorrelationID, "call-1")
+	is.Equal(p.NodeID, uint32(7))
+	is.Equal(p.AuthKey, "secret")
+	is.Equal(string(p.Payload), string(hepTestMsg.SIPData))
+}
+
+func TestHEP(t *testing.T) {
+	is := is.New(t)
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer c.Close()
+
+	h := NewHEP(HEPOptions{Server: "udp://" + c.LocalAddr().String(), AuthKey: "secret", NodeID: 7})
+	ctx := context.Background()
+	is.NoErr(h.Connect(ctx))
+	defer h.Close()
+	is.NoErr(h.Publish(ctx, hepTestMsg))
+	is.NoErr(h.PublishCDR(ctx, &cdr.Record{CallID: "call-1", Capture: hepTestMsg.Capture}))
+
+	buf := make([]byte, 65536)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.ReadFrom(buf)
+	is.NoErr(err)
+	p, err := hep.Decode(buf[:n])
+	is.NoErr(err)
+	checkHEPMsg(is, p)
+
+	n, _, err = c.ReadFrom(buf)
+	is.NoErr(err)
+	p, err = hep.Decode(buf[:n])
+	is.NoErr(err)
+	is.Equal(p.ProtoType, uint8(hep.ProtoLog))
+	is.Equal(p.CorrelationID, "call-1")
+	var r cdr.Record
+	is.NoErr(json.Unmarshal(p.Payload, &r))
+	is.Equal(r.CallID, "call-1")
+	is.Equal(testutil.ToFloat64(h.metrics.Published), 2.0)
+}
+
+// A TCP connection which fails is reconnected, and the packet sent again.
+func TestHEPReconnect(t *testing.T) {
+	is := is.New(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer l.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	next := func() *bufio.Reader {
+		select {
+		case c := <-conns:
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			return bufio.NewReader(c)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a connection")
+			return nil
+		}
+	}
+
+	h := NewHEP(HEPOptions{Server: "tcp://" + l.Addr().String(), AuthKey: "secret", NodeID: 7})
+	ctx := context.Background()
+	is.NoErr(h.Connect(ctx))
+	defer h.Close()
+	first := next()
+	is.NoErr(h.Publish(ctx, hepTestMsg))
+	p, err := hep.Read(first)
+	is.NoErr(err)
+	checkHEPMsg(is, p)
+
+	h.conn.Close() // the connection fails
+	is.NoErr(h.Publish(ctx, hepTestMsg))
+	p, err = hep.Read(next())
+	is.NoErr(err)
+	checkHEPMsg(is, p)
+	is.Equal(testutil.ToFloat64(h.metrics.Published), 2.0)
+	is.Equal(testutil.ToFloat64(h.metrics.Failed), 0.0)
+}
+
+func TestHEPServer(t *testing.T) {
+	for _, server := range []string{"http://homer:9060", "udp://[::1"} {
+		t.Run(server, func(t *testing.T) {
+			is := is.New(t)
+			is.True(NewHEP(HEPOptions{Server: server}).Connect(context.Background()) != nil)
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package publisher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// Formats of HTTP request bodies.
+const (
+	// HTTPFormatJSON posts a batch as a JSON array.
+	HTTPFormatJSON = "json"
+	// HTTPFormatNDJSON posts a batch as newline delimited JSON, one value to
+	// a line.
+	HTTPFormatNDJSON = "ndjson"
+)
+
+const (
+	// httpQueueDepth is how many batches may wait to be posted.
+	httpQueueDepth = 100
+	// httpMaxBackoff is the longest to wait between retries, even if the
+	// collector asks for longer with Retry-After.
+	httpMaxBackoff = 30 * time.Second
+	// httpCloseTimeout is how long Close lets failed batches be retried
+	// before giving up on them.
+	httpCloseTimeout = 10 * time.Second
+)
+
+var (
+	// ErrHTTPTimeout indicates that a batch couldn't be queued to be posted
+	// in time, as too many are waiting already.
+	ErrHTTPTimeout = errors.New("http batch queue timed out")
+	// ErrHTTPRejected indicates that the collector rejected a batch, with a
+	// status which retrying won't change.
+	ErrHTTPRejected = errors.New("http collector rejected batch")
+)
+
+// HTTPPublisher posts batches of messages, and of call detail records, to an
+// HTTP collector.  Each batch is posted once BatchSize have been published,
+// or once the first of them is BatchAge old.  Batches which fail with a
+// network error, a 5xx status, or 429 are retried with exponential backoff,
+// or after the Retry-After the collector sent, up to httpMaxBackoff.  Each
+// message is counted published or failed as its batch is.
+type HTTPPublisher struct {
+	opts    HTTPOptions
+	metrics *Metrics
+	client  *http.Client
+
+	mu   sync.Mutex
+	msgs *httpBatch
+	cdrs *httpBatch
+
+	batches chan *httpBatch
+	stop    chan struct{}
+	closing chan struct{}
+	timeout time.Duration
+	wg      sync.WaitGroup
+}
+
+// HTTPOptions controls where and how HTTPPublisher posts batches.  CDRURL is
+// where call detail records are posted, URL with "/cdr" appended to its path
+// if empty.  Format is HTTPFormatJSON, the default, or HTTPFormatNDJSON.
+// Batches are retried up to MaxRetries times, waiting Backoff at first, and
+// twice as long each time after.  BearerToken is sent as the Authorization,
+// and TLS files are those of mutual TLS.
+type HTTPOptions struct {
+	URL        string
+	CDRURL     string
+	Format     string
+	Gzip       bool
+	BatchSize  int
+	BatchAge   time.Duration
+	Timeout    time.Duration
+	MaxRetries int
+	Backoff    time.Duration
+
+	BearerToken string
+	TLSCAFile   string
+	TLSKeyFile  string
+	TLSCertFile string
+}
+
+// httpBatch is a batch of JSON encoded messages or records for a URL.
+type httpBatch struct {
+	url     string
+	started time.Time
+	items   [][]byte
+}
+
+// NewHTTP creates an HTTPPublisher from the given options.
+func NewHTTP(o HTTPOptions) *HTTPPublisher {
+	if o.CDRURL == "" {
+		if u, err := url.Parse(o.URL); err == nil {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/cdr"
+			o.CDRURL = u.String()
+		}
+	}
+	if o.Format == "" {
+		o.Format = HTTPFormatJSON
+	}
+	if o.BatchSize < 1 {
+		o.BatchSize = 1
+	}
+	if o.BatchAge <= 0 {
+		o.BatchAge = time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 500 * time.Millisecond
+	}
+	return &HTTPPublisher{
+		opts:    o,
+		metrics: NewMetrics("http"),
+		batches: make(chan *httpBatch, httpQueueDepth),
+		stop:    make(chan struct{}),
+		closing: make(chan struct{}),
+		timeout: httpCloseTimeout,
+	}
+}
+
+// Connect checks the options, and begins posting batches.  It doesn't
+// contact the collector, which is only sent batches.
+func (h *HTTPPublisher) Connect(ctx context.Context) error {
+	for _, u := range []string{h.opts.URL, h.opts.CDRURL} {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			return fmt.Errorf("http collector %q must be an http:// or https:// URL", u)
+		}
+	}
+	switch h.opts.Format {
+	case HTTPFormatJSON, HTTPFormatNDJSON:
+	default:
+		return fmt.Errorf("unknown http format %q (json, ndjson)", h.opts.Format)
+	}
+	tc, err := tlsCfg(h.opts.TLSCAFile, h.opts.TLSKeyFile, h.opts.TLSCertFile)
+	if err != nil {
+		return err
+	}
+	h.client = &http.Client{
+		Timeout:   h.opts.Timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tc},
+	}
+
+	h.wg.Add(2)
+	go h.post(ctx)
+	go h.age(ctx)
+	return nil
+}
+
+// add adds data to the pending batch, queueing it to be posted once full.
+func (h *HTTPPublisher) add(ctx context.Context, pending **httpBatch, target string, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if *pending == nil {
+		*pending = &httpBatch{url: target, started: time.Now()}
+	}
+	b := *pending
+	b.items = append(b.items, data)
+	if len(b.items) < h.opts.BatchSize {
+		return nil
+	}
+	*pending = nil
+	return h.queue(ctx, b)
+}
+
+// queue queues a batch to be posted, waiting until the ctx deadline, or
+// defaultResponseTimeout, if too many are waiting already.  The lock must be
+// held, so batches are queued in order.
+func (h *HTTPPublisher) queue(ctx context.Context, b *httpBatch) error {
+	timer := time.NewTimer(timeoutFromCtx(ctx, defaultResponseTimeout))
+	defer timer.Stop()
+	select {
+	case h.batches <- b:
+		return nil
+	case <-timer.C:
+		h.metrics.Failed.Add(float64(len(b.items)))
+		return ErrHTTPTimeout
+	}
+}
+
+// age queues pending batches once their first item is BatchAge old, until
+// stop is closed.
+func (h *HTTPPublisher) age(ctx context.Context) {
+	defer h.wg.Done()
+	interval := h.opts.BatchAge / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			h.mu.Lock()
+			for _, pending := range []**httpBatch{&h.msgs, &h.cdrs} {
+				if *pending == nil || now.Sub((*pending).started) < h.opts.BatchAge {
+					continue
+				}
+				if err := h.queue(ctx, *pending); err != nil {
+					zerolog.Ctx(ctx).Err(err).Msg("http batch dropped")
+				}
+				*pending = nil
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// post posts each queued batch, in order, until the queue is closed.
+func (h *HTTPPublisher) post(ctx context.Context) {
+	defer h.wg.Done()
+	log := zerolog.Ctx(ctx)
+	for b := range h.batches {
+		n := float64(len(b.items))
+		if err := h.send(ctx, b); err != nil {
+			h.metrics.Failed.Add(n)
+			log.Err(err).Str("url", b.url).Int("count", len(b.items)).Msg("http post failed")
+			continue
+		}
+		h.metrics.Published.Add(n)
+	}
+}
+
+// encode encodes a batch as the request body, compressing it if enabled.
+func (h *HTTPPublisher) encode(b *httpBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if h.opts.Gzip {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	sep, end := []byte{'\n'}, []byte{'\n'}
+	if h.opts.Format == HTTPFormatJSON {
+		_, _ = w.Write([]byte{'['})
+		sep, end = []byte{','}, []byte{']'}
+	}
+	for i, item := range b.items {
+		if i > 0 {
+			_, _ = w.Write(sep)
+		}
+		_, _ = w.Write(item)
+	}
+	_, _ = w.Write(end)
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("compressing http batch: %w", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// retryable is an error which posting the batch again may not repeat, with
+// how long the collector asked to wait first, if it did.
+type retryable struct {
+	err   error
+	after time.Duration
+}
+
+func (r *retryable) Error() string { return r.err.Error() }
+
+func (r *retryable) Unwrap() error { return r.err }
+
+// send posts a batch, retrying with exponential backoff while it fails with
+// an error which may not be repeated.  Retrying stops once the publisher has
+// been closing for too long, or ctx is done.
+func (h *HTTPPublisher) send(ctx context.Context, b *httpBatch) error {
+	body, err := h.encode(b)
+	if err != nil {
+		return err
+	}
+	backoff := h.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := h.request(ctx, b.url, body)
+		var r *retryable
+		if err == nil || !errors.As(err, &r) || attempt >= h.opts.MaxRetries {
+			return err
+		}
+		wait := backoff
+		if r.after > 0 {
+			wait = r.after
+		}
+		if wait > httpMaxBackoff {
+			wait = httpMaxBackoff
+		}
+		zerolog.Ctx(ctx).Warn().Err(err).Dur("wait", wait).Msg("retrying http post")
+		select {
+		case <-time.After(wait):
+		case <-h.closing:
+			return fmt.Errorf("%w, not retried as closing", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > httpMaxBackoff {
+			backoff = httpMaxBackoff
+		}
+	}
+}
+
+// request posts a request body to target once.
+func (h *HTTPPublisher) request(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating http request: %w", err)
+	}
+	if h.opts.Format == HTTPFormatNDJSON {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.opts.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if h.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.opts.BearerToken)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return &retryable{err: fmt.Errorf("http post failed: %w", err)}
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &retryable{
+			err:   fmt.Errorf("http collector returned %s", resp.Status),
+			after: retryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrHTTPRejected, resp.Status)
+	}
+}
+
+// retryAfter returns how long a Retry-After header, in seconds or an HTTP
+// date, asks to wait from now, or 0 if it doesn't.
+func retryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(header)); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Publish encodes a collect.Msg into json and adds it to the batch of
+// messages.
+func (h *HTTPPublisher) Publish(ctx context.Context, msg *collect.Msg) error {
+	jbytes, err := json.Marshal(msg)
+	if err != nil {
+		return h.metrics.Count(fmt.Errorf("marshaling Msg to json: %w", err))
+	}
+	return h.add(ctx, &h.msgs, h.opts.URL, jbytes)
+}
+
+// PublishCDR encodes a cdr.Record into json and adds it to the batch of
+// records.
+func (h *HTTPPublisher) PublishCDR(ctx context.Context, r *cdr.Record) error {
+	jbytes, err := json.Marshal(r)
+	if err != nil {
+		return h.metrics.Count(fmt.Errorf("marshaling Record to json: %w", err))
+	}
+	return h.add(ctx, &h.cdrs, h.opts.CDRURL, jbytes)
+}
+
+// Close posts the pending batches, and waits for everything queued to be
+// posted.  Batches which fail are retried as usual for up to
+// httpCloseTimeout, after which they aren't retried again.
+func (h *HTTPPublisher) Close() {
+	if h.client == nil {
+		return
+	}
+	close(h.stop)
+	h.mu.Lock()
+	for _, pending := range []**httpBatch{&h.msgs, &h.cdrs} {
+		if *pending != nil {
+			h.batches <- *pending
+			*pending = nil
+		}
+	}
+	h.mu.Unlock()
+	close(h.batches)
+
+	posted := make(chan struct{})
+	go func() { h.wg.Wait(); close(posted) }()
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case <-posted:
+	case <-timer.C:
+		close(h.closing)
+		<-posted
+	}
+}
+
+// Metrics returns a list of prometheus.Collector interfaces, suitable for
+// passing to prometheus.Registry to export publishing metrics.
+func (h *HTTPPublisher) Metrics() []prometheus.Collector { return h.metrics.List() }
@@ -0,0 +1,249 @@
+package publisher
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testCollector is an HTTP collector recording the IDs of each batch posted
+// to it, answering with each of its statuses in turn, then 200 OK.
+type testCollector struct {
+	*httptest.Server
+	sync.Mutex
+	statuses []int
+	posts    int
+	batches  map[string][][]string
+	headers  http.Header
+}
+
+func newTestCollector(is *is.I, statuses ...int) *testCollector {
+	c := &testCollector{statuses: statuses, batches: make(map[string][][]string)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Lock()
+		defer c.Unlock()
+		c.posts++
+		c.headers = r.Header
+		if len(c.statuses) > 0 {
+			status := c.statuses[0]
+			c.statuses = c.statuses[1:]
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(status)
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			is.NoErr(err)
+			body = zr
+		}
+		type item struct {
+			ID     string `json:"id"`
+			CallID string `json:"call_id"`
+		}
+		var items []item
+		if r.Header.Get("Content-Type") == "application/x-ndjson" {
+			scanner := bufio.NewScanner(body)
+			for scanner.Scan() {
+				var it item
+				is.NoErr(json.Unmarshal(scanner.Bytes(), &it))
+				items = append(items, it)
+			}
+		} else {
+			is.NoErr(json.NewDecoder(body).Decode(&items))
+		}
+		var ids []string
+		for _, it := range items {
+			ids = append(ids, it.ID+it.CallID)
+		}
+		c.batches[r.URL.Path] = append(c.batches[r.URL.Path], ids)
+	}))
+	return c
+}
+
+func TestHTTP(t *testing.T) {
+	testCases := map[string]struct {
+		opts     HTTPOptions
+		statuses []int
+		batches  map[string][][]string
+		posts    int
+		failed   float64
+	}{
+		"json": {
+			HTTPOptions{BatchSize: 2},
+			nil,
+			map[string][][]string{"/sip": {{"1", "2"}, {"3"}}, "/sip/cdr": {{"call-1"}}},
+			3, 0,
+		},
+		"gzipped ndjson": {
+			HTTPOptions{BatchSize: 3, Format: HTTPFormatNDJSON, Gzip: true},
+			nil,
+			map[string][][]string{"/sip": {{"1", "2", "3"}}, "/sip/cdr": {{"call-1"}}},
+			2, 0,
+		},
+		"retried": {
+			HTTPOptions{BatchSize: 3, MaxRetries: 2},
+			[]int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			map[string][][]string{"/sip": {{"1", "2", "3"}}, "/sip/cdr": {{"call-1"}}},
+			4, 0,
+		},
+		"retries exhausted": {
+			HTTPOptions{BatchSize: 3, MaxRetries: 1},
+			[]int{http.StatusBadGateway, http.StatusInternalServerError},
+			map[string][][]string{"/sip/cdr": {{"call-1"}}},
+			3, 3,
+		},
+		"rejected": {
+			HTTPOptions{BatchSize: 3, MaxRetries: 2},
+			[]int{http.StatusBadRequest},
+			map[string][][]string{"/sip/cdr": {{"call-1"}}},
+			2, 3,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			c := newTestCollector(is, tc.statuses...)
+			defer c.Close()
+			o := tc.opts
+			o.URL = c.URL + "/sip"
+			o.BatchAge = time.Hour
+			o.Backoff = time.Millisecond
+			o.BearerToken = "secret"
+			h := NewHTTP(o)
+			ctx := context.Background()
+			is.NoErr(h.Connect(ctx))
+			for _, id := range []string{"1", "2", "3"} {
+				is.NoErr(h.Publish(ctx, &collect.Msg{ID: id}))
+			}
+			// the batch of messages settles before the record's is posted,
+			// so the statuses are taken in order.
+			if tc.statuses != nil {
+				waitHTTP(h, 3)
+			}
+			is.NoErr(h.PublishCDR(ctx, &cdr.Record{CallID: "call-1"}))
+			h.Close()
+
+			is.Equal(c.batches, tc.batches)
+			is.Equal(c.posts, tc.posts)
+			is.Equal(c.headers.Get("Authorization"), "Bearer secret")
+			is.Equal(testutil.ToFloat64(h.metrics.Failed), tc.failed)
+			is.Equal(testutil.ToFloat64(h.metrics.Published), 4-tc.failed)
+		})
+	}
+}
+
+func TestHTTPClose(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	// the batches still pending when closing are retried.
+	c := newTestCollector(is, http.StatusServiceUnavailable)
+	defer c.Close()
+	h := NewHTTP(HTTPOptions{URL: c.URL + "/sip", BatchSize: 10, BatchAge: time.Hour, MaxRetries: 2, Backoff: time.Millisecond})
+	is.NoErr(h.Connect(ctx))
+	is.NoErr(h.Publish(ctx, &collect.Msg{ID: "1"}))
+	h.Close()
+	is.Equal(c.posts, 2)
+	is.Equal(testutil.ToFloat64(h.metrics.Published), 1.0)
+
+	// but not for longer than the close timeout.
+	statuses := make([]int, 100)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+	c = newTestCollector(is, statuses...)
+	defer c.Close()
+	h = NewHTTP(HTTPOptions{URL: c.URL + "/sip", BatchSize: 10, BatchAge: time.Hour, MaxRetries: 100, Backoff: time.Second})
+	h.timeout = 10 * time.Millisecond
+	is.NoErr(h.Connect(ctx))
+	is.NoErr(h.Publish(ctx, &collect.Msg{ID: "1"}))
+	start := time.Now()
+	h.Close()
+	is.True(time.Since(start) < time.Second)
+	is.Equal(testutil.ToFloat64(h.metrics.Failed), 1.0)
+}
+
+// waitHTTP waits up to a second for n items to be counted published or
+// failed.
+func waitHTTP(h *HTTPPublisher, n float64) {
+	for i := 0; i < 100; i++ {
+		if testutil.ToFloat64(h.metrics.Published)+testutil.ToFloat64(h.metrics.Failed) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPBatchAge(t *testing.T) {
+	is := is.New(t)
+	c := newTestCollector(is)
+	defer c.Close()
+	h := NewHTTP(HTTPOptions{URL: c.URL, BatchSize: 100, BatchAge: 20 * time.Millisecond})
+	ctx := context.Background()
+	is.NoErr(h.Connect(ctx))
+	defer h.Close()
+	is.NoErr(h.Publish(ctx, &collect.Msg{ID: "1"}))
+	waitHTTP(h, 1)
+	is.Equal(testutil.ToFloat64(h.metrics.Published), 1.0)
+}
+
+func TestHTTPOptions(t *testing.T) {
+	testCases := map[string]HTTPOptions{
+		"bad scheme":  {URL: "ftp://collector/sip"},
+		"bad format":  {URL: "http://collector/sip", Format: "xml"},
+		"missing ca":  {URL: "https://collector/sip", TLSCAFile: "testdata/missing.pem"},
+		"missing key": {URL: "https://collector/sip", TLSKeyFile: "testdata/missing.key", TLSCertFile: "testdata/missing.pem"},
+	}
+	for name, o := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			is.True(NewHTTP(o).Connect(context.Background()) != nil)
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC)
+	testCases := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"Mon, 20 Jul 2020 12:00:30 GMT": 30 * time.Second,
+		"Mon, 20 Jul 2020 11:00:00 GMT": 0,
+		"soon":                          0,
+	}
+	for header, expect := range testCases {
+		t.Run(header, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(retryAfter(header, now), expect)
+		})
+	}
+}
+
+func TestHTTPRejectedError(t *testing.T) {
+	is := is.New(t)
+	c := newTestCollector(is, http.StatusForbidden)
+	defer c.Close()
+	h := NewHTTP(HTTPOptions{URL: c.URL})
+	is.NoErr(h.Connect(context.Background()))
+	defer h.Close()
+	err := h.send(context.Background(), &httpBatch{url: c.URL, items: [][]byte{[]byte("{}")}})
+	is.True(errors.Is(err, ErrHTTPRejected))
+}
@@ -0,0 +1,295 @@
+package publisher
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/xdg/scram"
+)
+
+// Partition keys of Kafka messages.
+const (
+	// KafkaKeyCallID keys each message by its Call-ID, so a call's messages,
+	// and its call detail record, go to the same partition in order.
+	KafkaKeyCallID = "call-id"
+	// KafkaKeyNone leaves messages without a key, spreading them over every
+	// partition.
+	KafkaKeyNone = "none"
+)
+
+var (
+	// ErrKafkaTimeout indicates that a message couldn't be queued to the
+	// Kafka producer in time, as it's too far behind.
+	ErrKafkaTimeout = errors.New("kafka producer queue timed out")
+)
+
+// KafkaPublisher produces each collect.Msg to a Kafka topic, and each
+// cdr.Record to another.  Messages are batched and sent asynchronously; each
+// is counted published or failed once the brokers report its delivery.
+type KafkaPublisher struct {
+	opts     KafkaOptions
+	metrics  *Metrics
+	producer sarama.AsyncProducer
+	wg       sync.WaitGroup
+}
+
+// KafkaOptions controls how the Kafka producer is created.  CDRTopic is
+// where call detail records are produced, Topic with ".cdr" appended if
+// empty.  Key is KafkaKeyCallID, the default, or KafkaKeyNone; Acks is "all",
+// the default, "leader", or "none"; and Compression is "none", the default,
+// "gzip", "snappy", "lz4", or "zstd".
+// Up to BatchSize messages are sent at once, waiting at most Linger for
+// more.  Idempotent delivery requires Acks to be "all".  SASL is "plain",
+// "scram-sha-256", or "scram-sha-512", or empty to disable it.
+type KafkaOptions struct {
+	Brokers     []string
+	Topic       string
+	CDRTopic    string
+	ClientID    string
+	Version     string
+	Key         string
+	Acks        string
+	Compression string
+	BatchSize   int
+	Linger      time.Duration
+	Idempotent  bool
+
+	SASL         string
+	SASLUser     string
+	SASLPassword string
+
+	TLS         bool
+	TLSCAFile   string
+	TLSKeyFile  string
+	TLSCertFile string
+}
+
+// NewKafka creates a KafkaPublisher from the given options.
+func NewKafka(o KafkaOptions) *KafkaPublisher {
+	if o.CDRTopic == "" {
+		o.CDRTopic = o.Topic + ".cdr"
+	}
+	if o.Acks == "" {
+		o.Acks = "all"
+	}
+	if o.Compression == "" {
+		o.Compression = "none"
+	}
+	return &KafkaPublisher{opts: o, metrics: NewMetrics("kafka")}
+}
+
+var kafkaAcks = map[string]sarama.RequiredAcks{
+	"all":    sarama.WaitForAll,
+	"leader": sarama.WaitForLocal,
+	"none":   sarama.NoResponse,
+}
+
+var kafkaCompression = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+// config creates the producer's configuration from the options.
+func (k *KafkaPublisher) config() (*sarama.Config, error) {
+	o := k.opts
+	cfg := sarama.NewConfig()
+	if o.ClientID != "" {
+		cfg.ClientID = o.ClientID
+	}
+	if o.Version != "" {
+		v, err := sarama.ParseKafkaVersion(o.Version)
+		if err != nil {
+			return nil, fmt.Errorf("kafka version: %w", err)
+		}
+		cfg.Version = v
+	}
+	switch o.Key {
+	case "", KafkaKeyCallID, KafkaKeyNone:
+	default:
+		return nil, fmt.Errorf("unknown kafka partition key %q (call-id, none)", o.Key)
+	}
+
+	acks, ok := kafkaAcks[strings.ToLower(o.Acks)]
+	if !ok {
+		return nil, fmt.Errorf("unknown kafka acks %q (all, leader, none)", o.Acks)
+	}
+	cfg.Producer.RequiredAcks = acks
+	codec, ok := kafkaCompression[strings.ToLower(o.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown kafka compression %q (none, gzip, snappy, lz4, zstd)", o.Compression)
+	}
+	cfg.Producer.Compression = codec
+	cfg.Producer.Flush.Messages = o.BatchSize
+	cfg.Producer.Flush.MaxMessages = o.BatchSize
+	cfg.Producer.Flush.Frequency = o.Linger
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Return.Errors = true
+	if o.Idempotent {
+		if acks != sarama.WaitForAll {
+			return nil, errors.New("idempotent kafka delivery requires acks all")
+		}
+		cfg.Producer.Idempotent = true
+		cfg.Net.MaxOpenRequests = 1
+	}
+
+	switch strings.ToLower(o.SASL) {
+	case "":
+	case "plain":
+		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case "scram-sha-256":
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: scram.SHA256} }
+	case "scram-sha-512":
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: scramSHA512} }
+	default:
+		return nil, fmt.Errorf("unknown kafka sasl mechanism %q (plain, scram-sha-256, scram-sha-512)", o.SASL)
+	}
+	if o.SASL != "" {
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.User = o.SASLUser
+		cfg.Net.SASL.Password = o.SASLPassword
+	}
+
+	if o.TLS {
+		tc, err := tlsCfg(o.TLSCAFile, o.TLSKeyFile, o.TLSCertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tc
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("kafka config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Connect creates the producer, connecting to the brokers, and begins
+// counting delivery reports.
+func (k *KafkaPublisher) Connect(ctx context.Context) error {
+	cfg, err := k.config()
+	if err != nil {
+		return err
+	}
+	producer, err := sarama.NewAsyncProducer(k.opts.Brokers, cfg)
+	if err != nil {
+		return fmt.Errorf("kafka connect failed: %w", err)
+	}
+	k.producer = producer
+
+	log := zerolog.Ctx(ctx)
+	k.wg.Add(2)
+	go func() {
+		defer k.wg.Done()
+		for range producer.Successes() {
+			_ = k.metrics.Count(nil)
+		}
+	}()
+	go func() {
+		defer k.wg.Done()
+		for err := range producer.Errors() {
+			log.Err(k.metrics.Count(err.Err)).Str("topic", err.Msg.Topic).Msg("kafka delivery failed")
+		}
+	}()
+	return nil
+}
+
+// message creates the producer message of data, keyed by callID unless keys
+// are disabled.
+func (k *KafkaPublisher) message(topic, callID string, data []byte) *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)}
+	if k.opts.Key != KafkaKeyNone && callID != "" {
+		pm.Key = sarama.StringEncoder(callID)
+	}
+	return pm
+}
+
+// send queues a message to the producer, waiting until the ctx deadline, or
+// defaultResponseTimeout, if it's too far behind to take it.
+func (k *KafkaPublisher) send(ctx context.Context, pm *sarama.ProducerMessage) error {
+	zerolog.Ctx(ctx).Debug().Str("topic", pm.Topic).Msg("producing kafka message")
+	timer := time.NewTimer(timeoutFromCtx(ctx, defaultResponseTimeout))
+	defer timer.Stop()
+	select {
+	case k.producer.Input() <- pm:
+		return nil
+	case <-ctx.Done():
+		return k.metrics.Count(ctx.Err())
+	case <-timer.C:
+		return k.metrics.Count(ErrKafkaTimeout)
+	}
+}
+
+// Publish encodes a collect.Msg into json and queues it to be produced to
+// the topic, keyed by its Call-ID.
+func (k *KafkaPublisher) Publish(ctx context.Context, msg *collect.Msg) error {
+	jbytes, err := json.Marshal(msg)
+	if err != nil {
+		return k.metrics.Count(fmt.Errorf("marshaling Msg to json: %w", err))
+	}
+	return k.send(ctx, k.message(k.opts.Topic, msg.ID, jbytes))
+}
+
+// PublishCDR encodes a cdr.Record into json and queues it to be produced to
+// the CDR topic, keyed by its Call-ID.
+func (k *KafkaPublisher) PublishCDR(ctx context.Context, r *cdr.Record) error {
+	jbytes, err := json.Marshal(r)
+	if err != nil {
+		return k.metrics.Count(fmt.Errorf("marshaling Record to json: %w", err))
+	}
+	return k.send(ctx, k.message(k.opts.CDRTopic, r.CallID, jbytes))
+}
+
+// Close flushes what's queued, waiting for its delivery reports, and
+// disconnects from the brokers.
+func (k *KafkaPublisher) Close() {
+	if k.producer == nil {
+		return
+	}
+	k.producer.AsyncClose()
+	k.wg.Wait()
+}
+
+// Metrics returns a list of prometheus.Collector interfaces, suitable for
+// passing to prometheus.Registry to export publishing metrics.
+func (k *KafkaPublisher) Metrics() []prometheus.Collector { return k.metrics.List() }
+
+// scramSHA512 generates the SHA-512 hashes of SCRAM-SHA-512.
+var scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+
+// scramClient performs the SCRAM exchange of SASL authentication for
+// sarama.
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return fmt.Errorf("kafka scram: %w", err)
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) { return c.conv.Step(challenge) }
+
+func (c *scramClient) Done() bool { return c.conv.Done() }
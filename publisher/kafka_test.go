@@ -0,0 +1,87 @@
+package publisher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKafka(t *testing.T) {
+	is := is.New(t)
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("sip", 0, broker.BrokerID()).
+			SetLeader("sip.cdr", 0, broker.BrokerID()),
+		// records too large for the broker can't be delivered.
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetVersion(3). // of Kafka 1.0.0
+			SetError("sip.cdr", 0, sarama.ErrMessageSizeTooLarge),
+	})
+
+	k := NewKafka(KafkaOptions{
+		Brokers:     []string{broker.Addr()},
+		Topic:       "sip",
+		Acks:        "leader",
+		Compression: "gzip",
+		BatchSize:   2,
+		Linger:      10 * time.Millisecond,
+	})
+	ctx := context.Background()
+	is.NoErr(k.Connect(ctx))
+	is.NoErr(k.Publish(ctx, &collect.Msg{ID: "call-1"}))
+	is.NoErr(k.Publish(ctx, &collect.Msg{ID: "call-2"}))
+	is.NoErr(k.PublishCDR(ctx, &cdr.Record{CallID: "call-1"}))
+	k.Close()
+	is.Equal(testutil.ToFloat64(k.metrics.Published), 2.0)
+	is.Equal(testutil.ToFloat64(k.metrics.Failed), 1.0)
+}
+
+func TestKafkaMessage(t *testing.T) {
+	is := is.New(t)
+	k := NewKafka(KafkaOptions{Topic: "sip"})
+	pm := k.message("sip", "call-1", []byte("{}"))
+	is.Equal(pm.Key, sarama.StringEncoder("call-1"))
+	is.Equal(pm.Value, sarama.ByteEncoder("{}"))
+
+	k = NewKafka(KafkaOptions{Topic: "sip", Key: KafkaKeyNone})
+	is.Equal(k.message("sip", "call-1", nil).Key, nil)
+}
+
+func TestKafkaConfig(t *testing.T) {
+	testCases := map[string]struct {
+		opts  KafkaOptions
+		valid bool
+	}{
+		"defaults":          {KafkaOptions{}, true},
+		"idempotent":        {KafkaOptions{Idempotent: true, Version: "2.1.0"}, true},
+		"idempotent leader": {KafkaOptions{Idempotent: true, Version: "2.1.0", Acks: "leader"}, false},
+		"idempotent old":    {KafkaOptions{Idempotent: true, Version: "0.10.0.0"}, false},
+		"bad key":           {KafkaOptions{Key: "from"}, false},
+		"bad acks":          {KafkaOptions{Acks: "some"}, false},
+		"bad compression":   {KafkaOptions{Compression: "brotli"}, false},
+		"bad version":       {KafkaOptions{Version: "latest"}, false},
+		"scram":             {KafkaOptions{SASL: "SCRAM-SHA-512", SASLUser: "u", SASLPassword: "p"}, true},
+		"sasl without user": {KafkaOptions{SASL: "plain"}, false},
+		"bad sasl":          {KafkaOptions{SASL: "kerberos", SASLUser: "u"}, false},
+		"missing ca":        {KafkaOptions{TLS: true, TLSCAFile: "testdata/missing.pem"}, false},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			cfg, err := NewKafka(tc.opts).config()
+			is.Equal(err == nil, tc.valid)
+			if tc.valid {
+				is.True(cfg.Producer.Return.Successes && cfg.Producer.Return.Errors)
+			}
+		})
+	}
+}
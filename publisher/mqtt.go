@@ -1,15 +1,22 @@
 package publisher
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nextcaller/sip-capture/cdr"
 	"github.com/nextcaller/sip-capture/collect"
+	"github.com/nextcaller/sip-capture/spool"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
@@ -26,6 +33,10 @@ const (
 	// disconnectQueisce is how long to wait for the server during disconnects;
 	// measured in milliseconds.  see `go doc paho.mqtt.golang.Client.Disconnect`
 	disconnectQuiesce = 250
+
+	// spoolRetry is how long to wait to replay the spool again, or to
+	// connect to the broker again, after failing to.
+	spoolRetry = time.Second * 5
 )
 
 var (
@@ -41,20 +52,40 @@ func timeoutFromCtx(ctx context.Context, def time.Duration) time.Duration {
 }
 
 // MQTTPublisher knows how to Publish a collect.Msg to a given topic on its
-// connected broker.
+// connected broker, and a cdr.Record to another.  With a spool, what can't be
+// published is kept on disk and replayed in order once the broker is back.
 type MQTTPublisher struct {
-	client mqtt.Client
-	opts   MQTTOptions
+	client  mqtt.Client
+	opts    MQTTOptions
+	metrics *Metrics
+
+	spool    *spool.Spool
+	retry    time.Duration
+	stop     chan struct{}
+	replayed chan struct{}
 }
 
-// MQTTOptions controls how the internal mqtt client is created.
+// MQTTOptions controls how the internal mqtt client is created.  CDRTopic
+// is where call detail records are published, Topic with "/cdr" appended if
+// empty.  Messages are spooled in Spool.Dir, unless it's empty.
 type MQTTOptions struct {
 	Topic       string
+	CDRTopic    string
 	Telemetry   string
 	Broker      string
 	ClientID    string
 	TLSKeyFile  string
 	TLSCertFile string
+	Spool       spool.Options
+}
+
+// tokenDone returns a channel receiving whether token completed within
+// timeout.  This version of paho's tokens has no channel of its own to select
+// on, so waiting is left to a goroutine, bounded by timeout.
+func tokenDone(token mqtt.Token, timeout time.Duration) <-chan bool {
+	done := make(chan bool, 1)
+	go func() { done <- token.WaitTimeout(timeout) }()
+	return done
 }
 
 func (m *MQTTPublisher) sendMsg(ctx context.Context, topic string, data []byte) error {
@@ -62,11 +93,13 @@ func (m *MQTTPublisher) sendMsg(ctx context.Context, topic string, data []byte)
 	log.Debug().Bytes("msg", data).Msg("publishing mqtt message")
 	token := m.client.Publish(topic, MQTTQOSOne, false, data)
 
-	timeout := timeoutFromCtx(ctx, defaultResponseTimeout)
-
-	// does not handle early ctx cancellation correctly.
-	if !token.WaitTimeout(timeout) {
-		return ErrPublishTimeout
+	select {
+	case ok := <-tokenDone(token, timeoutFromCtx(ctx, defaultResponseTimeout)):
+		if !ok {
+			return ErrPublishTimeout
+		}
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 	if token.Error() != nil {
 		return fmt.Errorf("mqtt publish failed: %w", token.Error())
@@ -79,13 +112,109 @@ func (m *MQTTPublisher) sendMsg(ctx context.Context, topic string, data []byte)
 func (m *MQTTPublisher) Publish(ctx context.Context, msg *collect.Msg) error {
 	jbytes, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("marshaling Msg to json: %w", err)
+		return m.metrics.Count(fmt.Errorf("marshaling Msg to json: %w", err))
 	}
-	return m.sendMsg(ctx, m.opts.Topic, jbytes)
+	return m.deliver(ctx, m.opts.Topic, jbytes)
 }
 
-// Connect initiates a client MQTT connection to the configured broker.
-func (m *MQTTPublisher) Connect(ctx context.Context) error {
+// PublishCDR encodes a cdr.Record into json and sends it to the broker's CDR
+// topic with QoS level 1.
+func (m *MQTTPublisher) PublishCDR(ctx context.Context, r *cdr.Record) error {
+	jbytes, err := json.Marshal(r)
+	if err != nil {
+		return m.metrics.Count(fmt.Errorf("marshaling Record to json: %w", err))
+	}
+	topic := m.opts.CDRTopic
+	if topic == "" {
+		topic = m.opts.Topic + "/cdr"
+	}
+	return m.deliver(ctx, topic, jbytes)
+}
+
+// deliver sends data to the broker, unless earlier messages are still
+// spooled, in which case it's spooled after them to keep them in order.  If
+// sending fails, data is spooled to be replayed later.  Spooled messages are
+// counted published once replayed.
+func (m *MQTTPublisher) deliver(ctx context.Context, topic string, data []byte) error {
+	if m.spool == nil {
+		return m.metrics.Count(m.sendMsg(ctx, topic, data))
+	}
+	if m.spool.Len() == 0 {
+		err := m.sendMsg(ctx, topic, data)
+		if err == nil {
+			return m.metrics.Count(nil)
+		}
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("spooling mqtt message")
+	}
+	// a spooled message is its topic and data, split by a NUL, which topics
+	// can't contain.
+	if err := m.spool.Append([]byte(topic + "\x00" + string(data))); err != nil {
+		return m.metrics.Count(fmt.Errorf("spooling mqtt message: %w", err))
+	}
+	return nil
+}
+
+// replay sends what's spooled to the broker, oldest first, until stop is
+// closed, connecting to it first if need be, and waiting spoolRetry to try
+// again after a failure.  It closes the spool once stopped.
+func (m *MQTTPublisher) replay(ctx context.Context) {
+	defer close(m.replayed)
+	log := zerolog.Ctx(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	defer func() {
+		if err := m.spool.Close(); err != nil {
+			log.Err(err).Msg("closing mqtt spool failed")
+		}
+	}()
+	for {
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		data, _, err := m.spool.Next()
+		if err == io.EOF {
+			select {
+			case <-m.stop:
+				return
+			case <-m.spool.Ready():
+			}
+			continue
+		}
+		if err == nil && !m.client.IsConnected() {
+			err = m.connect(ctx)
+		}
+		if err == nil {
+			if i := bytes.IndexByte(data, 0); i < 0 {
+				log.Warn().Msg("dropping spooled mqtt message without a topic")
+				err = m.spool.Commit()
+			} else if err = m.sendMsg(ctx, string(data[:i]), data[i+1:]); err == nil {
+				_ = m.metrics.Count(nil)
+				err = m.spool.Commit()
+			}
+			if err == nil {
+				continue
+			}
+		}
+		log.Warn().Err(err).Msg("replaying mqtt spool failed")
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(m.retry):
+		}
+	}
+}
+
+// connect makes a client MQTT connection to the configured broker.
+func (m *MQTTPublisher) connect(ctx context.Context) error {
 	log := zerolog.Ctx(ctx)
 	timeout := timeoutFromCtx(ctx, defaultResponseTimeout)
 	token := m.client.Connect()
@@ -105,11 +234,53 @@ func (m *MQTTPublisher) Connect(ctx context.Context) error {
 	return nil
 }
 
-// Close disconnects from the broker.
+// Connect initiates a client MQTT connection to the configured broker, and
+// begins replaying the spool, if any.  With a spool, a broker which can't be
+// reached isn't an error: messages are spooled until replaying the spool
+// connects to it.
+func (m *MQTTPublisher) Connect(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	if m.opts.Spool.Dir == "" {
+		return m.connect(ctx)
+	}
+	sp, err := spool.Open(m.opts.Spool)
+	if err != nil {
+		return fmt.Errorf("opening mqtt spool: %w", err)
+	}
+	if err := m.connect(ctx); err != nil {
+		if ctx.Err() != nil {
+			_ = sp.Close()
+			return err
+		}
+		log.Warn().Err(err).Msg("spooling until the mqtt broker can be reached")
+	}
+	m.spool = sp
+	log.Info().Int("spooled", sp.Len()).Msg("replaying mqtt spool")
+	go m.replay(ctx)
+	return nil
+}
+
+// Close stops replaying the spool, leaving what's left in it for next time,
+// and disconnects from the broker.
 func (m *MQTTPublisher) Close() {
+	if m.spool != nil {
+		close(m.stop)
+		<-m.replayed
+	}
 	m.client.Disconnect(disconnectQuiesce)
 }
 
+// Metrics returns a list of prometheus.Collector interfaces, suitable for
+// passing to prometheus.Registry to export publishing metrics, and spool
+// metrics once connected.
+func (m *MQTTPublisher) Metrics() []prometheus.Collector {
+	list := m.metrics.List()
+	if m.spool != nil {
+		list = append(list, m.spool.Metrics()...)
+	}
+	return list
+}
+
 func tlsCfgFromFiles(key, cert string) (*tls.Config, error) {
 	certs, err := tls.LoadX509KeyPair(cert, key)
 	if err != nil {
@@ -119,6 +290,30 @@ func tlsCfgFromFiles(key, cert string) (*tls.Config, error) {
 	return cfg, nil
 }
 
+// tlsCfg creates a TLS config presenting the client certificate in the key
+// and cert files, if both are set, and verifying servers with the CAs in the
+// ca file, if set, or else the system's.
+func tlsCfg(ca, key, cert string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if key != "" && cert != "" {
+		var err error
+		if cfg, err = tlsCfgFromFiles(key, cert); err != nil {
+			return nil, err
+		}
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in tls ca %s", ca)
+		}
+	}
+	return cfg, nil
+}
+
 // NewMQTT creates an MQTTPublisher from the given options.
 func NewMQTT(o MQTTOptions) *MQTTPublisher {
 	if o.ClientID == "" {
@@ -139,7 +334,11 @@ func NewMQTT(o MQTTOptions) *MQTTPublisher {
 	client := mqtt.NewClient(opts)
 
 	return &MQTTPublisher{
-		opts:   o,
-		client: client,
+		opts:     o,
+		client:   client,
+		metrics:  NewMetrics("mqtt"),
+		retry:    spoolRetry,
+		stop:     make(chan struct{}),
+		replayed: make(chan struct{}),
 	}
 }
@@ -0,0 +1,139 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/nextcaller/sip-capture/spool"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testToken struct{ err error }
+
+func (t testToken) Wait() bool                     { return true }
+func (t testToken) WaitTimeout(time.Duration) bool { return true }
+func (t testToken) Error() error                   { return t.err }
+
+// testClient is an mqtt.Client recording what it publishes, or failing to
+// if the broker is down.
+type testClient struct {
+	mqtt.Client
+	sync.Mutex
+	down      bool
+	connected bool
+	topics    []string
+}
+
+func (c *testClient) Connect() mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	if c.down {
+		return testToken{errors.New("connection refused")}
+	}
+	c.connected = true
+	return testToken{}
+}
+
+func (c *testClient) IsConnected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.connected
+}
+
+func (c *testClient) setDown(down bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.down = down
+	c.connected = c.connected && !down
+}
+
+func (c *testClient) Disconnect(uint) {}
+
+func (c *testClient) Publish(topic string, _ byte, _ bool, _ interface{}) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	if !c.connected {
+		return testToken{errors.New("not connected")}
+	}
+	c.topics = append(c.topics, topic)
+	return testToken{}
+}
+
+func (c *testClient) published() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.topics...)
+}
+
+func TestMQTTSpool(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	o := MQTTOptions{Topic: "sip", Spool: spool.Options{Dir: dir, MaxSize: 1000}}
+
+	// without a spool, the broker must be up to connect.
+	m := NewMQTT(MQTTOptions{Topic: "sip"})
+	m.client = &testClient{down: true}
+	is.True(m.Connect(ctx) != nil)
+
+	// with the broker down, messages are spooled until the spool is full.
+	m = NewMQTT(o)
+	m.client = &testClient{down: true}
+	is.NoErr(m.Connect(ctx))
+	is.NoErr(m.Publish(ctx, &collect.Msg{ID: "1"}))
+	is.NoErr(m.PublishCDR(ctx, &cdr.Record{CallID: "call-1"}))
+	is.NoErr(m.Publish(ctx, &collect.Msg{ID: "2"}))
+	is.True(errors.Is(m.Publish(ctx, &collect.Msg{ID: "3", SIPData: make([]byte, 1000)}), spool.ErrFull))
+	m.Close()
+	is.Equal(testutil.ToFloat64(m.metrics.Published), 0.0)
+	is.Equal(testutil.ToFloat64(m.metrics.Failed), 1.0)
+
+	// once it's back, they're replayed in order, ahead of new messages.
+	c := &testClient{down: true}
+	m = NewMQTT(o)
+	m.client = c
+	m.retry = time.Millisecond
+	is.NoErr(m.Connect(ctx))
+	c.setDown(false)
+	for i := 0; i < 100 && len(c.published()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.NoErr(m.Publish(ctx, &collect.Msg{ID: "4"}))
+	m.Close()
+	is.Equal(c.published(), []string{"sip", "sip/cdr", "sip", "sip"})
+	is.Equal(testutil.ToFloat64(m.metrics.Published), 4.0)
+	is.Equal(len(m.Metrics()), 7)
+}
+
+// hungToken is a publish the broker never acknowledges.
+type hungToken struct{ testToken }
+
+func (hungToken) WaitTimeout(d time.Duration) bool { time.Sleep(d); return false }
+
+type hungClient struct{ testClient }
+
+func (*hungClient) Publish(string, byte, bool, interface{}) mqtt.Token { return hungToken{} }
+
+func TestMQTTCancel(t *testing.T) {
+	is := is.New(t)
+	m := NewMQTT(MQTTOptions{Topic: "sip"})
+	m.client = &hungClient{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	err := m.Publish(ctx, &collect.Msg{ID: "1"})
+	is.True(errors.Is(err, context.Canceled))
+	is.True(time.Since(start) < defaultResponseTimeout)
+}
@@ -0,0 +1,232 @@
+package publisher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// NATSPublisher publishes each collect.Msg to a NATS subject, and each
+// cdr.Record to another.  With JetStream, each waits for the stream to
+// acknowledge it, and carries a Nats-Msg-Id so the stream drops duplicates
+// of it published again.
+type NATSPublisher struct {
+	opts    NATSOptions
+	metrics *Metrics
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+}
+
+// NATSOptions controls how the NATS connection is made.  URL is a comma
+// separated list of servers.  Subject and CDRSubject are templates of where
+// messages and call detail records are published; CDRSubject is Subject with
+// ".cdr" appended if empty.  Only one of Token, NKeyFile (an nkey seed), or
+// CredsFile (a user JWT and seed) is needed to authenticate.
+type NATSOptions struct {
+	URL        string
+	Subject    string
+	CDRSubject string
+	Name       string
+	JetStream  bool
+
+	Token     string
+	NKeyFile  string
+	CredsFile string
+
+	TLS         bool
+	TLSCAFile   string
+	TLSKeyFile  string
+	TLSCertFile string
+}
+
+// NewNATS creates a NATSPublisher from the given options.
+func NewNATS(o NATSOptions) *NATSPublisher {
+	if o.CDRSubject == "" {
+		o.CDRSubject = o.Subject + ".cdr"
+	}
+	return &NATSPublisher{opts: o, metrics: NewMetrics("nats")}
+}
+
+// Connect connects to the NATS servers, reconnecting as long as it's open,
+// and enables JetStream if configured.
+func (n *NATSPublisher) Connect(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	o := n.opts
+	opts := []nats.Option{
+		nats.Name(o.Name),
+		nats.Timeout(defaultResponseTimeout),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("nats disconnected")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info().Str("server", c.ConnectedUrl()).Msg("nats reconnected")
+		}),
+	}
+	if o.Token != "" {
+		opts = append(opts, nats.Token(o.Token))
+	}
+	if o.NKeyFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(o.NKeyFile)
+		if err != nil {
+			return fmt.Errorf("loading nats nkey: %w", err)
+		}
+		opts = append(opts, opt)
+	}
+	if o.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(o.CredsFile))
+	}
+	if o.TLS {
+		opts = append(opts, nats.Secure())
+	}
+	if o.TLSCAFile != "" {
+		opts = append(opts, nats.RootCAs(o.TLSCAFile))
+	}
+	if o.TLSKeyFile != "" && o.TLSCertFile != "" {
+		opts = append(opts, nats.ClientCert(o.TLSCertFile, o.TLSKeyFile))
+	}
+
+	conn, err := nats.Connect(o.URL, opts...)
+	if err != nil {
+		return fmt.Errorf("nats connect failed: %w", err)
+	}
+	if o.JetStream {
+		js, err := conn.JetStream()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("nats jetstream: %w", err)
+		}
+		n.js = js
+	}
+	n.conn = conn
+	return nil
+}
+
+// send publishes data to subject, waiting for JetStream to acknowledge it,
+// with msgID, if enabled.
+func (n *NATSPublisher) send(ctx context.Context, subject, msgID string, data []byte) error {
+	zerolog.Ctx(ctx).Debug().Str("subject", subject).Msg("publishing nats message")
+	if n.js == nil {
+		return n.metrics.Count(n.conn.Publish(subject, data))
+	}
+	m := &nats.Msg{Subject: subject, Data: data}
+	_, err := n.js.PublishMsg(m, nats.MsgId(msgID), nats.AckWait(timeoutFromCtx(ctx, defaultResponseTimeout)))
+	if err != nil {
+		err = fmt.Errorf("nats jetstream publish failed: %w", err)
+	}
+	return n.metrics.Count(err)
+}
+
+// Publish encodes a collect.Msg into json and publishes it to its subject.
+// Its Nats-Msg-Id is its ID, the Call-ID, with the capture time and a hash
+// of the message appended, as every message of a call shares the Call-ID.
+func (n *NATSPublisher) Publish(ctx context.Context, msg *collect.Msg) error {
+	jbytes, err := json.Marshal(msg)
+	if err != nil {
+		return n.metrics.Count(fmt.Errorf("marshaling Msg to json: %w", err))
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(msg.SIPData)
+	msgID := fmt.Sprintf("%s-%d-%x", msg.ID, msg.Time.UnixNano(), h.Sum64())
+	subject := natsSubject(n.opts.Subject, msg.ID, sipMethod(msg.SIPData), msg.Capture)
+	return n.send(ctx, subject, msgID, jbytes)
+}
+
+// PublishCDR encodes a cdr.Record into json and publishes it to its
+// subject.  Its Nats-Msg-Id is its Call-ID with "-cdr" appended.
+func (n *NATSPublisher) PublishCDR(ctx context.Context, r *cdr.Record) error {
+	jbytes, err := json.Marshal(r)
+	if err != nil {
+		return n.metrics.Count(fmt.Errorf("marshaling Record to json: %w", err))
+	}
+	subject := natsSubject(n.opts.CDRSubject, r.CallID, "", r.Capture)
+	return n.send(ctx, subject, r.CallID+"-cdr", jbytes)
+}
+
+// Close flushes what's been published, and disconnects.
+func (n *NATSPublisher) Close() {
+	if n.conn == nil {
+		return
+	}
+	_ = n.conn.FlushTimeout(defaultResponseTimeout)
+	n.conn.Close()
+}
+
+// Metrics returns a list of prometheus.Collector interfaces, suitable for
+// passing to prometheus.Registry to export publishing metrics.
+func (n *NATSPublisher) Metrics() []prometheus.Collector { return n.metrics.List() }
+
+// natsSubject expands the placeholders of a subject template: {id},
+// {method}, {interface}, {transport}, {src_ip}, {dst_ip}, {src_port}, and
+// {dst_port}.  Each value becomes a single subject token.
+func natsSubject(template, id, method string, meta *capture.Meta) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	if meta == nil {
+		meta = &capture.Meta{}
+	}
+	port := func(p uint16) string {
+		if p == 0 {
+			return ""
+		}
+		return strconv.Itoa(int(p))
+	}
+	ip := func(a net.IP) string {
+		if len(a) == 0 {
+			return ""
+		}
+		return a.String()
+	}
+	r := strings.NewReplacer(
+		"{id}", subjectToken(id),
+		"{method}", subjectToken(method),
+		"{interface}", subjectToken(meta.Interface),
+		"{transport}", subjectToken(meta.Transport),
+		"{src_ip}", subjectToken(ip(meta.SrcIP)),
+		"{dst_ip}", subjectToken(ip(meta.DstIP)),
+		"{src_port}", subjectToken(port(meta.SrcPort)),
+		"{dst_port}", subjectToken(port(meta.DstPort)),
+	)
+	return r.Replace(template)
+}
+
+// subjectToken makes s a single subject token, replacing the separators and
+// wildcards subjects reserve with _, and is _ if s is empty.
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// sipMethod returns the method of a SIP request, or "response" for a
+// response.
+func sipMethod(data []byte) string {
+	line := data
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+	if bytes.HasPrefix(line, []byte("SIP/")) {
+		return "response"
+	}
+	return string(line)
+}
@@ -0,0 +1,169 @@
+package publisher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testNATSMsg is a message published to a testNATSServer.
+type testNATSMsg struct {
+	subject string
+	msgID   string
+}
+
+// testNATSServer speaks just enough of the NATS protocol to accept a client,
+// record what it publishes, and acknowledge publishes awaiting a reply as a
+// JetStream stream would.
+type testNATSServer struct {
+	ln net.Listener
+	sync.Mutex
+	msgs []testNATSMsg
+}
+
+func newTestNATSServer(is *is.I) *testNATSServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	s := &testNATSServer{ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *testNATSServer) url() string { return "nats://" + s.ln.Addr().String() }
+
+func (s *testNATSServer) published() []testNATSMsg {
+	s.Lock()
+	defer s.Unlock()
+	return append([]testNATSMsg(nil), s.msgs...)
+}
+
+func (s *testNATSServer) handle(c net.Conn) {
+	defer c.Close()
+	fmt.Fprint(c, `INFO {"server_id":"test","version":"2.2.0","proto":1,"headers":true,"max_payload":1048576}`+"\r\n")
+	r := bufio.NewReader(c)
+	subs := make(map[string]string)
+	seen := make(map[string]bool)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "PING":
+			fmt.Fprint(c, "PONG\r\n")
+		case "SUB":
+			subs[f[1]] = f[len(f)-1]
+		case "PUB", "HPUB":
+			// PUB subject [reply] size, or HPUB subject [reply] header-size size
+			args := f[1 : len(f)-1]
+			hdrLen := 0
+			if f[0] == "HPUB" {
+				hdrLen, _ = strconv.Atoi(args[len(args)-1])
+				args = args[:len(args)-1]
+			}
+			size, _ := strconv.Atoi(f[len(f)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			m := testNATSMsg{subject: args[0]}
+			for _, h := range strings.Split(string(data[:hdrLen]), "\r\n") {
+				if strings.HasPrefix(h, "Nats-Msg-Id:") {
+					m.msgID = strings.TrimSpace(strings.TrimPrefix(h, "Nats-Msg-Id:"))
+				}
+			}
+			// requests of the JetStream API, such as for account info, are
+			// answered without being recorded.
+			reply := `{"type":"io.nats.jetstream.api.v1.account_info_response"}`
+			if !strings.HasPrefix(m.subject, "$JS.API.") {
+				s.Lock()
+				s.msgs = append(s.msgs, m)
+				reply = fmt.Sprintf(`{"stream":"SIP","seq":%d,"duplicate":%v}`, len(s.msgs), seen[m.msgID])
+				s.Unlock()
+				seen[m.msgID] = true
+			}
+			if len(args) < 2 {
+				continue
+			}
+			for subject, sid := range subs {
+				if strings.HasSuffix(subject, ".*") && strings.HasPrefix(args[1], strings.TrimSuffix(subject, "*")) {
+					fmt.Fprintf(c, "MSG %s %s %d\r\n%s\r\n", args[1], sid, len(reply), reply)
+				}
+			}
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+	is := is.New(t)
+	s := newTestNATSServer(is)
+	defer s.ln.Close()
+	ctx := context.Background()
+
+	meta := &capture.Meta{SrcIP: net.IP{192, 0, 2, 1}, SrcPort: 5060, Transport: "udp", Interface: "eth0"}
+	invite := &collect.Msg{
+		ID:      "a84b4c76e66710@pc33.example.com",
+		SIPData: []byte("INVITE sip:bob@example.com SIP/2.0\r\n\r\n"),
+		Time:    time.Date(2020, 7, 20, 12, 0, 0, 0, time.UTC),
+		Capture: meta,
+	}
+	ok := &collect.Msg{ID: invite.ID, SIPData: []byte("SIP/2.0 200 OK\r\n\r\n"), Time: invite.Time, Capture: meta}
+
+	// core publishing, with subject templates.
+	n := NewNATS(NATSOptions{URL: s.url(), Subject: "sip.{interface}.{method}.{src_ip}.{src_port}"})
+	is.NoErr(n.Connect(ctx))
+	is.NoErr(n.Publish(ctx, invite))
+	is.NoErr(n.Publish(ctx, ok))
+	is.NoErr(n.PublishCDR(ctx, &cdr.Record{CallID: invite.ID}))
+	n.Close()
+	is.Equal(s.published(), []testNATSMsg{
+		{subject: "sip.eth0.INVITE.192_0_2_1.5060"},
+		{subject: "sip.eth0.response.192_0_2_1.5060"},
+		{subject: "sip._._._._.cdr"},
+	})
+	is.Equal(testutil.ToFloat64(n.metrics.Published), 3.0)
+
+	// JetStream publishing, acknowledged, with message IDs.
+	s = newTestNATSServer(is)
+	defer s.ln.Close()
+	n = NewNATS(NATSOptions{URL: s.url(), Subject: "sip.{id}", JetStream: true})
+	is.NoErr(n.Connect(ctx))
+	is.NoErr(n.Publish(ctx, invite))
+	is.NoErr(n.Publish(ctx, invite)) // a duplicate, which the stream drops
+	is.NoErr(n.Publish(ctx, ok))
+	is.NoErr(n.PublishCDR(ctx, &cdr.Record{CallID: invite.ID}))
+	n.Close()
+	msgs := s.published()
+	is.Equal(len(msgs), 4)
+	is.Equal(msgs[0].subject, "sip.a84b4c76e66710@pc33_example_com")
+	is.True(strings.HasPrefix(msgs[0].msgID, invite.ID+"-"))
+	is.Equal(msgs[0].msgID, msgs[1].msgID)
+	is.True(msgs[2].msgID != msgs[0].msgID)
+	is.Equal(msgs[3], testNATSMsg{subject: "sip.a84b4c76e66710@pc33_example_com.cdr", msgID: invite.ID + "-cdr"})
+	is.Equal(testutil.ToFloat64(n.metrics.Published), 4.0)
+}
@@ -0,0 +1,136 @@
+// Package publisher sends captured SIP messages, and call detail records, to
+// where they're consumed: an MQTT broker, a HOMER server, Kafka, NATS, an
+// HTTP collector, or several of these at once.
+//
+// Each kind of Publisher is registered by name, so configuration can choose
+// which to use with New.
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nextcaller/sip-capture/cdr"
+	"github.com/nextcaller/sip-capture/collect"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Publisher sends messages and call detail records somewhere.  Connect must
+// be called before publishing, and Close once done.
+type Publisher interface {
+	Connect(context.Context) error
+	Publish(context.Context, *collect.Msg) error
+	PublishCDR(context.Context, *cdr.Record) error
+	Close()
+	// Metrics returns a list of prometheus.Collector interfaces, suitable
+	// for passing to prometheus.Registry to export publishing metrics.
+	Metrics() []prometheus.Collector
+}
+
+// Options holds the options of every kind of Publisher; each uses only its
+// own.
+type Options struct {
+	MQTT  MQTTOptions
+	HEP   HEPOptions
+	Kafka KafkaOptions
+	NATS  NATSOptions
+	HTTP  HTTPOptions
+}
+
+// Factory creates a Publisher of one kind from the options.
+type Factory func(Options) Publisher
+
+var registry = map[string]Factory{
+	"mqtt":  func(o Options) Publisher { return NewMQTT(o.MQTT) },
+	"hep":   func(o Options) Publisher { return NewHEP(o.HEP) },
+	"kafka": func(o Options) Publisher { return NewKafka(o.Kafka) },
+	"nats":  func(o Options) Publisher { return NewNATS(o.NATS) },
+	"http":  func(o Options) Publisher { return NewHTTP(o.HTTP) },
+}
+
+// Register makes a kind of Publisher available to New by name.  It is meant
+// to be called from init, and panics if the name is already registered.
+func Register(name string, f Factory) {
+	if _, ok := registry[name]; ok {
+		panic("publisher: " + name + " registered twice")
+	}
+	registry[name] = f
+}
+
+// Names returns the names of every registered kind of Publisher, sorted.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the Publisher for a comma separated list of registered names.
+// If there's more than one, the Publisher is a Fanout to each of them.
+func New(list string, o Options) (Publisher, error) {
+	sinks := make(map[string]Publisher)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || sinks[name] != nil {
+			continue
+		}
+		f, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown publisher %q (known: %s)", name, strings.Join(Names(), ", "))
+		}
+		sinks[name] = f(o)
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, fmt.Errorf("no publisher in %q", list)
+	case 1:
+		for _, p := range sinks {
+			return p, nil
+		}
+	}
+	return NewFanout(sinks), nil
+}
+
+// Metrics counts what a single Publisher has published, and failed to, with
+// the publisher label set to its name.
+type Metrics struct {
+	Published prometheus.Counter
+	Failed    prometheus.Counter
+}
+
+// NewMetrics creates a newly initialized Metrics for the named Publisher.
+func NewMetrics(name string) *Metrics {
+	labels := prometheus.Labels{"publisher": name}
+	return &Metrics{
+		Published: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "publisher_published_total",
+			Help:        "Number of messages and call detail records published, by publisher",
+			ConstLabels: labels,
+		}),
+		Failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "publisher_failed_total",
+			Help:        "Number of messages and call detail records which failed to publish, by publisher",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+// Count counts the result of publishing once, returning err.
+func (m *Metrics) Count(err error) error {
+	if err != nil {
+		m.Failed.Inc()
+	} else {
+		m.Published.Inc()
+	}
+	return err
+}
+
+// List the items contained with a metrics so they can be exposed via a
+// prometheus.Registry.
+func (m *Metrics) List() []prometheus.Collector {
+	return []prometheus.Collector{m.Published, m.Failed}
+}
@@ -0,0 +1,88 @@
+package sdp
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/nextcaller/sip-capture/sipmsg"
+)
+
+// FindBody returns the session description in a SIP message body of the
+// given Content-Type: the body itself if it's application/sdp, or the first
+// application/sdp part of a multipart body, such as SIP-I's SDP alongside
+// ISUP.  It returns nil if there is none.
+func FindBody(contentType string, body []byte) []byte {
+	if isSDP(contentType) {
+		return body
+	}
+	return findPart(sipmsg.ParseParts(contentType, body))
+}
+
+func findPart(parts []sipmsg.Part) []byte {
+	for _, p := range parts {
+		if isSDP(p.ContentType) {
+			return p.Body
+		}
+		if b := findPart(p.Parts); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func isSDP(contentType string) bool {
+	media, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.EqualFold(media, "application/sdp")
+}
+
+// FromBody parses the session description found in a SIP message body by
+// FindBody.  It returns nil, and no error, if there is none.
+func FromBody(contentType string, body []byte) (*Session, error) {
+	b := FindBody(contentType, body)
+	if b == nil {
+		return nil, nil
+	}
+	return Parse(b)
+}
+
+// Body is the session description in one SIP message's body, found by
+// FindBody and parsed only once first needed, so everything looking at it
+// shares a single parse.  It is not safe for concurrent use.
+type Body struct {
+	contentType string
+	body        []byte
+
+	found   bool
+	raw     []byte
+	parsed  bool
+	session *Session
+	err     error
+}
+
+// NewBody returns the Body of a SIP message body of the given Content-Type,
+// without yet looking for its session description.
+func NewBody(contentType string, body []byte) *Body {
+	return &Body{contentType: contentType, body: body}
+}
+
+// Raw returns the session description as found by FindBody, or nil if there
+// is none.
+func (b *Body) Raw() []byte {
+	if !b.found {
+		b.raw = FindBody(b.contentType, b.body)
+		b.found = true
+	}
+	return b.raw
+}
+
+// Session returns the session description parsed as by FromBody.  It returns
+// nil, and no error, if there is none.
+func (b *Body) Session() (*Session, error) {
+	if !b.parsed {
+		if raw := b.Raw(); raw != nil {
+			b.session, b.err = Parse(raw)
+		}
+		b.parsed = true
+	}
+	return b.session, b.err
+}
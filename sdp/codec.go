@@ -0,0 +1,106 @@
+package sdp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// static are the static RTP payload types of RFC 3551, which needn't have an
+// rtpmap attribute.
+var static = map[int]Codec{
+	0:  {Name: "PCMU", ClockRate: 8000, Channels: 1},
+	3:  {Name: "GSM", ClockRate: 8000, Channels: 1},
+	4:  {Name: "G723", ClockRate: 8000, Channels: 1},
+	5:  {Name: "DVI4", ClockRate: 8000, Channels: 1},
+	6:  {Name: "DVI4", ClockRate: 16000, Channels: 1},
+	7:  {Name: "LPC", ClockRate: 8000, Channels: 1},
+	8:  {Name: "PCMA", ClockRate: 8000, Channels: 1},
+	9:  {Name: "G722", ClockRate: 8000, Channels: 1},
+	10: {Name: "L16", ClockRate: 44100, Channels: 2},
+	11: {Name: "L16", ClockRate: 44100, Channels: 1},
+	12: {Name: "QCELP", ClockRate: 8000, Channels: 1},
+	13: {Name: "CN", ClockRate: 8000, Channels: 1},
+	14: {Name: "MPA", ClockRate: 90000},
+	15: {Name: "G728", ClockRate: 8000, Channels: 1},
+	16: {Name: "DVI4", ClockRate: 11025, Channels: 1},
+	17: {Name: "DVI4", ClockRate: 22050, Channels: 1},
+	18: {Name: "G729", ClockRate: 8000, Channels: 1},
+	25: {Name: "CelB", ClockRate: 90000},
+	26: {Name: "JPEG", ClockRate: 90000},
+	28: {Name: "nv", ClockRate: 90000},
+	31: {Name: "H261", ClockRate: 90000},
+	32: {Name: "MPV", ClockRate: 90000},
+	33: {Name: "MP2T", ClockRate: 90000},
+	34: {Name: "H263", ClockRate: 90000},
+}
+
+// codecs describes each RTP payload type of m, in the order offered.
+// Payload types which are neither static nor mapped are left out, as are
+// the formats of media which isn't RTP, such as T.38 over UDPTL.
+func codecs(m *Media) []Codec {
+	if !strings.Contains(m.Proto, "RTP/") {
+		return nil
+	}
+	mapped := make(map[int]Codec)
+	params := make(map[int]string)
+	for _, a := range m.Attributes {
+		pt, rest, ok := payloadAttribute(a.Value)
+		if !ok {
+			continue
+		}
+		switch a.Name {
+		case "rtpmap":
+			mapped[pt] = parseRTPMap(rest, m.Type == "audio")
+		case "fmtp":
+			params[pt] = rest
+		}
+	}
+
+	var list []Codec
+	for _, f := range m.Formats {
+		pt, err := strconv.Atoi(f)
+		if err != nil {
+			continue
+		}
+		c, ok := mapped[pt]
+		if !ok {
+			if c, ok = static[pt]; !ok {
+				continue
+			}
+		}
+		c.PayloadType = pt
+		c.Params = params[pt]
+		list = append(list, c)
+	}
+	return list
+}
+
+// payloadAttribute splits the payload type from the rest of an rtpmap or
+// fmtp attribute's value.
+func payloadAttribute(v string) (int, string, bool) {
+	i := strings.IndexByte(v, ' ')
+	if i < 0 {
+		return 0, "", false
+	}
+	pt, err := strconv.Atoi(v[:i])
+	if err != nil {
+		return 0, "", false
+	}
+	return pt, strings.TrimSpace(v[i+1:]), true
+}
+
+// parseRTPMap parses an encoding such as "opus/48000/2".  Audio has one
+// channel unless it says otherwise.
+func parseRTPMap(v string, audio bool) Codec {
+	f := strings.Split(v, "/")
+	c := Codec{Name: f[0]}
+	if len(f) > 1 {
+		c.ClockRate, _ = strconv.Atoi(f[1])
+	}
+	if len(f) > 2 {
+		c.Channels, _ = strconv.Atoi(f[2])
+	} else if audio {
+		c.Channels = 1
+	}
+	return c
+}
@@ -0,0 +1,281 @@
+// Package sdp parses SDP session descriptions (RFC 4566), as carried in the
+// bodies of SIP INVITEs and their answers, into the media they describe:
+// each m-line's type, address, port, codecs, and direction.
+package sdp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNotSDP indicates a body not beginning with a v= line.
+	ErrNotSDP = errors.New("not an SDP session description")
+	// ErrLine indicates a line not of the form x=value.
+	ErrLine = errors.New("invalid SDP line")
+)
+
+// Session is a parsed session description.
+type Session struct {
+	Version    int         `json:"version"`
+	Origin     *Origin     `json:"origin,omitempty"`
+	Name       string      `json:"name,omitempty"`
+	Info       string      `json:"info,omitempty"`
+	Connection *Connection `json:"connection,omitempty"`
+	Bandwidth  []Bandwidth `json:"bandwidth,omitempty"`
+	Times      []Time      `json:"times,omitempty"`
+	Attributes []Attribute `json:"attributes,omitempty"`
+	Media      []Media     `json:"media,omitempty"`
+}
+
+// Origin is the o= line, identifying the session and its version.
+type Origin struct {
+	Username       string `json:"username"`
+	SessionID      string `json:"session_id"`
+	SessionVersion string `json:"session_version"`
+	NetType        string `json:"net_type"`
+	AddrType       string `json:"addr_type"`
+	Address        string `json:"address"`
+}
+
+// Connection is a c= line.  Address has any multicast TTL and address count
+// removed.
+type Connection struct {
+	NetType  string `json:"net_type"`
+	AddrType string `json:"addr_type"`
+	Address  string `json:"address"`
+}
+
+// Time is a t= line.
+type Time struct {
+	Start uint64 `json:"start"`
+	Stop  uint64 `json:"stop"`
+}
+
+// Bandwidth is a b= line.
+type Bandwidth struct {
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+// Attribute is an a= line.  Flags, such as sendrecv, have no Value.
+type Attribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// Media is an m= line, and the lines following it.  Its Connection and
+// Direction are its own, or else the session's; Direction is sendrecv if
+// neither gives one.  Codecs describe each RTP payload type in Formats, from
+// rtpmap and fmtp attributes, or the static payload types of RFC 3551.
+type Media struct {
+	Type       string      `json:"type"`
+	Port       int         `json:"port"`
+	Ports      int         `json:"ports,omitempty"`
+	Proto      string      `json:"proto"`
+	Formats    []string    `json:"formats"`
+	Connection *Connection `json:"connection,omitempty"`
+	Direction  string      `json:"direction"`
+	Codecs     []Codec     `json:"codecs,omitempty"`
+	Attributes []Attribute `json:"attributes,omitempty"`
+	Bandwidth  []Bandwidth `json:"bandwidth,omitempty"`
+}
+
+// Codec is an RTP payload type's encoding.
+type Codec struct {
+	PayloadType int    `json:"payload_type"`
+	Name        string `json:"name"`
+	ClockRate   int    `json:"clock_rate,omitempty"`
+	Channels    int    `json:"channels,omitempty"`
+	Params      string `json:"params,omitempty"`
+}
+
+// directions are the attributes giving the direction of media.
+var directions = map[string]bool{
+	"sendrecv": true,
+	"sendonly": true,
+	"recvonly": true,
+	"inactive": true,
+}
+
+// Attribute returns the value of the first attribute with the given name,
+// and whether there was one.
+func (m *Media) Attribute(name string) (string, bool) {
+	return attribute(m.Attributes, name)
+}
+
+// Attribute returns the value of the first session level attribute with the
+// given name, and whether there was one.
+func (s *Session) Attribute(name string) (string, bool) {
+	return attribute(s.Attributes, name)
+}
+
+func attribute(attrs []Attribute, name string) (string, bool) {
+	for _, a := range attrs {
+		if a.Name == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Parse parses a session description.  Lines may end in CRLF or a bare LF.
+// Lines of unknown types are ignored, as RFC 4566 requires.
+func Parse(data []byte) (*Session, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	if !strings.HasPrefix(lines[0], "v=") {
+		return nil, ErrNotSDP
+	}
+
+	s := &Session{}
+	var m *Media
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return nil, ErrLine
+		}
+		value := line[2:]
+
+		switch line[0] {
+		case 'v':
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, ErrNotSDP
+			}
+			s.Version = v
+		case 'o':
+			f := strings.Fields(value)
+			if len(f) != 6 {
+				return nil, ErrLine
+			}
+			s.Origin = &Origin{f[0], f[1], f[2], f[3], f[4], f[5]}
+		case 's':
+			s.Name = value
+		case 'i':
+			if m == nil {
+				s.Info = value
+			}
+		case 'c':
+			c, err := parseConnection(value)
+			if err != nil {
+				return nil, err
+			}
+			if m == nil {
+				s.Connection = c
+			} else if m.Connection == nil {
+				m.Connection = c
+			}
+		case 'b':
+			b, err := parseBandwidth(value)
+			if err != nil {
+				return nil, err
+			}
+			if m == nil {
+				s.Bandwidth = append(s.Bandwidth, b)
+			} else {
+				m.Bandwidth = append(m.Bandwidth, b)
+			}
+		case 't':
+			f := strings.Fields(value)
+			if len(f) != 2 {
+				return nil, ErrLine
+			}
+			start, err1 := strconv.ParseUint(f[0], 10, 64)
+			stop, err2 := strconv.ParseUint(f[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				return nil, ErrLine
+			}
+			s.Times = append(s.Times, Time{start, stop})
+		case 'm':
+			media, err := parseMedia(value)
+			if err != nil {
+				return nil, err
+			}
+			s.Media = append(s.Media, media)
+			m = &s.Media[len(s.Media)-1]
+		case 'a':
+			name, val := value, ""
+			if i := strings.IndexByte(value, ':'); i >= 0 {
+				name, val = value[:i], value[i+1:]
+			}
+			a := Attribute{Name: name, Value: val}
+			if m == nil {
+				s.Attributes = append(s.Attributes, a)
+			} else {
+				m.Attributes = append(m.Attributes, a)
+			}
+		}
+	}
+
+	direction := "sendrecv"
+	for _, a := range s.Attributes {
+		if directions[a.Name] {
+			direction = a.Name
+		}
+	}
+	for i := range s.Media {
+		m := &s.Media[i]
+		if m.Connection == nil {
+			m.Connection = s.Connection
+		}
+		m.Direction = direction
+		for _, a := range m.Attributes {
+			if directions[a.Name] {
+				m.Direction = a.Name
+			}
+		}
+		m.Codecs = codecs(m)
+	}
+	return s, nil
+}
+
+func parseConnection(value string) (*Connection, error) {
+	f := strings.Fields(value)
+	if len(f) != 3 {
+		return nil, ErrLine
+	}
+	addr := f[2]
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	return &Connection{NetType: f[0], AddrType: f[1], Address: addr}, nil
+}
+
+func parseBandwidth(value string) (Bandwidth, error) {
+	i := strings.IndexByte(value, ':')
+	if i < 0 {
+		return Bandwidth{}, ErrLine
+	}
+	n, err := strconv.Atoi(value[i+1:])
+	if err != nil {
+		return Bandwidth{}, ErrLine
+	}
+	return Bandwidth{Type: value[:i], Value: n}, nil
+}
+
+func parseMedia(value string) (Media, error) {
+	f := strings.Fields(value)
+	if len(f) < 3 {
+		return Media{}, ErrLine
+	}
+	m := Media{Type: f[0], Proto: f[2], Formats: f[3:]}
+	port := f[1]
+	if i := strings.IndexByte(port, '/'); i >= 0 {
+		n, err := strconv.Atoi(port[i+1:])
+		if err != nil {
+			return Media{}, ErrLine
+		}
+		m.Ports = n
+		port = port[:i]
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return Media{}, ErrLine
+	}
+	m.Port = n
+	return m, nil
+}
@@ -0,0 +1,136 @@
+package sdp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParse(t *testing.T) {
+	is := is.New(t)
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "offer.sdp"))
+	is.NoErr(err)
+	s, err := Parse(data)
+	is.NoErr(err)
+
+	is.Equal(s.Version, 0)
+	is.Equal(s.Origin, &Origin{"alice", "2890844526", "2890844527", "IN", "IP4", "host.atlanta.example.com"})
+	is.Equal(s.Name, "-")
+	is.Equal(s.Info, "A call")
+	is.Equal(s.Connection, &Connection{"IN", "IP4", "192.0.2.10"})
+	is.Equal(s.Bandwidth, []Bandwidth{{"AS", 256}})
+	is.Equal(s.Times, []Time{{0, 0}})
+	v, ok := s.Attribute("recvonly")
+	is.True(ok)
+	is.Equal(v, "")
+	is.Equal(len(s.Media), 3)
+
+	audio := s.Media[0]
+	is.Equal(audio.Type, "audio")
+	is.Equal(audio.Port, 49170)
+	is.Equal(audio.Proto, "RTP/AVP")
+	is.Equal(audio.Formats, []string{"0", "8", "18", "101", "96"})
+	is.Equal(audio.Connection, s.Connection) // the session's
+	is.Equal(audio.Direction, "recvonly")    // the session's
+	is.Equal(audio.Codecs, []Codec{
+		{PayloadType: 0, Name: "PCMU", ClockRate: 8000, Channels: 1},
+		{PayloadType: 8, Name: "PCMA", ClockRate: 8000, Channels: 1},
+		{PayloadType: 18, Name: "G729", ClockRate: 8000, Channels: 1, Params: "annexb=no"},
+		{PayloadType: 101, Name: "telephone-event", ClockRate: 8000, Channels: 1, Params: "0-15"},
+		{PayloadType: 96, Name: "opus", ClockRate: 48000, Channels: 2},
+	})
+	v, ok = audio.Attribute("ptime")
+	is.True(ok)
+	is.Equal(v, "20")
+
+	video := s.Media[1]
+	is.Equal(video.Port, 51372)
+	is.Equal(video.Ports, 2)
+	is.Equal(video.Connection, &Connection{"IN", "IP6", "2001:db8::20"})
+	is.Equal(video.Direction, "sendonly")
+	is.Equal(video.Bandwidth, []Bandwidth{{"TIAS", 512000}})
+	is.Equal(video.Codecs, []Codec{
+		{PayloadType: 31, Name: "H261", ClockRate: 90000},
+		{PayloadType: 97, Name: "H264", ClockRate: 90000, Params: "profile-level-id=42e01f"},
+	})
+
+	image := s.Media[2]
+	is.Equal(image.Proto, "udptl")
+	is.Equal(image.Formats, []string{"t38"})
+	is.Equal(len(image.Codecs), 0)
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]struct {
+		input string
+		err   error
+	}{
+		"empty":          {"", ErrNotSDP},
+		"no version":     {"o=- 1 1 IN IP4 192.0.2.1\r\n", ErrNotSDP},
+		"bad version":    {"v=zero\r\n", ErrNotSDP},
+		"not a line":     {"v=0\r\nhello\r\n", ErrLine},
+		"short origin":   {"v=0\r\no=- 1 1 IN IP4\r\n", ErrLine},
+		"bad connection": {"v=0\r\nc=IN IP4\r\n", ErrLine},
+		"bad media":      {"v=0\r\nm=audio port RTP/AVP 0\r\n", ErrLine},
+		"short media":    {"v=0\r\nm=audio 5000\r\n", ErrLine},
+		"bad time":       {"v=0\r\nt=now 0\r\n", ErrLine},
+		"bad bandwidth":  {"v=0\r\nb=AS\r\n", ErrLine},
+		"unknown type":   {"v=0\r\nz=0 -1h\r\nk=prompt\r\n", nil},
+		"multicast":      {"v=0\nc=IN IP4 233.252.0.1/127/3\n", nil},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			_, err := Parse([]byte(tc.input))
+			is.Equal(err, tc.err)
+		})
+	}
+}
+
+func TestFromBody(t *testing.T) {
+	is := is.New(t)
+	offer, err := ioutil.ReadFile(filepath.Join("testdata", "offer.sdp"))
+	is.NoErr(err)
+
+	s, err := FromBody("application/SDP", offer)
+	is.NoErr(err)
+	is.Equal(len(s.Media), 3)
+
+	// SIP-I, with the SDP alongside ISUP
+	mixed := []byte("--b1\r\nContent-Type: application/ISUP;version=itu-t92+\r\n\r\n\x01\x00\x49\r\n" +
+		"--b1\r\nContent-Type: application/sdp\r\n\r\n" + string(offer) + "\r\n--b1--\r\n")
+	s, err = FromBody(`multipart/mixed;boundary="b1"`, mixed)
+	is.NoErr(err)
+	is.Equal(s.Media[0].Port, 49170)
+
+	s, err = FromBody("text/plain", offer)
+	is.NoErr(err)
+	is.Equal(s, nil)
+
+	_, err = FromBody("application/sdp", []byte("hello"))
+	is.Equal(err, ErrNotSDP)
+}
+
+func TestBody(t *testing.T) {
+	is := is.New(t)
+	offer, err := ioutil.ReadFile(filepath.Join("testdata", "offer.sdp"))
+	is.NoErr(err)
+
+	b := NewBody("application/sdp", offer)
+	is.Equal(b.Raw(), offer)
+	s, err := b.Session()
+	is.NoErr(err)
+	again, _ := b.Session()
+	is.True(s == again) // parsed only once
+
+	b = NewBody("text/plain", offer)
+	is.Equal(b.Raw(), nil)
+	s, err = b.Session()
+	is.NoErr(err)
+	is.Equal(s, nil)
+
+	_, err = NewBody("application/sdp", []byte("hello")).Session()
+	is.Equal(err, ErrNotSDP)
+}
@@ -0,0 +1,68 @@
+package sipmsg
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"sort"
+	"strings"
+)
+
+// maxPartDepth limits how deeply multipart bodies may be nested within each
+// other.
+const maxPartDepth = 4
+
+// Part is one part of a multipart body, such as the SDP and ISUP parts of a
+// SIP-I INVITE.  Parts which are themselves multipart are split in turn.
+type Part struct {
+	ContentType string  `json:"content_type,omitempty"`
+	Headers     Headers `json:"headers,omitempty"`
+	Body        []byte  `json:"body"`
+	Parts       []Part  `json:"parts,omitempty"`
+}
+
+// ParseParts splits a multipart body, of the given Content-Type, into its
+// parts.  It returns nil if the body isn't multipart, or if its parts can't
+// be read.
+func ParseParts(contentType string, body []byte) []Part {
+	return parseParts(contentType, body, 0)
+}
+
+func parseParts(contentType string, body []byte, depth int) []Part {
+	if depth == maxPartDepth {
+		return nil
+	}
+	media, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(media, "multipart/") || params["boundary"] == "" {
+		return nil
+	}
+
+	var parts []Part
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			return nil
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil
+		}
+		part := Part{Body: data}
+		for name, values := range p.Header {
+			for _, v := range values {
+				part.Headers = append(part.Headers, Header{Name: CanonicalName(name), Value: v})
+			}
+		}
+		// the part's headers come in a map, so put them in a stable order.
+		sort.SliceStable(part.Headers, func(i, j int) bool { return part.Headers[i].Name < part.Headers[j].Name })
+		part.ContentType = part.Headers.Get("Content-Type")
+		part.Parts = parseParts(part.ContentType, data, depth+1)
+		parts = append(parts, part)
+	}
+}
@@ -0,0 +1,101 @@
+package sipmsg
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"strings"
+)
+
+// Header is a single header field, with its name in canonical long form.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Headers are a message's header fields, in the order they appeared.  A
+// header repeated on several lines appears once for each.
+type Headers []Header
+
+// compact maps the compact form of each header name to its long form.
+var compact = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"j": "Reject-Contact",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"n": "Identity-Info",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+	"y": "Identity",
+}
+
+// irregular holds the canonical names which aren't capitalized like MIME
+// headers are.
+var irregular = map[string]string{
+	"call-id":          "Call-ID",
+	"cseq":             "CSeq",
+	"mime-version":     "MIME-Version",
+	"rack":             "RAck",
+	"rseq":             "RSeq",
+	"sip-etag":         "SIP-ETag",
+	"sip-if-match":     "SIP-If-Match",
+	"www-authenticate": "WWW-Authenticate",
+}
+
+// CanonicalName returns the canonical long form of a header name, in any
+// case, expanding compact forms such as "i" to "Call-ID".
+func CanonicalName(name string) string {
+	lower := strings.ToLower(name)
+	if long, ok := compact[lower]; ok {
+		return long
+	}
+	if c, ok := irregular[lower]; ok {
+		return c
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// Get returns the value of the first header with the given name, in long or
+// compact form, or "" if there is none.
+func (h Headers) Get(name string) string {
+	name = CanonicalName(name)
+	for _, f := range h {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the value of every header with the given name, in long or
+// compact form.
+func (h Headers) Values(name string) []string {
+	name = CanonicalName(name)
+	var values []string
+	for _, f := range h {
+		if f.Name == name {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// MarshalJSON encodes headers as an object of each name's values.
+func (h Headers) MarshalJSON() ([]byte, error) {
+	m := make(map[string][]string, len(h))
+	for _, f := range h {
+		m[f.Name] = append(m[f.Name], f.Value)
+	}
+	return json.Marshal(m)
+}
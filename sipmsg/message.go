@@ -0,0 +1,259 @@
+// Package sipmsg parses SIP messages (RFC 3261) into their parts: the start
+// line, headers in their canonical long form, and the structure of the
+// headers most often needed, such as the Request-URI, From, To, Contact, Via,
+// and CSeq.  Multipart bodies are split into their parts.
+//
+// Parsing is forgiving: only a broken start line or header block is an
+// error.  A structured header which can't be understood is left out of its
+// field, but is still found among the Headers.
+package sipmsg
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrStartLine indicates a message not beginning with a SIP request or
+	// status line.
+	ErrStartLine = errors.New("invalid SIP start line")
+	// ErrHeader indicates a header line without a name and colon.
+	ErrHeader = errors.New("invalid SIP header")
+)
+
+// Message is a parsed SIP message.  Exactly one of Request and Status is set.
+type Message struct {
+	Request *RequestLine `json:"request,omitempty"`
+	Status  *StatusLine  `json:"status,omitempty"`
+	Headers Headers      `json:"headers"`
+
+	Via         []Via      `json:"via,omitempty"`
+	From        *NameAddr  `json:"from,omitempty"`
+	To          *NameAddr  `json:"to,omitempty"`
+	Contact     []NameAddr `json:"contact,omitempty"`
+	CallID      string     `json:"call_id,omitempty"`
+	CSeq        *CSeq      `json:"cseq,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+
+	// Body is the message body, which is already published whole, so it's
+	// left out of JSON.  Parts are the parts of a multipart body.
+	Body  []byte `json:"-"`
+	Parts []Part `json:"parts,omitempty"`
+}
+
+// RequestLine is the start line of a request.
+type RequestLine struct {
+	Method  string `json:"method"`
+	URI     *URI   `json:"uri"`
+	Version string `json:"version"`
+}
+
+// StatusLine is the start line of a response.
+type StatusLine struct {
+	Version string `json:"version"`
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+}
+
+// CSeq is the sequence number and method of a CSeq header.
+type CSeq struct {
+	Seq    uint32 `json:"seq"`
+	Method string `json:"method"`
+}
+
+// IsRequest reports whether m is a request rather than a response.
+func (m *Message) IsRequest() bool { return m.Request != nil }
+
+// Method returns the method of a request, or of the request a response
+// answers, from its CSeq.
+func (m *Message) Method() string {
+	if m.Request != nil {
+		return m.Request.Method
+	}
+	if m.CSeq != nil {
+		return m.CSeq.Method
+	}
+	return ""
+}
+
+// Parse parses a whole SIP message.  Lines may end in CRLF or a bare LF, and
+// headers may be folded over several lines.  If there's a Content-Length the
+// body is cut to it.
+func Parse(data []byte) (*Message, error) {
+	head, body := splitHead(data)
+	lines := strings.Split(string(head), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	m := &Message{}
+	if err := m.parseStartLine(lines[0]); err != nil {
+		return nil, err
+	}
+	if err := m.parseHeaders(lines[1:]); err != nil {
+		return nil, err
+	}
+
+	if n, err := strconv.Atoi(m.Headers.Get("Content-Length")); err == nil && n >= 0 && n < len(body) {
+		body = body[:n]
+	}
+	if len(body) > 0 {
+		m.Body = body
+		m.Parts = ParseParts(m.ContentType, body)
+	}
+	return m, nil
+}
+
+// splitHead splits data at the empty line ending the headers.  A message
+// with no empty line is all headers.
+func splitHead(data []byte) ([]byte, []byte) {
+	for i := 0; i < len(data); {
+		end := bytes.IndexByte(data[i:], '\n')
+		if end < 0 {
+			break
+		}
+		line := data[i : i+end]
+		if len(line) == 0 || (len(line) == 1 && line[0] == '\r') {
+			head := data[:i]
+			head = bytes.TrimSuffix(head, []byte("\n"))
+			head = bytes.TrimSuffix(head, []byte("\r"))
+			return head, data[i+end+1:]
+		}
+		i += end + 1
+	}
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+func (m *Message) parseStartLine(line string) error {
+	if strings.HasPrefix(line, "SIP/") {
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			return ErrStartLine
+		}
+		code, err := strconv.Atoi(parts[1])
+		if err != nil || code < 100 || code > 699 {
+			return ErrStartLine
+		}
+		m.Status = &StatusLine{Version: parts[0], Code: code}
+		if len(parts) == 3 {
+			m.Status.Reason = parts[2]
+		}
+		return nil
+	}
+
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] == "" || !strings.HasPrefix(parts[2], "SIP/") {
+		return ErrStartLine
+	}
+	uri, err := ParseURI(parts[1])
+	if err != nil {
+		return ErrStartLine
+	}
+	m.Request = &RequestLine{Method: parts[0], URI: uri, Version: parts[2]}
+	return nil
+}
+
+func (m *Message) parseHeaders(lines []string) error {
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// a continuation of the previous header's value
+			if len(m.Headers) == 0 {
+				return ErrHeader
+			}
+			h := &m.Headers[len(m.Headers)-1]
+			h.Value = strings.TrimSpace(h.Value + " " + strings.TrimSpace(line))
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return ErrHeader
+		}
+		name := strings.TrimSpace(line[:colon])
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return ErrHeader
+		}
+		m.Headers = append(m.Headers, Header{
+			Name:  CanonicalName(name),
+			Value: strings.TrimSpace(line[colon+1:]),
+		})
+	}
+
+	for _, h := range m.Headers {
+		switch h.Name {
+		case "Via":
+			for _, v := range splitList(h.Value) {
+				if via, err := ParseVia(v); err == nil {
+					m.Via = append(m.Via, *via)
+				}
+			}
+		case "Contact":
+			for _, v := range splitList(h.Value) {
+				if na, err := ParseNameAddr(v); err == nil {
+					m.Contact = append(m.Contact, *na)
+				}
+			}
+		case "From":
+			if m.From == nil {
+				m.From, _ = ParseNameAddr(h.Value)
+			}
+		case "To":
+			if m.To == nil {
+				m.To, _ = ParseNameAddr(h.Value)
+			}
+		case "Call-ID":
+			if m.CallID == "" {
+				m.CallID = h.Value
+			}
+		case "CSeq":
+			if m.CSeq == nil {
+				m.CSeq = parseCSeq(h.Value)
+			}
+		case "Content-Type":
+			if m.ContentType == "" {
+				m.ContentType = h.Value
+			}
+		}
+	}
+	return nil
+}
+
+func parseCSeq(v string) *CSeq {
+	f := strings.Fields(v)
+	if len(f) != 2 {
+		return nil
+	}
+	n, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil {
+		return nil
+	}
+	return &CSeq{Seq: uint32(n), Method: f[1]}
+}
+
+// splitList splits a header value holding a comma separated list, such as
+// several Vias or Contacts, ignoring commas within quotes and angle brackets.
+func splitList(v string) []string {
+	var list []string
+	quoted, angled, start := false, false, 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			angled = true
+		case c == '>':
+			angled = false
+		case c == ',' && !angled:
+			list = append(list, strings.TrimSpace(v[start:i]))
+			start = i + 1
+		}
+	}
+	return append(list, strings.TrimSpace(v[start:]))
+}
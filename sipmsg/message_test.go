@@ -0,0 +1,163 @@
+package sipmsg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func load(is *is.I, file string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	is.NoErr(err)
+	return data
+}
+
+func TestParseRequest(t *testing.T) {
+	is := is.New(t)
+	m, err := Parse(load(is, "sip-i-invite.txt"))
+	is.NoErr(err)
+
+	is.True(m.IsRequest())
+	is.Equal(m.Method(), "INVITE")
+	is.Equal(m.Request.Version, "SIP/2.0")
+	is.Equal(m.Request.URI, &URI{Scheme: "sip", User: "+15551234567", Host: "gw.example.com", Params: Params{"user": "phone"}})
+
+	// compact forms are expanded, and folded lines joined.
+	is.Equal(m.Headers.Get("Call-ID"), "3848276298220188511@atlanta.example.com")
+	is.Equal(m.Headers.Get("i"), "3848276298220188511@atlanta.example.com")
+	is.Equal(m.Headers.Get("subject"), "a header folded over three lines")
+	is.Equal(m.Headers.Values("Via"), []string{
+		"SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK74bf9;received=192.0.2.10",
+		"SIP/2.0/TCP [2001:db8::1]:5061;branch=z9hG4bK-outer, SIP / 2.0 / tls proxy.example.com;branch=z9hG4bK-2;rport",
+	})
+	is.Equal(m.Headers.Get("MIME-Version"), "1.0")
+
+	is.Equal(len(m.Via), 3)
+	is.Equal(m.Via[0].Branch, "z9hG4bK74bf9")
+	is.Equal(m.Via[1].Host, "2001:db8::1")
+	is.Equal(m.Via[1].Port, uint16(5061))
+	is.Equal(m.Via[2].Transport, "TLS")
+	is.Equal(m.Via[2].Protocol, "SIP/2.0")
+
+	is.Equal(m.From.Display, `Alice "A" Smith`)
+	is.Equal(m.From.Tag(), "9fxced76sl")
+	is.Equal(m.To.URI, &URI{Scheme: "tel", User: "+15551234567", Params: Params{"phone-context": "example.com"}})
+	is.Equal(m.CallID, "3848276298220188511@atlanta.example.com")
+	is.Equal(m.CSeq, &CSeq{Seq: 31862, Method: "INVITE"})
+
+	is.Equal(len(m.Contact), 2)
+	is.Equal(m.Contact[0].URI.Params["transport"], "udp")
+	is.Equal(m.Contact[0].Params["expires"], "3600")
+	is.Equal(m.Contact[1].Display, "Bob")
+	is.Equal(m.Contact[1].URI.Scheme, "sips")
+	is.Equal(m.Contact[1].URI.Host, "2001:db8::2")
+
+	is.Equal(m.ContentType, "multipart/mixed;boundary=unique-boundary-1")
+	is.Equal(len(m.Parts), 2)
+	is.Equal(m.Parts[0].ContentType, "application/sdp")
+	is.True(strings.HasPrefix(string(m.Parts[0].Body), "v=0\r\n"))
+	is.Equal(m.Parts[1].ContentType, "application/ISUP;version=itu-t92+")
+	is.Equal(m.Parts[1].Headers.Get("Content-Disposition"), "signal;handling=optional")
+	is.Equal(m.Parts[1].Body[0], byte(0x01)) // binary ISUP IAM
+}
+
+func TestParseResponse(t *testing.T) {
+	is := is.New(t)
+	m, err := Parse(load(is, "response.txt"))
+	is.NoErr(err)
+
+	is.True(!m.IsRequest())
+	is.Equal(m.Status, &StatusLine{Version: "SIP/2.0", Code: 180, Reason: "Ringing"})
+	is.Equal(m.Method(), "INVITE") // from the CSeq
+	is.Equal(m.From.URI.User, "alice")
+	is.Equal(m.From.Tag(), "9fxced76sl") // an addr-spec's parameters are the header's
+	is.Equal(m.To.Display, "Bob")
+	is.Equal(m.To.Tag(), "314159")
+	is.Equal(m.Headers.Get("WWW-Authenticate"), `Digest realm="example.com"`)
+	is.Equal(len(m.Body), 0)
+	is.Equal(len(m.Parts), 0)
+}
+
+func TestParseBody(t *testing.T) {
+	is := is.New(t)
+
+	// bare LFs, and a body cut to its Content-Length
+	m, err := Parse([]byte("MESSAGE sip:bob@example.com SIP/2.0\nContent-Type: text/plain\nContent-Length: 5\n\nhello, world"))
+	is.NoErr(err)
+	is.Equal(string(m.Body), "hello")
+	is.Equal(len(m.Parts), 0)
+
+	// no body at all
+	m, err = Parse([]byte("OPTIONS sip:example.com SIP/2.0\r\nCall-ID: x\r\n"))
+	is.NoErr(err)
+	is.Equal(m.CallID, "x")
+	is.Equal(len(m.Body), 0)
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]struct {
+		input string
+		err   error
+	}{
+		"empty":            {"", ErrStartLine},
+		"not sip":          {"GET / HTTP/1.1\r\n\r\n", ErrStartLine},
+		"bad status":       {"SIP/2.0 2000 OK\r\n\r\n", ErrStartLine},
+		"no status":        {"SIP/2.0\r\n\r\n", ErrStartLine},
+		"bad request uri":  {"INVITE bob SIP/2.0\r\n\r\n", ErrStartLine},
+		"no colon":         {"INVITE sip:bob@example.com SIP/2.0\r\nVia SIP/2.0/UDP host\r\n\r\n", ErrHeader},
+		"space in name":    {"INVITE sip:bob@example.com SIP/2.0\r\nCall ID: x\r\n\r\n", ErrHeader},
+		"leading fold":     {"INVITE sip:bob@example.com SIP/2.0\r\n folded: x\r\n\r\n", ErrHeader},
+		"unparsed headers": {"INVITE sip:bob@example.com SIP/2.0\r\nFrom: <sip:\r\nCSeq: one\r\n\r\n", nil},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			m, err := Parse([]byte(tc.input))
+			is.Equal(err, tc.err)
+			if err == nil {
+				// badly formed structured headers are only found in Headers.
+				is.Equal(m.From, nil)
+				is.Equal(m.CSeq, nil)
+				is.Equal(len(m.Headers), 2)
+			}
+		})
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	is := is.New(t)
+	for in, want := range map[string]string{
+		"i":                   "Call-ID",
+		"CALL-ID":             "Call-ID",
+		"v":                   "Via",
+		"cseq":                "CSeq",
+		"www-authenticate":    "WWW-Authenticate",
+		"max-forwards":        "Max-Forwards",
+		"p-asserted-identity": "P-Asserted-Identity",
+		"X-Foo":               "X-Foo",
+	} {
+		is.Equal(CanonicalName(in), want)
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	is := is.New(t)
+	m, err := Parse(load(is, "response.txt"))
+	is.NoErr(err)
+	data, err := json.Marshal(m)
+	is.NoErr(err)
+
+	var got map[string]interface{}
+	is.NoErr(json.Unmarshal(data, &got))
+	is.Equal(got["status"], map[string]interface{}{"version": "SIP/2.0", "code": float64(180), "reason": "Ringing"})
+	is.Equal(got["call_id"], "3848276298220188511@atlanta.example.com")
+	is.Equal(got["cseq"], map[string]interface{}{"seq": float64(31862), "method": "INVITE"})
+	headers := got["headers"].(map[string]interface{})
+	is.Equal(headers["CSeq"], []interface{}{"31862 INVITE"})
+	_, ok := got["request"]
+	is.True(!ok)
+}
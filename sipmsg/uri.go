@@ -0,0 +1,287 @@
+package sipmsg
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrURI indicates an unparsable URI.
+	ErrURI = errors.New("invalid URI")
+	// ErrNameAddr indicates an unparsable name-addr or addr-spec.
+	ErrNameAddr = errors.New("invalid name-addr")
+	// ErrVia indicates an unparsable Via header value.
+	ErrVia = errors.New("invalid Via")
+)
+
+// Params are the parameters of a URI or header value, by lower case name.
+// Parameters without a value, such as lr, have an empty one.
+type Params map[string]string
+
+// URI is a parsed URI.  SIP and SIPS URIs are split into their user, host,
+// port, parameters and headers; tel URIs into their number, as User, and
+// parameters.  Any other scheme is kept as Opaque.
+type URI struct {
+	Scheme   string `json:"scheme"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	Params   Params `json:"params,omitempty"`
+	Headers  Params `json:"headers,omitempty"`
+	Opaque   string `json:"opaque,omitempty"`
+}
+
+// ParseURI parses a SIP, SIPS, tel, or other absolute URI.
+func ParseURI(s string) (*URI, error) {
+	colon := strings.IndexByte(s, ':')
+	if colon <= 0 {
+		return nil, ErrURI
+	}
+	u := &URI{Scheme: strings.ToLower(s[:colon])}
+	rest := s[colon+1:]
+
+	switch u.Scheme {
+	case "sip", "sips":
+	case "tel":
+		number, params := cut(rest, ';')
+		if number == "" {
+			return nil, ErrURI
+		}
+		u.User = number
+		u.Params = parseParams(params)
+		return u, nil
+	default:
+		if rest == "" {
+			return nil, ErrURI
+		}
+		u.Opaque = rest
+		return u, nil
+	}
+
+	rest, headers := cut(rest, '?')
+	if headers != "" {
+		u.Headers = make(Params)
+		for _, h := range strings.Split(headers, "&") {
+			name, value := cut(h, '=')
+			u.Headers[unescape(name)] = unescape(value)
+		}
+	}
+	if at := strings.LastIndexByte(rest, '@'); at >= 0 {
+		user, password := cut(rest[:at], ':')
+		u.User, u.Password = unescape(user), unescape(password)
+		rest = rest[at+1:]
+	}
+	hostport, params := cut(rest, ';')
+	u.Params = parseParams(params)
+
+	var err error
+	if u.Host, u.Port, err = splitHostPort(hostport); err != nil {
+		return nil, ErrURI
+	}
+	return u, nil
+}
+
+// NameAddr is the address of a From, To, Contact, or similar header, with
+// its display name and header parameters, such as tag.
+type NameAddr struct {
+	Display string `json:"display,omitempty"`
+	URI     *URI   `json:"uri"`
+	Params  Params `json:"params,omitempty"`
+}
+
+// Tag returns the tag parameter.
+func (n *NameAddr) Tag() string { return n.Params["tag"] }
+
+// ParseNameAddr parses a name-addr, such as `"Alice" <sip:alice@example.com>;tag=1`,
+// or an addr-spec, such as `sip:alice@example.com;tag=1`.  In an addr-spec the
+// parameters are the header's, not the URI's.
+func ParseNameAddr(s string) (*NameAddr, error) {
+	s = strings.TrimSpace(s)
+	n := &NameAddr{}
+
+	if strings.HasPrefix(s, `"`) {
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return nil, ErrNameAddr
+		}
+		n.Display = unquote(s[:end+1])
+		s = strings.TrimSpace(s[end+1:])
+		if !strings.HasPrefix(s, "<") {
+			return nil, ErrNameAddr
+		}
+	}
+
+	var addr, params string
+	if open := strings.IndexByte(s, '<'); open >= 0 {
+		end := strings.IndexByte(s[open:], '>')
+		if end < 0 {
+			return nil, ErrNameAddr
+		}
+		if n.Display == "" {
+			n.Display = strings.TrimSpace(s[:open])
+		}
+		addr = s[open+1 : open+end]
+		_, params = cut(s[open+end+1:], ';')
+	} else {
+		addr, params = cut(s, ';')
+	}
+
+	uri, err := ParseURI(strings.TrimSpace(addr))
+	if err != nil {
+		return nil, ErrNameAddr
+	}
+	n.URI = uri
+	n.Params = parseParams(params)
+	return n, nil
+}
+
+// Via is a single Via header value.
+type Via struct {
+	Protocol  string `json:"protocol"`
+	Transport string `json:"transport"`
+	Host      string `json:"host"`
+	Port      uint16 `json:"port,omitempty"`
+	Branch    string `json:"branch,omitempty"`
+	Params    Params `json:"params,omitempty"`
+}
+
+// ParseVia parses a single Via header value, such as
+// "SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK776asdhds;rport".
+func ParseVia(s string) (*Via, error) {
+	sent, params := cut(strings.TrimSpace(s), ';')
+	f := strings.Fields(sent)
+	if len(f) < 2 {
+		return nil, ErrVia
+	}
+	// the protocol may be written with spaces around its slashes.
+	protocol := strings.Join(f[:len(f)-1], "")
+	slash := strings.LastIndexByte(protocol, '/')
+	if slash <= 0 || slash == len(protocol)-1 {
+		return nil, ErrVia
+	}
+	host, port, err := splitHostPort(f[len(f)-1])
+	if err != nil {
+		return nil, ErrVia
+	}
+	v := &Via{
+		Protocol:  protocol[:slash],
+		Transport: strings.ToUpper(protocol[slash+1:]),
+		Host:      host,
+		Port:      port,
+		Params:    parseParams(params),
+	}
+	v.Branch = v.Params["branch"]
+	return v, nil
+}
+
+// parseParams parses the ;-separated parameters following a URI or header
+// value, without the leading semicolon.
+func parseParams(s string) Params {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	p := make(Params)
+	for _, param := range splitParams(s) {
+		name, value := cut(param, '=')
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		p[name] = unquote(strings.TrimSpace(value))
+	}
+	return p
+}
+
+// splitParams splits parameters at semicolons outside of quotes.
+func splitParams(s string) []string {
+	var params []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(params, s[start:])
+}
+
+// splitHostPort splits a host, which may be a bracketed IPv6 address, from
+// an optional port.
+func splitHostPort(s string) (string, uint16, error) {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return "", 0, ErrURI
+		}
+		host = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			if rest[0] != ':' {
+				return "", 0, ErrURI
+			}
+			port = rest[1:]
+		}
+	} else if colon := strings.IndexByte(s, ':'); colon >= 0 {
+		host, port = s[:colon], s[colon+1:]
+	}
+	if host == "" {
+		return "", 0, ErrURI
+	}
+	if port == "" {
+		return host, 0, nil
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, ErrURI
+	}
+	return host, uint16(n), nil
+}
+
+// cut splits s at the first sep, returning "" after it if there is none.
+func cut(s string, sep byte) (string, string) {
+	if i := strings.IndexByte(s, sep); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// unquote removes the quotes and escapes of a quoted string, returning
+// anything else unchanged.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// unescape decodes %-escapes, returning s unchanged if they're invalid.
+func unescape(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
@@ -0,0 +1,108 @@
+package sipmsg
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseURI(t *testing.T) {
+	testCases := map[string]struct {
+		input string
+		want  *URI
+		err   error
+	}{
+		"host only": {
+			input: "sip:example.com",
+			want:  &URI{Scheme: "sip", Host: "example.com"},
+		},
+		"everything": {
+			input: "SIPS:alice:secret@example.com:5061;transport=tcp;lr?subject=project%20x&priority=urgent",
+			want: &URI{
+				Scheme: "sips", User: "alice", Password: "secret", Host: "example.com", Port: 5061,
+				Params:  Params{"transport": "tcp", "lr": ""},
+				Headers: Params{"subject": "project x", "priority": "urgent"},
+			},
+		},
+		"ipv6": {
+			input: "sip:bob@[2001:db8::10]:5070",
+			want:  &URI{Scheme: "sip", User: "bob", Host: "2001:db8::10", Port: 5070},
+		},
+		"escaped user": {
+			input: "sip:%61lice@example.com",
+			want:  &URI{Scheme: "sip", User: "alice", Host: "example.com"},
+		},
+		"tel": {
+			input: "tel:+1-201-555-0123;ext=12",
+			want:  &URI{Scheme: "tel", User: "+1-201-555-0123", Params: Params{"ext": "12"}},
+		},
+		"other": {
+			input: "urn:service:sos",
+			want:  &URI{Scheme: "urn", Opaque: "service:sos"},
+		},
+		"no scheme":    {input: "alice@example.com", err: ErrURI},
+		"no host":      {input: "sip:alice@", err: ErrURI},
+		"bad port":     {input: "sip:example.com:99999", err: ErrURI},
+		"open bracket": {input: "sip:[2001:db8::1", err: ErrURI},
+		"empty tel":    {input: "tel:", err: ErrURI},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			u, err := ParseURI(tc.input)
+			is.Equal(err, tc.err)
+			is.Equal(u, tc.want)
+		})
+	}
+}
+
+func TestParseNameAddr(t *testing.T) {
+	testCases := map[string]struct {
+		input   string
+		display string
+		user    string
+		params  Params
+		err     error
+	}{
+		"quoted":          {`"Alice Smith" <sip:alice@example.com>;tag=1`, "Alice Smith", "alice", Params{"tag": "1"}, nil},
+		"quoted brackets": {`"<Bob>" <sip:bob@example.com>`, "<Bob>", "bob", nil, nil},
+		"token display":   {`Bob Jones <sip:bob@example.com;transport=tcp>`, "Bob Jones", "bob", nil, nil},
+		"no display":      {`<sip:carol@example.com>;tag=a;+sip.instance="<urn:uuid:1;2>"`, "", "carol", Params{"tag": "a", "+sip.instance": "<urn:uuid:1;2>"}, nil},
+		"addr-spec":       {`sip:dave@example.com;tag=2`, "", "dave", Params{"tag": "2"}, nil},
+		"unclosed":        {`<sip:eve@example.com`, "", "", nil, ErrNameAddr},
+		"unclosed quote":  {`"Eve <sip:eve@example.com>`, "", "", nil, ErrNameAddr},
+		"bad uri":         {`<eve>`, "", "", nil, ErrNameAddr},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			n, err := ParseNameAddr(tc.input)
+			is.Equal(err, tc.err)
+			if err != nil {
+				return
+			}
+			is.Equal(n.Display, tc.display)
+			is.Equal(n.URI.User, tc.user)
+			is.Equal(n.Params, tc.params)
+		})
+	}
+}
+
+func TestParseVia(t *testing.T) {
+	is := is.New(t)
+	v, err := ParseVia("SIP/2.0/udp pc33.example.com:5066;branch=z9hG4bK776asdhds;received=192.0.2.1;rport")
+	is.NoErr(err)
+	is.Equal(v, &Via{
+		Protocol:  "SIP/2.0",
+		Transport: "UDP",
+		Host:      "pc33.example.com",
+		Port:      5066,
+		Branch:    "z9hG4bK776asdhds",
+		Params:    Params{"branch": "z9hG4bK776asdhds", "received": "192.0.2.1", "rport": ""},
+	})
+
+	for _, bad := range []string{"", "SIP/2.0/UDP", "pc33.example.com", "SIP/2.0/ host", "SIP/2.0/UDP host:port"} {
+		_, err := ParseVia(bad)
+		is.Equal(err, ErrVia)
+	}
+}
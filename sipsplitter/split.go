@@ -300,3 +300,15 @@ func isResponse(line []byte) bool {
 	// could validate sip version and/or status code here.
 	return true
 }
+
+// IsMessage reports whether b begins with a line which could be the start line
+// of a SIP request or response, for transports such as SCTP which deliver
+// whole messages that only need a sanity check before decoding.
+func IsMessage(b []byte) bool {
+	eol := bytes.Index(b, crlf)
+	if eol == -1 {
+		return false
+	}
+	line := b[:eol+len(crlf)]
+	return isRequest(line) || isResponse(line)
+}
@@ -144,3 +144,11 @@ func BenchmarkFindSIPMessage(b *testing.B) {
 		}
 	}
 }
+
+func TestIsMessage(t *testing.T) {
+	is := is.New(t)
+	is.True(IsMessage([]byte("INVITE sip:bob@example.com SIP/2.0\r\nCall-ID: a\r\n\r\n")))
+	is.True(IsMessage([]byte("SIP/2.0 200 OK\r\nCall-ID: a\r\n\r\n")))
+	is.True(!IsMessage([]byte("hello, world")))
+	is.True(!IsMessage([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+}
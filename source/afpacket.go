@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package source
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/pcapfilter"
+)
+
+// afpacketPollTimeout bounds how long a read waits for the ring before
+// checking if the source has been closed.
+const afpacketPollTimeout = 100 * time.Millisecond
+
+// fanoutTypes maps the configurable fanout modes to their afpacket values.
+// Hash fanout also asks the kernel to defragment IP packets, so that all the
+// fragments of a SIP message reach the same socket.
+var fanoutTypes = map[string]afpacket.FanoutType{
+	"hash":     afpacket.FanoutHash | afpacket.FanoutHashWithDefrag,
+	"lb":       afpacket.FanoutLoadBalance,
+	"cpu":      afpacket.FanoutCPU,
+	"rollover": afpacket.FanoutRollover,
+	"random":   afpacket.FanoutRandom,
+	"qm":       afpacket.FanoutQueueMapping,
+}
+
+// ringHandle serializes reads of a TPacket ring with closing it, since the
+// ring's memory is unmapped by Close.
+type ringHandle struct {
+	sync.Mutex
+	tp     *afpacket.TPacket
+	closed bool
+	final  afpacket.SocketStatsV3
+}
+
+// ReadPacketData returns the next packet from the ring, or io.EOF once the
+// handle has been closed.  The VLAN tag the kernel strips from a packet is
+// given as a capture.VLAN.
+func (h *ringHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		h.Lock()
+		if h.closed {
+			h.Unlock()
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		data, ci, err := h.tp.ReadPacketData()
+		h.Unlock()
+		if err != afpacket.ErrTimeout {
+			tagVLAN(&ci)
+			return data, ci, err
+		}
+	}
+}
+
+// tagVLAN replaces afpacket's record of the VLAN tag the kernel stripped with
+// a capture.VLAN, which extraction understands whatever the platform.
+func tagVLAN(ci *gopacket.CaptureInfo) {
+	for i, a := range ci.AncillaryData {
+		if v, ok := a.(afpacket.AncillaryVLAN); ok {
+			ci.AncillaryData[i] = capture.VLAN(v.VLAN)
+		}
+	}
+}
+
+// Close releases the ring and socket.
+func (h *ringHandle) Close() {
+	h.Lock()
+	defer h.Unlock()
+	if !h.closed {
+		h.closed = true
+		_, h.final, _ = h.tp.SocketStats()
+		h.tp.Close()
+	}
+}
+
+// stats returns the kernel's packet, drop, and queue freeze counters, or
+// their final values once closed.
+func (h *ringHandle) stats() (afpacket.SocketStatsV3, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return h.final, nil
+	}
+	_, v3, err := h.tp.SocketStats()
+	return v3, err
+}
+
+// ringMetrics creates counters reading the kernel statistics of the ring for
+// iface.  The last good values are kept so counters never go backwards.
+func ringMetrics(iface string, h *ringHandle) []prometheus.Collector {
+	var mu sync.Mutex
+	var last afpacket.SocketStatsV3
+	read := func(f func(*afpacket.SocketStatsV3) uint) func() float64 {
+		return func() float64 {
+			mu.Lock()
+			defer mu.Unlock()
+			if s, err := h.stats(); err == nil {
+				last = s
+			}
+			return float64(f(&last))
+		}
+	}
+	labels := prometheus.Labels{"interface": iface}
+	return []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "packets_ring_received_total",
+			Help:        "Packets received by the kernel for the AF_PACKET ring",
+			ConstLabels: labels,
+		}, read((*afpacket.SocketStatsV3).Packets)),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "packets_ring_dropped_total",
+			Help:        "Packets dropped by the kernel because the AF_PACKET ring was full",
+			ConstLabels: labels,
+		}, read((*afpacket.SocketStatsV3).Drops)),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "packets_ring_freezes_total",
+			Help:        "Times the kernel froze the AF_PACKET ring queue because no block was free",
+			ConstLabels: labels,
+		}, read((*afpacket.SocketStatsV3).QueueFreezes)),
+	}
+}
+
+// NewAFPacket creates a ClosableSource capturing from iface through a memory
+// mapped TPACKET_V3 ring, with the appropriate filter attached to the socket,
+// its packets tagged with the capture.Interface.  Unlike NewPCAP, it does not
+// use libpcap at all; the filter is compiled by pcapfilter, so only its
+// subset of the pcap-filter syntax is supported.
+func NewAFPacket(iface string, filter string, opts AFPacketOptions) (*ClosableSource, error) {
+	opts = opts.withDefaults()
+	fanout, ok := fanoutTypes[opts.FanoutType]
+	if !ok {
+		return nil, fmt.Errorf("unknown fanout type %v", opts.FanoutType)
+	}
+
+	tp, err := afpacket.NewTPacket(
+		afpacket.OptInterface(iface),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptFrameSize(afpacket.DefaultFrameSize),
+		afpacket.OptBlockSize(opts.BlockSize),
+		afpacket.OptNumBlocks(opts.NumBlocks),
+		afpacket.OptPollTimeout(afpacketPollTimeout),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("opening AF_PACKET ring on %v: %w", iface, err)
+	}
+
+	if filter != "" {
+		insns, err := pcapfilter.Compile(filter, layers.LinkTypeEthernet, 65535)
+		if err != nil {
+			tp.Close()
+			return nil, err
+		}
+		if err := tp.SetBPF(insns); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("setting BPF filter to %v: %w", filter, err)
+		}
+	}
+
+	if opts.FanoutGroup != 0 {
+		if err := tp.SetFanout(fanout, opts.FanoutGroup); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("joining fanout group %v: %w", opts.FanoutGroup, err)
+		}
+	}
+
+	h := &ringHandle{tp: tp}
+	src := newClosableSource(iface, filter, h, gopacket.NewPacketSource(labelled{h, capture.Interface(iface)}, layers.LinkTypeEthernet))
+	src.metrics.Ring = ringMetrics(iface, h)
+	return src, nil
+}
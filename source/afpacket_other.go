@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package source
+
+import "errors"
+
+// NewAFPacket is only available on Linux.
+func NewAFPacket(iface string, filter string, opts AFPacketOptions) (*ClosableSource, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on linux")
+}
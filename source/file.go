@@ -0,0 +1,125 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nextcaller/sip-capture/pcapfilter"
+)
+
+// pcapngMagic is the block type of the Section Header Block that begins every
+// pcapng file.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// StdinPath is the file name NewFile treats as meaning standard input.
+const StdinPath = "-"
+
+// captureReader is satisfied by both pcapgo.Reader and pcapgo.NgReader.
+type captureReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// fileHandle closes the file underneath a pcap or pcapng reader.
+type fileHandle struct {
+	f io.Closer
+	r *filteredReader
+}
+
+func (h fileHandle) Close() { _ = h.f.Close() }
+
+// Err returns the error which ended the file early, if any.
+func (h fileHandle) Err() error {
+	if err, ok := h.r.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// filteredReader applies a BPF filter to every packet read from a capture
+// file, skipping those which don't match, the same way libpcap would for a
+// live capture.
+type filteredReader struct {
+	captureReader
+	filter *pcapfilter.Matcher
+	failed prometheus.Counter
+	err    atomic.Value
+}
+
+// ReadPacketData returns the next packet that passes the filter.  A damaged
+// capture file can't be resynchronized, so any error ends the file as if it
+// had reached io.EOF, instead of letting gopacket.PacketSource retry forever,
+// but it's counted and kept, so a truncated file can be told from a whole
+// one.
+func (r *filteredReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := r.captureReader.ReadPacketData()
+		if err != nil {
+			if err != io.EOF {
+				r.failed.Inc()
+				r.err.Store(err)
+			}
+			return nil, ci, io.EOF
+		}
+		if r.filter == nil || r.filter.Matches(data) {
+			return data, ci, nil
+		}
+	}
+}
+
+// openCapture detects if r is a pcapng or classic pcap file, and returns the
+// appropriate pcapgo reader.
+func openCapture(r io.Reader) (captureReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, fmt.Errorf("reading capture file header: %w", err)
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		return pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	}
+	return pcapgo.NewReader(br)
+}
+
+// NewFile creates a ClosableSource which reads packets from a pcap or pcapng
+// capture file, or from standard input if path is StdinPath.  Packets keep
+// the timestamps recorded in the file, and only those matching the BPF filter
+// are delivered.  The Packets channel is closed at the end of the file, or
+// at the first error reading it, which Err then returns.
+func NewFile(path string, filter string) (*ClosableSource, error) {
+	var f io.ReadCloser = os.Stdin
+	if path != StdinPath {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, fmt.Errorf("opening capture file %v: %w", path, err)
+		}
+	}
+
+	r, err := openCapture(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading capture file %v: %w", path, err)
+	}
+
+	fr := &filteredReader{captureReader: r}
+	if filter != "" {
+		fr.filter, err = pcapfilter.NewMatcher(filter, r.LinkType())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	src := newClosableSource(path, filter, fileHandle{f: f, r: fr}, gopacket.NewPacketSource(fr, r.LinkType()))
+	fr.failed = src.metrics.FileErrors
+	return src, nil
+}
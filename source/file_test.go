@@ -0,0 +1,73 @@
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeCapture writes a pcap file of n packets, cutting the last short by
+// truncate bytes.
+func writeCapture(t *testing.T, n, truncate int) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		data := udpPacket(t, "", 64, uint16(i), "INVITE", start).Data()
+		ci := gopacket.CaptureInfo{Timestamp: start, CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(st.Size() - int64(truncate)); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestFileTruncated(t *testing.T) {
+	for name, tc := range map[string]struct {
+		truncate int
+		packets  int
+		failed   bool
+	}{
+		"whole":     {0, 3, false},
+		"truncated": {10, 2, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			path := writeCapture(t, 3, tc.truncate)
+			defer os.Remove(path)
+
+			src, err := NewFile(path, "")
+			is.NoErr(err)
+			defer src.Close()
+			n := 0
+			for range src.Packets() {
+				n++
+			}
+			is.Equal(n, tc.packets)
+			is.Equal(src.Err() != nil, tc.failed)
+			is.Equal(testutil.ToFloat64(src.metrics.FileErrors) == 1, tc.failed)
+		})
+	}
+}
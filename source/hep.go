@@ -0,0 +1,324 @@
+package source
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/hep"
+)
+
+// DefaultHEPListen is the address HEP sources listen on by default, the port
+// registered for HEP.
+const DefaultHEPListen = "udp://:9060"
+
+// hepSource receives HEP packets over UDP and TCP, and delivers their SIP
+// payloads as if they had been captured from the network.
+type hepSource struct {
+	packets chan gopacket.Packet
+	metrics *Metrics
+
+	mu        sync.Mutex
+	done      chan struct{}
+	listeners []net.Listener
+	pconns    []net.PacketConn
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+func (s *hepSource) Packets() chan gopacket.Packet { return s.packets }
+
+// Close stops listening and closes every connection; the Packets channel
+// closes once they have all finished.
+func (s *hepSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	close(s.done)
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, c := range s.pconns {
+		c.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// hepTransports are the transports of the HEP IP protocols SIP is carried
+// over.
+var hepTransports = map[layers.IPProtocol]string{
+	layers.IPProtocolUDP:  capture.UDP,
+	layers.IPProtocolTCP:  capture.TCP,
+	layers.IPProtocolSCTP: capture.SCTP,
+}
+
+// hepPacket builds a UDP packet carrying a HEP payload, with the addresses
+// and ports it was originally captured with, so it can be extracted the same
+// as a captured packet.  UDP is used even for payloads which were carried
+// over TCP, because each HEP payload is already one whole SIP message, so the
+// transport it was carried over is named in the AncillaryData, after the HEP
+// packet itself and the capture.Node which sent it.
+func hepPacket(h *hep.Packet) (gopacket.Packet, error) {
+	src, dst := h.SrcIP, h.DstIP
+	if src == nil {
+		src = net.IPv4zero
+	}
+	if dst == nil {
+		dst = net.IPv4zero
+	}
+
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(h.SrcPort),
+		DstPort: layers.UDPPort(h.DstPort),
+	}
+	var ip gopacket.NetworkLayer
+	var first gopacket.LayerType
+	if src.To4() != nil && dst.To4() != nil {
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Flags:    layers.IPv4DontFragment,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src.To4(),
+			DstIP:    dst.To4(),
+		}
+		first = layers.LayerTypeIPv4
+	} else {
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src.To16(),
+			DstIP:      dst.To16(),
+		}
+		first = layers.LayerTypeIPv6
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		ip.(gopacket.SerializableLayer), udp, gopacket.Payload(h.Payload))
+	if err != nil {
+		return nil, fmt.Errorf("building packet from HEP: %w", err)
+	}
+
+	p := gopacket.NewPacket(buf.Bytes(), hepDecoder{first}, gopacket.Default)
+
+	md := p.Metadata()
+	md.Timestamp = h.Timestamp
+	if md.Timestamp.IsZero() {
+		md.Timestamp = time.Now()
+	}
+	md.CaptureLength = len(buf.Bytes())
+	md.Length = md.CaptureLength
+	md.AncillaryData = append(md.AncillaryData, h, capture.Node{
+		ID:            h.NodeID,
+		Name:          h.NodeName,
+		CorrelationID: h.CorrelationID,
+	})
+	if t, ok := hepTransports[h.Protocol]; ok {
+		md.AncillaryData = append(md.AncillaryData, capture.Transport(t))
+	}
+	return p, nil
+}
+
+// hepDecoder decodes a packet built by hepPacket.  gopacket only decodes UDP
+// as SIP on port 5060, but a HEP payload is known to be SIP whatever its
+// ports, so the SIP layer is decoded directly after the UDP layer.
+type hepDecoder struct {
+	network gopacket.LayerType
+}
+
+func (d hepDecoder) Decode(data []byte, pb gopacket.PacketBuilder) error {
+	var ip gopacket.DecodingLayer = &layers.IPv4{}
+	if d.network == layers.LayerTypeIPv6 {
+		ip = &layers.IPv6{}
+	}
+	if err := ip.DecodeFromBytes(data, pb); err != nil {
+		return err
+	}
+	pb.AddLayer(ip.(gopacket.Layer))
+	pb.SetNetworkLayer(ip.(gopacket.NetworkLayer))
+
+	udp := &layers.UDP{}
+	if err := udp.DecodeFromBytes(ip.(gopacket.Layer).LayerPayload(), pb); err != nil {
+		return err
+	}
+	pb.AddLayer(udp)
+	pb.SetTransportLayer(udp)
+	return pb.NextDecoder(layers.LayerTypeSIP)
+}
+
+// deliver sends the SIP payload of a HEP packet on, returning false if the
+// source has been closed.
+func (s *hepSource) deliver(transport string, h *hep.Packet) bool {
+	if h.ProtoType != hep.ProtoSIP {
+		return true
+	}
+	p, err := hepPacket(h)
+	if err != nil {
+		s.metrics.HEPInvalid.WithLabelValues(transport).Inc()
+		return true
+	}
+	select {
+	case s.packets <- p:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *hepSource) serveUDP(c net.PacketConn) {
+	defer s.wg.Done()
+	transport := c.LocalAddr().Network()
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.metrics.HEPReceived.WithLabelValues(transport).Inc()
+		h, err := hep.Decode(buf[:n])
+		if err != nil {
+			s.metrics.HEPInvalid.WithLabelValues(transport).Inc()
+			continue
+		}
+		if !s.deliver(transport, h) {
+			return
+		}
+	}
+}
+
+func (s *hepSource) serveTCP(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		s.mu.Lock()
+		select {
+		case <-s.done:
+			s.mu.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+// serveConn reads HEPv3 packets from a TCP connection until it is closed.
+// Nothing after a packet which can't be decoded can be trusted to be framed
+// correctly, so that ends the connection.
+func (s *hepSource) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	transport := c.LocalAddr().Network()
+	r := bufio.NewReader(c)
+	for {
+		h, err := hep.Read(r)
+		if err != nil {
+			var ne net.Error
+			if err != io.EOF && !errors.As(err, &ne) {
+				s.metrics.HEPReceived.WithLabelValues(transport).Inc()
+				s.metrics.HEPInvalid.WithLabelValues(transport).Inc()
+			}
+			return
+		}
+		s.metrics.HEPReceived.WithLabelValues(transport).Inc()
+		if !s.deliver(transport, h) {
+			return
+		}
+	}
+}
+
+// NewHEP creates a ClosableSource which listens for HEP packets, such as
+// those mirrored by Kamailio, OpenSIPS, or heplify, on each of the addresses
+// given as URLs such as udp://:9060 or tcp://10.0.0.1:9060.  HEPv1, v2, and
+// v3 are accepted over UDP, and HEPv3 over TCP.  The SIP payloads are
+// delivered as UDP packets with their original addresses, ports, and capture
+// times, carrying the decoded *hep.Packet, the capture.Node which sent it, and
+// the capture.Transport it was originally carried over in their
+// AncillaryData.
+func NewHEP(addrs ...string) (*ClosableSource, error) {
+	s := &hepSource{
+		packets: make(chan gopacket.Packet, 1000),
+		done:    make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	for _, addr := range addrs {
+		u, err := url.Parse(addr)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("parsing HEP listen address: %w", err)
+		}
+		switch u.Scheme {
+		case "udp", "udp4", "udp6":
+			c, err := net.ListenPacket(u.Scheme, u.Host)
+			if err != nil {
+				s.Close()
+				return nil, fmt.Errorf("listening for HEP on %v: %w", addr, err)
+			}
+			s.pconns = append(s.pconns, c)
+		case "tcp", "tcp4", "tcp6":
+			l, err := net.Listen(u.Scheme, u.Host)
+			if err != nil {
+				s.Close()
+				return nil, fmt.Errorf("listening for HEP on %v: %w", addr, err)
+			}
+			s.listeners = append(s.listeners, l)
+		default:
+			s.Close()
+			return nil, fmt.Errorf("HEP listen address %v must be a udp:// or tcp:// URL", addr)
+		}
+	}
+
+	src := newClosableSource(strings.Join(addrs, ","), "", s, s)
+	s.metrics = src.metrics
+	for _, c := range s.pconns {
+		s.wg.Add(1)
+		go s.serveUDP(c)
+	}
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go s.serveTCP(l)
+	}
+	go func() { s.wg.Wait(); close(s.packets) }()
+	return src, nil
+}
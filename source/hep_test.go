@@ -0,0 +1,123 @@
+package source
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/nextcaller/sip-capture/hep"
+)
+
+const hepInvite = "INVITE sip:bob@example.com SIP/2.0\r\nCall-ID: abc@host\r\nContent-Length: 0\r\n\r\n"
+
+// hep2 builds a HEPv2 packet of hepInvite sent from 10.0.0.1:5080 to
+// 10.0.0.2:5080, at time ts.
+func hep2(ts time.Time) []byte {
+	b := []byte{2, 16, 2, byte(layers.IPProtocolUDP), 0x13, 0xd8, 0x13, 0xd8, 10, 0, 0, 1, 10, 0, 0, 2}
+	tm := make([]byte, 10)
+	binary.LittleEndian.PutUint32(tm, uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(tm[4:], uint32(ts.Nanosecond()/1000))
+	return append(append(b, tm...), hepInvite...)
+}
+
+// hep3 builds a HEPv3 packet of hepInvite sent over TCP from
+// [2001:db8::1]:5061 to [2001:db8::2]:5061, with a correlation ID and node.
+func hep3() []byte {
+	var b []byte
+	add := func(typ uint16, body []byte) {
+		c := make([]byte, 6)
+		binary.BigEndian.PutUint16(c[2:], typ)
+		binary.BigEndian.PutUint16(c[4:], uint16(6+len(body)))
+		b = append(append(b, c...), body...)
+	}
+	add(2, []byte{byte(layers.IPProtocolTCP)})
+	add(5, net.ParseIP("2001:db8::1"))
+	add(6, net.ParseIP("2001:db8::2"))
+	add(7, []byte{0x13, 0xc5})
+	add(8, []byte{0x13, 0xc5})
+	add(11, []byte{hep.ProtoSIP})
+	add(12, []byte{0, 0, 0, 42})
+	add(17, []byte("abc@host"))
+	add(19, []byte("kamailio-1"))
+	add(15, []byte(hepInvite))
+	hdr := []byte("HEP3\x00\x00")
+	binary.BigEndian.PutUint16(hdr[4:], uint16(6+len(b)))
+	return append(hdr, b...)
+}
+
+func nextPacket(t *testing.T, c chan gopacket.Packet) gopacket.Packet {
+	t.Helper()
+	select {
+	case p := <-c:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+		return nil
+	}
+}
+
+func TestHEP(t *testing.T) {
+	is := is.New(t)
+
+	src, err := NewHEP("udp://127.0.0.1:0", "tcp://127.0.0.1:0")
+	is.NoErr(err)
+	s := src.handle.(*hepSource)
+
+	ts := time.Date(2020, 6, 1, 12, 0, 0, 5000, time.UTC)
+	u, err := net.Dial("udp", s.pconns[0].LocalAddr().String())
+	is.NoErr(err)
+	defer u.Close()
+	_, err = u.Write([]byte("not hep"))
+	is.NoErr(err)
+	_, err = u.Write(hep2(ts))
+	is.NoErr(err)
+
+	p := nextPacket(t, src.Packets())
+	is.True(p.Metadata().Timestamp.Equal(ts))
+	ip4, ok := p.NetworkLayer().(*layers.IPv4)
+	is.True(ok)
+	is.True(ip4.SrcIP.Equal(net.IPv4(10, 0, 0, 1)))
+	is.True(ip4.DstIP.Equal(net.IPv4(10, 0, 0, 2)))
+	udp := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	is.Equal(udp.SrcPort, layers.UDPPort(5080))
+	sip, ok := p.Layer(layers.LayerTypeSIP).(*layers.SIP)
+	is.True(ok) // decoded as SIP despite the port
+	is.Equal(sip.GetCallID(), "abc@host")
+	is.Equal(capture.TransportOf(p), capture.UDP)
+	is.Equal(capture.NodeOf(p), capture.Node{}) // HEPv2 has no node chunks
+
+	c, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	is.NoErr(err)
+	defer c.Close()
+	_, err = c.Write(append(hep3(), hep3()...))
+	is.NoErr(err)
+
+	for i := 0; i < 2; i++ {
+		p = nextPacket(t, src.Packets())
+		ip6, ok := p.NetworkLayer().(*layers.IPv6)
+		is.True(ok)
+		is.True(ip6.SrcIP.Equal(net.ParseIP("2001:db8::1")))
+		_, ok = p.Layer(layers.LayerTypeSIP).(*layers.SIP)
+		is.True(ok)
+		h, ok := p.Metadata().AncillaryData[0].(*hep.Packet)
+		is.True(ok)
+		is.Equal(h.Protocol, layers.IPProtocolTCP)
+		is.Equal(h.CorrelationID, "abc@host")
+		is.Equal(capture.NodeOf(p), capture.Node{ID: 42, Name: "kamailio-1", CorrelationID: "abc@host"})
+		is.Equal(capture.TransportOf(p), capture.TCP) // carried over TCP, though rebuilt as UDP
+	}
+
+	src.Close()
+	for range src.Packets() {
+	}
+	is.Equal(testutil.ToFloat64(src.metrics.HEPReceived.WithLabelValues("udp")), 2.0)
+	is.Equal(testutil.ToFloat64(src.metrics.HEPInvalid.WithLabelValues("udp")), 1.0)
+	is.Equal(testutil.ToFloat64(src.metrics.HEPReceived.WithLabelValues("tcp")), 2.0)
+}
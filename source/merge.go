@@ -0,0 +1,157 @@
+package source
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// dedup remembers which interface recently carried each packet, so that a
+// copy of it seen on another interface can be dropped.  Copies on the same
+// interface are kept, since they are retransmissions which matter to SIP.
+type dedup struct {
+	sync.Mutex
+	window time.Duration
+	seen   map[uint64]sighting
+	purged time.Time
+}
+
+type sighting struct {
+	iface string
+	ts    time.Time
+}
+
+// packetKey hashes what identifies a packet no matter which interface it is
+// seen on: its addresses, IPv4 identification, and network layer payload.
+// Link layer headers, TTLs, and IP checksums may all differ between copies.
+func packetKey(p gopacket.Packet) (uint64, bool) {
+	h := fnv.New64a()
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		var id [5]byte
+		binary.BigEndian.PutUint16(id[:], ip.Id)
+		binary.BigEndian.PutUint16(id[2:], ip.FragOffset)
+		id[4] = byte(ip.Protocol)
+		h.Write(ip.SrcIP)
+		h.Write(ip.DstIP)
+		h.Write(id[:])
+		h.Write(ip.Payload)
+	case *layers.IPv6:
+		h.Write(ip.SrcIP)
+		h.Write(ip.DstIP)
+		h.Write([]byte{byte(ip.NextHeader)})
+		h.Write(ip.Payload)
+	default:
+		return 0, false
+	}
+	return h.Sum64(), true
+}
+
+// duplicate reports if p was seen on a different interface within the
+// window, going by packet timestamps.
+func (d *dedup) duplicate(iface string, p gopacket.Packet) bool {
+	key, ok := packetKey(p)
+	if !ok {
+		return false
+	}
+	ts := p.Metadata().Timestamp
+
+	d.Lock()
+	defer d.Unlock()
+	if ts.Sub(d.purged) > d.window {
+		for k, s := range d.seen {
+			if ts.Sub(s.ts) > d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.purged = ts
+	}
+
+	if s, ok := d.seen[key]; ok && s.iface != iface {
+		if diff := ts.Sub(s.ts); diff <= d.window && diff >= -d.window {
+			return true
+		}
+	}
+	d.seen[key] = sighting{iface: iface, ts: ts}
+	return false
+}
+
+// merged fans in the packets of several sources.
+type merged struct {
+	sources []*ClosableSource
+	packets chan gopacket.Packet
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (m *merged) Packets() chan gopacket.Packet { return m.packets }
+
+// Close closes every source; the Packets channel closes once all of them
+// have finished.
+func (m *merged) Close() {
+	m.once.Do(func() { close(m.done) })
+	for _, s := range m.sources {
+		s.Close()
+	}
+}
+
+// NewMerged creates a ClosableSource delivering the packets of all srcs, as
+// tagged with their capture.Interface by the live sources.  A packet seen on
+// more than one interface within window is only delivered once; a zero window
+// keeps every copy.  Closing the merged source closes all of srcs.  A single
+// source has no copies to drop, so is returned as it is.
+func NewMerged(window time.Duration, srcs ...*ClosableSource) *ClosableSource {
+	if len(srcs) == 1 {
+		return srcs[0]
+	}
+	m := &merged{
+		sources: srcs,
+		packets: make(chan gopacket.Packet, 1000),
+		done:    make(chan struct{}),
+	}
+	var d *dedup
+	if window > 0 {
+		d = &dedup{window: window, seen: make(map[uint64]sighting)}
+	}
+	metrics := NewMetrics()
+
+	var names []string
+	var wg sync.WaitGroup
+	for _, s := range srcs {
+		names = append(names, s.name)
+		metrics.CapSource.WithLabelValues(s.name, s.filter).Set(1)
+		metrics.Ring = append(metrics.Ring, s.metrics.Ring...)
+		received := metrics.Received.WithLabelValues(s.name)
+		duplicates := metrics.Duplicates.WithLabelValues(s.name)
+
+		wg.Add(1)
+		go func(s *ClosableSource) {
+			defer wg.Done()
+			for p := range s.Packets() {
+				received.Inc()
+				if d != nil && d.duplicate(s.name, p) {
+					duplicates.Inc()
+					continue
+				}
+				select {
+				case m.packets <- p:
+				case <-m.done:
+					return
+				}
+			}
+		}(s)
+	}
+	go func() { wg.Wait(); close(m.packets) }()
+
+	return &ClosableSource{
+		handle:  m,
+		source:  m,
+		metrics: metrics,
+		name:    strings.Join(names, ","),
+	}
+}
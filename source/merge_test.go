@@ -0,0 +1,148 @@
+package source
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/matryer/is"
+	"github.com/nextcaller/sip-capture/capture"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// chanSource is a packetSource whose packets are fed by the test.
+type chanSource chan gopacket.Packet
+
+func (c chanSource) Packets() chan gopacket.Packet { return c }
+func (c chanSource) Close()                        {}
+
+// udpPacket builds a packet as captured on iface, its ttl and IPv4 id making
+// copies on different interfaces distinguishable.
+func udpPacket(t *testing.T, iface string, ttl uint8, id uint16, payload string, ts time.Time) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, ttl},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Id:       id,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	udp := &layers.UDP{SrcPort: 5060, DstPort: 5060}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	md := p.Metadata()
+	md.Timestamp = ts
+	md.AncillaryData = append(md.AncillaryData, capture.Interface(iface))
+	return p
+}
+
+func TestMergedDedup(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	access, core := make(chanSource), make(chanSource)
+	m := NewMerged(100*time.Millisecond,
+		newClosableSource("eth0", "udp", access, access),
+		newClosableSource("eth1", "", core, core),
+	)
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		for p := range m.Packets() {
+			got = append(got, capture.InterfaceOf(p)+":"+string(p.ApplicationLayer().Payload()))
+		}
+		close(done)
+	}()
+
+	access <- udpPacket(t, "eth0", 64, 1, "INVITE", start)
+	// routed copy on the core side, differing only in link layer and TTL
+	core <- udpPacket(t, "eth1", 63, 1, "INVITE", start.Add(time.Millisecond))
+	// a retransmission on the same interface is kept
+	access <- udpPacket(t, "eth0", 64, 1, "INVITE", start.Add(2*time.Millisecond))
+	// a different packet is kept
+	core <- udpPacket(t, "eth1", 63, 2, "BYE", start.Add(3*time.Millisecond))
+	// the same packet outside the window is kept
+	core <- udpPacket(t, "eth1", 63, 1, "INVITE", start.Add(time.Second))
+	close(access)
+	close(core)
+	<-done
+
+	// the interfaces are read concurrently, so only order within each is kept
+	sort.Strings(got)
+	is.Equal(got, []string{"eth0:INVITE", "eth0:INVITE", "eth1:BYE", "eth1:INVITE"})
+	is.Equal(testutil.ToFloat64(m.metrics.Received.WithLabelValues("eth0")), 2.0)
+	is.Equal(testutil.ToFloat64(m.metrics.Received.WithLabelValues("eth1")), 3.0)
+	is.Equal(testutil.ToFloat64(m.metrics.Duplicates.WithLabelValues("eth0")), 0.0)
+	is.Equal(testutil.ToFloat64(m.metrics.Duplicates.WithLabelValues("eth1")), 1.0)
+	is.Equal(testutil.ToFloat64(m.metrics.CapSource.WithLabelValues("eth0", "udp")), 1.0)
+	is.Equal(testutil.ToFloat64(m.metrics.CapSource.WithLabelValues("eth1", "")), 1.0)
+}
+
+func TestMergedNoDedup(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	access, core := make(chanSource), make(chanSource)
+	m := NewMerged(0,
+		newClosableSource("eth0", "", access, access),
+		newClosableSource("eth1", "", core, core),
+	)
+
+	n := 0
+	done := make(chan struct{})
+	go func() {
+		for range m.Packets() {
+			n++
+		}
+		close(done)
+	}()
+
+	access <- udpPacket(t, "eth0", 64, 1, "INVITE", start)
+	core <- udpPacket(t, "eth1", 63, 1, "INVITE", start)
+	close(access)
+	close(core)
+	<-done
+
+	is.Equal(n, 2)
+}
+
+func TestMergedSingle(t *testing.T) {
+	is := is.New(t)
+
+	// nothing to merge or deduplicate, so no goroutine is put in between.
+	c := make(chanSource)
+	src := newClosableSource("eth0", "", c, c)
+	is.Equal(NewMerged(100*time.Millisecond, src), src)
+}
+
+// dataSource is a gopacket.PacketDataSource returning one empty packet.
+type dataSource struct{}
+
+func (dataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return []byte{}, gopacket.CaptureInfo{}, nil
+}
+
+func TestLabelled(t *testing.T) {
+	is := is.New(t)
+
+	p, err := gopacket.NewPacketSource(labelled{dataSource{}, "eth0"}, layers.LinkTypeEthernet).NextPacket()
+	is.NoErr(err)
+	is.Equal(capture.InterfaceOf(p), "eth0")
+}
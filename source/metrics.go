@@ -5,9 +5,21 @@ import (
 )
 
 // Metrics contains a Prometheus metric recording a packet source
-// descriptor and BPF filter as labels on a constant gauge.
+// descriptor and BPF filter as labels on a constant gauge, and for sources
+// with a kernel ring buffer, its received, dropped, and freeze counters.
+// Merged sources also count the packets received from each interface, and
+// those dropped as duplicates of a packet seen on another interface.  HEP
+// sources count the HEP packets received over each transport, and those
+// which couldn't be decoded, and file sources count read errors which ended
+// the file early.
 type Metrics struct {
-	CapSource *prometheus.GaugeVec
+	CapSource   *prometheus.GaugeVec
+	Ring        []prometheus.Collector
+	Received    *prometheus.CounterVec
+	Duplicates  *prometheus.CounterVec
+	HEPReceived *prometheus.CounterVec
+	HEPInvalid  *prometheus.CounterVec
+	FileErrors  prometheus.Counter
 }
 
 // NewMetrics creates a new Metrics object.
@@ -17,6 +29,26 @@ func NewMetrics() *Metrics {
 			Name: "packets_source_info",
 			Help: "Constant, labeled with BPF filter and capture interface",
 		}, []string{"source", "bpf_filter"}),
+		Received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "packets_interface_total",
+			Help: "Packets received from each capture interface",
+		}, []string{"interface"}),
+		Duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "packets_interface_duplicate_total",
+			Help: "Packets dropped because the same packet was just seen on another interface",
+		}, []string{"interface"}),
+		HEPReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "packets_hep_total",
+			Help: "HEP packets received over each transport",
+		}, []string{"transport"}),
+		HEPInvalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "packets_hep_invalid_total",
+			Help: "HEP packets received over each transport which couldn't be decoded",
+		}, []string{"transport"}),
+		FileErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "packets_file_errors_total",
+			Help: "Capture files ended early by an error reading them",
+		}),
 	}
 
 	return m
@@ -25,7 +57,12 @@ func NewMetrics() *Metrics {
 // List the items contained with a Metrics so that they can be exposed via a
 // prometheus.Registry
 func (m Metrics) List() []prometheus.Collector {
-	return []prometheus.Collector{
+	return append([]prometheus.Collector{
 		m.CapSource,
-	}
+		m.Received,
+		m.Duplicates,
+		m.HEPReceived,
+		m.HEPInvalid,
+		m.FileErrors,
+	}, m.Ring...)
 }
@@ -0,0 +1,33 @@
+package source
+
+// Defaults for AFPacketOptions; a 64MiB ring by default.
+const (
+	DefaultBlockSize  = 1 << 20
+	DefaultNumBlocks  = 64
+	DefaultFanoutType = "hash"
+)
+
+// AFPacketOptions controls the memory mapped ring created by NewAFPacket.
+// BlockSize must be a multiple of the page size and larger than any packet.
+// A non-zero FanoutGroup joins the socket to that kernel fanout group, so
+// several sip-capture processes can share the interface's traffic, split by
+// FanoutType (hash, lb, cpu, rollover, random, or qm).
+type AFPacketOptions struct {
+	BlockSize   int
+	NumBlocks   int
+	FanoutGroup uint16
+	FanoutType  string
+}
+
+func (o AFPacketOptions) withDefaults() AFPacketOptions {
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.NumBlocks == 0 {
+		o.NumBlocks = DefaultNumBlocks
+	}
+	if o.FanoutType == "" {
+		o.FanoutType = DefaultFanoutType
+	}
+	return o
+}
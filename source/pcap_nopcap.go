@@ -0,0 +1,11 @@
+//go:build nopcap
+// +build nopcap
+
+package source
+
+import "errors"
+
+// NewPCAP is unavailable when built without libpcap; use NewAFPacket.
+func NewPCAP(iface string, filter string) (*ClosableSource, error) {
+	return nil, errors.New("built without libpcap support (nopcap); use the afpacket capture")
+}
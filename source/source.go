@@ -0,0 +1,82 @@
+package source
+
+import (
+	"github.com/google/gopacket"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nextcaller/sip-capture/capture"
+)
+
+// handle is the part of a packet capture handle, such as pcap.Handle, that
+// ClosableSource needs to shut it down.
+type handle interface {
+	Close()
+}
+
+// packetSource delivers packets, such as a gopacket.PacketSource.
+type packetSource interface {
+	Packets() chan gopacket.Packet
+}
+
+// labelled is a gopacket.PacketDataSource reading from a live interface,
+// adding the capture.Interface to the AncillaryData of each packet as it's
+// read.
+type labelled struct {
+	gopacket.PacketDataSource
+	iface capture.Interface
+}
+
+func (l labelled) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := l.PacketDataSource.ReadPacketData()
+	ci.AncillaryData = append(ci.AncillaryData, l.iface)
+	return data, ci, err
+}
+
+// ClosableSource wraps a capture handle and gopacket.PacketSource together
+// into one unit which can deliver packets via Packets() and expose a Close()
+// method to cleanly shut down.
+type ClosableSource struct {
+	handle  handle
+	source  packetSource
+	metrics *Metrics
+	name    string
+	filter  string
+}
+
+// newClosableSource creates a ClosableSource for a capture from name (an
+// interface or file) with filter, recording both in its metrics.
+func newClosableSource(name, filter string, h handle, src packetSource) *ClosableSource {
+	c := &ClosableSource{
+		handle:  h,
+		source:  src,
+		metrics: NewMetrics(),
+		name:    name,
+		filter:  filter,
+	}
+	c.metrics.CapSource.WithLabelValues(name, filter).Set(1)
+	return c
+}
+
+// Packets returns a channel of gopacket.Packets from the capture source.
+func (c *ClosableSource) Packets() chan gopacket.Packet {
+	return c.source.Packets()
+}
+
+// Close stops the capture handle which should in turn close the
+// source.Packets() channel.
+func (c *ClosableSource) Close() {
+	c.handle.Close()
+}
+
+// Err returns the error which ended the source early, such as a truncated
+// capture file, or nil if it hasn't.
+func (c *ClosableSource) Err() error {
+	if e, ok := c.handle.(interface{ Err() error }); ok {
+		return e.Err()
+	}
+	return nil
+}
+
+// Metrics returns a slice of prometheus.Collector items
+// for exposing the interface and filter options via Prometheus.
+func (c ClosableSource) Metrics() []prometheus.Collector { return c.metrics.List() }
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package spool
+
+// freeBytes can't find the free space elsewhere, so MinFree isn't enforced.
+func freeBytes(dir string) (int64, bool) { return 0, false }
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package spool
+
+import "syscall"
+
+// freeBytes returns the space available to unprivileged users on the
+// filesystem holding dir, and whether it could be found.
+func freeBytes(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true
+}
@@ -0,0 +1,51 @@
+package spool
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics contains Prometheus metrics about a Spool: what it holds, and how
+// many records have been spooled, replayed, and dropped.
+type Metrics struct {
+	Records  prometheus.Gauge
+	Bytes    prometheus.Gauge
+	Spooled  prometheus.Counter
+	Replayed prometheus.Counter
+	Dropped  *prometheus.CounterVec
+}
+
+// NewMetrics creates a newly initialized Metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Records: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "spool_records",
+			Help: "Number of records in the spool waiting to be replayed",
+		}),
+		Bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "spool_bytes",
+			Help: "Size of the spool's segment files on disk",
+		}),
+		Spooled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spool_spooled_total",
+			Help: "Number of records written to the spool",
+		}),
+		Replayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spool_replayed_total",
+			Help: "Number of records replayed from the spool",
+		}),
+		Dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spool_dropped_total",
+			Help: "Number of records which could not be spooled or replayed, by reason (full, disk, expired, corrupt)",
+		}, []string{"reason"}),
+	}
+	for _, reason := range []string{DroppedFull, DroppedDisk, DroppedExpired, DroppedCorrupt} {
+		m.Dropped.WithLabelValues(reason)
+	}
+	return m
+}
+
+// List the items contained with a Metrics so that they can be exposed via a
+// prometheus.Registry.
+func (m Metrics) List() []prometheus.Collector {
+	return []prometheus.Collector{m.Records, m.Bytes, m.Spooled, m.Replayed, m.Dropped}
+}
@@ -0,0 +1,503 @@
+// Package spool keeps records on disk, in order, until they can be sent on,
+// such as while a broker is unreachable.
+//
+// Records are appended to numbered segment files in a directory, each record
+// with a header of its length, a CRC-32C checksum, and the time it was
+// spooled.  Records are read back oldest first, and a segment is removed once
+// every record in it has been committed.  As the spool is opened, each
+// segment is checked, and one left damaged by a crash is truncated at its
+// first bad record.  How far the first segment has been read is saved as the
+// spool is closed; after a crash, what was committed of that segment is read
+// again, so records may be replayed twice.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultSegmentSize is the size at which a segment file is closed and
+	// the next begun.
+	DefaultSegmentSize = 16 << 20
+
+	// headerSize is the size of each record's header: its length, checksum,
+	// and the time it was spooled, in nanoseconds since the Unix epoch.
+	headerSize = 16
+	// segmentExt is the extension of segment files, named by their sequence
+	// number in hex so they sort in order.
+	segmentExt = ".seg"
+	// positionFile holds the sequence number of the first segment, and the
+	// offset of the next record to read from it, as of the spool closing.
+	positionFile = "position"
+)
+
+// Reasons records are counted as dropped by the spool_dropped_total metric.
+const (
+	DroppedFull    = "full"
+	DroppedDisk    = "disk"
+	DroppedExpired = "expired"
+	DroppedCorrupt = "corrupt"
+)
+
+var (
+	// ErrFull indicates that a record couldn't be spooled as the spool holds
+	// MaxSize already, or the record is larger than a segment.
+	ErrFull = errors.New("spool is full")
+	// ErrDiskFull indicates that a record couldn't be spooled as its
+	// filesystem has less than MinFree space left.
+	ErrDiskFull = errors.New("too little disk space left to spool")
+	// ErrClosed indicates that the spool has been closed.
+	ErrClosed = errors.New("spool is closed")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Options controls where a Spool keeps its segments, and its limits.  A zero
+// MaxSize, MaxAge, or MinFree is no limit.
+type Options struct {
+	// Dir is the directory segments are kept in, created if need be.
+	Dir string
+	// MaxSize is the most bytes of segments to keep; records which don't fit
+	// are dropped.
+	MaxSize int64
+	// MaxAge is how long a record may wait to be replayed; older ones are
+	// dropped as they're read.
+	MaxAge time.Duration
+	// MinFree is the space to leave free on Dir's filesystem, checked as each
+	// segment is begun.
+	MinFree int64
+	// SegmentSize is the size segments are kept to, DefaultSegmentSize if
+	// zero.
+	SegmentSize int64
+}
+
+type segment struct {
+	seq  uint64
+	path string
+	size int64
+	// records is how many records of the segment are yet to be committed.
+	records int
+}
+
+// Spool is a bounded queue of records on disk.  It's safe to append to from
+// one goroutine while reading from another.
+type Spool struct {
+	mu      sync.Mutex
+	o       Options
+	metrics *Metrics
+	// segs are the segments, oldest first; the last is appended to.
+	segs    []*segment
+	nextSeq uint64
+	w       *os.File
+	r       *os.File
+	// roff is the offset of the next record to read from segs[0].
+	roff    int64
+	size    int64
+	records int
+	// peeked is the length of the record last returned by Next, until it's
+	// committed.
+	peeked int64
+	ready  chan struct{}
+	closed bool
+}
+
+// Open opens the spool kept in o.Dir, checking the segments already there.
+func Open(o Options) (*Spool, error) {
+	if o.Dir == "" {
+		return nil, errors.New("no spool directory")
+	}
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(o.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %w", err)
+	}
+	s := &Spool{o: o, metrics: NewMetrics(), ready: make(chan struct{}, 1)}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	s.update()
+	return s, nil
+}
+
+// recover finds the segments in the spool directory, in order, truncating
+// each at its first bad record.
+func (s *Spool) recover() error {
+	entries, err := ioutil.ReadDir(s.o.Dir)
+	if err != nil {
+		return fmt.Errorf("reading spool directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		s.segs = append(s.segs, &segment{seq: seq, path: filepath.Join(s.o.Dir, name)})
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].seq < s.segs[j].seq })
+
+	segs := s.segs[:0]
+	for _, seg := range s.segs {
+		s.nextSeq = seg.seq + 1
+		if err := s.check(seg); err != nil {
+			return err
+		}
+		if seg.records == 0 {
+			if err := os.Remove(seg.path); err != nil {
+				return fmt.Errorf("removing empty spool segment: %w", err)
+			}
+			continue
+		}
+		segs = append(segs, seg)
+		s.size += seg.size
+		s.records += seg.records
+	}
+	s.segs = segs
+	return s.restorePosition()
+}
+
+// restorePosition skips what was committed of the first segment before the
+// spool was last closed, and removes the position file, which would be stale
+// after a crash.
+func (s *Spool) restorePosition() error {
+	path := filepath.Join(s.o.Dir, positionFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading spool position: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing spool position: %w", err)
+	}
+	var seq uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(data), "%x %d", &seq, &off); err != nil || len(s.segs) == 0 || s.segs[0].seq != seq {
+		return nil
+	}
+	seg := s.segs[0]
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return fmt.Errorf("opening spool segment: %w", err)
+	}
+	defer f.Close()
+	for s.roff < off && seg.records > 1 {
+		n, _, err := readRecord(f, s.roff, seg.size)
+		if err != nil {
+			return fmt.Errorf("reading spool segment: %w", err)
+		}
+		s.roff += n
+		seg.records--
+		s.records--
+	}
+	return nil
+}
+
+// check counts the good records of a segment, truncating it after them.
+func (s *Spool) check(seg *segment) error {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("opening spool segment: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("opening spool segment: %w", err)
+	}
+	for {
+		n, _, err := readRecord(f, seg.size, info.Size())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			s.metrics.Dropped.WithLabelValues(DroppedCorrupt).Inc()
+			if err := f.Truncate(seg.size); err != nil {
+				return fmt.Errorf("truncating damaged spool segment: %w", err)
+			}
+			return nil
+		}
+		seg.size += n
+		seg.records++
+	}
+}
+
+// errCorrupt indicates a record which is cut short or fails its checksum.
+var errCorrupt = errors.New("corrupt spool record")
+
+// readRecord reads the record at off in f, which ends at end, returning its
+// size with its header, and its data, with the time it was spooled.  It
+// returns io.EOF at the end of f.
+func readRecord(f *os.File, off, end int64) (int64, record, error) {
+	var hdr [headerSize]byte
+	if n, err := f.ReadAt(hdr[:], off); err != nil {
+		if err == io.EOF && n == 0 {
+			return 0, record{}, io.EOF
+		}
+		if err == io.EOF {
+			return 0, record{}, errCorrupt
+		}
+		return 0, record{}, err
+	}
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	if off+headerSize+int64(length) > end {
+		return 0, record{}, errCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, off+headerSize); err != nil {
+		if err == io.EOF {
+			return 0, record{}, errCorrupt
+		}
+		return 0, record{}, err
+	}
+	crc := crc32.Update(crc32.Checksum(hdr[8:], castagnoli), castagnoli, data)
+	if crc != sum {
+		return 0, record{}, errCorrupt
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:16])))
+	return headerSize + int64(length), record{data: data, time: t}, nil
+}
+
+type record struct {
+	data []byte
+	time time.Time
+}
+
+// Append adds data to the end of the spool.
+func (s *Spool) Append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	n := int64(headerSize + len(data))
+	if n > s.o.SegmentSize || (s.o.MaxSize > 0 && s.size+n > s.o.MaxSize) {
+		s.metrics.Dropped.WithLabelValues(DroppedFull).Inc()
+		return ErrFull
+	}
+	if s.w == nil || s.segs[len(s.segs)-1].size+n > s.o.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+	copy(buf[headerSize:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], castagnoli))
+
+	seg := s.segs[len(s.segs)-1]
+	if _, err := s.w.Write(buf); err != nil {
+		// don't leave part of a record for the next to follow.
+		_ = s.w.Truncate(seg.size)
+		return fmt.Errorf("writing spool segment: %w", err)
+	}
+	seg.size += n
+	seg.records++
+	s.size += n
+	s.records++
+	s.metrics.Spooled.Inc()
+	s.update()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate syncs and closes the segment being appended to, and begins the
+// next, if there's space left on disk.
+func (s *Spool) rotate() error {
+	if s.w != nil {
+		err := s.w.Sync()
+		if cerr := s.w.Close(); err == nil {
+			err = cerr
+		}
+		s.w = nil
+		if err != nil {
+			return fmt.Errorf("closing spool segment: %w", err)
+		}
+	}
+	if s.o.MinFree > 0 {
+		if free, ok := freeBytes(s.o.Dir); ok && free < s.o.MinFree+s.o.SegmentSize {
+			s.metrics.Dropped.WithLabelValues(DroppedDisk).Inc()
+			return ErrDiskFull
+		}
+	}
+	seg := &segment{seq: s.nextSeq, path: filepath.Join(s.o.Dir, fmt.Sprintf("%016x%s", s.nextSeq, segmentExt))}
+	w, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("creating spool segment: %w", err)
+	}
+	s.nextSeq++
+	s.w = w
+	s.segs = append(s.segs, seg)
+	return nil
+}
+
+// Next returns the oldest record in the spool, and the time it was spooled,
+// without removing it; it's returned again until Commit is called.  Records
+// older than MaxAge are dropped first.  Next returns io.EOF if the spool is
+// empty.
+func (s *Spool) Next() ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, time.Time{}, ErrClosed
+	}
+	for s.records > 0 {
+		seg := s.segs[0]
+		if s.r == nil {
+			r, err := os.Open(seg.path)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("opening spool segment: %w", err)
+			}
+			s.r = r
+		}
+		n, rec, err := readRecord(s.r, s.roff, seg.size)
+		if err == errCorrupt || err == io.EOF {
+			// damaged since it was opened; the rest of the segment is lost.
+			s.metrics.Dropped.WithLabelValues(DroppedCorrupt).Inc()
+			s.records -= seg.records
+			seg.records = 0
+			if err := s.advance(); err != nil {
+				return nil, time.Time{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("reading spool segment: %w", err)
+		}
+		s.peeked = n
+		if s.o.MaxAge > 0 && time.Since(rec.time) > s.o.MaxAge {
+			s.metrics.Dropped.WithLabelValues(DroppedExpired).Inc()
+			if err := s.commit(); err != nil {
+				return nil, time.Time{}, err
+			}
+			continue
+		}
+		return rec.data, rec.time, nil
+	}
+	return nil, time.Time{}, io.EOF
+}
+
+// Commit removes the record last returned by Next from the spool, counting
+// it replayed.
+func (s *Spool) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.peeked == 0 {
+		return nil
+	}
+	s.metrics.Replayed.Inc()
+	return s.commit()
+}
+
+// commit moves past the record last read, removing its segment once every
+// record in it has been.
+func (s *Spool) commit() error {
+	seg := s.segs[0]
+	s.roff += s.peeked
+	s.peeked = 0
+	seg.records--
+	s.records--
+	defer s.update()
+	if seg.records > 0 {
+		return nil
+	}
+	return s.advance()
+}
+
+// advance removes the first segment, which has been read, moving on to the
+// next.  The segment being appended to is closed first.
+func (s *Spool) advance() error {
+	seg := s.segs[0]
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	if len(s.segs) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	s.segs = s.segs[1:]
+	s.roff = 0
+	s.peeked = 0
+	s.size -= seg.size
+	if err := os.Remove(seg.path); err != nil {
+		return fmt.Errorf("removing spool segment: %w", err)
+	}
+	return nil
+}
+
+// update sets the gauges of what the spool holds.
+func (s *Spool) update() {
+	s.metrics.Records.Set(float64(s.records))
+	s.metrics.Bytes.Set(float64(s.size))
+}
+
+// Len returns how many records are in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records
+}
+
+// Ready returns a channel which receives once records have been appended,
+// to wake a reader which found the spool empty.
+func (s *Spool) Ready() <-chan struct{} { return s.ready }
+
+// Close syncs the segment being appended to, and closes the spool.  What's
+// left in it is replayed once it's opened again.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.r != nil {
+		s.r.Close()
+	}
+	var err error
+	if s.w != nil {
+		err = s.w.Sync()
+		if cerr := s.w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if s.roff > 0 {
+		pos := fmt.Sprintf("%016x %d\n", s.segs[0].seq, s.roff)
+		if perr := ioutil.WriteFile(filepath.Join(s.o.Dir, positionFile), []byte(pos), 0o640); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// Metrics returns a list of prometheus.Collector interfaces, suitable for
+// passing to prometheus.Registry to export spool metrics.
+func (s *Spool) Metrics() []prometheus.Collector { return s.metrics.List() }
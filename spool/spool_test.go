@@ -0,0 +1,161 @@
+package spool
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// segments returns the names of the segment files in dir.
+func segments(is *is.I, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	is.NoErr(err)
+	return names
+}
+
+// drain reads and commits everything in the spool.
+func drain(is *is.I, s *Spool) []string {
+	var got []string
+	for {
+		data, _, err := s.Next()
+		if err == io.EOF {
+			return got
+		}
+		is.NoErr(err)
+		got = append(got, string(data))
+		is.NoErr(s.Commit())
+	}
+}
+
+func TestSpool(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	// three records to a segment.
+	o := Options{Dir: dir, SegmentSize: 3 * (headerSize + 6)}
+	s, err := Open(o)
+	is.NoErr(err)
+	var want []string
+	for i := 0; i < 8; i++ {
+		want = append(want, fmt.Sprintf("rec%03d", i))
+		is.NoErr(s.Append([]byte(want[i])))
+	}
+	is.Equal(s.Len(), 8)
+	is.Equal(len(segments(is, dir)), 3)
+	select {
+	case <-s.Ready():
+	default:
+		t.Fatal("spool not ready after append")
+	}
+
+	// what's read but not committed is read again once reopened.
+	data, _, err := s.Next()
+	is.NoErr(err)
+	is.Equal(string(data), want[0])
+	is.NoErr(s.Commit())
+	data, _, err = s.Next()
+	is.NoErr(err)
+	is.Equal(string(data), want[1])
+	is.NoErr(s.Close())
+	_, _, err = s.Next()
+	is.Equal(err, ErrClosed)
+
+	s, err = Open(o)
+	is.NoErr(err)
+	is.Equal(s.Len(), 7)
+	data, _, err = s.Next()
+	is.NoErr(err)
+	is.Equal(string(data), want[1])
+	is.NoErr(s.Close())
+
+	// after a crash, what was committed of the first segment is read again.
+	is.NoErr(os.Remove(filepath.Join(dir, positionFile)))
+	s, err = Open(o)
+	is.NoErr(err)
+	is.Equal(s.Len(), 8)
+	is.Equal(drain(is, s), want)
+	is.Equal(len(segments(is, dir)), 0)
+	is.Equal(testutil.ToFloat64(s.metrics.Replayed), 8.0)
+	is.Equal(testutil.ToFloat64(s.metrics.Records), 0.0)
+	is.Equal(testutil.ToFloat64(s.metrics.Bytes), 0.0)
+
+	// appending again, once drained, begins a new segment.
+	is.NoErr(s.Append([]byte("again!")))
+	is.Equal(drain(is, s), []string{"again!"})
+	is.NoErr(s.Close())
+}
+
+func TestSpoolDamaged(t *testing.T) {
+	testCases := map[string]func(data []byte) []byte{
+		"torn header": func(data []byte) []byte { return append(data, 0, 0, 0) },
+		"torn record": func(data []byte) []byte { return data[:len(data)-2] },
+		"bad checksum": func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		},
+		"bad length": func(data []byte) []byte {
+			data[len(data)-headerSize-6] = 0xff
+			return data
+		},
+	}
+	for name, damage := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			dir, err := ioutil.TempDir("", "spool")
+			is.NoErr(err)
+			defer os.RemoveAll(dir)
+
+			s, err := Open(Options{Dir: dir})
+			is.NoErr(err)
+			is.NoErr(s.Append([]byte("first!")))
+			is.NoErr(s.Append([]byte("second")))
+			is.NoErr(s.Close())
+
+			names := segments(is, dir)
+			is.Equal(len(names), 1)
+			data, err := ioutil.ReadFile(names[0])
+			is.NoErr(err)
+			is.NoErr(ioutil.WriteFile(names[0], damage(data), 0o640))
+
+			s, err = Open(Options{Dir: dir})
+			is.NoErr(err)
+			defer s.Close()
+			want := []string{"first!", "second"}
+			if name != "torn header" {
+				want = want[:1]
+			}
+			is.Equal(drain(is, s), want)
+			is.Equal(testutil.ToFloat64(s.metrics.Dropped.WithLabelValues(DroppedCorrupt)), 1.0)
+		})
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "spool")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(Options{Dir: dir, MaxSize: 2 * (headerSize + 6), MaxAge: time.Millisecond})
+	is.NoErr(err)
+	defer s.Close()
+	is.NoErr(s.Append([]byte("first!")))
+	is.NoErr(s.Append([]byte("second")))
+	is.Equal(s.Append([]byte("third!")), ErrFull)
+	is.Equal(testutil.ToFloat64(s.metrics.Dropped.WithLabelValues(DroppedFull)), 1.0)
+
+	time.Sleep(2 * time.Millisecond)
+	_, _, err = s.Next()
+	is.Equal(err, io.EOF)
+	is.Equal(testutil.ToFloat64(s.metrics.Dropped.WithLabelValues(DroppedExpired)), 2.0)
+	is.Equal(s.Len(), 0)
+}
@@ -0,0 +1,296 @@
+package tlsdecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+)
+
+// suite describes how a cipher suite protects records and derives its keys.
+type suite struct {
+	tls13  bool
+	rsaKex bool // a TLS 1.2 suite using RSA key exchange
+	cbc    bool
+	keyLen int
+	macLen int
+	hash   func() hash.Hash // the PRF or HKDF hash
+	mac    func() hash.Hash // the record MAC hash of CBC suites
+}
+
+var (
+	aes128GCMSHA256 = suite{keyLen: 16, hash: sha256.New}
+	aes256GCMSHA384 = suite{keyLen: 32, hash: sha512.New384}
+	aes128CBCSHA    = suite{cbc: true, keyLen: 16, macLen: sha1.Size, hash: sha256.New, mac: sha1.New}
+	aes256CBCSHA    = suite{cbc: true, keyLen: 32, macLen: sha1.Size, hash: sha256.New, mac: sha1.New}
+	aes128CBCSHA256 = suite{cbc: true, keyLen: 16, macLen: sha256.Size, hash: sha256.New, mac: sha256.New}
+	aes256CBCSHA256 = suite{cbc: true, keyLen: 32, macLen: sha256.Size, hash: sha256.New, mac: sha256.New}
+	aes256CBCSHA384 = suite{cbc: true, keyLen: 32, macLen: sha512.Size384, hash: sha512.New384, mac: sha512.New384}
+)
+
+// rsaKex returns s as a suite using RSA key exchange.
+func rsaKex(s suite) *suite {
+	s.rsaKex = true
+	return &s
+}
+
+// tls13 returns s as a TLS 1.3 suite.
+func tls13(s suite) *suite {
+	s.tls13 = true
+	return &s
+}
+
+// suites are the cipher suites which can be decrypted, by IANA number.  The
+// ChaCha20-Poly1305 suites are missing as the standard library has no
+// implementation of ChaCha20.
+var suites = map[uint16]*suite{
+	// TLS 1.3
+	0x1301: tls13(aes128GCMSHA256), // TLS_AES_128_GCM_SHA256
+	0x1302: tls13(aes256GCMSHA384), // TLS_AES_256_GCM_SHA384
+
+	// TLS 1.2 RSA key exchange
+	0x009c: rsaKex(aes128GCMSHA256), // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: rsaKex(aes256GCMSHA384), // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x002f: rsaKex(aes128CBCSHA),    // TLS_RSA_WITH_AES_128_CBC_SHA
+	0x0035: rsaKex(aes256CBCSHA),    // TLS_RSA_WITH_AES_256_CBC_SHA
+	0x003c: rsaKex(aes128CBCSHA256), // TLS_RSA_WITH_AES_128_CBC_SHA256
+	0x003d: rsaKex(aes256CBCSHA256), // TLS_RSA_WITH_AES_256_CBC_SHA256
+
+	// TLS 1.2 (EC)DHE key exchange
+	0xc02f: &aes128GCMSHA256, // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: &aes256GCMSHA384, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: &aes128GCMSHA256, // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: &aes256GCMSHA384, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0x009e: &aes128GCMSHA256, // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: &aes256GCMSHA384, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc013: &aes128CBCSHA,    // TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA
+	0xc014: &aes256CBCSHA,    // TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA
+	0xc009: &aes128CBCSHA,    // TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA
+	0xc00a: &aes256CBCSHA,    // TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA
+	0xc027: &aes128CBCSHA256, // TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256
+	0xc028: &aes256CBCSHA384, // TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384
+	0xc023: &aes128CBCSHA256, // TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256
+	0xc024: &aes256CBCSHA384, // TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384
+	0x0033: &aes128CBCSHA,    // TLS_DHE_RSA_WITH_AES_128_CBC_SHA
+	0x0039: &aes256CBCSHA,    // TLS_DHE_RSA_WITH_AES_256_CBC_SHA
+	0x0067: &aes128CBCSHA256, // TLS_DHE_RSA_WITH_AES_128_CBC_SHA256
+	0x006b: &aes256CBCSHA256, // TLS_DHE_RSA_WITH_AES_256_CBC_SHA256
+}
+
+// prf is the TLS 1.2 pseudorandom function (RFC 5246, section 5).
+func prf(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	out := make([]byte, 0, n+mac.Size())
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// expandLabel is the TLS 1.3 HKDF-Expand-Label function (RFC 8446, section
+// 7.1), with an empty context.
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(n>>8), byte(n), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	mac := hmac.New(h, secret)
+	out := make([]byte, 0, n+mac.Size())
+	var t []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+// decrypter removes the protection from the records sent by one side of a
+// connection, in order.  A record which fails to decrypt leaves the
+// decrypter as it was, so that another may be tried.
+type decrypter interface {
+	// decrypt returns the content type and plaintext of a record, given
+	// its 5 byte header and its fragment.
+	decrypt(header, fragment []byte) (byte, []byte, error)
+}
+
+// additionalData is the TLS 1.2 MAC and AEAD additional data for a record.
+func additionalData(seq uint64, header []byte, length int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, seq)
+	copy(ad[8:11], header[:3])
+	binary.BigEndian.PutUint16(ad[11:], uint16(length))
+	return ad
+}
+
+// gcm12 decrypts TLS 1.2 AES-GCM records, whose nonce is a fixed 4 byte IV
+// and an explicit 8 bytes sent with each record.
+type gcm12 struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+func newGCM12(key, iv []byte) (*gcm12, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gcm12{aead: aead, iv: iv}, nil
+}
+
+func (c *gcm12) decrypt(header, fragment []byte) (byte, []byte, error) {
+	const explicit = 8
+	if len(fragment) < explicit+c.aead.Overhead() {
+		return 0, nil, errRecord
+	}
+	nonce := append(append([]byte(nil), c.iv...), fragment[:explicit]...)
+	ad := additionalData(c.seq, header, len(fragment)-explicit-c.aead.Overhead())
+	plain, err := c.aead.Open(nil, nonce, fragment[explicit:], ad)
+	if err != nil {
+		return 0, nil, errDecrypt
+	}
+	c.seq++
+	return header[0], plain, nil
+}
+
+// cbc12 decrypts TLS 1.2 AES-CBC records, with an explicit IV and an HMAC,
+// either of the plaintext before it's padded and encrypted, or of the
+// ciphertext when encrypt-then-MAC (RFC 7366) was negotiated.
+type cbc12 struct {
+	block cipher.Block
+	mac   hash.Hash
+	etm   bool
+	seq   uint64
+}
+
+func newCBC12(s *suite, key, macKey []byte, etm bool) (*cbc12, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cbc12{block: block, mac: hmac.New(s.mac, macKey), etm: etm}, nil
+}
+
+// sum returns the record MAC of data.
+func (c *cbc12) sum(header, data []byte) []byte {
+	c.mac.Reset()
+	c.mac.Write(additionalData(c.seq, header, len(data)))
+	c.mac.Write(data)
+	return c.mac.Sum(nil)
+}
+
+func (c *cbc12) decrypt(header, fragment []byte) (byte, []byte, error) {
+	bs, macLen := c.block.BlockSize(), c.mac.Size()
+	if c.etm {
+		if len(fragment) < bs+macLen {
+			return 0, nil, errRecord
+		}
+		tag := fragment[len(fragment)-macLen:]
+		fragment = fragment[:len(fragment)-macLen]
+		if !hmac.Equal(tag, c.sum(header, fragment)) {
+			return 0, nil, errDecrypt
+		}
+	}
+	if len(fragment) < 2*bs || len(fragment)%bs != 0 {
+		return 0, nil, errRecord
+	}
+	plain := make([]byte, len(fragment)-bs)
+	cipher.NewCBCDecrypter(c.block, fragment[:bs]).CryptBlocks(plain, fragment[bs:])
+
+	pad := int(plain[len(plain)-1])
+	if pad+1 > len(plain) {
+		return 0, nil, errDecrypt
+	}
+	for _, b := range plain[len(plain)-pad-1:] {
+		if int(b) != pad {
+			return 0, nil, errDecrypt
+		}
+	}
+	plain = plain[:len(plain)-pad-1]
+
+	if !c.etm {
+		if len(plain) < macLen {
+			return 0, nil, errDecrypt
+		}
+		tag := plain[len(plain)-macLen:]
+		plain = plain[:len(plain)-macLen]
+		if !hmac.Equal(tag, c.sum(header, plain)) {
+			return 0, nil, errDecrypt
+		}
+	}
+	c.seq++
+	return header[0], plain, nil
+}
+
+// aead13 decrypts TLS 1.3 records, which hide their real content type at the
+// end of the plaintext, followed by any padding.
+type aead13 struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+// newAEAD13 creates a decrypter from a TLS 1.3 traffic secret.
+func newAEAD13(s *suite, secret []byte) (*aead13, error) {
+	block, err := aes.NewCipher(expandLabel(s.hash, secret, "key", s.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aead13{aead: aead, iv: expandLabel(s.hash, secret, "iv", aead.NonceSize())}, nil
+}
+
+func (c *aead13) decrypt(header, fragment []byte) (byte, []byte, error) {
+	nonce := append([]byte(nil), c.iv...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i, b := range seq {
+		nonce[len(nonce)-8+i] ^= b
+	}
+	plain, err := c.aead.Open(nil, nonce, fragment, header)
+	if err != nil {
+		return 0, nil, errDecrypt
+	}
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errRecord
+	}
+	c.seq++
+	return plain[i], plain[:i], nil
+}
+
+// opens reports whether a record decrypts, without moving on to the next.
+func (c *aead13) opens(header, fragment []byte) bool {
+	seq := c.seq
+	_, _, err := c.decrypt(header, fragment)
+	c.seq = seq
+	return err == nil
+}
@@ -0,0 +1,142 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key log labels, as written by NSS, OpenSSL, BoringSSL, and Go.
+const (
+	labelMasterSecret          = "CLIENT_RANDOM"
+	labelClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	labelServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	labelClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	labelServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// keyLogRecheck is how often the key log may be checked for new lines.
+const keyLogRecheck = time.Second
+
+// keyLogEntry identifies a secret in a key log.
+type keyLogEntry struct {
+	label  string
+	random [32]byte
+}
+
+// KeyLog holds the secrets from an NSS key log file, such as one written by
+// an endpoint given SSLKEYLOGFILE.  Endpoints append to the file as they make
+// new connections, so whenever a secret isn't known yet, the file is read
+// again for any lines added since it was last read, at most once every
+// keyLogRecheck.
+type KeyLog struct {
+	path string
+
+	mu      sync.Mutex
+	checked time.Time
+	size    int64
+	modTime time.Time
+	partial []byte
+	secrets map[keyLogEntry][]byte
+}
+
+// OpenKeyLog reads the key log file at path.
+func OpenKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{
+		path:    path,
+		secrets: make(map[keyLogEntry][]byte),
+	}
+	if err := k.update(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// update reads any lines added to the file since it was last read; the lock
+// must be held.  A file which shrinks has been replaced, and is read again
+// from the start.
+func (k *KeyLog) update() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return fmt.Errorf("opening key log: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("opening key log: %w", err)
+	}
+	if fi.Size() == k.size && fi.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	if fi.Size() < k.size {
+		k.size, k.partial = 0, nil
+	}
+	if _, err := f.Seek(k.size, 0); err != nil {
+		return fmt.Errorf("reading key log: %w", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("reading key log: %w", err)
+	}
+	k.size += int64(len(data))
+	k.modTime = fi.ModTime()
+
+	// the last line may still be being written.
+	data = append(k.partial, data...)
+	end := bytes.LastIndexByte(data, '\n') + 1
+	k.partial = append([]byte(nil), data[end:]...)
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		k.add(line)
+	}
+	return nil
+}
+
+// add records the secret on one line of a key log, ignoring comments and
+// anything it doesn't understand.
+func (k *KeyLog) add(line string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+	random, err := hex.DecodeString(fields[1])
+	if err != nil || len(random) != 32 {
+		return
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil || len(secret) == 0 {
+		return
+	}
+	e := keyLogEntry{label: fields[0]}
+	copy(e.random[:], random)
+	k.secrets[e] = secret
+}
+
+// secret returns the secret logged with label for the connection with the
+// given client random, reading the file again if it isn't known yet and
+// wasn't checked within keyLogRecheck.  Sessions ask again as more of their
+// records arrive.
+func (k *KeyLog) secret(label string, clientRandom []byte) ([]byte, bool) {
+	e := keyLogEntry{label: label}
+	copy(e.random[:], clientRandom)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if s, ok := k.secrets[e]; ok {
+		return s, true
+	}
+	now := time.Now()
+	if now.Sub(k.checked) < keyLogRecheck {
+		return nil, false
+	}
+	k.checked = now
+	if err := k.update(); err != nil {
+		return nil, false
+	}
+	s, ok := k.secrets[e]
+	return s, ok
+}
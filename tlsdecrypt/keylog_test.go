@@ -0,0 +1,58 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestKeyLog(t *testing.T) {
+	is := is.New(t)
+	random := bytes.Repeat([]byte{0xab}, 32)
+	line := func(label, secret string) string {
+		return label + " " + "abababababababababababababababababababababababababababababababab" + " " + secret + "\n"
+	}
+
+	kl := writeKeyLog(t, []byte("# SSL/TLS secrets log file\n"+
+		line(labelMasterSecret, "0102")+
+		"garbage\n"+
+		line(labelClientTrafficSecret, "not hex")+
+		line(labelServerTrafficSecret, "03")[:20]))
+
+	s, ok := kl.secret(labelMasterSecret, random)
+	is.True(ok)
+	is.Equal(s, []byte{1, 2})
+	_, ok = kl.secret(labelClientTrafficSecret, random)
+	is.True(!ok)
+
+	// the rest of a line which was only partly written
+	f, err := os.OpenFile(kl.path, os.O_APPEND|os.O_WRONLY, 0)
+	is.NoErr(err)
+	_, err = f.WriteString(line(labelServerTrafficSecret, "03")[20:])
+	is.NoErr(err)
+	is.NoErr(f.Close())
+	_, ok = kl.secret(labelServerTrafficSecret, random)
+	is.True(!ok) // not checked again so soon
+	kl.checked = time.Time{}
+	s, ok = kl.secret(labelServerTrafficSecret, random)
+	is.True(ok)
+	is.Equal(s, []byte{3})
+
+	// a new, shorter, file replaces the old one
+	is.NoErr(ioutil.WriteFile(kl.path, []byte(line(labelClientTrafficSecret, "04")), 0600))
+	is.NoErr(os.Chtimes(kl.path, time.Now(), time.Now().Add(time.Minute)))
+	kl.checked = time.Time{}
+	s, ok = kl.secret(labelClientTrafficSecret, random)
+	is.True(ok)
+	is.Equal(s, []byte{4})
+}
+
+func TestOpenKeyLogMissing(t *testing.T) {
+	is := is.New(t)
+	_, err := OpenKeyLog("testdata/does-not-exist")
+	is.True(err != nil)
+}
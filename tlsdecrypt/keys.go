@@ -0,0 +1,59 @@
+package tlsdecrypt
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Keys are the secrets sessions may be decrypted with.  Sessions which use
+// TLS 1.3, or an (EC)DHE key exchange, can only be decrypted with a KeyLog;
+// TLS 1.2 sessions with RSA key exchange can also be decrypted with the
+// server's RSA private key.
+type Keys struct {
+	KeyLog *KeyLog
+	RSA    []*rsa.PrivateKey
+}
+
+// LoadRSAKey reads a PEM encoded RSA private key, in either PKCS #1 or
+// PKCS #8 form, from the file at path.
+func LoadRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading RSA key: %w", err)
+	}
+	key, err := ParseRSAKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParseRSAKey parses the first PEM encoded RSA private key in data, in either
+// PKCS #1 or PKCS #8 form.
+func ParseRSAKey(data []byte) (*rsa.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no RSA private key found")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("private key is not an RSA key")
+			}
+			return rsaKey, nil
+		}
+	}
+}
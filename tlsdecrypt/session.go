@@ -0,0 +1,628 @@
+// Package tlsdecrypt decrypts captured TLS 1.2 and 1.3 connections, such as
+// SIP over TLS, with the secrets an endpoint logged to an NSS key log file
+// (SSLKEYLOGFILE), or for TLS 1.2 sessions using RSA key exchange, with the
+// server's RSA private key.
+//
+// Only the AES-GCM and AES-CBC cipher suites are understood.  Sessions using
+// anything else, resumed TLS 1.2 sessions whose master secret isn't in the key
+// log, and connections captured after their handshake can't be decrypted.
+package tlsdecrypt
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// TLS record content types.
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+// TLS handshake message types.
+const (
+	handshakeClientHello       = 1
+	handshakeServerHello       = 2
+	handshakeServerHelloDone   = 14
+	handshakeClientKeyExchange = 16
+	handshakeFinished          = 20
+	handshakeKeyUpdate         = 24
+)
+
+// TLS extensions.
+const (
+	extensionEncryptThenMAC       = 0x0016
+	extensionExtendedMasterSecret = 0x0017
+	extensionSupportedVersions    = 0x002b
+)
+
+const (
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+
+	recordHeaderLen = 5
+	// maxRecordLen is the largest a record's fragment may be, allowing for
+	// the expansion of encryption.
+	maxRecordLen = 16384 + 2048
+	// maxPending limits how much of a session is kept while waiting for
+	// the handshake to progress or for its secrets to be logged.
+	maxPending = 1 << 18
+	// maxTranscript limits how many handshake messages are kept to compute
+	// an extended master secret.
+	maxTranscript = 1 << 16
+)
+
+// helloRetryRandom is the random of a ServerHello which is really a
+// HelloRetryRequest.
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var (
+	// ErrNotTLS is returned for a connection which doesn't look like TLS.
+	ErrNotTLS = errors.New("tlsdecrypt: not a TLS connection")
+	// ErrNoHandshake is returned for a connection whose handshake wasn't
+	// captured.
+	ErrNoHandshake = errors.New("tlsdecrypt: handshake not captured")
+	// ErrNoSecret is returned when a session's secrets can't be found in
+	// the key log, and can't be found with an RSA private key.
+	ErrNoSecret = errors.New("tlsdecrypt: session secrets not available")
+	// ErrUnsupported is returned for a protocol version or cipher suite
+	// which can't be decrypted.
+	ErrUnsupported = errors.New("tlsdecrypt: unsupported")
+
+	errRecord  = errors.New("tlsdecrypt: malformed record")
+	errDecrypt = errors.New("tlsdecrypt: record failed to decrypt")
+)
+
+// IsRecord reports whether data starts with what could be the header of a
+// TLS record.
+func IsRecord(data []byte) bool {
+	return len(data) >= 3 &&
+		data[0] >= recordChangeCipherSpec && data[0] <= recordApplicationData &&
+		data[1] == 3 && data[2] <= 4
+}
+
+// half is the state of the records sent by one side of a connection.
+type half struct {
+	buf     []byte   // data not yet split into records
+	records [][]byte // records not yet handled
+	pending int      // the size of records
+
+	hs         []byte   // handshake message data not yet parsed
+	transcript [][]byte // handshake messages, for the extended master secret
+
+	// encrypted is set once the records sent are protected.
+	encrypted bool
+	dec       decrypter
+
+	// TLS 1.3 has separate handshake and application traffic keys.
+	app       *aead13
+	appSecret []byte
+	appPhase  bool
+}
+
+// Session decrypts both directions of one TLS connection.  Each direction is
+// given to the Session by the side which sent it, 0 or 1; which of the sides
+// is the client is worked out from the handshake.  Since each direction is
+// usually captured and assembled separately, records may be given to the
+// Session in a different order from the one they were sent in, and are held
+// until whatever they depend on has been seen.
+//
+// A Session is not safe for concurrent use.
+type Session struct {
+	keys *Keys
+	out  func(side int, plaintext []byte)
+
+	halves [2]half
+	client int
+
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	suite        *suite
+	ems, etm     bool
+	serverDone   bool
+	premaster    []byte // encrypted with the server's RSA key
+
+	decrypted bool
+	err       error
+}
+
+// NewSession creates a Session which gives the application data decrypted
+// from each side to out.
+func NewSession(keys *Keys, out func(side int, plaintext []byte)) *Session {
+	return &Session{keys: keys, out: out, client: -1}
+}
+
+// Decrypted reports whether any records have been decrypted.
+func (s *Session) Decrypted() bool { return s.decrypted }
+
+// Pending reports whether any of the records sent by side are waiting for
+// the other side's handshake messages before they can be decrypted.
+func (s *Session) Pending(side int) bool { return len(s.halves[side].records) > 0 }
+
+// Err returns the reason the session can't be decrypted, if it can't.
+func (s *Session) Err() error { return s.err }
+
+// Close finishes the session, returning the reason any of it couldn't be
+// decrypted, if there was one.
+func (s *Session) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	for i := range s.halves {
+		if len(s.halves[i].records) > 0 {
+			s.fail(s.waiting())
+			break
+		}
+	}
+	return s.err
+}
+
+// waiting gives the reason a session might be stuck.
+func (s *Session) waiting() error {
+	if s.clientRandom == nil || s.suite == nil {
+		return ErrNoHandshake
+	}
+	return ErrNoSecret
+}
+
+func (s *Session) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	for i := range s.halves {
+		s.halves[i] = half{}
+	}
+}
+
+// Feed gives the session more of the data sent by side, decrypting whatever
+// can be.
+func (s *Session) Feed(side int, data []byte) {
+	if s.err != nil {
+		return
+	}
+	h := &s.halves[side]
+	h.buf = append(h.buf, data...)
+	for len(h.buf) >= recordHeaderLen {
+		if !IsRecord(h.buf) {
+			if !s.decrypted && s.clientRandom == nil {
+				s.fail(ErrNotTLS)
+			} else {
+				s.fail(errRecord)
+			}
+			return
+		}
+		n := int(binary.BigEndian.Uint16(h.buf[3:]))
+		if n > maxRecordLen {
+			s.fail(errRecord)
+			return
+		}
+		if len(h.buf) < recordHeaderLen+n {
+			break
+		}
+		h.records = append(h.records, append([]byte(nil), h.buf[:recordHeaderLen+n]...))
+		h.pending += recordHeaderLen + n
+		h.buf = h.buf[recordHeaderLen+n:]
+	}
+	if len(h.buf) == 0 {
+		h.buf = nil
+	}
+	s.advance()
+	if s.err == nil && s.halves[0].pending+s.halves[1].pending > maxPending {
+		s.fail(s.waiting())
+	}
+}
+
+// advance handles every record which can be, until none can.
+func (s *Session) advance() {
+	for progress := true; progress && s.err == nil; {
+		progress = false
+		for side := range s.halves {
+			h := &s.halves[side]
+			for len(h.records) > 0 && s.err == nil {
+				rec := h.records[0]
+				ok := s.record(side, rec)
+				if !ok {
+					break
+				}
+				if len(h.records) > 0 {
+					h.records = h.records[1:]
+					h.pending -= len(rec)
+				}
+				progress = true
+			}
+		}
+	}
+}
+
+// record handles one record from side, returning false if it must wait for
+// more of the handshake.
+func (s *Session) record(side int, rec []byte) bool {
+	h := &s.halves[side]
+	header, fragment := rec[:recordHeaderLen], rec[recordHeaderLen:]
+
+	if !h.encrypted {
+		switch header[0] {
+		case recordHandshake:
+			s.handshake(side, fragment)
+			return true
+		case recordAlert:
+			return true
+		case recordChangeCipherSpec:
+			if s.suite == nil {
+				return false
+			}
+			// TLS 1.3 only sends it for compatibility with middleboxes.
+			if !s.suite.tls13 {
+				h.encrypted = true
+			}
+			return true
+		}
+		// application data is encrypted in TLS 1.3 from the ServerHello
+		// on; in TLS 1.2, it must follow a ChangeCipherSpec.
+		if s.suite == nil {
+			return false
+		}
+		if !s.suite.tls13 {
+			s.fail(ErrNoHandshake)
+			return true
+		}
+		h.encrypted = true
+	}
+
+	if s.suite.tls13 {
+		return s.record13(side, header, fragment)
+	}
+	if h.dec == nil {
+		s.keys12()
+		if h.dec == nil {
+			return false
+		}
+	}
+	typ, plain, err := h.dec.decrypt(header, fragment)
+	if err != nil {
+		s.fail(err)
+		return true
+	}
+	s.decrypted = true
+	if typ == recordApplicationData && len(plain) > 0 {
+		s.out(side, plain)
+	}
+	return true
+}
+
+// record13 handles an encrypted TLS 1.3 record from side.  Until the side's
+// Finished message, records are protected with the handshake traffic keys,
+// and after it with the application traffic keys.  If the handshake secrets
+// weren't logged, records which can't be decrypted with the application keys
+// are assumed to be part of the handshake.
+func (s *Session) record13(side int, header, fragment []byte) bool {
+	h := &s.halves[side]
+	s.keys13()
+	if h.app == nil {
+		// the application secrets may not have been logged yet.
+		return false
+	}
+
+	if !h.appPhase {
+		if h.dec != nil {
+			if typ, plain, err := h.dec.decrypt(header, fragment); err == nil {
+				s.decrypted = true
+				if typ == recordHandshake && s.handshake13(side, plain, handshakeFinished) {
+					h.appPhase = true
+				}
+				return true
+			}
+		}
+		if !h.app.opens(header, fragment) {
+			if h.dec != nil {
+				s.fail(errDecrypt)
+			}
+			return true
+		}
+		h.appPhase, h.hs = true, nil
+	}
+
+	typ, plain, err := h.app.decrypt(header, fragment)
+	if err != nil {
+		s.fail(err)
+		return true
+	}
+	s.decrypted = true
+	switch typ {
+	case recordApplicationData:
+		if len(plain) > 0 {
+			s.out(side, plain)
+		}
+	case recordHandshake:
+		if s.handshake13(side, plain, handshakeKeyUpdate) {
+			h.appSecret = expandLabel(s.suite.hash, h.appSecret, "traffic upd", s.suite.hash().Size())
+			app, err := newAEAD13(s.suite, h.appSecret)
+			if err != nil {
+				s.fail(err)
+				return true
+			}
+			h.app = app
+		}
+	}
+	return true
+}
+
+// handshake13 parses decrypted TLS 1.3 handshake messages sent by side,
+// reporting whether one of them was of the type looked for.
+func (s *Session) handshake13(side int, data []byte, want byte) bool {
+	h := &s.halves[side]
+	var found bool
+	h.hs = append(h.hs, data...)
+	h.hs = messages(h.hs, func(typ byte, _, _ []byte) { found = found || typ == want })
+	return found
+}
+
+// messages calls f with the type and body of each whole handshake message in
+// data, returning what's left over.
+func messages(data []byte, f func(typ byte, msg, body []byte)) []byte {
+	for len(data) >= 4 {
+		n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if len(data) < 4+n {
+			break
+		}
+		f(data[0], data[:4+n], data[4:4+n])
+		data = data[4+n:]
+	}
+	return data
+}
+
+// handshake parses the unencrypted handshake messages sent by side.
+func (s *Session) handshake(side int, fragment []byte) {
+	h := &s.halves[side]
+	h.hs = append(h.hs, fragment...)
+	h.hs = messages(h.hs, func(typ byte, msg, body []byte) {
+		if s.err != nil {
+			return
+		}
+		switch typ {
+		case handshakeClientHello:
+			if len(body) < 34 {
+				s.fail(errRecord)
+				return
+			}
+			s.client = side
+			s.clientRandom = append([]byte(nil), body[2:34]...)
+		case handshakeServerHello:
+			s.client = 1 - side
+			s.serverHello(body)
+		case handshakeServerHelloDone:
+			s.serverDone = true
+		case handshakeClientKeyExchange:
+			// RSA key exchange sends the encrypted premaster secret,
+			// preceded by its length.
+			if len(body) > 2 && int(binary.BigEndian.Uint16(body)) == len(body)-2 {
+				s.premaster = append([]byte(nil), body[2:]...)
+			}
+		}
+		if size(h.transcript) < maxTranscript {
+			h.transcript = append(h.transcript, append([]byte(nil), msg...))
+		}
+	})
+}
+
+func size(msgs [][]byte) (n int) {
+	for _, m := range msgs {
+		n += len(m)
+	}
+	return n
+}
+
+// serverHello records the version, cipher suite, and extensions the server
+// chose.
+func (s *Session) serverHello(body []byte) {
+	if len(body) < 35 {
+		s.fail(errRecord)
+		return
+	}
+	random := body[2:34]
+	if bytes.Equal(random, helloRetryRandom) {
+		// the client tries again, with the same random.
+		return
+	}
+	s.serverRandom = append([]byte(nil), random...)
+	version := binary.BigEndian.Uint16(body)
+
+	rest := body[34:]
+	sid := int(rest[0])
+	if len(rest) < 1+sid+3 {
+		s.fail(errRecord)
+		return
+	}
+	rest = rest[1+sid:]
+	id := binary.BigEndian.Uint16(rest)
+	rest = rest[3:]
+
+	if len(rest) >= 2 {
+		exts := rest[2:]
+		if n := int(binary.BigEndian.Uint16(rest)); n < len(exts) {
+			exts = exts[:n]
+		}
+		for len(exts) >= 4 {
+			typ := binary.BigEndian.Uint16(exts)
+			n := int(binary.BigEndian.Uint16(exts[2:]))
+			if len(exts) < 4+n {
+				break
+			}
+			data := exts[4 : 4+n]
+			switch typ {
+			case extensionSupportedVersions:
+				if n == 2 {
+					version = binary.BigEndian.Uint16(data)
+				}
+			case extensionExtendedMasterSecret:
+				s.ems = true
+			case extensionEncryptThenMAC:
+				s.etm = true
+			}
+			exts = exts[4+n:]
+		}
+	}
+
+	suite := suites[id]
+	switch {
+	case version != versionTLS12 && version != versionTLS13:
+		s.fail(fmt.Errorf("%w version %#04x", ErrUnsupported, version))
+	case suite == nil:
+		s.fail(fmt.Errorf("%w cipher suite %#04x", ErrUnsupported, id))
+	case suite.tls13 != (version == versionTLS13):
+		s.fail(errRecord)
+	default:
+		s.version, s.suite = version, suite
+	}
+}
+
+// keys12 sets up the TLS 1.2 decrypters, if the master secret can be found.
+func (s *Session) keys12() {
+	if s.client < 0 || s.clientRandom == nil || s.serverRandom == nil {
+		return
+	}
+	master := s.masterSecret()
+	if master == nil {
+		return
+	}
+
+	st := s.suite
+	seed := append(append([]byte(nil), s.serverRandom...), s.clientRandom...)
+	ivLen := 4
+	block := prf(st.hash, master, "key expansion", seed, 2*st.macLen+2*st.keyLen+2*ivLen)
+	take := func(n int) []byte {
+		b := block[:n]
+		block = block[n:]
+		return b
+	}
+	clientMAC, serverMAC := take(st.macLen), take(st.macLen)
+	clientKey, serverKey := take(st.keyLen), take(st.keyLen)
+	clientIV, serverIV := take(ivLen), take(ivLen)
+
+	var client, server decrypter
+	var err error
+	if st.cbc {
+		if client, err = newCBC12(st, clientKey, clientMAC, s.etm); err == nil {
+			server, err = newCBC12(st, serverKey, serverMAC, s.etm)
+		}
+	} else {
+		if client, err = newGCM12(clientKey, clientIV); err == nil {
+			server, err = newGCM12(serverKey, serverIV)
+		}
+	}
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.halves[s.client].dec = client
+	s.halves[1-s.client].dec = server
+}
+
+// masterSecret finds the TLS 1.2 master secret in the key log, or works it
+// out from the premaster secret, returning nil if it can't be found yet.
+func (s *Session) masterSecret() []byte {
+	if s.keys.KeyLog != nil {
+		if master, ok := s.keys.KeyLog.secret(labelMasterSecret, s.clientRandom); ok {
+			return master
+		}
+	}
+	if !s.suite.rsaKex || len(s.keys.RSA) == 0 {
+		if s.keys.KeyLog == nil {
+			s.fail(ErrNoSecret)
+		}
+		return nil
+	}
+	// the session hash covers the handshake up to the ClientKeyExchange.
+	if s.premaster == nil || (s.ems && !s.serverDone) {
+		return nil
+	}
+
+	var premaster []byte
+	for _, key := range s.keys.RSA {
+		if pm, err := rsa.DecryptPKCS1v15(nil, key, s.premaster); err == nil && len(pm) == 48 {
+			premaster = pm
+			break
+		}
+	}
+	if premaster == nil {
+		if s.keys.KeyLog == nil {
+			s.fail(ErrNoSecret)
+		}
+		return nil
+	}
+
+	if s.ems {
+		return prf(s.suite.hash, premaster, "extended master secret", s.sessionHash(), 48)
+	}
+	seed := append(append([]byte(nil), s.clientRandom...), s.serverRandom...)
+	return prf(s.suite.hash, premaster, "master secret", seed, 48)
+}
+
+// sessionHash is the hash of the TLS 1.2 handshake messages, up to and
+// including the ClientKeyExchange: the ClientHello, the server's first
+// flight, and then the client's.
+func (s *Session) sessionHash() []byte {
+	h := s.suite.hash()
+	client, server := s.halves[s.client].transcript, s.halves[1-s.client].transcript
+	if len(client) > 0 {
+		h.Write(client[0])
+	}
+	for _, m := range server {
+		h.Write(m)
+		if m[0] == handshakeServerHelloDone {
+			break
+		}
+	}
+	for _, m := range client[1:] {
+		h.Write(m)
+		if m[0] == handshakeClientKeyExchange {
+			break
+		}
+	}
+	return h.Sum(nil)
+}
+
+// keys13 sets up the TLS 1.3 decrypters for whichever of the traffic
+// secrets have been logged.
+func (s *Session) keys13() {
+	if s.client < 0 || s.clientRandom == nil || s.keys.KeyLog == nil {
+		if s.keys.KeyLog == nil {
+			s.fail(ErrNoSecret)
+		}
+		return
+	}
+	set := func(side int, hsLabel, appLabel string) {
+		h := &s.halves[side]
+		if h.dec == nil {
+			if secret, ok := s.keys.KeyLog.secret(hsLabel, s.clientRandom); ok {
+				dec, err := newAEAD13(s.suite, secret)
+				if err != nil {
+					s.fail(err)
+					return
+				}
+				h.dec = dec
+			}
+		}
+		if h.app == nil {
+			if secret, ok := s.keys.KeyLog.secret(appLabel, s.clientRandom); ok {
+				app, err := newAEAD13(s.suite, secret)
+				if err != nil {
+					s.fail(err)
+					return
+				}
+				h.app, h.appSecret = app, secret
+			}
+		}
+	}
+	set(s.client, labelClientHandshakeSecret, labelClientTrafficSecret)
+	set(1-s.client, labelServerHandshakeSecret, labelServerTrafficSecret)
+}
@@ -0,0 +1,323 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+const (
+	request  = "INVITE sip:bob@example.com SIP/2.0\r\nContent-Length: 0\r\n\r\n"
+	response = "SIP/2.0 200 OK\r\nContent-Length: 0\r\n\r\n"
+)
+
+var (
+	certOnce sync.Once
+	certKey  *rsa.PrivateKey
+	cert     tls.Certificate
+)
+
+// serverCert returns a self signed RSA certificate, and its key.
+func serverCert(t *testing.T) (tls.Certificate, *rsa.PrivateKey) {
+	certOnce.Do(func() {
+		var err error
+		certKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "sbc.example.com"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &certKey.PublicKey, certKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: certKey}
+	})
+	return cert, certKey
+}
+
+// recorder keeps a copy of everything written to a connection.
+type recorder struct {
+	net.Conn
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (r recorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	r.buf.Write(b)
+	r.mu.Unlock()
+	return r.Conn.Write(b)
+}
+
+// capture has a client send a request over TLS, and the server respond,
+// returning what each side sent and the key log the client wrote.
+func capture(t *testing.T, maxVersion uint16, suite uint16) (client, server, keylog []byte, negotiated uint16) {
+	is := is.New(t)
+	c, _ := serverCert(t)
+	var mu sync.Mutex
+	var cbuf, sbuf, kbuf bytes.Buffer
+
+	cc, sc := net.Pipe()
+	clientConf := &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         maxVersion,
+		KeyLogWriter:       &kbuf,
+	}
+	if suite != 0 {
+		clientConf.CipherSuites = []uint16{suite}
+	}
+	tc := tls.Client(recorder{cc, &mu, &cbuf}, clientConf)
+	ts := tls.Server(recorder{sc, &mu, &sbuf}, &tls.Config{Certificates: []tls.Certificate{c}})
+
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(request))
+		if _, err := io.ReadFull(ts, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err := ts.Write([]byte(response))
+		done <- err
+	}()
+
+	_, err := tc.Write([]byte(request))
+	is.NoErr(err)
+	buf := make([]byte, len(response))
+	_, err = io.ReadFull(tc, buf)
+	is.NoErr(err)
+	is.NoErr(<-done)
+	negotiated = tc.ConnectionState().CipherSuite
+	// close the pipes beneath, as nothing would read the alerts closing
+	// the TLS connections would send.
+	cc.Close()
+	sc.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return cbuf.Bytes(), sbuf.Bytes(), kbuf.Bytes(), negotiated
+}
+
+// writeKeyLog writes a key log to a temporary file, and opens it.
+func writeKeyLog(t *testing.T, data []byte) *KeyLog {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "keylog")
+	is.NoErr(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "keylog")
+	is.NoErr(ioutil.WriteFile(path, data, 0600))
+	kl, err := OpenKeyLog(path)
+	is.NoErr(err)
+	return kl
+}
+
+// decrypt feeds a session with the client's data, then the server's, in
+// chunks of the given size, returning what it decrypted from each side.
+func decrypt(keys *Keys, client, server []byte, chunk int) (string, string, error) {
+	var out [2]bytes.Buffer
+	s := NewSession(keys, func(side int, plain []byte) { out[side].Write(plain) })
+	for side, data := range [][]byte{client, server} {
+		for len(data) > 0 {
+			n := chunk
+			if n > len(data) {
+				n = len(data)
+			}
+			s.Feed(side, data[:n])
+			data = data[n:]
+		}
+	}
+	err := s.Close()
+	return out[0].String(), out[1].String(), err
+}
+
+func TestSession(t *testing.T) {
+	testCases := map[string]struct {
+		version uint16
+		suite   uint16
+		keylog  bool
+		rsa     bool
+		err     error
+	}{
+		"tls 1.3": {
+			version: tls.VersionTLS13,
+			keylog:  true,
+		},
+		"tls 1.2 ecdhe gcm": {
+			version: tls.VersionTLS12,
+			suite:   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			keylog:  true,
+		},
+		"tls 1.2 ecdhe gcm sha384": {
+			version: tls.VersionTLS12,
+			suite:   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			keylog:  true,
+		},
+		"tls 1.2 ecdhe cbc": {
+			version: tls.VersionTLS12,
+			suite:   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			keylog:  true,
+		},
+		"tls 1.2 ecdhe with only a key": {
+			version: tls.VersionTLS12,
+			suite:   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			rsa:     true,
+			err:     ErrNoSecret,
+		},
+		"tls 1.3 with only a key": {
+			version: tls.VersionTLS13,
+			rsa:     true,
+			err:     ErrNoSecret,
+		},
+		"tls 1.2 not logged": {
+			version: tls.VersionTLS12,
+			suite:   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			err:     ErrNoSecret,
+		},
+		"tls 1.3 not logged": {
+			version: tls.VersionTLS13,
+			err:     ErrNoSecret,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			client, server, keylog, suite := capture(t, tc.version, tc.suite)
+			if suites[suite] == nil {
+				t.Skipf("negotiated unsupported cipher suite %#04x", suite)
+			}
+
+			keys := &Keys{}
+			if tc.keylog {
+				keys.KeyLog = writeKeyLog(t, keylog)
+			} else if !tc.rsa {
+				keys.KeyLog = writeKeyLog(t, []byte("# nothing here\n"))
+			}
+			if tc.rsa {
+				_, key := serverCert(t)
+				keys.RSA = []*rsa.PrivateKey{key}
+			}
+
+			// whole, and in small pieces
+			for _, chunk := range []int{len(client) + len(server), 7} {
+				req, resp, err := decrypt(keys, client, server, chunk)
+				is.True(errors.Is(err, tc.err))
+				if tc.err == nil {
+					is.Equal(req, request)
+					is.Equal(resp, response)
+				}
+			}
+		})
+	}
+}
+
+// The RSA key exchange sessions in testdata were captured from OpenSSL, as Go
+// no longer supports RSA key exchange.
+func TestSessionRSA(t *testing.T) {
+	is := is.New(t)
+	key, err := LoadRSAKey(filepath.Join("testdata", "server.key"))
+	is.NoErr(err)
+	_, wrong := serverCert(t)
+
+	for _, name := range []string{"rsa-gcm", "rsa-gcm-noems", "rsa-cbc", "rsa-cbc-noetm"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			client, err := ioutil.ReadFile(filepath.Join("testdata", name+".client"))
+			is.NoErr(err)
+			server, err := ioutil.ReadFile(filepath.Join("testdata", name+".server"))
+			is.NoErr(err)
+
+			for _, chunk := range []int{len(client) + len(server), 7} {
+				req, resp, err := decrypt(&Keys{RSA: []*rsa.PrivateKey{wrong, key}}, client, server, chunk)
+				is.NoErr(err)
+				is.Equal(req, request)
+				is.Equal(resp, response)
+			}
+
+			_, _, err = decrypt(&Keys{RSA: []*rsa.PrivateKey{wrong}}, client, server, 100)
+			is.True(errors.Is(err, ErrNoSecret))
+		})
+	}
+}
+
+func TestSessionServerFirst(t *testing.T) {
+	is := is.New(t)
+	client, server, keylog, _ := capture(t, tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	keys := &Keys{KeyLog: writeKeyLog(t, keylog)}
+
+	// the server's side is given first, as side 0.
+	req, resp, err := decrypt(keys, server, client, 100)
+	is.NoErr(err)
+	is.Equal(req, response)
+	is.Equal(resp, request)
+}
+
+func TestSessionKeyLogUpdated(t *testing.T) {
+	is := is.New(t)
+	client, server, keylog, _ := capture(t, tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+
+	kl := writeKeyLog(t, nil)
+	keys := &Keys{KeyLog: kl}
+	var out [2]bytes.Buffer
+	s := NewSession(keys, func(side int, plain []byte) { out[side].Write(plain) })
+	s.Feed(0, client)
+	is.Equal(out[0].Len(), 0) // waiting for the secret
+
+	// the endpoint logs the secret a little later.
+	f, err := os.OpenFile(kl.path, os.O_APPEND|os.O_WRONLY, 0)
+	is.NoErr(err)
+	_, err = f.Write(keylog)
+	is.NoErr(err)
+	is.NoErr(f.Close())
+
+	s.Feed(1, server)
+	is.NoErr(s.Close())
+	is.Equal(out[0].String(), request)
+	is.Equal(out[1].String(), response)
+}
+
+func TestSessionNotTLS(t *testing.T) {
+	is := is.New(t)
+	_, _, err := decrypt(&Keys{}, []byte(request), nil, 100)
+	is.True(errors.Is(err, ErrNotTLS))
+}
+
+func TestSessionNoHandshake(t *testing.T) {
+	is := is.New(t)
+	client, server, keylog, _ := capture(t, tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	keys := &Keys{KeyLog: writeKeyLog(t, keylog)}
+
+	// skip the client's handshake records.
+	for i := 0; i < 4; i++ {
+		n := 5 + (int(client[3])<<8 | int(client[4]))
+		client = client[n:]
+	}
+	_, _, err := decrypt(keys, client, server[:0], 100)
+	is.True(errors.Is(err, ErrNoHandshake))
+}
+
+func TestIsRecord(t *testing.T) {
+	is := is.New(t)
+	is.True(IsRecord([]byte{22, 3, 1, 0, 200}))
+	is.True(IsRecord([]byte{23, 3, 3}))
+	is.True(!IsRecord([]byte("INVITE")))
+	is.True(!IsRecord([]byte{22, 3}))
+}